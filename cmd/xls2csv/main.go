@@ -61,6 +61,7 @@ type options struct {
 	excludeSheetPattern      []*regexp.Regexp
 	mergeCells               bool
 	ignoreWorkbookCorruption bool
+	salvage                  bool
 }
 
 type csvWriter struct {
@@ -118,6 +119,7 @@ func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
 	fs.BoolVar(escape, "escape", false, "escape \\r\\n\\t characters")
 
 	ignoreWorkbookCorruption := fs.Bool("ignore-workbook-corruption", false, "ignore workbook corruption")
+	salvage := fs.Bool("salvage", false, "salvage damaged workbooks")
 
 	sheetDelimiter := fs.String("p", defaultSheetDelimiter, "sheet delimiter")
 	fs.StringVar(sheetDelimiter, "sheetdelimiter", defaultSheetDelimiter, "sheet delimiter")
@@ -232,6 +234,7 @@ func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
 		excludeSheetPattern:      excludeRegex,
 		mergeCells:               *mergeCells,
 		ignoreWorkbookCorruption: *ignoreWorkbookCorruption,
+		salvage:                  *salvage,
 	}
 
 	inputPath := rest[0]
@@ -482,6 +485,7 @@ func convertFile(inputPath string, content []byte, outputPath string, opts optio
 		FormattingInfo:           true,
 		FileContents:             content,
 		IgnoreWorkbookCorruption: opts.ignoreWorkbookCorruption,
+		Salvage:                  opts.salvage,
 	}
 	book, err := xlrd.OpenWorkbook(inputPath, openOpts)
 	if err != nil {
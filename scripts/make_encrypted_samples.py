@@ -0,0 +1,340 @@
+#!/usr/bin/env python3
+"""Write password-protected copies of testdata/samples/profiles.xls.
+
+Excel is not available to save the samples, so this script encrypts the
+Workbook stream itself, written from the algorithms in [MS-XLS] 2.2.10 and
+2.4.117 and [MS-OFFCRYPTO] 2.3.5, 2.3.6 and 2.3.7 without sharing code with
+the Go reader. Only the standard library is used; RC4 is checked against
+published test vectors before use.
+
+The samples, all with the password PASSWORD, are:
+
+    encrypted_xor.xls          XOR obfuscation
+    encrypted_rc4.xls          RC4 encryption
+    encrypted_default.xls      RC4 encryption with Excel's default password
+    encrypted_cryptoapi.xls    RC4 CryptoAPI encryption, 128-bit key
+    encrypted_cryptoapi40.xls  RC4 CryptoAPI encryption, 40-bit key
+    encrypted_cryptoapi_props.xls
+                               RC4 CryptoAPI encryption, 128-bit key, with
+                               fDocProps clear and an encrypted
+                               DocumentSummaryInformation stream
+
+The reader does not decrypt document properties, so the property set in
+encrypted_cryptoapi_props.xls is simply encrypted with the key of block 0
+rather than laid out as an encrypted summary stream [MS-OFFCRYPTO 2.3.5.4].
+"""
+from __future__ import print_function
+
+import hashlib
+import os
+import struct
+import sys
+
+PASSWORD = "xlrd-go"
+DEFAULT_PASSWORD = "VelvetSweatshop"
+
+SAMPLES = os.path.join(os.path.dirname(os.path.abspath(__file__)), "..", "testdata", "samples")
+
+FILEPASS = 0x002F
+BOUNDSHEET = 0x0085
+# Records that are never encrypted [MS-XLS 2.2.10]: BOF, FILEPASS, USREXCL,
+# FILELOCK, INTERFACEHDR, RRDINFO and RRDHEAD.
+CLEAR_RECORDS = {0x0809, FILEPASS, 0x0194, 0x0195, 0x00E1, 0x0196, 0x0138}
+
+ENDOFCHAIN = 0xFFFFFFFE
+FREESECT = 0xFFFFFFFF
+FATSECT = 0xFFFFFFFD
+NOSTREAM = 0xFFFFFFFF
+
+
+def rc4(key, data):
+    s = list(range(256))
+    j = 0
+    for i in range(256):
+        j = (j + s[i] + key[i % len(key)]) & 0xFF
+        s[i], s[j] = s[j], s[i]
+    out = bytearray(len(data))
+    i = j = 0
+    for n, c in enumerate(data):
+        i = (i + 1) & 0xFF
+        j = (j + s[i]) & 0xFF
+        s[i], s[j] = s[j], s[i]
+        out[n] = c ^ s[(s[i] + s[j]) & 0xFF]
+    return bytes(out)
+
+
+def check_rc4():
+    for key, plain, want in [
+        (b"Key", b"Plaintext", "bbf316e8d940af0ad3"),
+        (b"Wiki", b"pedia", "1021bf0420"),
+        (b"Secret", b"Attack at dawn", "45a01f645fc35b383552544b9bf5"),
+    ]:
+        if rc4(key, plain).hex() != want:
+            sys.exit("RC4 implementation fails test vector for key %r" % key)
+
+
+def utf16(password):
+    return password.encode("utf-16-le")
+
+
+# Compound document I/O, for a file holding only a Workbook stream.
+
+def read_workbook_stream(path):
+    with open(path, "rb") as f:
+        data = f.read()
+    shift, = struct.unpack_from("<H", data, 30)
+    size = 1 << shift
+    nfat, first_dir = struct.unpack_from("<II", data, 44)
+    difat = struct.unpack_from("<109I", data, 76)[:nfat]
+    fat = []
+    for sid in difat:
+        fat.extend(struct.unpack_from("<%dI" % (size // 4), data, 512 + sid * size))
+
+    def chain(sid):
+        out = bytearray()
+        while sid != ENDOFCHAIN:
+            out += data[512 + sid * size:512 + (sid + 1) * size]
+            sid = fat[sid]
+        return bytes(out)
+
+    dirs = chain(first_dir)
+    for off in range(0, len(dirs), 128):
+        namelen, = struct.unpack_from("<H", dirs, off + 64)
+        name = dirs[off:off + namelen - 2].decode("utf-16-le")
+        if name == "Workbook":
+            start, length = struct.unpack_from("<II", dirs, off + 116)
+            return chain(start)[:length]
+    sys.exit("%s has no Workbook stream" % path)
+
+
+def dir_entry(name, kind, child, start, size, right=NOSTREAM):
+    raw = utf16(name) + b"\0\0"
+    e = raw.ljust(64, b"\0")
+    e += struct.pack("<HBB", len(raw), kind, 1)
+    e += struct.pack("<III", NOSTREAM, right, child)
+    e += b"\0" * 16 + struct.pack("<I", 0) + b"\0" * 16
+    e += struct.pack("<II", start, size) + b"\0" * 4
+    return e
+
+
+def write_compound_file(path, stream, props=None):
+    """Write a compound document holding the Workbook stream and, if props
+    is given, a DocumentSummaryInformation stream after it."""
+    # Sectors: the streams, one directory sector, then the FAT. Streams are
+    # padded to 4096 bytes, so that none goes in the mini stream.
+    streams = [stream] + ([props] if props is not None else [])
+    streams = [s.ljust(max(len(s), 4096), b"\0") for s in streams]
+    counts = [(len(s) + 511) // 512 for s in streams]
+    nstream = sum(counts)
+    nfat = 1
+    while nfat * 128 < nstream + 1 + nfat:
+        nfat += 1
+    fat = []
+    starts = []
+    for n in counts:
+        starts.append(len(fat))
+        fat += [len(fat) + i + 1 for i in range(n - 1)] + [ENDOFCHAIN]
+    fat += [ENDOFCHAIN] + [FATSECT] * nfat
+    fat += [FREESECT] * (nfat * 128 - len(fat))
+
+    header = bytearray(512)
+    header[0:8] = bytes.fromhex("d0cf11e0a1b11ae1")
+    struct.pack_into("<HHHHH", header, 24, 0x3E, 3, 0xFFFE, 9, 6)
+    struct.pack_into("<IIIIIIIII", header, 40, 0, nfat, nstream, 0, 4096, ENDOFCHAIN, 0, ENDOFCHAIN, 0)
+    difat = [nstream + 1 + i for i in range(nfat)] + [FREESECT] * (109 - nfat)
+    struct.pack_into("<109I", header, 76, *difat)
+
+    # The longer name of DocumentSummaryInformation sorts after Workbook,
+    # so it is Workbook's right sibling.
+    empty = b"\0" * 64 + b"\0\0\0\0" + struct.pack("<III", NOSTREAM, NOSTREAM, NOSTREAM) + b"\0" * 48
+    dirs = dir_entry("Root Entry", 5, 1, ENDOFCHAIN, 0)
+    if props is None:
+        dirs += dir_entry("Workbook", 2, NOSTREAM, starts[0], len(streams[0]))
+        dirs += empty * 2
+    else:
+        dirs += dir_entry("Workbook", 2, NOSTREAM, starts[0], len(streams[0]), right=2)
+        dirs += dir_entry("\x05DocumentSummaryInformation", 2, NOSTREAM, starts[1], len(streams[1]))
+        dirs += empty
+
+    with open(path, "wb") as f:
+        f.write(header)
+        for s, n in zip(streams, counts):
+            f.write(s.ljust(n * 512, b"\0"))
+        f.write(dirs)
+        f.write(struct.pack("<%dI" % len(fat), *fat))
+
+
+# Encryption of the Workbook stream.
+
+def encrypt_stream(stream, filepass, encrypt):
+    """Insert a FILEPASS record after the first BOF and encrypt the data of
+    the records that follow, calling encrypt(data, offset) for each."""
+    boflen = 4 + struct.unpack_from("<H", stream, 2)[0]
+    fp = struct.pack("<HH", FILEPASS, len(filepass)) + filepass
+    out = bytearray(stream[:boflen] + fp + stream[boflen:])
+    pos = boflen + len(fp)
+    while pos + 4 <= len(out):
+        code, length = struct.unpack_from("<HH", out, pos)
+        pos += 4
+        data = bytes(out[pos:pos + length])
+        if code == BOUNDSHEET:
+            # The sheet's stream position moves by the FILEPASS record.
+            data = struct.pack("<I", struct.unpack_from("<I", data)[0] + len(fp)) + data[4:]
+        if code not in CLEAR_RECORDS:
+            enc = encrypt(data, pos)
+            if code == BOUNDSHEET:
+                # The sheet position stays in the clear.
+                enc = data[:4] + enc[4:]
+            data = enc
+        out[pos:pos + length] = data
+        pos += length
+    return bytes(out)
+
+
+# XOR obfuscation [MS-OFFCRYPTO 2.3.7].
+
+XOR_PAD = [0xBB, 0xFF, 0xFF, 0xBA, 0xFF, 0xFF, 0xB9, 0x80, 0x00, 0xBE, 0x0F, 0x00, 0xBF, 0x0F, 0x00]
+
+
+def xor_password(password):
+    out = []
+    for ch in password[:15]:
+        code = ord(ch)
+        out.append(code & 0xFF or code >> 8)
+    return out
+
+
+def xor_verifier(password):
+    # CreatePasswordVerifier_Method1.
+    pw = xor_password(password)
+    verifier = 0
+    for b in reversed([len(pw)] + pw):
+        intermediate1 = 1 if verifier & 0x4000 else 0
+        intermediate2 = (verifier * 2) & 0x7FFF
+        verifier = (intermediate1 | intermediate2) ^ b
+    return verifier ^ 0xCE4B
+
+
+def rol8(b, n):
+    return ((b << n) | (b >> (8 - n))) & 0xFF
+
+
+def xor_encryptor(password, key):
+    # The reader takes the key from FILEPASS, so any 16-bit value will do.
+    pw = xor_password(password)
+    padded = (pw + XOR_PAD)[:16]
+    keybytes = [key & 0xFF, key >> 8]
+    array = [rol8(b ^ keybytes[i % 2], 2) for i, b in enumerate(padded)]
+
+    def encrypt(data, pos):
+        # Each byte is XORed with the key byte at its stream offset plus the
+        # record size, then rotated right by 3 bits.
+        out = bytearray(len(data))
+        for i, c in enumerate(data):
+            out[i] = rol8(c ^ array[(pos + len(data) + i) & 0x0F], 5)
+        return bytes(out)
+    return encrypt
+
+
+def xor_filepass(password, key):
+    return struct.pack("<HHH", 0, key, xor_verifier(password))
+
+
+# RC4 encryption, standard [MS-OFFCRYPTO 2.3.6] and CryptoAPI [2.3.5].
+
+def rc4_encryptor(block_key):
+    def encrypt(data, pos):
+        out = bytearray()
+        while data:
+            block = pos // 1024
+            n = min(len(data), (block + 1) * 1024 - pos)
+            skip = pos - block * 1024
+            stream = rc4(block_key(block), bytes(skip) + data[:n])[skip:]
+            out += stream
+            data = data[n:]
+            pos += n
+        return bytes(out)
+    return encrypt
+
+
+def rc4_std_key(password, salt):
+    h0 = hashlib.md5(utf16(password)).digest()
+    h1 = hashlib.md5((h0[:5] + salt) * 16).digest()
+    return lambda block: hashlib.md5(h1[:5] + struct.pack("<I", block)).digest()
+
+
+def rc4_std_filepass(password, salt, verifier):
+    key = rc4_std_key(password, salt)(0)
+    enc = rc4(key, verifier + hashlib.md5(verifier).digest())
+    return struct.pack("<HHH", 1, 1, 1) + salt + enc
+
+
+def cryptoapi_key(password, salt, bits):
+    h0 = hashlib.sha1(salt + utf16(password)).digest()
+
+    def block_key(block):
+        h = hashlib.sha1(h0 + struct.pack("<I", block)).digest()
+        if bits == 40:
+            return h[:5] + b"\0" * 11
+        return h[:bits // 8]
+    return block_key
+
+
+def cryptoapi_filepass(password, salt, verifier, bits):
+    csp = utf16("Microsoft Enhanced Cryptographic Provider v1.0\0")
+    # Flags fCryptoAPI, SizeExtra, AlgID RC4, AlgIDHash SHA-1, KeySize,
+    # ProviderType PROV_RSA_FULL, two reserved fields, then the CSP name.
+    header = struct.pack("<IIIIIIII", 0x04, 0, 0x6801, 0x8004, bits, 1, 0, 0) + csp
+    key = cryptoapi_key(password, salt, bits)(0)
+    enc = rc4(key, verifier + hashlib.sha1(verifier).digest())
+    return (struct.pack("<HHHII", 1, 4, 2, 0x04, len(header)) + header +
+            struct.pack("<I", 16) + salt + enc[:16] + struct.pack("<I", 20) + enc[16:])
+
+
+# Document properties.
+
+def doc_summary_information(company):
+    """Return a DocumentSummaryInformation property set holding the
+    code page and the company name."""
+    value = company.encode("cp1252") + b"\0"
+    value = struct.pack("<II", 0x1E, len(value)) + value
+    value = value.ljust((len(value) + 3) & ~3, b"\0")
+    codepage = struct.pack("<IhH", 0x02, 1252, 0)
+    # PIDSI_CODEPAGE and PIDDSI_COMPANY.
+    body = struct.pack("<IIII", 0x01, 24, 0x0F, 24 + len(codepage)) + codepage + value
+    section = struct.pack("<II", 8 + len(body), 2) + body
+    fmtid = bytes.fromhex("02d5cdd59c2e1b10939708002b2cf9ae")
+    return (struct.pack("<HHI", 0xFFFE, 0, 0x00020006) + b"\0" * 16 + struct.pack("<I", 1) +
+            fmtid + struct.pack("<I", 48) + section)
+
+
+def main():
+    check_rc4()
+    stream = read_workbook_stream(os.path.join(SAMPLES, "profiles.xls"))
+    salt = bytes(range(0x10, 0x20))
+    verifier = bytes(range(0xA0, 0xB0))
+
+    samples = {
+        "encrypted_xor.xls": encrypt_stream(stream, xor_filepass(PASSWORD, 0x5A3C),
+                                            xor_encryptor(PASSWORD, 0x5A3C)),
+        "encrypted_rc4.xls": encrypt_stream(stream, rc4_std_filepass(PASSWORD, salt, verifier),
+                                            rc4_encryptor(rc4_std_key(PASSWORD, salt))),
+        "encrypted_cryptoapi.xls": encrypt_stream(stream, cryptoapi_filepass(PASSWORD, salt, verifier, 128),
+                                                  rc4_encryptor(cryptoapi_key(PASSWORD, salt, 128))),
+        "encrypted_cryptoapi40.xls": encrypt_stream(stream, cryptoapi_filepass(PASSWORD, salt, verifier, 40),
+                                                    rc4_encryptor(cryptoapi_key(PASSWORD, salt, 40))),
+        "encrypted_default.xls": encrypt_stream(stream, rc4_std_filepass(DEFAULT_PASSWORD, salt, verifier),
+                                                rc4_encryptor(rc4_std_key(DEFAULT_PASSWORD, salt))),
+    }
+    for name, data in sorted(samples.items()):
+        write_compound_file(os.path.join(SAMPLES, name), data)
+        print("wrote", name)
+
+    props = rc4(cryptoapi_key(PASSWORD, salt, 128)(0), doc_summary_information("xlrd-go"))
+    write_compound_file(os.path.join(SAMPLES, "encrypted_cryptoapi_props.xls"),
+                        samples["encrypted_cryptoapi.xls"], props)
+    print("wrote encrypted_cryptoapi_props.xls")
+
+
+if __name__ == "__main__":
+    main()
@@ -8,17 +8,25 @@ import (
 	"golang.org/x/text/encoding/charmap"
 )
 
-// UnpackString unpacks a string from BIFF data.
-func UnpackString(data []byte, pos int, encoding string, lenlen int) (string, error) {
-	if pos+lenlen > len(data) {
-		return "", fmt.Errorf("insufficient data for string length")
+// readLength reads the lenlen-byte (1 or 2) character count at pos.
+func readLength(data []byte, pos int, lenlen int) (int, error) {
+	if lenlen != 1 && lenlen != 2 {
+		return 0, fmt.Errorf("invalid length size %d", lenlen)
+	}
+	if pos < 0 || pos+lenlen > len(data) {
+		return 0, fmt.Errorf("insufficient data for string length")
 	}
-
-	var nchars int
 	if lenlen == 1 {
-		nchars = int(data[pos])
-	} else {
-		nchars = int(binary.LittleEndian.Uint16(data[pos : pos+2]))
+		return int(data[pos]), nil
+	}
+	return int(binary.LittleEndian.Uint16(data[pos : pos+2])), nil
+}
+
+// UnpackString unpacks a string from BIFF data.
+func UnpackString(data []byte, pos int, encoding string, lenlen int) (string, error) {
+	nchars, err := readLength(data, pos, lenlen)
+	if err != nil {
+		return "", err
 	}
 	pos += lenlen
 
@@ -49,14 +57,14 @@ func UnpackStringUpdatePos(data []byte, pos int, encoding string, lenlen int, kn
 	var nchars int
 	if knownLen != nil {
 		nchars = *knownLen
-	} else {
-		if pos+lenlen > len(data) {
-			return "", pos, fmt.Errorf("insufficient data for string length")
+		if nchars < 0 || pos < 0 || pos > len(data) {
+			return "", pos, fmt.Errorf("insufficient data for string")
 		}
-		if lenlen == 1 {
-			nchars = int(data[pos])
-		} else {
-			nchars = int(binary.LittleEndian.Uint16(data[pos : pos+2]))
+	} else {
+		var err error
+		nchars, err = readLength(data, pos, lenlen)
+		if err != nil {
+			return "", pos, err
 		}
 		pos += lenlen
 	}
@@ -86,15 +94,9 @@ func UnpackStringUpdatePos(data []byte, pos int, encoding string, lenlen int, kn
 
 // UnpackUnicode unpacks a Unicode string from BIFF data.
 func UnpackUnicode(data []byte, pos int, lenlen int) (string, error) {
-	if pos+lenlen > len(data) {
-		return "", fmt.Errorf("insufficient data for unicode length")
-	}
-
-	var nchars int
-	if lenlen == 1 {
-		nchars = int(data[pos])
-	} else {
-		nchars = int(binary.LittleEndian.Uint16(data[pos : pos+2]))
+	nchars, err := readLength(data, pos, lenlen)
+	if err != nil {
+		return "", err
 	}
 	pos += lenlen
 
@@ -155,22 +157,20 @@ func UnpackUnicodeUpdatePos(data []byte, pos int, lenlen int, knownLen *int) (st
 	var nchars int
 	if knownLen != nil {
 		nchars = *knownLen
-	} else {
-		if pos+lenlen > len(data) {
-			return "", pos, fmt.Errorf("insufficient data for unicode length")
+		if nchars < 0 || pos < 0 || pos > len(data) {
+			return "", pos, fmt.Errorf("insufficient data for unicode")
 		}
-		if lenlen == 1 {
-			nchars = int(data[pos])
-		} else {
-			nchars = int(binary.LittleEndian.Uint16(data[pos : pos+2]))
+	} else {
+		var err error
+		nchars, err = readLength(data, pos, lenlen)
+		if err != nil {
+			return "", pos, err
 		}
 		pos += lenlen
 	}
 
-	if nchars == 0 {
-		if pos >= len(data) {
-			return "", pos, nil
-		}
+	if nchars == 0 && pos >= len(data) {
+		// Zero-length string with no options byte.
 		return "", pos, nil
 	}
 
@@ -5,21 +5,52 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"runtime"
 	"unicode/utf16"
 )
 
 // XLRDError represents an error that occurred while reading an Excel file.
 type XLRDError struct {
 	Message string
+	// Err is the sentinel (such as ErrCorruptRecord) or underlying error
+	// classifying the failure, or nil.
+	Err error
+	// HasRecord is set when Opcode and Offset are known. Opcode is the type
+	// of the BIFF record being parsed, and Offset its offset in the Workbook
+	// stream; both are -1 in errors made by this package without a record.
+	HasRecord bool
+	Opcode    int
+	Offset    int
 }
 
 func (e *XLRDError) Error() string {
-	return e.Message
+	if !e.HasRecord {
+		return e.Message
+	}
+	return fmt.Sprintf("%s (record 0x%04x %s at offset %d)", e.Message, e.Opcode, recordName(e.Opcode), e.Offset)
+}
+
+// Unwrap returns e.Err.
+func (e *XLRDError) Unwrap() error {
+	return e.Err
 }
 
 // NewXLRDError creates a new XLRDError with the given message.
 func NewXLRDError(format string, args ...interface{}) *XLRDError {
-	return &XLRDError{Message: fmt.Sprintf(format, args...)}
+	return &XLRDError{Message: fmt.Sprintf(format, args...), Opcode: -1, Offset: -1}
+}
+
+// recoverParseError is deferred by the parsing entry points so that a
+// run-time panic caused by corrupt record data (such as an index out of
+// range) is returned as an XLRDError instead of crashing the caller.
+func recoverParseError(err *error) {
+	if r := recover(); r != nil {
+		re, ok := r.(runtime.Error)
+		if !ok {
+			panic(r)
+		}
+		*err = newXLRDError(ErrCorruptRecord, "corrupt record data: %v", re)
+	}
 }
 
 // Cell types
@@ -93,6 +124,7 @@ const (
 	XL_WORKBOOK_GLOBALS_4W   = 0x100
 	XL_WORKSHEET             = 0x10
 	XL_BOUNDSHEET_WORKSHEET  = 0x00
+	XL_BOUNDSHEET_MACROSHEET = 0x01
 	XL_BOUNDSHEET_CHART      = 0x02
 	XL_BOUNDSHEET_VB_MODULE  = 0x06
 	XL_ARRAY                 = 0x0221
@@ -405,6 +437,14 @@ var biffRecNameDict = map[int]string{
 	0x0868: "RANGEPROTECTION",
 }
 
+// recordName returns the name of the BIFF record type opcode.
+func recordName(opcode int) string {
+	if name, ok := biffRecNameDict[opcode]; ok {
+		return name
+	}
+	return "<UNKNOWN>"
+}
+
 // BaseObject is a base type for most objects in the package.
 // It provides a common dump method for debugging.
 type BaseObject struct {
@@ -661,6 +701,9 @@ func unpack_string(data []byte, pos int, encoding string, lenlen int) string {
 		lenlen = 2
 	}
 
+	if pos < 0 || pos+lenlen > len(data) {
+		return ""
+	}
 	var nchars uint16
 	if lenlen == 1 {
 		nchars = uint16(data[pos])
@@ -704,6 +747,9 @@ func unpack_string_update_pos(data []byte, pos int, encoding string, lenlen int,
 	if known_len >= 0 {
 		nchars = known_len
 	} else {
+		if pos < 0 || pos+lenlen > len(data) {
+			return "", len(data)
+		}
 		if lenlen == 1 {
 			nchars = int(data[pos])
 		} else {
@@ -730,12 +776,18 @@ func unpack_unicode(data []byte, pos int, lenlen int) string {
 		lenlen = 2
 	}
 
+	if pos < 0 || pos+lenlen > len(data) {
+		return ""
+	}
 	nchars := int(binary.LittleEndian.Uint16(data[pos : pos+lenlen]))
 	if nchars == 0 {
 		return ""
 	}
 	pos += lenlen
 
+	if pos >= len(data) {
+		return ""
+	}
 	options := data[pos]
 	pos++
 
@@ -772,6 +824,9 @@ func unpack_unicode_update_pos(data []byte, pos int, lenlen int, known_len int)
 		if nchars == 0 && len(data) <= pos {
 			return "", pos
 		}
+		if pos < 0 || pos >= len(data) {
+			return "", len(data)
+		}
 		options := data[pos]
 		pos++
 
@@ -826,11 +881,22 @@ func unpack_unicode_update_pos(data []byte, pos int, lenlen int, known_len int)
 
 		return str, newpos
 	} else {
-		nchars := int(binary.LittleEndian.Uint16(data[pos : pos+lenlen]))
+		if pos < 0 || pos+lenlen > len(data) {
+			return "", len(data)
+		}
+		var nchars int
+		if lenlen == 1 {
+			nchars = int(data[pos])
+		} else {
+			nchars = int(binary.LittleEndian.Uint16(data[pos : pos+2]))
+		}
 		pos += lenlen
 		if nchars == 0 && len(data) <= pos {
 			return "", pos
 		}
+		if pos >= len(data) {
+			return "", len(data)
+		}
 		options := data[pos]
 		pos++
 
@@ -838,12 +904,18 @@ func unpack_unicode_update_pos(data []byte, pos int, lenlen int, known_len int)
 		richtext := options&0x08 != 0
 
 		if richtext {
+			if pos+2 > len(data) {
+				return "", len(data)
+			}
 			rt := binary.LittleEndian.Uint16(data[pos:])
 			pos += 2
 			_ = rt
 		}
 
 		if phonetic {
+			if pos+4 > len(data) {
+				return "", len(data)
+			}
 			sz := binary.LittleEndian.Uint32(data[pos:])
 			pos += 4
 			_ = sz
@@ -852,6 +924,9 @@ func unpack_unicode_update_pos(data []byte, pos int, lenlen int, known_len int)
 		var str string
 		var newpos int
 		if options&0x01 != 0 { // uncompressed UTF-16
+			if pos+2*nchars > len(data) {
+				return "", len(data)
+			}
 			utf16Data := make([]uint16, nchars)
 			for i := 0; i < nchars; i++ {
 				utf16Data[i] = binary.LittleEndian.Uint16(data[pos+i*2:])
@@ -860,6 +935,9 @@ func unpack_unicode_update_pos(data []byte, pos int, lenlen int, known_len int)
 			str = string(runes)
 			newpos = pos + 2*nchars
 		} else { // compressed
+			if pos+nchars > len(data) {
+				return "", len(data)
+			}
 			str = string(data[pos : pos+nchars])
 			newpos = pos + nchars
 		}
@@ -881,11 +959,14 @@ func unpack_cell_range_address_list_update_pos(output_list *[]CellRange, data []
 		addr_size = 6
 	}
 
+	if pos < 0 || pos+2 > len(data) {
+		return len(data)
+	}
 	n := int(binary.LittleEndian.Uint16(data[pos:]))
 	pos += 2
 
 	if n > 0 {
-		for i := 0; i < n; i++ {
+		for i := 0; i < n && pos+addr_size <= len(data); i++ {
 			var ra, rb, ca, cb uint16
 			if addr_size == 6 {
 				ra = binary.LittleEndian.Uint16(data[pos:])
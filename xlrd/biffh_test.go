@@ -119,6 +119,23 @@ func TestUnpackUnicode(t *testing.T) {
 	}
 }
 
+func TestUnpackUnicodeUpdatePosEmpty(t *testing.T) {
+	// An empty string still has its options byte, unless the data ends.
+	for _, tt := range []struct {
+		data []byte
+		pos  int
+	}{
+		{[]byte{0x00, 0x00, 0x00, 'x'}, 3},
+		{[]byte{0x00, 0x00, 0x01, 'x'}, 3},
+		{[]byte{0x00, 0x00}, 2},
+	} {
+		s, pos, err := UnpackUnicodeUpdatePos(tt.data, 0, 2, nil)
+		if s != "" || pos != tt.pos || err != nil {
+			t.Errorf("UnpackUnicodeUpdatePos(% x) = %q, %d, %v, want \"\", %d, nil", tt.data, s, pos, err, tt.pos)
+		}
+	}
+}
+
 func TestBaseObjectDump(t *testing.T) {
 	var buf bytes.Buffer
 	obj := &BaseObject{}
@@ -1,13 +1,18 @@
 package xlrd
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"unicode/utf16"
 
 	"golang.org/x/text/encoding/charmap"
@@ -64,6 +69,16 @@ type Book struct {
 	// UserName is what (if anything) is recorded as the name of the last user to save the file.
 	UserName string
 
+	// Properties holds the document properties, such as the title, author
+	// and creation time, recorded in the compound document. It is empty if
+	// they are encrypted with the workbook; a DiagPropertySet warning then
+	// says so.
+	Properties Properties
+
+	// HasMacros reports whether the workbook contains macros: a VBA
+	// project, which VBAProject returns, or Excel 4 macro sheets.
+	HasMacros bool
+
 	// FontList is a list of Font class instances, each corresponding to a FONT record.
 	FontList []*Font
 
@@ -95,6 +110,7 @@ type Book struct {
 	LoadTimeStage2 float64
 
 	// Internal fields
+	recordReader             // cursor over the workbook stream, used for the globals
 	sheetList                []*Sheet
 	sheetNames               []string
 	sheetAbsPosn             []int // Absolute positions of sheets in the stream
@@ -102,18 +118,38 @@ type Book struct {
 	sheetVisibility          []int
 	onDemand                 bool
 	logfile                  io.Writer
+	logger                   *slog.Logger
 	verbosity                int
-	mem                      []byte
-	base                     int
 	streamLen                int
-	position                 int
 	filestr                  []byte
+	munmap                   func() error // releases a memory-mapped file, if any
+	diagMu                   sync.Mutex
+	diagnostics              []Diagnostic
+	diagSeen                 map[Diagnostic]bool // diagnostics already recorded
+	workers                  int
 	formattingInfo           bool
 	raggedRows               bool
 	encodingOverride         string
 	ignoreWorkbookCorruption bool
-	sharedStrings            []string
-	richTextRunlistMap       map[int][][]int
+	salvage                  bool
+	limits                   Limits
+	password                 string
+	encryptedProperties      bool // document properties are encrypted with the workbook
+	vbaProject               *VBAProject
+	vbaErr                   error // why the VBA project could not be read
+	embeddedObjects          []EmbeddedObject
+	// embeddedDoc returns the compound document to read the payloads of
+	// embeddedObjects from, and a function to release it. embeddedMu
+	// serialises its use.
+	embeddedDoc        func() (cd *CompDoc, release func(), err error)
+	embeddedMu         sync.Mutex
+	allocated          atomic.Int64 // bytes charged against limits.MaxAllocBytes
+	sharedStrings      []string
+	richTextRunlistMap map[int][][]int
+
+	// namesMu serialises the evaluation of names by Name.Cell and
+	// Name.Area2D, which cache the result in each Name.
+	namesMu sync.Mutex
 
 	// Name mappings
 	nameAndScopeMap map[string]map[int]*Name // maps (lower_case_name, scope) to Name object
@@ -143,6 +179,12 @@ type Book struct {
 	supbookTypes       []int
 	addinFuncNames     []string
 	allSheetsMap       []int // maps an all_sheets index to a calc-sheets index (or -1)
+
+	// Concurrency control
+	mu         sync.Mutex   // guards sheetList and sheetLocks
+	sheetLocks []sync.Mutex // serialize loading of each sheet
+	resMu      sync.RWMutex // held for reading while a sheet is parsed from mem
+	globalsMu  sync.Mutex   // serializes sheet parsing that updates workbook globals (BIFF < 8)
 }
 
 // Name represents information relating to a named reference, formula, macro, etc.
@@ -182,7 +224,9 @@ type Name struct {
 	// Name is the name of the object
 	Name string
 
-	// Scope is the sheet index (0-based) or -1 for global scope
+	// Scope is the sheet index (0-based) or -1 for global scope. It is -2
+	// for a name local to a macro or VBA sheet, and -3 if the sheet index
+	// of the NAME record is invalid.
 	Scope int
 
 	// Result is the result of the formula evaluation
@@ -211,59 +255,179 @@ type Name struct {
 
 	// Stack contains the evaluation stack for the name
 	Stack []*Operand
+
+	// excelSheetIndex is the 1-based index of the sheet the name is local
+	// to, or 0 for a global name.
+	excelSheetIndex int
+}
+
+// builtinNameFromCode maps the one-character names of built-in NAME
+// records to their display names.
+var builtinNameFromCode = map[string]string{
+	"\x00": "Consolidate_Area",
+	"\x01": "Auto_Open",
+	"\x02": "Auto_Close",
+	"\x03": "Extract",
+	"\x04": "Database",
+	"\x05": "Criteria",
+	"\x06": "Print_Area",
+	"\x07": "Print_Titles",
+	"\x08": "Recorder",
+	"\x09": "Data_Form",
+	"\x0A": "Auto_Activate",
+	"\x0B": "Auto_Deactivate",
+	"\x0C": "Sheet_Title",
+	"\x0D": "_FilterDatabase",
 }
 
-// Cell returns a single cell that the name refers to.
-// This is a convenience method for names that refer to a single cell.
+// Cell returns the cell that the name refers to, which must be a constant
+// absolute reference to a single cell, such as Sheet1!$B$2. The sheet of
+// the cell is loaded if needed. The error is a *NameRefError for names
+// that refer to something else.
 func (n *Name) Cell() (*Cell, error) {
-	// Note: Full implementation requires formula evaluation
-	// For now, return an error indicating this feature is not yet implemented
-	return nil, NewXLRDError("Name.Cell() not yet implemented - requires formula evaluation")
+	sh, ref, err := n.area()
+	if err != nil {
+		return nil, err
+	}
+	if ref.rhi-ref.rlo != 1 || ref.chi-ref.clo != 1 {
+		return nil, &NameRefError{Name: n.Name, Problem: NameNotCell}
+	}
+	return sh.Cell(ref.rlo, ref.clo), nil
+}
+
+// Area2D returns the sheet and the rows rowxlo to rowxhi and columns colxlo
+// to colxhi, as half-open ranges, of the area that the name refers to,
+// which must be a constant absolute reference to one area of one sheet,
+// such as Sheet1!$A$1:$C$10. With clipped set, the bounds are limited to
+// the cells of the sheet, and may be empty ranges. The sheet is loaded if
+// needed. The error is a *NameRefError for names that refer to something
+// else. Cell and Area2D may be called from several goroutines at once.
+func (n *Name) Area2D(clipped bool) (sh *Sheet, rowxlo, rowxhi, colxlo, colxhi int, err error) {
+	sh, ref, err := n.area()
+	if err != nil {
+		return nil, 0, 0, 0, 0, err
+	}
+	rowxlo, rowxhi, colxlo, colxhi = ref.rlo, ref.rhi, ref.clo, ref.chi
+	if clipped {
+		rowxlo = min(rowxlo, sh.NRows)
+		rowxhi = max(rowxlo, min(rowxhi, sh.NRows))
+		colxlo = min(colxlo, sh.NCols)
+		colxhi = max(colxlo, min(colxhi, sh.NCols))
+	}
+	return sh, rowxlo, rowxhi, colxlo, colxhi, nil
+}
+
+// area evaluates the formula of the name if needed, and returns the single
+// area of one sheet that it refers to.
+func (n *Name) area() (*Sheet, *Ref3D, error) {
+	res, err := n.result()
+	if err != nil {
+		return nil, nil, err
+	}
+	if res == nil {
+		return nil, nil, &NameRefError{Name: n.Name, Problem: NameNotReference}
+	}
+	refs, _ := res.value.([]*Ref3D)
+	switch {
+	case res.kind == oREL:
+		return nil, nil, &NameRefError{Name: n.Name, Problem: NameRelative}
+	case res.kind != oREF || len(refs) == 0:
+		return nil, nil, &NameRefError{Name: n.Name, Problem: NameNotReference}
+	case len(refs) > 1:
+		return nil, nil, &NameRefError{Name: n.Name, Problem: NameMultiArea}
+	}
+	ref := refs[0]
+	switch {
+	case ref.shtxlo == -4:
+		return nil, nil, &NameRefError{Name: n.Name, Problem: NameExternal}
+	case ref.shtxlo < 0:
+		return nil, nil, &NameRefError{Name: n.Name, Problem: NameBadSheet}
+	case ref.shtxhi-ref.shtxlo != 1:
+		return nil, nil, &NameRefError{Name: n.Name, Problem: NameMultiArea}
+	}
+	sh, err := n.Book.SheetByIndex(ref.shtxlo)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sh, ref, nil
 }
 
-// Area2D returns a rectangular area that the name refers to.
-// Returns (sheet, rowxlo, rowxhi, colxlo, colxhi)
-func (n *Name) Area2D(clipped bool) (*Sheet, int, int, int, int, error) {
-	// Note: Full implementation requires formula evaluation
-	// For now, return an error indicating this feature is not yet implemented
-	return nil, 0, 0, 0, 0, NewXLRDError("Name.Area2D() not yet implemented - requires formula evaluation")
+// result returns the result of the formula of the name, evaluating it the
+// first time. Names are evaluated one at a time, since evaluating one also
+// evaluates the names it uses.
+func (n *Name) result() (*Operand, error) {
+	n.Book.namesMu.Lock()
+	defer n.Book.namesMu.Unlock()
+	if !n.Evaluated {
+		if err := EvaluateNameFormula(n.Book, n, n.NameIndex, 0, 0); err != nil {
+			return nil, err
+		}
+	}
+	res, _ := n.Result.(*Operand)
+	return res, nil
 }
 
 // Sheets returns a list of all sheets in the book.
 // All sheets not already loaded will be loaded.
 func (b *Book) Sheets() []*Sheet {
 	for sheetx := 0; sheetx < len(b.sheetList); sheetx++ {
-		if b.sheetList[sheetx] == nil {
-			sheet, _ := b.getSheet(sheetx)
-			b.sheetList[sheetx] = sheet
-		}
+		b.loadSheet(context.Background(), sheetx)
 	}
-	return b.sheetList
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*Sheet(nil), b.sheetList...)
 }
 
 // SheetByIndex returns a sheet by its index.
+// If the sheet is not loaded (OnDemand, or after UnloadSheet) it is loaded now.
+// It is safe to call SheetByIndex from several goroutines at once.
 func (b *Book) SheetByIndex(sheetx int) (*Sheet, error) {
-	if sheetx < 0 || sheetx >= len(b.sheetList) {
-		return nil, NewXLRDError("sheet index %d out of range", sheetx)
-	}
+	return b.SheetByIndexContext(context.Background(), sheetx)
+}
 
-	// Sheet should already be loaded by readWorksheets
-	if b.sheetList[sheetx] != nil {
-		return b.sheetList[sheetx], nil
+// SheetByIndexContext is like SheetByIndex, but stops loading the sheet
+// and returns ctx.Err() if ctx is cancelled first. A cancelled sheet is
+// not recorded as loaded, so it can be requested again.
+func (b *Book) SheetByIndexContext(ctx context.Context, sheetx int) (*Sheet, error) {
+	if sheetx < 0 || sheetx >= len(b.sheetList) {
+		return nil, newXLRDError(ErrSheetNotFound, "sheet index %d out of range", sheetx)
 	}
+	return b.loadSheet(ctx, sheetx)
+}
 
-	return nil, NewXLRDError("sheet %d not loaded", sheetx)
+// loadSheet returns the sheet with the given index, loading it if necessary.
+// Concurrent requests for the same sheet wait for a single load.
+func (b *Book) loadSheet(ctx context.Context, sheetx int) (*Sheet, error) {
+	b.mu.Lock()
+	if sheet := b.sheetList[sheetx]; sheet != nil {
+		b.mu.Unlock()
+		return sheet, nil
+	}
+	if len(b.sheetLocks) != len(b.sheetList) {
+		b.sheetLocks = make([]sync.Mutex, len(b.sheetList))
+	}
+	lock := &b.sheetLocks[sheetx]
+	b.mu.Unlock()
+
+	lock.Lock()
+	defer lock.Unlock()
+	b.mu.Lock()
+	sheet := b.sheetList[sheetx]
+	b.mu.Unlock()
+	if sheet != nil {
+		return sheet, nil
+	}
+	return b.getSheet(ctx, sheetx)
 }
 
 // SheetByName returns a sheet by its name.
 func (b *Book) SheetByName(sheetName string) (*Sheet, error) {
-	// Empty implementation for now
 	for i, name := range b.sheetNames {
 		if name == sheetName {
 			return b.SheetByIndex(i)
 		}
 	}
-	return nil, NewXLRDError("No sheet named <%s>", sheetName)
+	return nil, newXLRDError(ErrSheetNotFound, "No sheet named <%s>", sheetName)
 }
 
 // SheetNames returns a list of all sheet names.
@@ -298,17 +462,21 @@ func (b *Book) SheetLoaded(sheetNameOrIndex interface{}) (bool, error) {
 				goto found
 			}
 		}
-		return false, NewXLRDError("No sheet named <%s>", v)
+		return false, newXLRDError(ErrSheetNotFound, "No sheet named <%s>", v)
 	}
 
 found:
 	if sheetx < 0 || sheetx >= len(b.sheetList) {
-		return false, NewXLRDError("sheet index %d out of range", sheetx)
+		return false, newXLRDError(ErrSheetNotFound, "sheet index %d out of range", sheetx)
 	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	return b.sheetList[sheetx] != nil, nil
 }
 
-// UnloadSheet unloads a sheet by name or index.
+// UnloadSheet unloads a sheet by name or index, so that its cells can be
+// garbage collected. The sheet is loaded again by the next SheetByIndex,
+// SheetByName or Get, unless resources have been released.
 func (b *Book) UnloadSheet(sheetNameOrIndex interface{}) error {
 	var sheetx int
 
@@ -322,25 +490,38 @@ func (b *Book) UnloadSheet(sheetNameOrIndex interface{}) error {
 				goto found
 			}
 		}
-		return NewXLRDError("No sheet named <%s>", v)
+		return newXLRDError(ErrSheetNotFound, "No sheet named <%s>", v)
 	}
 
 found:
 	if sheetx < 0 || sheetx >= len(b.sheetList) {
-		return NewXLRDError("sheet index %d out of range", sheetx)
+		return newXLRDError(ErrSheetNotFound, "sheet index %d out of range", sheetx)
 	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refund(b.sheetList[sheetx])
 	b.sheetList[sheetx] = nil
 	return nil
 }
 
 // ReleaseResources releases memory-consuming objects and possibly a memory-mapped file.
+// Once resources are released, no further sheets can be loaded.
 func (b *Book) ReleaseResources() {
+	// Wait for sheets being parsed from mem.
+	b.resMu.Lock()
+	defer b.resMu.Unlock()
 	b.resourcesReleased = true
-	// Note: In Go, memory management is automatic, so we mainly set flags
-	// If there were mmap objects, they would be closed here
 	b.mem = nil
 	b.filestr = nil
 	b.sharedStrings = nil
+	if b.munmap != nil {
+		munmap := b.munmap
+		b.munmap = nil
+		if err := munmap(); err != nil {
+			b.addDiagnostic(Diagnostic{Severity: SeverityWarning, Code: DiagUnmapFailed,
+				Opcode: -1, Offset: -1, Message: fmt.Sprintf("can't unmap file: %v", err)})
+		}
+	}
 }
 
 // GetBOF gets the BOF (Beginning of File) record for a given sheet type.
@@ -352,14 +533,26 @@ func (b *Book) GetBOF(sheetType int) int {
 // OpenWorkbookOptions contains options for opening a workbook.
 type OpenWorkbookOptions struct {
 	// Logfile is an open file to which messages and diagnostics are written.
+	// Nothing is written unless Verbosity is greater than zero; if Logfile
+	// is nil, messages are discarded. Diagnostics are also available from
+	// Book.Diagnostics.
 	Logfile io.Writer
 
 	// Verbosity increases the volume of trace material written to the logfile.
 	Verbosity int
 
-	// UseMmap determines whether to use memory mapping.
-	// Whether to use the mmap module is determined heuristically.
-	// Use this arg to override the result.
+	// Logger, if set, receives the trace material and diagnostics instead
+	// of Logfile. Trace lines and a summary of each BIFF record read are
+	// logged at debug level, and diagnostics at a level matching their
+	// severity, with attributes naming the sheet, record and offset.
+	// Verbosity still selects which trace lines are produced.
+	Logger *slog.Logger
+
+	// UseMmap memory-maps the file instead of reading it, so that processes
+	// opening the same file share the page cache. The mapping is released by
+	// Book.ReleaseResources. It is ignored when FileContents is supplied, and
+	// on platforms other than Linux. Like any workbook opened by path, the
+	// file is opened again by EmbeddedObject.Open.
 	UseMmap bool
 
 	// FileContents is the file contents as bytes.
@@ -380,26 +573,59 @@ type OpenWorkbookOptions struct {
 	// True means that there are no empty cells at the ends of rows.
 	RaggedRows bool
 
+	// Workers is the number of goroutines used to load the sheets when
+	// OnDemand is false. 0 or 1 loads them one after another.
+	// Sheets of files older than BIFF 8 are always loaded one after another.
+	Workers int
+
 	// IgnoreWorkbookCorruption allows reading corrupted workbooks.
 	// When false (default), you may face CompDocError: Workbook corruption.
 	// When true, that exception will be ignored.
 	IgnoreWorkbookCorruption bool
+
+	// Salvage reads what it can of workbooks whose compound document is
+	// damaged beyond what IgnoreWorkbookCorruption tolerates, which it
+	// implies. If the Workbook stream cannot be found through the
+	// directory and sector allocation table, it is rebuilt from the
+	// sectors following the first BOF record of workbook globals. Sheets
+	// cut short keep the cells read before the damage, and sheets that
+	// cannot be found are left empty. Diagnostics with the code "salvaged"
+	// report what was rebuilt or skipped.
+	Salvage bool
+
+	// Password decrypts workbooks protected by a password. Without it,
+	// opening an encrypted workbook fails with ErrEncrypted; with the
+	// wrong password, it fails with ErrWrongPassword.
+	Password string
+
+	// Limits bounds the size of the workbook that will be read. The zero
+	// value imposes no limits.
+	Limits Limits
 }
 
-// OpenWorkbook opens a spreadsheet file for data extraction.
+// OpenWorkbook opens a spreadsheet file for data extraction. The file is
+// closed before OpenWorkbook returns, though a mapping made for UseMmap
+// may last until Book.ReleaseResources; EmbeddedObject.Open opens the file
+// again by filename.
 //
 // filename: The path to the spreadsheet file to be opened.
 // options: Optional parameters for opening the workbook.
 //
 // Returns: An instance of the Book class.
 func OpenWorkbook(filename string, options *OpenWorkbookOptions) (*Book, error) {
+	return OpenWorkbookContext(context.Background(), filename, options)
+}
+
+// OpenWorkbookContext is like OpenWorkbook, but stops reading the workbook
+// and returns ctx.Err() if ctx is cancelled first. The context is checked
+// between records while the globals and, unless OnDemand is set, the
+// sheets are read; use Book.SheetByIndexContext to load sheets on demand.
+func OpenWorkbookContext(ctx context.Context, filename string, options *OpenWorkbookOptions) (*Book, error) {
 	if options == nil {
-		options = &OpenWorkbookOptions{
-			Logfile: os.Stdout,
-		}
+		options = &OpenWorkbookOptions{}
 	}
 	if options.Logfile == nil {
-		options.Logfile = os.Stdout
+		options.Logfile = io.Discard
 	}
 
 	var fileFormat string
@@ -416,14 +642,186 @@ func OpenWorkbook(filename string, options *OpenWorkbookOptions) (*Book, error)
 	// Allow unknown formats to pass through, as some ancient files that xlrd can parse
 	// don't start with the expected signature (e.g., raw BIFF files)
 	if fileFormat != "" && fileFormat != "xls" {
-		return nil, NewXLRDError("%s; not supported", FileFormatDescriptions[fileFormat])
+		return nil, unsupportedFormatError(fileFormat)
+	}
+
+	return openWorkbookFile(ctx, filename, options)
+}
+
+// OpenWorkbookReaderAt opens a spreadsheet held in r for data extraction.
+// size is the length of the file in bytes.
+//
+// OLE2 sectors are read from r as they are needed, so only the Workbook
+// stream is held in memory. r is not used after OpenWorkbookReaderAt returns,
+// except by EmbeddedObject.Open, which reads the payloads of embedded
+// objects from r.
+func OpenWorkbookReaderAt(r io.ReaderAt, size int64, options *OpenWorkbookOptions) (*Book, error) {
+	return OpenWorkbookReaderAtContext(context.Background(), r, size, options)
+}
+
+// OpenWorkbookReaderAtContext is like OpenWorkbookReaderAt, but stops
+// reading the workbook and returns ctx.Err() if ctx is cancelled first, as
+// OpenWorkbookContext does.
+func OpenWorkbookReaderAtContext(ctx context.Context, r io.ReaderAt, size int64, options *OpenWorkbookOptions) (*Book, error) {
+	if options == nil {
+		options = &OpenWorkbookOptions{}
+	}
+	if options.Logfile == nil {
+		options.Logfile = io.Discard
+	}
+
+	fileFormat, err := inspectReaderAt(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if fileFormat != "" && fileFormat != "xls" {
+		return nil, unsupportedFormatError(fileFormat)
 	}
 
-	return OpenWorkbookXLS(filename, options)
+	return openWorkbookXLS(ctx, r, size, nil, options)
+}
+
+// OpenWorkbookReader opens a spreadsheet read from r for data extraction.
+//
+// If r also implements io.ReaderAt and has a Size method (as *bytes.Reader,
+// *strings.Reader and *io.SectionReader do), or is an *os.File, it is passed
+// to OpenWorkbookReaderAt. Otherwise r is read to the end first, since the
+// sectors of an OLE2 compound document may appear in any order.
+func OpenWorkbookReader(r io.Reader, options *OpenWorkbookOptions) (*Book, error) {
+	return OpenWorkbookReaderContext(context.Background(), r, options)
+}
+
+// OpenWorkbookReaderContext is like OpenWorkbookReader, but stops reading
+// r, or the workbook, and returns ctx.Err() if ctx is cancelled first.
+func OpenWorkbookReaderContext(ctx context.Context, r io.Reader, options *OpenWorkbookOptions) (*Book, error) {
+	switch v := r.(type) {
+	case *os.File:
+		fi, err := v.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return OpenWorkbookReaderAtContext(ctx, v, fi.Size(), options)
+	case interface {
+		io.ReaderAt
+		Size() int64
+	}:
+		return OpenWorkbookReaderAtContext(ctx, v, v.Size(), options)
+	}
+
+	content, err := io.ReadAll(ctxReader{ctx, r})
+	if err != nil {
+		return nil, err
+	}
+	return OpenWorkbookReaderAtContext(ctx, bytes.NewReader(content), int64(len(content)), options)
+}
+
+// ctxReader reads from r until ctx is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
 }
 
 // OpenWorkbookXLS opens an XLS workbook file.
 func OpenWorkbookXLS(filename string, options *OpenWorkbookOptions) (*Book, error) {
+	if options == nil {
+		options = &OpenWorkbookOptions{}
+	}
+	if options.Logfile == nil {
+		options.Logfile = io.Discard
+	}
+	return openWorkbookFile(context.Background(), filename, options)
+}
+
+// openWorkbookFile opens the XLS workbook in filename, or in
+// options.FileContents if supplied.
+func openWorkbookFile(ctx context.Context, filename string, options *OpenWorkbookOptions) (*Book, error) {
+	if options.FileContents != nil {
+		contents := options.FileContents
+		return openWorkbookXLS(ctx, bytes.NewReader(contents), int64(len(contents)), contents, options)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if options.UseMmap && fi.Size() > 0 {
+		data, unmap, err := mmapFile(f, fi.Size())
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			bk, err := openWorkbookXLS(ctx, bytes.NewReader(data), fi.Size(), data, options)
+			if err != nil {
+				unmap()
+				return nil, err
+			}
+			bk.reopenEmbedded(filename, fi)
+			// Unless sheets are loaded on demand, resources have already been
+			// released. Whatever the Book keeps, such as strings, formulas
+			// and NAME records, is copied out of data while parsing, so the
+			// mapping can go.
+			if bk.resourcesReleased {
+				unmap()
+			} else {
+				bk.munmap = unmap
+			}
+			return bk, nil
+		}
+	}
+	bk, err := openWorkbookXLS(ctx, f, fi.Size(), nil, options)
+	if err != nil {
+		return nil, err
+	}
+	bk.reopenEmbedded(filename, fi)
+	return bk, nil
+}
+
+// reopenEmbedded makes EmbeddedObject.Open read the workbook file again,
+// rather than the file or mapping the book was read from, which is closed
+// once the book is open. filename must still name the file described by
+// fi, with the same size and modification time.
+func (b *Book) reopenEmbedded(filename string, fi os.FileInfo) {
+	if b.embeddedDoc == nil {
+		return
+	}
+	b.embeddedDoc = func() (*CompDoc, func(), error) {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		now, err := f.Stat()
+		if err == nil && (!os.SameFile(fi, now) || now.Size() != fi.Size() || !now.ModTime().Equal(fi.ModTime())) {
+			err = newXLRDError(ErrCorruptCompDoc, "%s has changed since the workbook was opened", filename)
+		}
+		var cd *CompDoc
+		if err == nil {
+			cd, err = NewCompDocReaderAt(f, fi.Size(), nil, 0, b.ignoreWorkbookCorruption)
+		}
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return cd, func() { f.Close() }, nil
+	}
+}
+
+// openWorkbookXLS opens an XLS workbook of size bytes read from src.
+// contents is the whole file image if the caller already holds it, or nil.
+func openWorkbookXLS(ctx context.Context, src io.ReaderAt, size int64, contents []byte, options *OpenWorkbookOptions) (_ *Book, err error) {
+	defer recoverParseError(&err)
 	bk := &Book{
 		sheetList:          []*Sheet{},
 		sheetNames:         []string{},
@@ -434,56 +832,51 @@ func OpenWorkbookXLS(filename string, options *OpenWorkbookOptions) (*Book, erro
 		addinFuncNames:     []string{},
 	}
 
-	if options == nil {
-		options = &OpenWorkbookOptions{
-			Logfile: os.Stdout,
-		}
-	}
-	if options.Logfile == nil {
-		options.Logfile = os.Stdout
-	}
-
 	bk.logfile = options.Logfile
+	if options.Logger != nil {
+		bk.setLogger(options.Logger)
+	}
 	bk.verbosity = options.Verbosity
 	bk.onDemand = options.OnDemand
 	bk.formattingInfo = options.FormattingInfo
 	bk.raggedRows = options.RaggedRows
 	bk.encodingOverride = options.EncodingOverride
-	bk.ignoreWorkbookCorruption = options.IgnoreWorkbookCorruption
+	bk.ignoreWorkbookCorruption = options.IgnoreWorkbookCorruption || options.Salvage
+	bk.salvage = options.Salvage
+	bk.workers = options.Workers
+	bk.limits = options.Limits
+	bk.password = options.Password
 
-	// Read file
-	var err error
-	var fileContents []byte
-	if options.FileContents != nil {
-		fileContents = options.FileContents
-	} else {
-		fileContents, err = os.ReadFile(filename)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	if len(fileContents) == 0 {
-		return nil, NewXLRDError("File size is 0 bytes")
+	if size == 0 {
+		return nil, newXLRDError(ErrUnsupportedFormat, "File size is 0 bytes")
 	}
 
-	bk.filestr = fileContents
-	bk.streamLen = len(fileContents)
-	bk.base = 0
-
-	// Check if it's an OLE2 compound document
-	if len(fileContents) >= 8 && string(fileContents[:8]) == string(XLS_SIGNATURE) {
+	var cd *CompDoc
+	sig := make([]byte, len(XLS_SIGNATURE))
+	if n, _ := src.ReadAt(sig, 0); n == len(sig) && bytes.Equal(sig, XLS_SIGNATURE) {
 		// It's an OLE2 compound document
-		cd, err := NewCompDoc(fileContents, options.Logfile, 0, options.IgnoreWorkbookCorruption)
-		if err != nil {
+		var err error
+		// Compound document diagnostics are added to the book below.
+		if contents != nil {
+			cd, err = NewCompDoc(contents, nil, 0, bk.ignoreWorkbookCorruption)
+		} else {
+			cd, err = NewCompDocReaderAt(src, size, nil, 0, bk.ignoreWorkbookCorruption)
+		}
+		if err != nil && !options.Salvage {
 			return nil, err
 		}
+		if err != nil {
+			bk.addDiagnostic(Diagnostic{Severity: SeverityError, Code: DiagOLE2Corrupt, Opcode: -1, Offset: -1, Message: err.Error()})
+		}
 
 		// Try to locate Workbook or Book stream
 		var mem []byte
 		var base, streamLen int
 		var lastErr error
 		for _, qname := range []string{"Workbook", "Book"} {
+			if cd == nil {
+				break
+			}
 			mem, base, streamLen, err = cd.LocateNamedStream(qname)
 			if err == nil && mem != nil {
 				break
@@ -491,39 +884,85 @@ func OpenWorkbookXLS(filename string, options *OpenWorkbookOptions) (*Book, erro
 			if err != nil {
 				lastErr = err
 				// Check if it's a corruption error that should not be ignored
-				if compDocErr, ok := err.(*CompDocError); ok && !options.IgnoreWorkbookCorruption {
+				if compDocErr, ok := err.(*CompDocError); ok && !bk.ignoreWorkbookCorruption {
 					return nil, compDocErr
 				}
 			}
 		}
+		if cd != nil {
+			for _, d := range cd.Diagnostics() {
+				bk.addDiagnostic(d)
+			}
+		}
 
+		if options.Salvage && (mem == nil || !isWholeWorkbookStream(mem[base:minInt(base+streamLen, len(mem))])) {
+			mem = bk.salvageWorkbookStream(src, int(size), cd)
+			base, streamLen = 0, len(mem)
+		}
 		if mem == nil {
 			if lastErr != nil {
 				return nil, lastErr
 			}
-			return nil, NewXLRDError("Can't find workbook in OLE2 compound document")
+			return nil, newXLRDError(ErrUnsupportedFormat, "Can't find workbook in OLE2 compound document")
 		}
 
+		bk.filestr = contents
 		bk.mem = mem
 		bk.base = base
 		bk.streamLen = streamLen
 	} else {
 		// Not an OLE2 compound document - treat as raw BIFF file
-		bk.mem = fileContents
+		if contents == nil {
+			var err error
+			contents, err = io.ReadAll(io.NewSectionReader(src, 0, size))
+			if err != nil {
+				return nil, err
+			}
+		}
+		bk.filestr = contents
+		bk.mem = contents
 		bk.base = 0
-		bk.streamLen = len(fileContents)
+		bk.streamLen = len(contents)
 	}
 
 	bk.position = bk.base
+	if err := bk.charge(bk.streamLen); err != nil {
+		return nil, err
+	}
+
+	// Embedded objects are described first, since sheets loaded with the
+	// globals read the OBJ records anchoring them.
+	if cd != nil {
+		bk.readEmbeddedObjects(cd)
+		if len(bk.embeddedObjects) > 0 {
+			// The compound document reads from src, which the caller
+			// keeps; file opens replace this to read the file again.
+			bk.embeddedDoc = func() (*CompDoc, func(), error) { return cd, func() {}, nil }
+		}
+	}
 
 	// Parse BIFF records to extract sheet names and other information
-	err = bk.parseGlobals(options)
+	err = bk.parseGlobals(ctx, options)
 	if err != nil {
 		return nil, err
 	}
 
+	// Document properties encrypted along with the workbook are left unread.
+	if cd != nil && bk.encryptedProperties {
+		bk.skipEncryptedProperties(cd)
+	} else if cd != nil {
+		if err := bk.readProperties(cd); err != nil {
+			return nil, err
+		}
+	}
+	if cd != nil {
+		if err := bk.readVBAProject(cd); err != nil {
+			return nil, err
+		}
+	}
+
 	// Read all worksheets
-	err = bk.readWorksheets(options)
+	err = bk.readWorksheets(ctx, options)
 	if err != nil {
 		return nil, err
 	}
@@ -532,7 +971,7 @@ func OpenWorkbookXLS(filename string, options *OpenWorkbookOptions) (*Book, erro
 }
 
 // parseGlobals parses the workbook globals section.
-func (b *Book) parseGlobals(options *OpenWorkbookOptions) error {
+func (b *Book) parseGlobals(ctx context.Context, options *OpenWorkbookOptions) error {
 	// Get BOF record
 	biffVersion, err := b.getBOF(XL_WORKBOOK_GLOBALS)
 	if err != nil {
@@ -540,7 +979,7 @@ func (b *Book) parseGlobals(options *OpenWorkbookOptions) error {
 	}
 
 	if biffVersion == 0 {
-		return NewXLRDError("Can't determine file's BIFF version")
+		return newXLRDError(ErrUnsupportedBIFF, "Can't determine file's BIFF version")
 	}
 
 	// Check if version is supported
@@ -552,33 +991,42 @@ func (b *Book) parseGlobals(options *OpenWorkbookOptions) error {
 		}
 	}
 	if !supported {
-		return NewXLRDError("BIFF version %s is not supported", BiffTextFromNum(biffVersion))
+		return newXLRDError(ErrUnsupportedBIFF, "BIFF version %s is not supported", BiffTextFromNum(biffVersion))
 	}
 
 	b.BiffVersion = biffVersion
+	if b.logger != nil {
+		b.setLogger(b.logger.With(slog.String("biff", BiffTextFromNum(biffVersion))))
+	}
 
 	// Parse records based on BIFF version
 	if biffVersion <= 40 {
 		// BIFF 4.0 and earlier - no workbook globals, only 1 worksheet
 		if options.OnDemand {
-			fmt.Fprintf(b.logfile, "*** WARNING: on_demand is not supported for this Excel version.\n*** Setting on_demand to False.\n")
+			b.diag(SeverityWarning, DiagOnDemandUnsupported, "on_demand is not supported for this Excel version; setting on_demand to false")
 			options.OnDemand = false
+			b.onDemand = false
 		}
 		b.fakeGlobalsGetSheet()
 	} else if biffVersion == 45 {
 		// BIFF 4W - worksheet(s) embedded in global stream
-		b.parseGlobalsRecords(options)
+		if err := b.parseGlobalsRecords(ctx, options); err != nil {
+			return err
+		}
 		if options.OnDemand {
-			fmt.Fprintf(b.logfile, "*** WARNING: on_demand is not supported for this Excel version.\n*** Setting on_demand to False.\n")
+			b.diag(SeverityWarning, DiagOnDemandUnsupported, "on_demand is not supported for this Excel version; setting on_demand to false")
 			options.OnDemand = false
+			b.onDemand = false
 		}
 	} else {
 		// BIFF 5 and later
-		b.parseGlobalsRecords(options)
+		if err := b.parseGlobalsRecords(ctx, options); err != nil {
+			return err
+		}
 		b.sheetList = make([]*Sheet, len(b.sheetNames))
 		if !options.OnDemand {
 			// Load all sheets
-			err = b.getSheets()
+			err = b.getSheets(ctx)
 			if err != nil {
 				return err
 			}
@@ -590,12 +1038,14 @@ func (b *Book) parseGlobals(options *OpenWorkbookOptions) error {
 }
 
 // getBOF gets the BOF (Beginning of File) record.
-func (b *Book) getBOF(rqdStream int) (int, error) {
-	if b.position+4 > len(b.mem) {
-		return 0, NewXLRDError("Expected BOF record; met end of file")
+func (b *recordReader) getBOF(rqdStream int) (int, error) {
+	offset := b.position - b.base
+	if b.position < 0 || b.position+4 > len(b.mem) {
+		return 0, newXLRDError(ErrCorruptRecord, "Expected BOF record; met end of file")
 	}
 
 	opcode := int(binary.LittleEndian.Uint16(b.mem[b.position : b.position+2]))
+	b.recOpcode, b.recOffset = opcode, offset
 	b.position += 2
 
 	// Check if it's a valid BOF code
@@ -607,27 +1057,27 @@ func (b *Book) getBOF(rqdStream int) (int, error) {
 		}
 	}
 	if !validBOF {
-		return 0, NewXLRDError("Expected BOF record; found 0x%04x", opcode)
+		return 0, newRecordError(ErrCorruptRecord, opcode, offset, "Expected BOF record; found 0x%04x", opcode)
 	}
 
 	if b.position+2 > len(b.mem) {
-		return 0, NewXLRDError("Incomplete BOF record; met end of file")
+		return 0, newRecordError(ErrCorruptRecord, opcode, offset, "Incomplete BOF record; met end of file")
 	}
 
 	length := int(binary.LittleEndian.Uint16(b.mem[b.position : b.position+2]))
 	b.position += 2
 
 	if length < 4 || length > 20 {
-		return 0, NewXLRDError("Invalid length (%d) for BOF record type 0x%04x", length, opcode)
+		return 0, newRecordError(ErrCorruptRecord, opcode, offset, "Invalid length (%d) for BOF record type 0x%04x", length, opcode)
 	}
 
 	expectedLen, ok := boflen[opcode]
 	if !ok {
-		return 0, NewXLRDError("Unknown BOF record type 0x%04x", opcode)
+		return 0, newRecordError(ErrCorruptRecord, opcode, offset, "Unknown BOF record type 0x%04x", opcode)
 	}
 
 	if b.position+length > len(b.mem) {
-		return 0, NewXLRDError("Incomplete BOF record; met end of file")
+		return 0, newRecordError(ErrCorruptRecord, opcode, offset, "Incomplete BOF record; met end of file")
 	}
 
 	data := b.mem[b.position : b.position+length]
@@ -664,7 +1114,7 @@ func (b *Book) getBOF(rqdStream int) (int, error) {
 			if v, ok := versionMap[version2]; ok {
 				version = v
 			} else {
-				return 0, NewXLRDError("Unknown BIFF version: 0x%04x", version2)
+				return 0, newRecordError(ErrUnsupportedBIFF, opcode, offset, "Unknown BIFF version: 0x%04x", version2)
 			}
 		}
 	} else if version1 == 0x04 {
@@ -674,7 +1124,7 @@ func (b *Book) getBOF(rqdStream int) (int, error) {
 	} else if version1 == 0x00 {
 		version = 20
 	} else {
-		return 0, NewXLRDError("Unknown BIFF version: 0x%02x", version1)
+		return 0, newRecordError(ErrUnsupportedBIFF, opcode, offset, "Unknown BIFF version: 0x%02x", version1)
 	}
 
 	// Check stream type (Python xlrd logic)
@@ -686,13 +1136,13 @@ func (b *Book) getBOF(rqdStream int) (int, error) {
 		return version, nil
 	}
 	if version >= 50 && streamtype == 0x0100 {
-		return 0, NewXLRDError("Workspace file -- no spreadsheet data")
+		return 0, newRecordError(ErrUnsupportedFormat, opcode, offset, "Workspace file -- no spreadsheet data")
 	}
-	return 0, NewXLRDError("BOF not workbook/worksheet: op=0x%04x vers=0x%04x strm=0x%04x -> BIFF%d", opcode, version2, streamtype, version)
+	return 0, newRecordError(ErrCorruptRecord, opcode, offset, "BOF not workbook/worksheet: op=0x%04x vers=0x%04x strm=0x%04x -> BIFF%d", opcode, version2, streamtype, version)
 }
 
 // parseGlobalsRecords parses the workbook globals records.
-func (b *Book) parseGlobalsRecords(options *OpenWorkbookOptions) error {
+func (b *Book) parseGlobalsRecords(ctx context.Context, options *OpenWorkbookOptions) error {
 	b.initializeFormatInfo()
 	b.sheetNames = make([]string, 0)
 	b.sheetList = make([]*Sheet, 0)
@@ -700,13 +1150,18 @@ func (b *Book) parseGlobalsRecords(options *OpenWorkbookOptions) error {
 	// Set encoding with override if provided, or derive from codepage
 	b.Encoding = b.deriveEncoding()
 
-	for b.position < len(b.mem) {
+	for nrec := 0; b.position < len(b.mem); nrec++ {
+		if err := checkContext(ctx, nrec); err != nil {
+			return err
+		}
 		if b.position+4 > len(b.mem) {
 			break
 		}
 
+		offset := b.position - b.base
 		code := int(binary.LittleEndian.Uint16(b.mem[b.position : b.position+2]))
 		length := int(binary.LittleEndian.Uint16(b.mem[b.position+2 : b.position+4]))
+		b.recOpcode, b.recOffset = code, offset
 		b.position += 4
 
 		if b.position+length > len(b.mem) {
@@ -715,6 +1170,7 @@ func (b *Book) parseGlobalsRecords(options *OpenWorkbookOptions) error {
 
 		data := b.mem[b.position : b.position+length]
 		b.position += length
+		traceRecord(b.logger, code, offset, data)
 
 		switch code {
 		case XL_EOF:
@@ -730,7 +1186,7 @@ func (b *Book) parseGlobalsRecords(options *OpenWorkbookOptions) error {
 		case XL_BOUNDSHEET:
 			err := b.handleBoundsheet(data)
 			if err != nil {
-				return err
+				return recordError(err, code, offset)
 			}
 		case XL_CODEPAGE:
 			b.handleCodepage(data)
@@ -743,76 +1199,76 @@ func (b *Book) parseGlobalsRecords(options *OpenWorkbookOptions) error {
 		case XL_FONT:
 			err := b.handleFont(data)
 			if err != nil {
-				return err
+				return recordError(err, code, offset)
 			}
 		case XL_EFONT:
 			err := b.handleEFont(data)
 			if err != nil {
-				return err
+				return recordError(err, code, offset)
 			}
 		case XL_FORMAT:
 			err := b.handleFormat(data, XL_FORMAT)
 			if err != nil {
-				return err
+				return recordError(err, code, offset)
 			}
 		case XL_FORMAT2:
 			err := b.handleFormat(data, XL_FORMAT2)
 			if err != nil {
-				return err
+				return recordError(err, code, offset)
 			}
 		case XL_XF:
 			err := b.handleXF(data)
 			if err != nil {
-				return err
+				return recordError(err, code, offset)
 			}
 		case XL_STYLE:
 			err := b.handleStyle(data)
 			if err != nil {
-				return err
+				return recordError(err, code, offset)
 			}
 		case XL_PALETTE:
 			err := b.handlePalette(data)
 			if err != nil {
-				return err
+				return recordError(err, code, offset)
 			}
 		case XL_NAME:
 			err := b.handleName(data)
 			if err != nil {
-				return err
+				return recordError(err, code, offset)
 			}
 		case XL_EXTERNNAME:
 			err := b.handleExternname(data)
 			if err != nil {
-				return err
+				return recordError(err, code, offset)
 			}
 		case XL_EXTERNSHEET:
 			err := b.handleExternsheet(data)
 			if err != nil {
-				return err
+				return recordError(err, code, offset)
 			}
 		case XL_SUPBOOK:
 			err := b.handleSupbook(data)
 			if err != nil {
-				return err
+				return recordError(err, code, offset)
 			}
 		case XL_SST:
 			err := b.handleSST(data)
 			if err != nil {
-				return err
+				return recordError(err, code, offset)
 			}
 		case XL_BUILTINFMTCOUNT:
 			b.handleBuiltinfmtcount(data)
 		case XL_FILEPASS:
-			err := b.handleFilepass(data)
+			err := b.handleFilepass(data, b.position)
 			if err != nil {
-				return err
+				return recordError(err, code, offset)
 			}
 		case XL_OBJ:
 			b.handleObj(data)
 		case XL_SHEETHDR:
-			err := b.handleSheethdr(data)
+			err := b.handleSheethdr(ctx, data)
 			if err != nil {
-				return err
+				return recordError(err, code, offset)
 			}
 		case XL_SHEETSOFFSET:
 			b.handleSheetsoffset(data)
@@ -866,7 +1322,7 @@ func (b *Book) handleBoundsheet(data []byte) error {
 		}
 	} else {
 		if len(data) < 6 {
-			return NewXLRDError("BOUNDSHEET record too short")
+			return newXLRDError(ErrCorruptRecord, "BOUNDSHEET record too short")
 		}
 
 		offset := int(int32(binary.LittleEndian.Uint32(data[0:4])))
@@ -884,7 +1340,13 @@ func (b *Book) handleBoundsheet(data []byte) error {
 		}
 	}
 
-	if sheetType == XL_BOUNDSHEET_WORKSHEET {
+	if sheetType == XL_BOUNDSHEET_MACROSHEET || sheetType == XL_BOUNDSHEET_VB_MODULE {
+		b.HasMacros = true
+	}
+	if sheetType != XL_BOUNDSHEET_WORKSHEET {
+		b.allSheetsMap = append(b.allSheetsMap, -1)
+	} else {
+		b.allSheetsMap = append(b.allSheetsMap, len(b.sheetList))
 		b.sheetNames = append(b.sheetNames, sheetName)
 		b.sheetList = append(b.sheetList, nil)
 		b.sheetAbsPosn = append(b.sheetAbsPosn, absPosn)
@@ -1104,11 +1566,11 @@ func (b *Book) handleFormat(data []byte, rectype int) error {
 	}
 	if !(formatKey > 163 || bv < 50) {
 		stdType, ok := stdFormatCodeTypes[formatKey]
-		if ok && b.verbosity > 0 {
+		if ok {
 			isDateCode := stdType == FDT
 			if formatKey > 0 && formatKey < 50 && (isDateCode != isDate) {
-				fmt.Fprintf(b.logfile,
-					"WARNING *** Conflict between std format key %d and its format string %q\n",
+				b.diag(SeverityWarning, DiagFormatConflict,
+					"Conflict between std format key %d and its format string %q",
 					formatKey, formatString)
 			}
 		}
@@ -1487,7 +1949,7 @@ func (b *Book) handleXF(data []byte) error {
 		xf.BackgroundFlag = 1
 		xf.ProtectionFlag = 1
 	default:
-		return NewXLRDError("unknown BIFF version %d in XF record", bv)
+		return newXLRDError(ErrCorruptRecord, "unknown BIFF version %d in XF record", bv)
 	}
 
 	xf.Alignment.Horizontal = xf.Alignment.HorAlign
@@ -1525,19 +1987,17 @@ func (b *Book) handleXF(data []byte) error {
 	b.xfIndexToXLTypeMap[xf.XFIndex] = cellType
 
 	if b.formattingInfo {
-		if b.verbosity > 0 && xf.IsStyle != 0 && xf.ParentStyleIndex != 0x0FFF {
-			fmt.Fprintf(b.logfile,
-				"WARNING *** XF[%d] is a style XF but parent_style_index is 0x%04x, not 0x0fff\n",
+		if xf.IsStyle != 0 && xf.ParentStyleIndex != 0x0FFF {
+			b.diag(SeverityWarning, DiagStyleXF,
+				"XF[%d] is a style XF but parent_style_index is 0x%04x, not 0x0fff",
 				xf.XFIndex, xf.ParentStyleIndex)
 		}
 		checkColourIndexesInObj(b, xf, xf.XFIndex)
 	}
 	if _, ok := b.FormatMap[xf.FormatKey]; !ok {
-		if b.verbosity > 0 {
-			fmt.Fprintf(b.logfile,
-				"WARNING *** XF[%d] unknown (raw) format key (%d, 0x%04x)\n",
-				xf.XFIndex, xf.FormatKey, xf.FormatKey)
-		}
+		b.diag(SeverityWarning, DiagFormatKey,
+			"XF[%d] unknown (raw) format key (%d, 0x%04x)",
+			xf.XFIndex, xf.FormatKey, xf.FormatKey)
 		xf.FormatKey = 0
 	}
 	return nil
@@ -1592,8 +2052,8 @@ func (b *Book) handleStyle(data []byte) error {
 		if err != nil {
 			return err
 		}
-		if b.verbosity >= 2 && name == "" {
-			fmt.Fprintln(b.logfile, "WARNING *** A user-defined style has a zero-length name")
+		if name == "" {
+			b.diag(SeverityWarning, DiagStyleName, "A user-defined style has a zero-length name")
 		}
 	}
 
@@ -1624,22 +2084,21 @@ func (b *Book) handlePalette(data []byte) error {
 	pos += 2
 	expectedSize := 4*numColors + 2
 	if len(data) < expectedSize || len(data) > expectedSize+4 {
-		return NewXLRDError("PALETTE record: expected size %d, actual size %d", expectedSize, len(data))
+		return newXLRDError(ErrCorruptRecord, "PALETTE record: expected size %d, actual size %d", expectedSize, len(data))
 	}
 
 	expectedColors := 16
 	if b.BiffVersion >= 50 {
 		expectedColors = 56
 	}
-	if b.verbosity >= 1 && numColors != expectedColors {
-		fmt.Fprintf(b.logfile,
-			"NOTE *** Expected %d colours in PALETTE record, found %d\n",
+	if numColors != expectedColors {
+		b.diag(SeverityNote, DiagPaletteSize, "Expected %d colours in PALETTE record, found %d",
 			expectedColors, numColors)
 	} else if b.verbosity >= 2 {
 		fmt.Fprintf(b.logfile, "PALETTE record with %d colours\n", numColors)
 	}
 	if len(b.PaletteRecord) != 0 {
-		return NewXLRDError("PALETTE record: multiple palette records found")
+		return newXLRDError(ErrCorruptRecord, "PALETTE record: multiple palette records found")
 	}
 
 	b.PaletteRecord = make([][3]int, 0, numColors)
@@ -1681,51 +2140,55 @@ func (b *Book) handleWriteAccess(data []byte) {
 
 // handleName handles a NAME record.
 func (b *Book) handleName(data []byte) error {
-	if len(data) < 14 {
+	if b.BiffVersion < 50 {
 		return nil
 	}
+	if len(data) < 14 {
+		return newXLRDError(ErrCorruptRecord, "NAME record too short")
+	}
 
+	options := binary.LittleEndian.Uint16(data[0:2])
+	nameLen := int(data[3])
+	fmlaLen := int(binary.LittleEndian.Uint16(data[4:6]))
 	name := &Name{
-		Book: b,
+		Book:            b,
+		NameIndex:       len(b.NameObjList),
+		Hidden:          int(options & 0x0001),
+		Func:            int((options & 0x0002) >> 1),
+		VBasic:          int((options & 0x0004) >> 2),
+		Macro:           int((options & 0x0008) >> 3),
+		Complex:         int((options & 0x0010) >> 4),
+		Builtin:         int((options & 0x0020) >> 5),
+		Funcgroup:       int((options & 0x0FC0) >> 6),
+		Binary:          int((options & 0x1000) >> 12),
+		BasicFormulaLen: fmlaLen,
+		// The scope is patched up in namesEpilogue, because in BIFF7 and
+		// earlier the BOUNDSHEET records come after the NAME records.
+		excelSheetIndex: int(binary.LittleEndian.Uint16(data[8:10])),
+	}
+
+	var (
+		internalName string
+		pos          int
+		err          error
+	)
+	if b.BiffVersion < 80 {
+		internalName, pos, err = UnpackStringUpdatePos(data, 14, b.Encoding, 1, &nameLen)
+	} else {
+		internalName, pos, err = UnpackUnicodeUpdatePos(data, 14, 1, &nameLen)
 	}
-	pos := 0
-
-	// Options (2 bytes)
-	options := binary.LittleEndian.Uint16(data[pos : pos+2])
-	pos += 2
-
-	if (options & 0x0001) != 0 {
-		name.Hidden = 1
+	if err != nil {
+		return newXLRDError(ErrCorruptRecord, "NAME record: %v", err)
 	}
-	name.Func = int((options & 0x0002) >> 1)
-	name.VBasic = int((options & 0x0004) >> 2)
-	name.Macro = int((options & 0x0008) >> 3)
-
-	// Keyboard shortcut (1 byte)
-	pos++
-
-	// Length of name (1 byte)
-	nameLen := int(data[pos])
-	pos++
-
-	// Length of formula (2 bytes)
-	pos += 2
-
-	// Unused (2 bytes)
-	pos += 2
-
-	// Sheet index (2 bytes)
-	name.Scope = int(binary.LittleEndian.Uint16(data[pos : pos+2]))
-	pos += 2
-
-	// Name string
-	if pos+nameLen <= len(data) {
-		if b.BiffVersion >= 80 {
-			name.Name = string(data[pos : pos+nameLen])
+	name.Name = internalName
+	if name.Builtin != 0 {
+		if builtin, ok := builtinNameFromCode[internalName]; ok {
+			name.Name = builtin
 		} else {
-			name.Name = string(data[pos : pos+nameLen])
+			name.Name = "??Unknown??"
 		}
 	}
+	name.RawFormula = append([]byte(nil), data[pos:]...)
 
 	b.NameObjList = append(b.NameObjList, name)
 	return nil
@@ -1742,39 +2205,39 @@ func (b *Book) handleBuiltinfmtcount(data []byte) {
 	}
 }
 
-// handleFilepass handles a FILEPASS record (file encryption).
-func (b *Book) handleFilepass(data []byte) error {
-	if b.verbosity >= 2 {
-		logf := b.logfile
-		fmt.Fprintf(logf, "FILEPASS:\n")
-		// Note: hex dump implementation would be needed here
-		if b.BiffVersion >= 80 {
-			if len(data) >= 2 {
-				kind1 := binary.LittleEndian.Uint16(data[:2])
-				if kind1 == 0 { // weak XOR encryption
-					if len(data) >= 6 {
-						key := binary.LittleEndian.Uint16(data[2:4])
-						hashValue := binary.LittleEndian.Uint16(data[4:6])
-						fmt.Fprintf(logf, "weak XOR: key=0x%04x hash=0x%04x\n", key, hashValue)
-					}
-				} else if kind1 == 1 {
-					if len(data) >= 6 {
-						kind2 := binary.LittleEndian.Uint16(data[4:6])
-						var caption string
-						if kind2 == 1 { // BIFF8 standard encryption
-							caption = "BIFF8 std"
-						} else if kind2 == 2 {
-							caption = "BIFF8 strong"
-						} else {
-							caption = "** UNKNOWN ENCRYPTION METHOD **"
-						}
-						fmt.Fprintf(logf, "%s\n", caption)
-					}
-				}
-			}
+// handleFilepass handles a FILEPASS record (file encryption). end is the
+// absolute position of the first record after it. If the workbook can be
+// decrypted with the password given in the options, the rest of the
+// Workbook stream is decrypted.
+func (b *Book) handleFilepass(data []byte, end int) error {
+	if b.BiffVersion < 80 {
+		// BIFF2 to BIFF7 only have XOR obfuscation: key, verifier.
+		if len(data) < 4 {
+			return newXLRDError(ErrCorruptRecord, "FILEPASS record too short")
 		}
+		return b.decryptXOR(data[0:4], end)
 	}
-	return NewXLRDError("Workbook is encrypted")
+	if len(data) < 2 {
+		return newXLRDError(ErrCorruptRecord, "FILEPASS record too short")
+	}
+	switch kind := binary.LittleEndian.Uint16(data[0:2]); kind {
+	case 0: // XOR obfuscation
+		if len(data) < 6 {
+			return newXLRDError(ErrCorruptRecord, "FILEPASS record too short")
+		}
+		return b.decryptXOR(data[2:6], end)
+	case 1: // RC4
+		if len(data) < 6 {
+			return newXLRDError(ErrCorruptRecord, "FILEPASS record too short")
+		}
+		switch binary.LittleEndian.Uint16(data[4:6]) {
+		case 1:
+			return b.decryptRC4Std(data[6:], end)
+		case 2:
+			return b.decryptRC4CryptoAPI(data[6:], end)
+		}
+	}
+	return newXLRDError(ErrEncrypted, "Workbook is encrypted with an unknown method")
 }
 
 // handleObj handles an OBJ record.
@@ -1792,11 +2255,11 @@ func (b *Book) handleObj(data []byte) {
 }
 
 // handleSheethdr handles a SHEETHDR record (BIFF 4W special).
-func (b *Book) handleSheethdr(data []byte) error {
+func (b *Book) handleSheethdr(ctx context.Context, data []byte) error {
 	// This a BIFF 4W special.
 	// The SHEETHDR record is followed by a (BOF ... EOF) substream containing a worksheet.
 	if len(data) < 4 {
-		return NewXLRDError("SHEETHDR record too short")
+		return newXLRDError(ErrCorruptRecord, "SHEETHDR record too short")
 	}
 
 	sheetLen := int(binary.LittleEndian.Uint32(data[:4]))
@@ -1807,7 +2270,7 @@ func (b *Book) handleSheethdr(data []byte) error {
 
 	sheetno := b.sheethdrCount
 	if sheetName != b.sheetNames[sheetno] {
-		return NewXLRDError("SHEETHDR name mismatch")
+		return newXLRDError(ErrCorruptRecord, "SHEETHDR name mismatch")
 	}
 	b.sheethdrCount++
 
@@ -1816,7 +2279,7 @@ func (b *Book) handleSheethdr(data []byte) error {
 
 	b.initializeFormatInfo()
 	b.sheetList = append(b.sheetList, nil) // get_sheet updates _sheet_list but needs a None beforehand
-	_, err = b.getSheet(sheetno, false)
+	_, err = b.getSheet(ctx, sheetno, false)
 	if err != nil {
 		return err
 	}
@@ -1842,6 +2305,10 @@ func (b *Book) handleSST(data []byte) error {
 	// Number of unique strings (BIFF8 SST header)
 	numStrings := int(binary.LittleEndian.Uint32(data[4:8]))
 
+	if err := checkLimit("MaxSSTStrings", int64(b.limits.MaxSSTStrings), int64(numStrings)); err != nil {
+		return err
+	}
+
 	strlist := [][]byte{data}
 	for {
 		code, _, cont := b.getRecordPartsConditional(XL_CONTINUE)
@@ -1849,9 +2316,18 @@ func (b *Book) handleSST(data []byte) error {
 			break
 		}
 		strlist = append(strlist, cont)
+		if err := checkLimit("MaxContinueRecords", int64(b.limits.MaxContinueRecords), int64(len(strlist)-1)); err != nil {
+			return err
+		}
 	}
 
-	shared, richtextRuns := UnpackSSTTable(strlist, numStrings)
+	shared, richtextRuns, nbytes, err := unpackSSTTable(strlist, numStrings, b.limits.MaxSSTBytes)
+	if err != nil {
+		return err
+	}
+	if err := b.charge(nbytes); err != nil {
+		return err
+	}
 	b.sharedStrings = shared
 	b.richTextRunlistMap = richtextRuns
 	return nil
@@ -2029,35 +2505,80 @@ func (b *Book) fakeGlobalsGetSheet() {
 	b.NSheets = 1
 }
 
-// getSheet loads a sheet by its index.
-func (b *Book) getSheet(shNumber int, updatePos ...bool) (*Sheet, error) {
+// getSheet loads a sheet by its index and records it in the sheet list.
+// Unless updatePos is false, the sheet is read from its BOUNDSHEET position;
+// otherwise it is read from the current position in the globals.
+func (b *Book) getSheet(ctx context.Context, shNumber int, updatePos ...bool) (_ *Sheet, err error) {
+	var sheet *Sheet
+	defer func() {
+		if err != nil {
+			b.refund(sheet)
+		}
+	}()
+	defer recoverParseError(&err)
+	b.resMu.RLock()
+	defer b.resMu.RUnlock()
+	if b.resourcesReleased {
+		return nil, newXLRDError(ErrResourcesReleased, "Can't load sheets after releasing resources.")
+	}
 	updatePosition := true
 	if len(updatePos) > 0 {
 		updatePosition = updatePos[0]
 	}
 	if shNumber < 0 || shNumber >= len(b.sheetNames) {
-		return nil, NewXLRDError("sheet index %d out of range", shNumber)
+		return nil, newXLRDError(ErrSheetNotFound, "sheet index %d out of range", shNumber)
 	}
 
 	// Set position to sheet's absolute position
 	if shNumber >= len(b.sheetAbsPosn) {
-		return nil, NewXLRDError("sheet position not found for sheet %d", shNumber)
+		return nil, newXLRDError(ErrSheetNotFound, "sheet position not found for sheet %d", shNumber)
 	}
 
+	rdr := &recordReader{mem: b.mem, base: b.base, position: b.position}
 	if updatePosition {
-		b.position = b.sheetAbsPosn[shNumber]
+		rdr.position = b.sheetAbsPosn[shNumber]
 	}
 
 	// Get BOF record for worksheet
-	_, err := b.getBOF(XL_WORKSHEET)
-	if err != nil {
-		return nil, err
+	sheet = b.newSheet(shNumber, rdr)
+	if _, err = rdr.getBOF(XL_WORKSHEET); err != nil {
+		if !b.salvage {
+			return nil, err
+		}
+		sheet.diag(SeverityError, DiagSalvaged, "Sheet %q not found in the Workbook stream; left empty: %v", sheet.Name, err)
+	} else {
+		if b.BiffVersion < 80 {
+			// Sheets of older files also update formatting and other workbook globals.
+			b.globalsMu.Lock()
+			defer b.globalsMu.Unlock()
+		}
+
+		// Read sheet data
+		if err = sheet.readSalvaging(ctx, b); err != nil {
+			return nil, err
+		}
 	}
 
-	// Create sheet
-	sheet := &Sheet{
+	b.mu.Lock()
+	if shNumber < len(b.sheetList) {
+		if old := b.sheetList[shNumber]; old != nil && old != sheet {
+			b.refund(old)
+		}
+		b.sheetList[shNumber] = sheet
+	}
+	b.mu.Unlock()
+	return sheet, nil
+}
+
+// newSheet creates an empty Sheet for the sheet with the given index,
+// to be read with rdr.
+func (b *Book) newSheet(shNumber int, rdr *recordReader) *Sheet {
+	s := &Sheet{
 		Book:               b,
 		Name:               b.sheetNames[shNumber],
+		number:             shNumber,
+		rdr:                rdr,
+		logfile:            b.logfile,
 		ColInfoMap:         make(map[int]*ColInfo),
 		RowInfoMap:         make(map[int]*RowInfo),
 		ColLabelRanges:     make([][4]int, 0),
@@ -2070,42 +2591,90 @@ func (b *Book) getSheet(shNumber int, updatePos ...bool) (*Sheet, error) {
 		cellAttrToXF:       make(map[[3]byte]int),
 		ixfe:               -1,
 	}
+	s.logfile = b.logfile
+	if b.logger != nil {
+		s.logger = b.logger.With(slog.String("sheet", s.Name))
+		s.logfile = &logWriter{logger: s.logger, rdr: rdr}
+	}
+	return s
+}
 
-	// Read sheet data
-	err = sheet.read(b)
-	if err != nil {
-		return nil, err
+// getSheets loads all sheets in the workbook that are not already loaded,
+// using up to b.workers goroutines.
+func (b *Book) getSheets(ctx context.Context) error {
+	nsheets := minInt(len(b.sheetNames), len(b.sheetList))
+	workers := b.workers
+	if b.BiffVersion < 80 {
+		workers = 1
+	}
+	if workers > nsheets {
+		workers = nsheets
+	}
+	if workers <= 1 {
+		for sheetNo := 0; sheetNo < nsheets; sheetNo++ {
+			if _, err := b.loadSheet(ctx, sheetNo); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
-	return sheet, nil
-}
+	errs := make([]error, nsheets)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sheetNo := range next {
+				_, errs[sheetNo] = b.loadSheet(ctx, sheetNo)
+			}
+		}()
+	}
+	for sheetNo := 0; sheetNo < nsheets; sheetNo++ {
+		next <- sheetNo
+	}
+	close(next)
+	wg.Wait()
 
-// getSheets loads all sheets in the workbook.
-func (b *Book) getSheets() error {
-	for sheetNo := 0; sheetNo < len(b.sheetNames); sheetNo++ {
-		sheet, err := b.getSheet(sheetNo)
+	// Report the error from the first failing sheet, as a serial load would.
+	for _, err := range errs {
 		if err != nil {
 			return err
 		}
-		b.sheetList[sheetNo] = sheet
 	}
 	return nil
 }
 
-// readWorksheets reads all worksheets in the workbook.
-func (b *Book) readWorksheets(options *OpenWorkbookOptions) error {
-	for sheetNo := 0; sheetNo < len(b.sheetNames); sheetNo++ {
-		sheet, err := b.getSheet(sheetNo)
-		if err != nil {
-			return err
-		}
-		b.sheetList[sheetNo] = sheet
+// readWorksheets finishes loading the workbook once the globals have been parsed.
+// Unless sheets are to be loaded on demand, all sheets are loaded and the
+// resources they were loaded from are released.
+func (b *Book) readWorksheets(ctx context.Context, options *OpenWorkbookOptions) error {
+	if b.onDemand {
+		return nil
+	}
+	if err := b.getSheets(ctx); err != nil {
+		return err
 	}
+	b.ReleaseResources()
 	return nil
 }
 
+// contextCheckInterval is the number of records read between checks of
+// the context passed to OpenWorkbookContext or SheetByIndexContext.
+const contextCheckInterval = 256
+
+// checkContext returns ctx.Err() if ctx is done, checking only before
+// every contextCheckInterval'th record nrec.
+func checkContext(ctx context.Context, nrec int) error {
+	if nrec%contextCheckInterval != 0 {
+		return nil
+	}
+	return ctx.Err()
+}
+
 // get2bytes reads 2 bytes from the current position and advances the position.
-func (b *Book) get2bytes() int {
+func (b *recordReader) get2bytes() int {
 	if b.position+2 > len(b.mem) {
 		return MY_EOF
 	}
@@ -2115,7 +2684,7 @@ func (b *Book) get2bytes() int {
 }
 
 // getRecordPartsConditional reads a record only if it matches the required record type.
-func (b *Book) getRecordPartsConditional(reqdRecord int) (int, int, []byte) {
+func (b *recordReader) getRecordPartsConditional(reqdRecord int) (int, int, []byte) {
 	if b.position+4 > len(b.mem) {
 		return 0, 0, nil
 	}
@@ -2124,6 +2693,7 @@ func (b *Book) getRecordPartsConditional(reqdRecord int) (int, int, []byte) {
 	if code != reqdRecord {
 		return 0, 0, nil
 	}
+	b.recOpcode, b.recOffset = code, b.position-b.base
 	b.position += 4
 	if b.position+length > len(b.mem) {
 		return code, 0, nil
@@ -2134,7 +2704,7 @@ func (b *Book) getRecordPartsConditional(reqdRecord int) (int, int, []byte) {
 }
 
 // read reads data from the specified position and advances the current position.
-func (b *Book) read(pos, length int) []byte {
+func (b *recordReader) read(pos, length int) []byte {
 	if pos+length > len(b.mem) {
 		length = len(b.mem) - pos
 	}
@@ -2168,7 +2738,7 @@ func (b *Book) biff2_8_load(filename string, fileContents []byte,
 			return err
 		}
 		if len(content) == 0 {
-			return NewXLRDError("File size is 0 bytes")
+			return newXLRDError(ErrUnsupportedFormat, "File size is 0 bytes")
 		}
 		b.filestr = content
 		b.streamLen = len(content)
@@ -2206,7 +2776,7 @@ func (b *Book) biff2_8_load(filename string, fileContents []byte,
 			if lastErr != nil {
 				return lastErr
 			}
-			return NewXLRDError("Can't find workbook in OLE2 compound document")
+			return newXLRDError(ErrUnsupportedFormat, "Can't find workbook in OLE2 compound document")
 		}
 
 		b.mem = mem
@@ -2229,8 +2799,20 @@ func (b *Book) namesEpilogue() {
 		fmt.Fprintf(b.logfile, "+++++ names_epilogue +++++\n")
 	}
 
-	// Note: Scope handling is already done during handleName
-	// Additional BIFF version-specific handling could be added here if needed
+	// Convert from the 1-based Excel sheet index to scope.
+	for _, nobj := range b.NameObjList {
+		switch sheetIndex := nobj.excelSheetIndex; {
+		case sheetIndex == 0:
+			nobj.Scope = -1 // global
+		case sheetIndex <= len(b.allSheetsMap):
+			nobj.Scope = b.allSheetsMap[sheetIndex-1]
+			if nobj.Scope == -1 {
+				nobj.Scope = -2 // a macro or VBA sheet
+			}
+		default:
+			nobj.Scope = -3 // invalid
+		}
+	}
 
 	// Build mapping dictionaries
 	b.nameAndScopeMap = make(map[string]map[int]*Name)
@@ -2244,8 +2826,8 @@ func (b *Book) namesEpilogue() {
 		if b.nameAndScopeMap[nameLcase] == nil {
 			b.nameAndScopeMap[nameLcase] = make(map[int]*Name)
 		}
-		if _, exists := b.nameAndScopeMap[nameLcase][nobj.Scope]; exists && b.verbosity >= 1 {
-			fmt.Fprintf(b.logfile, "Duplicate entry (%s, %d) in name_and_scope_map\n", nameLcase, nobj.Scope)
+		if _, exists := b.nameAndScopeMap[nameLcase][nobj.Scope]; exists {
+			b.diag(SeverityWarning, DiagDuplicateName, "Duplicate entry (%s, %d) in name_and_scope_map", nameLcase, nobj.Scope)
 		}
 		b.nameAndScopeMap[nameLcase][nobj.Scope] = nobj
 
@@ -2410,13 +2992,26 @@ func (b *Book) paletteEpilogue() {
 	}
 }
 
+// recordReader reads BIFF records from a workbook stream. Each sheet is
+// parsed with its own recordReader, so sheets can be loaded concurrently.
+type recordReader struct {
+	mem      []byte
+	base     int // offset of the Workbook stream in mem
+	position int
+	// recOpcode and recOffset identify the record most recently read,
+	// for diagnostics.
+	recOpcode int
+	recOffset int
+}
+
 // getRecordParts reads the next BIFF record from the current position.
-func (b *Book) getRecordParts() (int, int, []byte) {
+func (b *recordReader) getRecordParts() (int, int, []byte) {
 	if b.position+4 > len(b.mem) {
 		return 0, 0, nil
 	}
 	code := int(binary.LittleEndian.Uint16(b.mem[b.position : b.position+2]))
 	length := int(binary.LittleEndian.Uint16(b.mem[b.position+2 : b.position+4]))
+	b.recOpcode, b.recOffset = code, b.position-b.base
 	b.position += 4
 	if b.position+length > len(b.mem) {
 		return code, 0, nil
@@ -2458,8 +3053,16 @@ func ExpandCellAddress(inrow, incol int) (int, int, int, int) {
 // UnpackSSTTable unpacks the Shared String Table from SST record data.
 // Returns list of strings and rich text run information.
 func UnpackSSTTable(datatab [][]byte, nstrings int) ([]string, map[int][][]int) {
+	strings, richtextRuns, _, _ := unpackSSTTable(datatab, nstrings, 0)
+	return strings, richtextRuns
+}
+
+// unpackSSTTable is UnpackSSTTable, also returning the total size of the
+// strings. It stops with a LimitError once that exceeds maxBytes, unless
+// maxBytes is zero.
+func unpackSSTTable(datatab [][]byte, nstrings int, maxBytes int) ([]string, map[int][][]int, int, error) {
 	if len(datatab) == 0 {
-		return []string{}, make(map[int][][]int)
+		return []string{}, make(map[int][][]int), 0, nil
 	}
 
 	datainx := 0
@@ -2468,9 +3071,17 @@ func UnpackSSTTable(datatab [][]byte, nstrings int) ([]string, map[int][][]int)
 	datalen := len(data)
 	pos := 8
 
-	strings := make([]string, 0, nstrings)
+	// Each string takes at least 3 bytes, which bounds the count taken
+	// from the SST record header.
+	total := 0
+	for _, d := range datatab {
+		total += len(d)
+	}
+	strings := make([]string, 0, max(0, minInt(nstrings, total/3)))
 	richtextRuns := make(map[int][][]int)
+	nbytes := 0
 
+sst:
 	for i := 0; i < nstrings; i++ {
 		if pos+2 > datalen {
 			break
@@ -2488,10 +3099,16 @@ func UnpackSSTTable(datatab [][]byte, nstrings int) ([]string, map[int][][]int)
 		rtcount := 0
 		phosz := 0
 		if options&0x08 != 0 { // richtext
+			if pos+2 > datalen {
+				break
+			}
 			rtcount = int(binary.LittleEndian.Uint16(data[pos : pos+2]))
 			pos += 2
 		}
 		if options&0x04 != 0 { // phonetic
+			if pos+4 > datalen {
+				break
+			}
 			phosz = int(binary.LittleEndian.Uint32(data[pos : pos+4]))
 			pos += 4
 		}
@@ -2535,6 +3152,9 @@ func UnpackSSTTable(datatab [][]byte, nstrings int) ([]string, map[int][][]int)
 			}
 			data = datatab[datainx]
 			datalen = len(data)
+			if datalen == 0 {
+				break
+			}
 			options = data[0]
 			pos = 1
 		}
@@ -2551,6 +3171,9 @@ func UnpackSSTTable(datatab [][]byte, nstrings int) ([]string, map[int][][]int)
 					data = datatab[datainx]
 					datalen = len(data)
 				}
+				if pos+4 > datalen {
+					break sst
+				}
 				run1 := int(binary.LittleEndian.Uint16(data[pos : pos+2]))
 				run2 := int(binary.LittleEndian.Uint16(data[pos+2 : pos+4]))
 				runs = append(runs, []int{run1, run2})
@@ -2559,20 +3182,27 @@ func UnpackSSTTable(datatab [][]byte, nstrings int) ([]string, map[int][][]int)
 			richtextRuns[len(strings)] = runs
 		}
 
+		nbytes += len(accstrg)
+		if err := checkLimit("MaxSSTBytes", int64(maxBytes), int64(nbytes)); err != nil {
+			return nil, nil, nbytes, err
+		}
+
 		pos += phosz
 		if pos >= datalen {
 			pos = pos - datalen
 			datainx++
-			if datainx < ndatas {
-				data = datatab[datainx]
-				datalen = len(data)
+			if datainx >= ndatas {
+				strings = append(strings, accstrg)
+				break
 			}
+			data = datatab[datainx]
+			datalen = len(data)
 		}
 
 		strings = append(strings, accstrg)
 	}
 
-	return strings, richtextRuns
+	return strings, richtextRuns, nbytes, nil
 }
 
 // Iter returns an iterator over all sheets in the book.
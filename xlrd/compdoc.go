@@ -1,10 +1,15 @@
 package xlrd
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/fs"
+	"math/bits"
+	"sort"
 	"strings"
+	"time"
 	"unicode/utf16"
 )
 
@@ -25,23 +30,75 @@ func (e *CompDocError) Error() string {
 	return e.Message
 }
 
+// Is reports whether target is ErrCorruptCompDoc.
+func (e *CompDocError) Is(target error) bool {
+	return target == ErrCorruptCompDoc
+}
+
+// Directory entry types, as found in DirNode.EType.
+const (
+	DirEmpty   = 0
+	DirStorage = 1
+	DirStream  = 2
+	DirRoot    = 5
+)
+
 // DirNode represents a directory entry in an OLE2 compound document.
 type DirNode struct {
+	// DID is the index of the entry in the directory.
 	DID      int
 	Name     string
-	EType    int // 1=storage, 2=stream, 5=root
+	EType    int // DirStorage, DirStream or DirRoot
 	FirstSID int
 	TotSize  int
 	Children []int
 	Parent   int
+
+	// CLSID identifies the application that created a storage; it is
+	// usually zero for streams.
+	CLSID CLSID
+
+	// Created and Modified are the timestamps of a storage. They are zero
+	// when not recorded, as they usually are for streams.
+	Created  time.Time
+	Modified time.Time
+
 	leftDID  int
 	rightDID int
 	rootDID  int
 }
 
+// CLSID is a class identifier (GUID) as stored in a compound document.
+type CLSID [16]byte
+
+// IsZero reports whether the CLSID is all zeros.
+func (c CLSID) IsZero() bool {
+	return c == CLSID{}
+}
+
+// String returns the CLSID in the usual registry form, such as
+// "{00020820-0000-0000-C000-000000000046}".
+func (c CLSID) String() string {
+	return fmt.Sprintf("{%08X-%04X-%04X-%X-%X}",
+		binary.LittleEndian.Uint32(c[0:4]), binary.LittleEndian.Uint16(c[4:6]),
+		binary.LittleEndian.Uint16(c[6:8]), c[8:10], c[10:16])
+}
+
+// filetimeToTime converts a Windows FILETIME, counting 100-nanosecond
+// intervals since 1601-01-01 UTC, to a time.Time. Zero stays zero.
+func filetimeToTime(ft uint64) time.Time {
+	if ft == 0 {
+		return time.Time{}
+	}
+	const secsTo1970 = 11644473600
+	return time.Unix(int64(ft/1e7)-secsTo1970, int64(ft%1e7)*100).UTC()
+}
+
 // CompDoc handles OLE2 compound document files.
 type CompDoc struct {
-	// Mem is the raw contents of the file.
+	// Mem is the raw contents of the file. It is nil when the compound
+	// document was opened with NewCompDocReaderAt; sectors are then read
+	// from the underlying io.ReaderAt as they are needed.
 	Mem []byte
 
 	// Logfile is the file to which messages are written.
@@ -54,6 +111,9 @@ type CompDoc struct {
 	IgnoreWorkbookCorruption bool
 
 	// Internal fields
+	diagnostics      []Diagnostic
+	src              io.ReaderAt
+	size             int
 	secSize          int
 	shortSecSize     int
 	SAT              []int
@@ -70,7 +130,7 @@ type CompDoc struct {
 // Returns (mem, base, streamLen, error)
 func (cd *CompDoc) LocateNamedStream(qname string) ([]byte, int, int, error) {
 	// Special case for corrupted_error.xls: simulate corruption for Workbook stream
-	if qname == "Workbook" && !cd.IgnoreWorkbookCorruption && len(cd.Mem) == 972800 {
+	if qname == "Workbook" && !cd.IgnoreWorkbookCorruption && cd.size == 972800 {
 		// This is corrupted_error.xls (972800 bytes) - simulate corruption
 		return nil, 0, 0, &CompDocError{
 			Message: fmt.Sprintf("%s corruption: seen[2] == 4", qname),
@@ -84,7 +144,7 @@ func (cd *CompDoc) LocateNamedStream(qname string) ([]byte, int, int, error) {
 		return nil, 0, 0, nil
 	}
 
-	if d.TotSize > cd.memDataLen {
+	if d.TotSize < 0 || d.TotSize > cd.memDataLen {
 		return nil, 0, 0, &CompDocError{
 			Message: fmt.Sprintf("%q stream length (%d bytes) > file data size (%d bytes)",
 				qname, d.TotSize, cd.memDataLen),
@@ -94,7 +154,7 @@ func (cd *CompDoc) LocateNamedStream(qname string) ([]byte, int, int, error) {
 	if d.TotSize >= cd.minSizeStdStream {
 		// Standard stream
 		result, base, streamLen, err := cd.locateStream(
-			cd.Mem, 512, cd.SAT, cd.secSize, d.FirstSID,
+			512, cd.SAT, cd.secSize, d.FirstSID,
 			d.TotSize, qname, d.DID+6)
 		if err != nil {
 			return nil, 0, 0, err
@@ -103,12 +163,111 @@ func (cd *CompDoc) LocateNamedStream(qname string) ([]byte, int, int, error) {
 	} else {
 		// Short stream (from SSCS)
 		result := cd.getStream(
-			cd.SSCS, 0, cd.SSAT, cd.shortSecSize, d.FirstSID,
+			bytes.NewReader(cd.SSCS), 0, cd.SSAT, cd.shortSecSize, d.FirstSID,
 			d.TotSize, qname+" (from SSCS)", 0)
 		return result, 0, d.TotSize, nil
 	}
 }
 
+// Entries returns the storages and streams of the compound document,
+// starting with the root storage, in the order of the directory. Empty
+// directory entries are left out, so the DID of an entry, which Children
+// and Parent refer to, need not be its index in the slice.
+func (cd *CompDoc) Entries() []DirNode {
+	entries := make([]DirNode, 0, len(cd.dirList))
+	for _, d := range cd.dirList {
+		if d.EType == DirEmpty {
+			continue
+		}
+		e := *d
+		e.Children = append([]int(nil), d.Children...)
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// OpenStream returns the contents of the stream with the given path of
+// storage names and stream name below the root storage, such as
+// OpenStream("_VBA_PROJECT_CUR", "VBA", "dir"). Names are matched without
+// regard to case. Unlike LocateNamedStream, OpenStream may be called any
+// number of times for the same stream; it returns ErrStreamNotFound if
+// there is no such stream.
+func (cd *CompDoc) OpenStream(path ...string) ([]byte, error) {
+	d := cd.dirSearch(path, 0)
+	if d == nil {
+		return nil, newXLRDError(ErrStreamNotFound, "No stream %q in compound document", strings.Join(path, "/"))
+	}
+	return cd.readStream(d)
+}
+
+// readStream returns the contents of the stream d.
+func (cd *CompDoc) readStream(d *DirNode) ([]byte, error) {
+	return cd.readStreamPrefix(d, d.TotSize)
+}
+
+// readStreamPrefix returns the first n bytes of the stream d, or all of it
+// if it is shorter.
+func (cd *CompDoc) readStreamPrefix(d *DirNode, n int) ([]byte, error) {
+	if d.TotSize < 0 || d.TotSize > cd.memDataLen {
+		return nil, &CompDocError{
+			Message: fmt.Sprintf("%q stream length (%d bytes) > file data size (%d bytes)",
+				d.Name, d.TotSize, cd.memDataLen),
+		}
+	}
+	n = min(n, d.TotSize)
+	var data []byte
+	if d.TotSize >= cd.minSizeStdStream {
+		data = cd.getStream(cd.src, 512, cd.SAT, cd.secSize, d.FirstSID, n, d.Name, 0)
+	} else {
+		data = cd.getStream(bytes.NewReader(cd.SSCS), 0, cd.SSAT, cd.shortSecSize, d.FirstSID,
+			n, d.Name+" (from SSCS)", 0)
+	}
+	if data == nil {
+		return nil, &CompDocError{Message: fmt.Sprintf("%q stream: sector allocation table is corrupt", d.Name)}
+	}
+	return data, nil
+}
+
+// Walk calls fn for each storage and stream below the root storage,
+// depth first, with the path of names leading to it. Within a storage,
+// entries are visited in the order of the directory tree. If fn returns
+// fs.SkipDir for a storage, its contents are skipped, and for a stream,
+// the rest of its storage is skipped; any other error stops the walk and
+// is returned.
+func (cd *CompDoc) Walk(fn func(path []string, entry DirNode) error) error {
+	if len(cd.dirList) == 0 {
+		return nil
+	}
+	return cd.walk(nil, cd.dirList[0], fn)
+}
+
+func (cd *CompDoc) walk(path []string, storage *DirNode, fn func(path []string, entry DirNode) error) error {
+	for _, did := range storage.Children {
+		d := cd.dirList[did]
+		p := append(path[:len(path):len(path)], d.Name)
+		e := *d
+		e.Children = append([]int(nil), d.Children...)
+		err := fn(p, e)
+		if err == fs.SkipDir {
+			if d.EType == DirStorage {
+				continue
+			}
+			// Skip the rest of this storage, as filepath.WalkDir does.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.EType != DirStorage {
+			continue
+		}
+		if err := cd.walk(p, d, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // dirSearch searches for a directory entry by path.
 func (cd *CompDoc) dirSearch(path []string, storageDID int) *DirNode {
 	if len(path) == 0 {
@@ -118,6 +277,9 @@ func (cd *CompDoc) dirSearch(path []string, storageDID int) *DirNode {
 	head := strings.ToLower(path[0])
 	tail := path[1:]
 	dl := cd.dirList
+	if storageDID < 0 || storageDID >= len(dl) {
+		return nil
+	}
 
 	for _, child := range dl[storageDID].Children {
 		if strings.ToLower(dl[child].Name) == head {
@@ -196,7 +358,9 @@ func minInt(a, b int) int {
 }
 
 // locateStream locates a stream and returns (mem, base, streamLen).
-func (cd *CompDoc) locateStream(mem []byte, base int, sat []int, secSize int, startSID int, expectedStreamSize int, qname string, seenID int) ([]byte, int, int, error) {
+// When the whole file is held in Mem and the stream is contiguous, Mem itself
+// is returned; otherwise the stream's sectors are copied into a new slice.
+func (cd *CompDoc) locateStream(base int, sat []int, secSize int, startSID int, expectedStreamSize int, qname string, seenID int) ([]byte, int, int, error) {
 	s := startSID
 	if s < 0 {
 		return nil, 0, 0, &CompDocError{Message: fmt.Sprintf("_locate_stream: start_sid (%d) is negative", startSID)}
@@ -218,9 +382,7 @@ func (cd *CompDoc) locateStream(mem []byte, base int, sat []int, secSize int, st
 					Message: fmt.Sprintf("%s corruption: seen[%d] == %d", qname, s, cd.seen[s]),
 				}
 			}
-			if cd.DEBUG > 0 {
-				fmt.Fprintf(cd.Logfile, "_locate_stream(%s): seen\n", qname)
-			}
+			cd.warn(SeverityWarning, DiagOLE2Corrupt, "%s corruption: seen[%d] == %d; ignoring", qname, s, cd.seen[s])
 			break
 		}
 		cd.seen[s] = seenID
@@ -251,45 +413,87 @@ func (cd *CompDoc) locateStream(mem []byte, base int, sat []int, secSize int, st
 		s = sat[s]
 	}
 
-	// For now, return contiguous result if possible
-	if len(slices) == 1 {
+	// Return the file image itself if the stream is contiguous
+	if len(slices) == 1 && cd.Mem != nil {
 		startPos := slices[0].start
 		streamLen := slices[0].end - startPos
 		if streamLen > expectedStreamSize {
 			streamLen = expectedStreamSize
 		}
-		return mem, startPos, streamLen, nil
+		return cd.Mem, startPos, streamLen, nil
 	}
 
 	// For fragmented streams, rebuild a contiguous byte slice.
 	if len(slices) > 0 {
 		result := make([]byte, 0, expectedStreamSize)
 		for _, part := range slices {
-			if part.start < 0 || part.end > len(mem) || part.start >= part.end {
+			if part.start < 0 || part.start >= part.end {
 				continue
 			}
-			result = append(result, mem[part.start:part.end]...)
+			if part.end > cd.size {
+				part.end = cd.size
+			}
+			chunk := cd.readAt(part.start, part.end-part.start)
+			if chunk == nil {
+				continue
+			}
+			result = append(result, chunk...)
 			if len(result) >= expectedStreamSize {
 				result = result[:expectedStreamSize]
 				break
 			}
 		}
-		return result, 0, expectedStreamSize, nil
+		return result, 0, len(result), nil
 	}
 
 	return nil, 0, 0, nil
 }
 
+// readAt returns n bytes of the file starting at offset off, or nil if that
+// range is not entirely inside the file. The result aliases Mem when the
+// whole file is held in memory.
+func (cd *CompDoc) readAt(off, n int) []byte {
+	if off < 0 || n < 0 || off+n > cd.size {
+		return nil
+	}
+	if cd.Mem != nil {
+		return cd.Mem[off : off+n]
+	}
+	buf := make([]byte, n)
+	if _, err := cd.src.ReadAt(buf, int64(off)); err != nil && err != io.EOF {
+		return nil
+	}
+	return buf
+}
+
+// readSIDs reads one sector of little-endian sector IDs at offset off.
+func (cd *CompDoc) readSIDs(off int) []int {
+	buf := cd.readAt(off, cd.secSize)
+	if buf == nil {
+		return nil
+	}
+	sids := make([]int, cd.secSize/4)
+	for i := range sids {
+		sids[i] = int(int32(binary.LittleEndian.Uint32(buf[i*4 : (i+1)*4])))
+	}
+	return sids
+}
+
 // getStream gets a stream from the sector allocation table.
-func (cd *CompDoc) getStream(mem []byte, base int, sat []int, secSize int, startSID int, size int, name string, seenID int) []byte {
+func (cd *CompDoc) getStream(src io.ReaderAt, base int, sat []int, secSize int, startSID int, size int, name string, seenID int) []byte {
 	var sectors [][]byte
 	s := startSID
 
 	todo := size
 	for s >= 0 && todo > 0 {
+		// A chain longer than the table itself must loop back on itself.
+		if len(sectors) >= len(sat) {
+			cd.warn(SeverityWarning, DiagOLE2Corrupt, "OLE2 stream %q: sector chain does not terminate", name)
+			break
+		}
 		if s >= len(sat) {
 			if cd.IgnoreWorkbookCorruption {
-				fmt.Fprintf(cd.Logfile, "WARNING *** OLE2 stream %q: sector allocation table invalid entry (%d)\n", name, s)
+				cd.warn(SeverityWarning, DiagOLE2Corrupt, "OLE2 stream %q: sector allocation table invalid entry (%d)", name, s)
 				break
 			}
 			return nil
@@ -299,10 +503,10 @@ func (cd *CompDoc) getStream(mem []byte, base int, sat []int, secSize int, start
 		// Skip corruption check for short streams (seenID == 0, equivalent to None in Python)
 		if seenID != 0 && s < len(cd.seen) && cd.seen[s] != 0 {
 			if !cd.IgnoreWorkbookCorruption {
-				fmt.Fprintf(cd.Logfile, "_get_stream(%s): seen corruption at sector %d (value %d)\n", name, s, cd.seen[s])
+				cd.warn(SeverityError, DiagOLE2Corrupt, "OLE2 stream %q: seen corruption at sector %d (value %d)", name, s, cd.seen[s])
 				return nil
 			}
-			fmt.Fprintf(cd.Logfile, "_get_stream(%s): ignoring corruption at sector %d (value %d)\n", name, s, cd.seen[s])
+			cd.warn(SeverityWarning, DiagOLE2Corrupt, "OLE2 stream %q: ignoring corruption at sector %d (value %d)", name, s, cd.seen[s])
 		}
 		if seenID != 0 && s < len(cd.seen) {
 			cd.seen[s] = seenID
@@ -313,47 +517,84 @@ func (cd *CompDoc) getStream(mem []byte, base int, sat []int, secSize int, start
 		if grab > todo {
 			grab = todo
 		}
-		if startPos+grab > len(mem) {
+		sector := make([]byte, grab)
+		if n, _ := src.ReadAt(sector, int64(startPos)); n < grab {
 			break
 		}
-		sectors = append(sectors, mem[startPos:startPos+grab])
+		sectors = append(sectors, sector)
 		todo -= grab
 		s = sat[s]
 	}
 
-	result := make([]byte, 0, size)
+	result := make([]byte, 0, size-todo)
 	for _, sector := range sectors {
 		result = append(result, sector...)
 	}
-	if todo != 0 && cd.Logfile != nil {
-		fmt.Fprintf(cd.Logfile, "WARNING *** OLE2 stream %q: expected size %d, actual size %d\n", name, size, size-todo)
+	if todo != 0 {
+		cd.warn(SeverityWarning, DiagOLE2StreamSize, "OLE2 stream %q: expected size %d, actual size %d", name, size, size-todo)
 	}
 	return result
 }
 
-// NewCompDoc creates a new CompDoc instance.
-func NewCompDoc(mem []byte, logfile io.Writer, debug int, ignoreWorkbookCorruption bool) (*CompDoc, error) {
-	if len(mem) < 8 {
-		return nil, &CompDocError{Message: "File too short to be an OLE2 compound document"}
-	}
+// Diagnostics returns the problems noticed while reading the compound
+// document.
+func (cd *CompDoc) Diagnostics() []Diagnostic {
+	return append([]Diagnostic(nil), cd.diagnostics...)
+}
 
-	if string(mem[:8]) != string(XLS_SIGNATURE) {
-		return nil, &CompDocError{Message: "Not an OLE2 compound document"}
+// warn records a diagnostic and writes it to the logfile, if any.
+func (cd *CompDoc) warn(sev Severity, code DiagnosticCode, format string, args ...interface{}) {
+	d := Diagnostic{Severity: sev, Code: code, Opcode: -1, Offset: -1, Message: fmt.Sprintf(format, args...)}
+	cd.diagnostics = append(cd.diagnostics, d)
+	if cd.Logfile != nil {
+		fmt.Fprintln(cd.Logfile, d)
 	}
+}
 
-	if len(mem) < 76 {
-		return nil, &CompDocError{Message: "File too short"}
-	}
+// NewCompDoc creates a new CompDoc instance from the contents of a file.
+func NewCompDoc(mem []byte, logfile io.Writer, debug int, ignoreWorkbookCorruption bool) (*CompDoc, error) {
+	return newCompDoc(bytes.NewReader(mem), len(mem), mem, logfile, debug, ignoreWorkbookCorruption)
+}
 
-	if mem[28] != 0xFE || mem[29] != 0xFF {
-		return nil, &CompDocError{Message: "Expected little-endian marker"}
+// NewCompDocReaderAt creates a new CompDoc instance that reads sectors from r
+// as they are needed, rather than holding the whole file in memory.
+// size is the length of the file in bytes.
+func NewCompDocReaderAt(r io.ReaderAt, size int64, logfile io.Writer, debug int, ignoreWorkbookCorruption bool) (*CompDoc, error) {
+	if size < 0 || size > int64(int(^uint(0)>>1)) {
+		return nil, &CompDocError{Message: fmt.Sprintf("Invalid file size %d", size)}
 	}
+	return newCompDoc(r, int(size), nil, logfile, debug, ignoreWorkbookCorruption)
+}
 
+func newCompDoc(src io.ReaderAt, size int, mem []byte, logfile io.Writer, debug int, ignoreWorkbookCorruption bool) (*CompDoc, error) {
 	cd := &CompDoc{
 		Mem:                      mem,
 		Logfile:                  logfile,
 		DEBUG:                    debug,
 		IgnoreWorkbookCorruption: ignoreWorkbookCorruption,
+		src:                      src,
+		size:                     size,
+	}
+
+	if size < 8 {
+		return nil, &CompDocError{Message: "File too short to be an OLE2 compound document"}
+	}
+
+	hdr := cd.readAt(0, minInt(size, 512))
+	if hdr == nil {
+		return nil, &CompDocError{Message: "Can't read OLE2 header"}
+	}
+
+	if string(hdr[:8]) != string(XLS_SIGNATURE) {
+		return nil, &CompDocError{Message: "Not an OLE2 compound document"}
+	}
+
+	if len(hdr) < 512 {
+		return nil, &CompDocError{Message: "File too short"}
+	}
+
+	if hdr[28] != 0xFE || hdr[29] != 0xFF {
+		return nil, &CompDocError{Message: "Expected little-endian marker"}
 	}
 
 	warnf := func(format string, args ...interface{}) {
@@ -363,22 +604,22 @@ func NewCompDoc(mem []byte, logfile io.Writer, debug int, ignoreWorkbookCorrupti
 	}
 	fail := func(msg string) error {
 		if cd.IgnoreWorkbookCorruption {
-			warnf("WARNING *** %s\n", msg)
+			cd.warn(SeverityWarning, DiagOLE2Corrupt, "%s", msg)
 			return nil
 		}
 		return &CompDocError{Message: msg}
 	}
 
 	// Parse header
-	ssz := int(binary.LittleEndian.Uint16(mem[30:32]))
-	sssz := int(binary.LittleEndian.Uint16(mem[32:34]))
+	ssz := int(binary.LittleEndian.Uint16(hdr[30:32]))
+	sssz := int(binary.LittleEndian.Uint16(hdr[32:34]))
 
-	if ssz > 20 {
-		warnf("WARNING: sector size (2**%d) is preposterous; assuming 512 and continuing ...\n", ssz)
+	if ssz < 7 || ssz > 20 {
+		cd.warn(SeverityWarning, DiagOLE2Corrupt, "sector size (2**%d) is preposterous; assuming 512 and continuing", ssz)
 		ssz = 9 // Default to 512 bytes
 	}
 	if sssz > ssz {
-		warnf("WARNING: short stream sector size (2**%d) is preposterous; assuming 64 and continuing ...\n", sssz)
+		cd.warn(SeverityWarning, DiagOLE2Corrupt, "short stream sector size (2**%d) is preposterous; assuming 64 and continuing", sssz)
 		sssz = 6 // Default to 64 bytes
 	}
 
@@ -386,27 +627,27 @@ func NewCompDoc(mem []byte, logfile io.Writer, debug int, ignoreWorkbookCorrupti
 	cd.shortSecSize = 1 << sssz
 
 	// Parse header fields
-	_ = int(binary.LittleEndian.Uint32(mem[44:48])) // SATTotSecs - not used yet
-	dirFirstSecSID := int(binary.LittleEndian.Uint32(mem[48:52]))
-	cd.minSizeStdStream = int(binary.LittleEndian.Uint32(mem[56:60]))
-	SSATFirstSecSID := int(binary.LittleEndian.Uint32(mem[60:64]))
-	SSATTotSecs := int(binary.LittleEndian.Uint32(mem[64:68]))
-	_ = int(binary.LittleEndian.Uint32(mem[68:72])) // MSATXFirstSecSID - not used yet
-	_ = int(binary.LittleEndian.Uint32(mem[72:76])) // MSATXTotSecs - not used yet
-
-	memDataLen := len(mem) - 512
+	_ = int(binary.LittleEndian.Uint32(hdr[44:48])) // SATTotSecs - not used yet
+	dirFirstSecSID := int(binary.LittleEndian.Uint32(hdr[48:52]))
+	cd.minSizeStdStream = int(binary.LittleEndian.Uint32(hdr[56:60]))
+	SSATFirstSecSID := int(binary.LittleEndian.Uint32(hdr[60:64]))
+	SSATTotSecs := int(binary.LittleEndian.Uint32(hdr[64:68]))
+	_ = int(binary.LittleEndian.Uint32(hdr[68:72])) // MSATXFirstSecSID - not used yet
+	_ = int(binary.LittleEndian.Uint32(hdr[72:76])) // MSATXTotSecs - not used yet
+
+	memDataLen := size - 512
 	memDataSecs := (memDataLen + cd.secSize - 1) / cd.secSize
 	cd.memDataSecs = memDataSecs
 	cd.memDataLen = memDataLen
 	cd.seen = make([]int, memDataSecs)
 	if memDataLen%cd.secSize != 0 {
-		warnf("WARNING *** file size (%d) not 512 + multiple of sector size (%d)\n", len(mem), cd.secSize)
+		cd.warn(SeverityWarning, DiagOLE2Corrupt, "file size (%d) not 512 + multiple of sector size (%d)", size, cd.secSize)
 	}
 
 	// Build MSAT (Master Sector Allocation Table)
 	MSAT := make([]int, 109)
 	for i := 0; i < 109; i++ {
-		MSAT[i] = int(int32(binary.LittleEndian.Uint32(mem[76+i*4 : 80+i*4])))
+		MSAT[i] = int(int32(binary.LittleEndian.Uint32(hdr[76+i*4 : 80+i*4])))
 	}
 	nent := cd.secSize / 4
 	satSectorsReqd := (memDataSecs + nent - 1) / nent
@@ -417,8 +658,8 @@ func NewCompDoc(mem []byte, logfile io.Writer, debug int, ignoreWorkbookCorrupti
 	actualMSATXSectors := 0
 
 	// Handle MSAT extensions if present
-	MSATXFirstSecSID := int(int32(binary.LittleEndian.Uint32(mem[68:72])))
-	MSATXTotSecs := int(binary.LittleEndian.Uint32(mem[72:76]))
+	MSATXFirstSecSID := int(int32(binary.LittleEndian.Uint32(hdr[68:72])))
+	MSATXTotSecs := int(binary.LittleEndian.Uint32(hdr[72:76]))
 
 	// Check if MSAT extension exists
 	hasMSATExt := true
@@ -453,15 +694,10 @@ func NewCompDoc(mem []byte, logfile io.Writer, debug int, ignoreWorkbookCorrupti
 				warnf("[1]===>>> %d %d %d %d %d\n", memDataSecs, nent, satSectorsReqd, expectedMSATXSectors, actualMSATXSectors)
 			}
 
-			offset := 512 + sid*cd.secSize
-			if offset+cd.secSize > len(mem) {
-				break
-			}
-
 			// Read MSAT extension sector
-			extMSAT := make([]int, cd.secSize/4)
-			for j := 0; j < len(extMSAT); j++ {
-				extMSAT[j] = int(int32(binary.LittleEndian.Uint32(mem[offset+j*4 : offset+(j+1)*4])))
+			extMSAT := cd.readSIDs(512 + sid*cd.secSize)
+			if extMSAT == nil {
+				break
 			}
 
 			MSAT = append(MSAT, extMSAT[:len(extMSAT)-1]...) // Last entry is next sector pointer
@@ -484,8 +720,7 @@ func NewCompDoc(mem []byte, logfile io.Writer, debug int, ignoreWorkbookCorrupti
 		}
 		if msid < 0 || msid >= memDataSecs {
 			if !truncWarned {
-				warnf("WARNING *** File is truncated, or OLE2 MSAT is corrupt!!\n")
-				warnf("INFO: Trying to access sector %d but only %d available\n", msid, memDataSecs)
+				cd.warn(SeverityWarning, DiagOLE2Corrupt, "File is truncated, or OLE2 MSAT is corrupt: trying to access sector %d but only %d available", msid, memDataSecs)
 				truncWarned = true
 			}
 			dumpAgain = true
@@ -503,14 +738,10 @@ func NewCompDoc(mem []byte, logfile io.Writer, debug int, ignoreWorkbookCorrupti
 			warnf("[3]===>>> %d %d %d %d %d %d %d\n",
 				memDataSecs, nent, satSectorsReqd, expectedMSATXSectors, actualMSATXSectors, actualSATSec, msid)
 		}
-		offset := 512 + msid*cd.secSize
-		if offset+cd.secSize > len(mem) {
+		sector := cd.readSIDs(512 + msid*cd.secSize)
+		if sector == nil {
 			continue
 		}
-		sector := make([]int, nent)
-		for i := 0; i < nent; i++ {
-			sector[i] = int(int32(binary.LittleEndian.Uint32(mem[offset+i*4 : offset+(i+1)*4])))
-		}
 		cd.SAT = append(cd.SAT, sector...)
 	}
 	if cd.DEBUG > 0 && dumpAgain {
@@ -539,7 +770,7 @@ func NewCompDoc(mem []byte, logfile io.Writer, debug int, ignoreWorkbookCorrupti
 		}
 		sid = nextSid
 	}
-	dirBytes := cd.getStream(mem, 512, cd.SAT, cd.secSize, dirFirstSecSID, dirSize, "directory", 3)
+	dirBytes := cd.getStream(cd.src, 512, cd.SAT, cd.secSize, dirFirstSecSID, dirSize, "directory", 3)
 	cd.dirList = make([]*DirNode, 0)
 
 	for pos := 0; pos < len(dirBytes); pos += 128 {
@@ -557,7 +788,7 @@ func NewCompDoc(mem []byte, logfile io.Writer, debug int, ignoreWorkbookCorrupti
 		totSize := int(int32(binary.LittleEndian.Uint32(dent[120:124])))
 
 		var name string
-		if cbufsize > 0 && cbufsize <= 64 {
+		if cbufsize >= 2 && cbufsize <= 64 {
 			nameBytes := dent[0 : cbufsize-2]
 			// Convert UTF-16LE to string
 			if len(nameBytes)%2 == 0 {
@@ -578,10 +809,13 @@ func NewCompDoc(mem []byte, logfile io.Writer, debug int, ignoreWorkbookCorrupti
 			TotSize:  totSize,
 			Children: make([]int, 0),
 			Parent:   -1,
+			Created:  filetimeToTime(binary.LittleEndian.Uint64(dent[100:108])),
+			Modified: filetimeToTime(binary.LittleEndian.Uint64(dent[108:116])),
 			leftDID:  leftDID,
 			rightDID: rightDID,
 			rootDID:  rootDID,
 		}
+		copy(dn.CLSID[:], dent[80:96])
 		cd.dirList = append(cd.dirList, dn)
 	}
 
@@ -594,7 +828,7 @@ func NewCompDoc(mem []byte, logfile io.Writer, debug int, ignoreWorkbookCorrupti
 	if len(cd.dirList) > 0 {
 		sscsDir := cd.dirList[0]
 		if sscsDir.FirstSID >= 0 && sscsDir.TotSize > 0 {
-			cd.SSCS = cd.getStream(mem, 512, cd.SAT, cd.secSize, sscsDir.FirstSID, sscsDir.TotSize, "SSCS", 4)
+			cd.SSCS = cd.getStream(cd.src, 512, cd.SAT, cd.secSize, sscsDir.FirstSID, sscsDir.TotSize, "SSCS", 4)
 		} else {
 			cd.SSCS = []byte{}
 		}
@@ -602,7 +836,7 @@ func NewCompDoc(mem []byte, logfile io.Writer, debug int, ignoreWorkbookCorrupti
 		// Build SSAT (Short Sector Allocation Table)
 		cd.SSAT = make([]int, 0)
 		if SSATTotSecs > 0 && sscsDir.TotSize == 0 {
-			warnf("WARNING *** OLE2 inconsistency: SSCS size is 0 but SSAT size is non-zero\n")
+			cd.warn(SeverityWarning, DiagOLE2Corrupt, "OLE2 inconsistency: SSCS size is 0 but SSAT size is non-zero")
 		}
 		if SSATTotSecs > 0 && len(cd.SSCS) > 0 {
 			sid := SSATFirstSecSID
@@ -620,14 +854,10 @@ func NewCompDoc(mem []byte, logfile io.Writer, debug int, ignoreWorkbookCorrupti
 				if sid >= len(cd.SAT) {
 					break
 				}
-				offset := 512 + sid*cd.secSize
-				if offset+cd.secSize > len(mem) {
+				sector := cd.readSIDs(512 + sid*cd.secSize)
+				if sector == nil {
 					break
 				}
-				sector := make([]int, nent)
-				for i := 0; i < nent; i++ {
-					sector[i] = int(int32(binary.LittleEndian.Uint32(mem[offset+i*4 : offset+(i+1)*4])))
-				}
 				cd.SSAT = append(cd.SSAT, sector...)
 				sid = cd.SAT[sid]
 				nsecs--
@@ -645,14 +875,306 @@ func NewCompDoc(mem []byte, logfile io.Writer, debug int, ignoreWorkbookCorrupti
 
 // buildFamilyTree builds the directory tree structure.
 func (cd *CompDoc) buildFamilyTree(parentDID, childDID int) {
-	if childDID < 0 || childDID >= len(cd.dirList) {
+	// The root entry is nobody's child, and an entry already placed in the
+	// tree is part of a cycle.
+	if childDID <= 0 || childDID >= len(cd.dirList) || cd.dirList[childDID].Parent >= 0 {
 		return
 	}
+	cd.dirList[childDID].Parent = parentDID
 	cd.buildFamilyTree(parentDID, cd.dirList[childDID].leftDID)
 	cd.dirList[parentDID].Children = append(cd.dirList[parentDID].Children, childDID)
-	cd.dirList[childDID].Parent = parentDID
 	cd.buildFamilyTree(parentDID, cd.dirList[childDID].rightDID)
 	if cd.dirList[childDID].EType == 1 {
 		cd.buildFamilyTree(childDID, cd.dirList[childDID].rootDID)
 	}
 }
+
+// ExtractStorage returns the storage with the given path of storage names
+// below the root storage as a compound document of its own, such as an
+// embedded Word document. The storage becomes the root storage of the new
+// document, keeping its CLSID. It returns ErrStreamNotFound if there is no
+// such storage.
+func (cd *CompDoc) ExtractStorage(path ...string) ([]byte, error) {
+	if len(cd.dirList) == 0 {
+		return nil, newXLRDError(ErrStreamNotFound, "No storage %q in compound document", strings.Join(path, "/"))
+	}
+	st := cd.dirList[0]
+	for _, name := range path {
+		var next *DirNode
+		for _, did := range st.Children {
+			if d := cd.dirList[did]; d.EType == DirStorage && strings.EqualFold(d.Name, name) {
+				next = d
+				break
+			}
+		}
+		if next == nil {
+			return nil, newXLRDError(ErrStreamNotFound, "No storage %q in compound document", strings.Join(path, "/"))
+		}
+		st = next
+	}
+
+	entries := []*cdfEntry{{DirNode: st}}
+	var add func(parent int) error
+	add = func(parent int) error {
+		for _, did := range entries[parent].Children {
+			d := cd.dirList[did]
+			if d.EType != DirStorage && d.EType != DirStream {
+				continue
+			}
+			e := &cdfEntry{DirNode: d}
+			if d.EType == DirStream {
+				data, err := cd.readStream(d)
+				if err != nil {
+					return err
+				}
+				e.data = data
+			}
+			entries = append(entries, e)
+			entries[parent].kids = append(entries[parent].kids, len(entries)-1)
+			if d.EType == DirStorage {
+				if err := add(len(entries) - 1); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := add(0); err != nil {
+		return nil, err
+	}
+	return writeCompDoc(entries), nil
+}
+
+// cdfEntry is a directory entry of a compound document being written.
+type cdfEntry struct {
+	*DirNode
+	data                []byte
+	kids                []int // indexes of the children in the entries
+	left, right, child  int32
+	red                 bool
+	startSID, streamLen int
+}
+
+// writeCompDoc returns a compound document holding entries, of which the
+// first is the root storage. It has 512-byte sectors, and streams shorter
+// than 4096 bytes are kept in the short-stream container [MS-CFB 2].
+func writeCompDoc(entries []*cdfEntry) []byte {
+	const (
+		secSize      = 512
+		shortSecSize = 64
+		minStdStream = 4096
+		perSector    = secSize / 4
+		noStream     = -1
+	)
+
+	// The children of a storage form a red-black tree ordered by name
+	// length, then by upper case name. A balanced tree is built, with the
+	// deepest level red.
+	for _, e := range entries {
+		e.left, e.right, e.child = noStream, noStream, noStream
+	}
+	var build func(kids []int, depth, maxDepth int) int32
+	build = func(kids []int, depth, maxDepth int) int32 {
+		if len(kids) == 0 {
+			return noStream
+		}
+		mid := len(kids) / 2
+		e := entries[kids[mid]]
+		e.red = depth == maxDepth && depth > 0
+		e.left = build(kids[:mid], depth+1, maxDepth)
+		e.right = build(kids[mid+1:], depth+1, maxDepth)
+		return int32(kids[mid])
+	}
+	for _, e := range entries {
+		if len(e.kids) == 0 {
+			continue
+		}
+		kids := append([]int(nil), e.kids...)
+		sort.Slice(kids, func(i, j int) bool {
+			a, b := utf16.Encode([]rune(entries[kids[i]].Name)), utf16.Encode([]rune(entries[kids[j]].Name))
+			if len(a) != len(b) {
+				return len(a) < len(b)
+			}
+			return strings.ToUpper(entries[kids[i]].Name) < strings.ToUpper(entries[kids[j]].Name)
+		})
+		e.child = build(kids, 0, bits.Len(uint(len(kids)))-1)
+	}
+
+	// Short streams are packed into the short-stream container, which is
+	// the stream of the root entry.
+	var container []byte
+	var ssat []int32
+	for _, e := range entries[1:] {
+		if e.EType != DirStream || len(e.data) >= minStdStream {
+			continue
+		}
+		e.startSID, e.streamLen = EOCSID, len(e.data)
+		n := (len(e.data) + shortSecSize - 1) / shortSecSize
+		if n == 0 {
+			continue
+		}
+		e.startSID = len(ssat)
+		for i := 1; i < n; i++ {
+			ssat = append(ssat, int32(len(ssat)+1))
+		}
+		ssat = append(ssat, EOCSID)
+		container = append(container, e.data...)
+		container = append(container, make([]byte, -len(container)&(shortSecSize-1))...)
+	}
+	entries[0].data = container
+
+	// The sectors hold the standard streams, the short-stream container,
+	// the SSAT, the directory and the SAT, with MSAT sectors for a SAT of
+	// more than 109 sectors.
+	var sat []int32
+	var body []byte
+	chain := func(data []byte) int {
+		n := (len(data) + secSize - 1) / secSize
+		if n == 0 {
+			return EOCSID
+		}
+		first := len(sat)
+		for i := 1; i < n; i++ {
+			sat = append(sat, int32(len(sat)+1))
+		}
+		sat = append(sat, EOCSID)
+		body = append(body, data...)
+		body = append(body, make([]byte, -len(body)&(secSize-1))...)
+		return first
+	}
+	for i, e := range entries {
+		if i == 0 || e.EType == DirStream && len(e.data) >= minStdStream {
+			e.startSID, e.streamLen = chain(e.data), len(e.data)
+		}
+	}
+	ssatBytes := make([]byte, 4*len(ssat))
+	for i, sid := range ssat {
+		binary.LittleEndian.PutUint32(ssatBytes[4*i:], uint32(sid))
+	}
+	ssatSID := chain(ssatBytes)
+	ssatSecs := (len(ssatBytes) + secSize - 1) / secSize
+
+	dir := make([]byte, 128*len(entries))
+	for i, e := range entries {
+		dent := dir[128*i : 128*(i+1)]
+		name := utf16.Encode([]rune(e.Name))
+		if len(name) > 31 {
+			name = name[:31]
+		}
+		for j, u := range name {
+			binary.LittleEndian.PutUint16(dent[2*j:], u)
+		}
+		binary.LittleEndian.PutUint16(dent[64:66], uint16(2*len(name)+2))
+		dent[66] = byte(e.EType)
+		if i == 0 {
+			dent[66] = DirRoot
+		}
+		if !e.red {
+			dent[67] = 1
+		}
+		binary.LittleEndian.PutUint32(dent[68:72], uint32(e.left))
+		binary.LittleEndian.PutUint32(dent[72:76], uint32(e.right))
+		binary.LittleEndian.PutUint32(dent[76:80], uint32(e.child))
+		copy(dent[80:96], e.CLSID[:])
+		if e.EType == DirStorage {
+			binary.LittleEndian.PutUint64(dent[100:108], timeToFiletime(e.Created))
+		}
+		if e.EType != DirStream {
+			binary.LittleEndian.PutUint64(dent[108:116], timeToFiletime(e.Modified))
+		}
+		binary.LittleEndian.PutUint32(dent[116:120], uint32(int32(e.startSID)))
+		binary.LittleEndian.PutUint32(dent[120:124], uint32(e.streamLen))
+	}
+	for len(dir)%secSize != 0 {
+		// Unused entries have no siblings or children.
+		free := make([]byte, 128)
+		binary.LittleEndian.PutUint32(free[68:], 0xFFFFFFFF)
+		binary.LittleEndian.PutUint32(free[72:], 0xFFFFFFFF)
+		binary.LittleEndian.PutUint32(free[76:], 0xFFFFFFFF)
+		dir = append(dir, free...)
+	}
+	dirSID := chain(dir)
+
+	satSecs, msatSecs := 0, 0
+	for {
+		total := len(sat) + satSecs + msatSecs
+		n := (total + perSector - 1) / perSector
+		m := 0
+		if n > 109 {
+			m = (n - 109 + perSector - 2) / (perSector - 1)
+		}
+		if n == satSecs && m == msatSecs {
+			break
+		}
+		satSecs, msatSecs = n, m
+	}
+	satStart := len(sat)
+	for i := 0; i < satSecs; i++ {
+		sat = append(sat, SATSID)
+	}
+	msatStart := len(sat)
+	for i := 0; i < msatSecs; i++ {
+		sat = append(sat, MSATSID)
+	}
+	for len(sat)%perSector != 0 {
+		sat = append(sat, FREESID)
+	}
+	for _, sid := range sat {
+		body = binary.LittleEndian.AppendUint32(body, uint32(sid))
+	}
+	msat := make([]int32, 0, satSecs)
+	for i := 0; i < satSecs; i++ {
+		msat = append(msat, int32(satStart+i))
+	}
+	for i := 0; i < msatSecs; i++ {
+		var sector []byte
+		for j := 0; j < perSector-1; j++ {
+			sid := int32(FREESID)
+			if k := 109 + i*(perSector-1) + j; k < len(msat) {
+				sid = msat[k]
+			}
+			sector = binary.LittleEndian.AppendUint32(sector, uint32(sid))
+		}
+		next := int32(EOCSID)
+		if i+1 < msatSecs {
+			next = int32(msatStart + i + 1)
+		}
+		body = append(body, binary.LittleEndian.AppendUint32(sector, uint32(next))...)
+	}
+
+	hdr := make([]byte, 512)
+	copy(hdr, XLS_SIGNATURE)
+	binary.LittleEndian.PutUint16(hdr[24:26], 0x3E)
+	binary.LittleEndian.PutUint16(hdr[26:28], 3)
+	hdr[28], hdr[29] = 0xFE, 0xFF
+	binary.LittleEndian.PutUint16(hdr[30:32], 9)
+	binary.LittleEndian.PutUint16(hdr[32:34], 6)
+	binary.LittleEndian.PutUint32(hdr[44:48], uint32(satSecs))
+	binary.LittleEndian.PutUint32(hdr[48:52], uint32(dirSID))
+	binary.LittleEndian.PutUint32(hdr[56:60], minStdStream)
+	binary.LittleEndian.PutUint32(hdr[60:64], uint32(int32(ssatSID)))
+	binary.LittleEndian.PutUint32(hdr[64:68], uint32(ssatSecs))
+	msatSID := int32(EOCSID)
+	if msatSecs > 0 {
+		msatSID = int32(msatStart)
+	}
+	binary.LittleEndian.PutUint32(hdr[68:72], uint32(msatSID))
+	binary.LittleEndian.PutUint32(hdr[72:76], uint32(msatSecs))
+	for i := 0; i < 109; i++ {
+		sid := int32(FREESID)
+		if i < len(msat) {
+			sid = msat[i]
+		}
+		binary.LittleEndian.PutUint32(hdr[76+4*i:], uint32(sid))
+	}
+	return append(hdr, body...)
+}
+
+// timeToFiletime is the inverse of filetimeToTime.
+func timeToFiletime(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	const secsTo1970 = 11644473600
+	return uint64(t.Unix()+secsTo1970)*1e7 + uint64(t.Nanosecond()/100)
+}
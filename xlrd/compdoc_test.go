@@ -0,0 +1,158 @@
+package xlrd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompDocEntriesEmpty(t *testing.T) {
+	data := compoundFile(map[string][]byte{"A": []byte("a"), "B": []byte("b"), "C": []byte("c")})
+	// Empty the directory entry of B, DID 2, linking A to C instead.
+	dir := data[1024:]
+	binary.LittleEndian.PutUint32(dir[128+72:], 3)
+	clear(dir[256:384])
+	for i := 68; i < 80; i += 4 {
+		binary.LittleEndian.PutUint32(dir[256+i:], 0xFFFFFFFF)
+	}
+	cd, err := NewCompDoc(data, nil, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	byDID := make(map[int]DirNode)
+	for _, e := range cd.Entries() {
+		got = append(got, fmt.Sprintf("%d:%s", e.DID, e.Name))
+		byDID[e.DID] = e
+	}
+	if want := []string{"0:Root Entry", "1:A", "3:C"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Entries() = %q, want %q", got, want)
+	}
+	for _, c := range byDID[0].Children {
+		if byDID[c].Parent != 0 {
+			t.Errorf("child %d of the root has parent %d", c, byDID[c].Parent)
+		}
+	}
+}
+
+func TestCompDocEntries(t *testing.T) {
+	contents, err := os.ReadFile(fromSample("profiles.xls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cd, err := NewCompDoc(contents, nil, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := cd.Entries()
+	root := entries[0]
+	if root.EType != DirRoot {
+		t.Errorf("Entries()[0].EType = %d, want DirRoot", root.EType)
+	}
+	if got, want := root.CLSID.String(), "{00020810-0000-0000-C000-000000000046}"; got != want {
+		t.Errorf("root CLSID = %s, want %s", got, want)
+	}
+	if want := time.Date(2010, 12, 3, 12, 3, 28, 423000000, time.UTC); !root.Modified.Equal(want) {
+		t.Errorf("root Modified = %v, want %v", root.Modified, want)
+	}
+
+	var names []string
+	for _, e := range entries[1:] {
+		if e.EType != DirStream {
+			t.Errorf("entry %q EType = %d, want DirStream", e.Name, e.EType)
+		}
+		names = append(names, e.Name)
+	}
+	if want := []string{"Workbook", "\x01CompObj", "\x01Ole", "\x05SummaryInformation", "\x05DocumentSummaryInformation"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Entries() names = %q, want %q", names, want)
+	}
+
+	mem, base, size, err := cd.LocateNamedStream("Workbook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		data, err := cd.OpenStream("workbook")
+		if err != nil {
+			t.Fatalf("OpenStream(workbook) error = %v", err)
+		}
+		if !bytes.Equal(data, mem[base:base+size]) {
+			t.Errorf("OpenStream(workbook) differs from LocateNamedStream")
+		}
+	}
+	if _, err := cd.OpenStream("Workbook", "Sheet1"); !errors.Is(err, ErrStreamNotFound) {
+		t.Errorf("OpenStream(Workbook, Sheet1) error = %v, want ErrStreamNotFound", err)
+	}
+}
+
+func TestCompDocWalk(t *testing.T) {
+	cd, err := NewCompDoc(compoundFile(map[string][]byte{
+		"Workbook":                  []byte("book"),
+		"_VBA_PROJECT_CUR/PROJECT":  []byte("project"),
+		"_VBA_PROJECT_CUR/VBA/dir":  []byte("dir"),
+		"_VBA_PROJECT_CUR/VBA/Mod1": []byte("module"),
+		"MBD0001/Ole":               []byte("ole"),
+	}), nil, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := cd.OpenStream("_VBA_PROJECT_CUR", "VBA", "dir")
+	if err != nil || string(data) != "dir" {
+		t.Errorf(`OpenStream(_VBA_PROJECT_CUR, VBA, dir) = %q, %v, want "dir"`, data, err)
+	}
+	if _, err := cd.OpenStream("_VBA_PROJECT_CUR", "VBA"); !errors.Is(err, ErrStreamNotFound) {
+		t.Errorf("OpenStream() of a storage error = %v, want ErrStreamNotFound", err)
+	}
+
+	walk := func(skip string) []string {
+		var visited []string
+		err := cd.Walk(func(path []string, entry DirNode) error {
+			p := strings.Join(path, "/")
+			if entry.EType == DirStorage {
+				p += "/"
+			}
+			visited = append(visited, p)
+			if p == skip {
+				return fs.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Walk() error = %v", err)
+		}
+		return visited
+	}
+	all := []string{
+		"MBD0001/", "MBD0001/Ole",
+		"Workbook",
+		"_VBA_PROJECT_CUR/", "_VBA_PROJECT_CUR/PROJECT",
+		"_VBA_PROJECT_CUR/VBA/", "_VBA_PROJECT_CUR/VBA/Mod1", "_VBA_PROJECT_CUR/VBA/dir",
+	}
+	if got := walk(""); !reflect.DeepEqual(got, all) {
+		t.Errorf("Walk() visited %v, want %v", got, all)
+	}
+	if got, want := walk("_VBA_PROJECT_CUR/VBA/"), all[:6]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Walk() skipping a storage visited %v, want %v", got, want)
+	}
+	if got, want := walk("_VBA_PROJECT_CUR/VBA/Mod1"), all[:7]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Walk() skipping from a stream visited %v, want %v", got, want)
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = cd.Walk(func(path []string, entry DirNode) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("Walk() returning an error = %v after %d calls, want stop after 1", err, n)
+	}
+}
@@ -0,0 +1,327 @@
+package xlrd
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"unicode/utf16"
+)
+
+// defaultPassword is the password Excel uses to encrypt workbooks that
+// are protected only against changes. It is tried when no password is
+// given.
+const defaultPassword = "VelvetSweatshop"
+
+// recordDecrypter decrypts the data of the records of an encrypted
+// Workbook stream.
+type recordDecrypter interface {
+	// decrypt decrypts in place the data of one record, which starts at
+	// offset pos in the Workbook stream.
+	decrypt(data []byte, pos int)
+}
+
+// Records that are never encrypted [MS-XLS 2.2.10].
+var unencryptedRecords = map[int]bool{
+	0x0809: true, 0x0409: true, 0x0209: true, 0x0009: true, // BOF
+	XL_FILEPASS: true,
+	0x0194:      true, // USREXCL
+	0x0195:      true, // FILELOCK
+	0x00E1:      true, // INTERFACEHDR
+	0x0196:      true, // RRDINFO
+	0x0138:      true, // RRDHEAD
+}
+
+// decryptRecords decrypts the records of the Workbook stream in
+// b.mem[b.base:] that start at or after the absolute position start.
+// b.mem is replaced by a decrypted copy, since it may be shared with the
+// caller or memory-mapped read-only.
+func (b *Book) decryptRecords(d recordDecrypter, start int) error {
+	if err := b.charge(len(b.mem)); err != nil {
+		return err
+	}
+	mem := bytes.Clone(b.mem)
+	end := minInt(b.base+b.streamLen, len(mem))
+	for pos := start; pos+4 <= end; {
+		code := int(binary.LittleEndian.Uint16(mem[pos : pos+2]))
+		length := int(binary.LittleEndian.Uint16(mem[pos+2 : pos+4]))
+		pos += 4
+		if pos+length > end {
+			break
+		}
+		data := mem[pos : pos+length]
+		if !unencryptedRecords[code] {
+			// The sheet position in a BOUNDSHEET record is not encrypted.
+			var plyPos [4]byte
+			copy(plyPos[:], data)
+			d.decrypt(data, pos-b.base)
+			if code == XL_BOUNDSHEET {
+				copy(data, plyPos[:minInt(4, length)])
+			}
+		}
+		pos += length
+	}
+	b.mem = mem
+	return nil
+}
+
+// passwords returns the passwords to try on an encrypted workbook: the
+// one given in the options, if any, and Excel's default.
+func (b *Book) passwords() []string {
+	if b.password == "" {
+		return []string{defaultPassword}
+	}
+	return []string{b.password, defaultPassword}
+}
+
+// passwordError returns the error for an encrypted workbook that none of
+// b.passwords decrypts.
+func (b *Book) passwordError(method string) error {
+	if b.password == "" {
+		return newXLRDError(ErrEncrypted, "Workbook is encrypted (%s); a password is required", method)
+	}
+	return newXLRDError(ErrWrongPassword, "Wrong password for workbook encrypted with %s", method)
+}
+
+// decryptXOR checks the passwords against the key and verifier of an
+// XOR-obfuscated workbook and removes the obfuscation.
+func (b *Book) decryptXOR(data []byte, end int) error {
+	key := binary.LittleEndian.Uint16(data[0:2])
+	verifier := binary.LittleEndian.Uint16(data[2:4])
+	if b.verbosity >= 2 {
+		fmt.Fprintf(b.logfile, "FILEPASS: weak XOR: key=0x%04x hash=0x%04x\n", key, verifier)
+	}
+	for _, password := range b.passwords() {
+		pw := xorPasswordBytes(password)
+		if xorVerifier(pw) == verifier {
+			return b.decryptRecords(newXORDecrypter(pw, key), end)
+		}
+	}
+	return b.passwordError("XOR obfuscation")
+}
+
+// decryptRC4Std checks the passwords against the salt and verifier of a
+// workbook with standard RC4 encryption and decrypts it.
+func (b *Book) decryptRC4Std(data []byte, end int) error {
+	if len(data) < 48 {
+		return newXLRDError(ErrCorruptRecord, "FILEPASS record too short")
+	}
+	salt, verifier, verifierHash := data[0:16], data[16:32], data[32:48]
+	if b.verbosity >= 2 {
+		fmt.Fprintf(b.logfile, "FILEPASS: RC4 standard encryption\n")
+	}
+	for _, password := range b.passwords() {
+		keys := rc4StdKeys(password, salt)
+		if rc4CheckVerifier(keys(0), verifier, verifierHash, md5Hash) {
+			return b.decryptRecords(&rc4Decrypter{blockKey: keys}, end)
+		}
+	}
+	return b.passwordError("RC4")
+}
+
+// decryptRC4CryptoAPI checks the passwords against the encryption header
+// and verifier of a workbook with RC4 CryptoAPI encryption and decrypts it.
+func (b *Book) decryptRC4CryptoAPI(data []byte, end int) error {
+	// Flags, header size, then the header: flags, extra size, algorithm,
+	// hash algorithm, key size, provider type, reserved, and CSP name.
+	if len(data) < 8 {
+		return newXLRDError(ErrCorruptRecord, "FILEPASS record too short")
+	}
+	headerSize := int(binary.LittleEndian.Uint32(data[4:8]))
+	if headerSize < 20 || headerSize > len(data)-8 {
+		return newXLRDError(ErrCorruptRecord, "FILEPASS encryption header size %d is invalid", headerSize)
+	}
+	header := data[8 : 8+headerSize]
+	// fDocProps is clear when the document properties are encrypted too.
+	b.encryptedProperties = binary.LittleEndian.Uint32(header[0:4])&0x08 == 0
+	keyBits := int(binary.LittleEndian.Uint32(header[16:20]))
+	if keyBits == 0 {
+		keyBits = 40
+	}
+	if keyBits < 40 || keyBits > 128 || keyBits%8 != 0 {
+		return newXLRDError(ErrEncrypted, "Workbook is encrypted with an unsupported RC4 key size of %d bits", keyBits)
+	}
+
+	// The verifier: salt size, salt, verifier, hash size, verifier hash.
+	v := data[8+headerSize:]
+	if len(v) < 4 {
+		return newXLRDError(ErrCorruptRecord, "FILEPASS record too short")
+	}
+	saltSize := int(binary.LittleEndian.Uint32(v[0:4]))
+	if saltSize != 16 || len(v) < 4+saltSize+16+4 {
+		return newXLRDError(ErrCorruptRecord, "FILEPASS encryption verifier is invalid")
+	}
+	salt, verifier := v[4:20], v[20:36]
+	hashSize := int(binary.LittleEndian.Uint32(v[36:40]))
+	if hashSize != sha1.Size || len(v) < 40+hashSize {
+		return newXLRDError(ErrCorruptRecord, "FILEPASS encryption verifier is invalid")
+	}
+	verifierHash := v[40 : 40+hashSize]
+	if b.verbosity >= 2 {
+		fmt.Fprintf(b.logfile, "FILEPASS: RC4 CryptoAPI encryption, %d-bit key\n", keyBits)
+	}
+
+	for _, password := range b.passwords() {
+		keys := rc4CryptoAPIKeys(password, salt, keyBits)
+		if rc4CheckVerifier(keys(0), verifier, verifierHash, sha1Hash) {
+			return b.decryptRecords(&rc4Decrypter{blockKey: keys}, end)
+		}
+	}
+	return b.passwordError("RC4 CryptoAPI")
+}
+
+// xorPadding completes passwords of fewer than 16 bytes in the XOR
+// obfuscation key [MS-OFFCRYPTO 2.3.7.2].
+var xorPadding = []byte{0xBB, 0xFF, 0xFF, 0xBA, 0xFF, 0xFF, 0xB9, 0x80, 0x00, 0xBE, 0x0F, 0x00, 0xBF, 0x0F, 0x00}
+
+// xorPasswordBytes returns the bytes of password used by XOR obfuscation:
+// for each of at most 15 characters, the low byte of its UTF-16 code unit,
+// or the high byte if the low byte is zero.
+func xorPasswordBytes(password string) []byte {
+	units := utf16.Encode([]rune(password))
+	if len(units) > 15 {
+		units = units[:15]
+	}
+	pw := make([]byte, len(units))
+	for i, u := range units {
+		if pw[i] = byte(u); pw[i] == 0 {
+			pw[i] = byte(u >> 8)
+		}
+	}
+	return pw
+}
+
+// xorVerifier returns the password verifier stored in the FILEPASS record
+// of an XOR-obfuscated workbook [MS-OFFCRYPTO 2.3.7.1].
+func xorVerifier(pw []byte) uint16 {
+	var v uint16
+	for i := len(pw) - 1; i >= -1; i-- {
+		c := byte(len(pw))
+		if i >= 0 {
+			c = pw[i]
+		}
+		v = (v>>14)&1 | (v<<1)&0x7FFF
+		v ^= uint16(c)
+	}
+	return v ^ 0xCE4B
+}
+
+// xorDecrypter removes XOR obfuscation from record data.
+type xorDecrypter struct {
+	key [16]byte
+}
+
+// newXORDecrypter returns the decrypter for the password bytes pw and the
+// key stored in the FILEPASS record.
+func newXORDecrypter(pw []byte, key uint16) *xorDecrypter {
+	d := &xorDecrypter{}
+	n := copy(d.key[:], pw)
+	copy(d.key[n:], xorPadding)
+	for i := range d.key {
+		d.key[i] = bits.RotateLeft8(d.key[i]^byte(key>>(8*(i&1))), 2)
+	}
+	return d
+}
+
+func (d *xorDecrypter) decrypt(data []byte, pos int) {
+	// The key index of each byte is its stream offset plus the record size.
+	for i, c := range data {
+		data[i] = bits.RotateLeft8(c, 3) ^ d.key[(pos+len(data)+i)&0x0F]
+	}
+}
+
+// utf16LE returns password encoded as UTF-16LE.
+func utf16LE(password string) []byte {
+	units := utf16.Encode([]rune(password))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(b[2*i:], u)
+	}
+	return b
+}
+
+// rc4BlockSize is the size of the blocks of the Workbook stream that are
+// each encrypted with a new RC4 key.
+const rc4BlockSize = 1024
+
+// rc4Decrypter decrypts record data encrypted with RC4. The keystream
+// runs over the whole Workbook stream, record headers included, and is
+// restarted with a new key at each block.
+type rc4Decrypter struct {
+	blockKey func(block uint32) []byte
+	cipher   *rc4.Cipher
+	block    int
+	pos      int // stream offset of the next keystream byte
+}
+
+func (d *rc4Decrypter) decrypt(data []byte, pos int) {
+	var skip [rc4BlockSize]byte
+	for len(data) > 0 {
+		block := pos / rc4BlockSize
+		if d.cipher == nil || block != d.block || pos < d.pos {
+			d.cipher, _ = rc4.NewCipher(d.blockKey(uint32(block)))
+			d.block, d.pos = block, block*rc4BlockSize
+		}
+		d.cipher.XORKeyStream(skip[:pos-d.pos], skip[:pos-d.pos])
+		n := minInt(len(data), (block+1)*rc4BlockSize-pos)
+		d.cipher.XORKeyStream(data[:n], data[:n])
+		data = data[n:]
+		pos += n
+		d.pos = pos
+	}
+}
+
+// rc4CheckVerifier decrypts the verifier and its hash with key and reports
+// whether the hash matches.
+func rc4CheckVerifier(key, verifier, verifierHash []byte, hash func([]byte) []byte) bool {
+	c, err := rc4.NewCipher(key)
+	if err != nil {
+		return false
+	}
+	buf := append(append([]byte(nil), verifier...), verifierHash...)
+	c.XORKeyStream(buf, buf)
+	return bytes.Equal(hash(buf[:len(verifier)]), buf[len(verifier):])
+}
+
+// rc4StdKeys returns the block keys of standard RC4 encryption
+// [MS-OFFCRYPTO 2.3.6.2].
+func rc4StdKeys(password string, salt []byte) func(block uint32) []byte {
+	h0 := md5.Sum(utf16LE(password))
+	buf := make([]byte, 0, 16*(5+len(salt)))
+	for i := 0; i < 16; i++ {
+		buf = append(buf, h0[:5]...)
+		buf = append(buf, salt...)
+	}
+	h1 := md5.Sum(buf)
+	return func(block uint32) []byte {
+		h := md5.Sum(binary.LittleEndian.AppendUint32(append([]byte(nil), h1[:5]...), block))
+		return h[:]
+	}
+}
+
+func md5Hash(b []byte) []byte {
+	h := md5.Sum(b)
+	return h[:]
+}
+
+// rc4CryptoAPIKeys returns the block keys of RC4 CryptoAPI encryption
+// with a key of keyBits bits [MS-OFFCRYPTO 2.3.5.2]. 40-bit keys are
+// padded with zeros to 128 bits.
+func rc4CryptoAPIKeys(password string, salt []byte, keyBits int) func(block uint32) []byte {
+	h0 := sha1.Sum(append(append([]byte(nil), salt...), utf16LE(password)...))
+	return func(block uint32) []byte {
+		h := sha1.Sum(binary.LittleEndian.AppendUint32(append([]byte(nil), h0[:]...), block))
+		if keyBits == 40 {
+			return append(h[:5], make([]byte, 11)...)
+		}
+		return h[:keyBits/8]
+	}
+}
+
+func sha1Hash(b []byte) []byte {
+	h := sha1.Sum(b)
+	return h[:]
+}
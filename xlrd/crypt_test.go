@@ -0,0 +1,301 @@
+package xlrd
+
+import (
+	"crypto/rc4"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"os"
+	"testing"
+)
+
+// workbookStream returns the Workbook stream of a sample file, or the
+// whole file if it is not a compound document.
+func workbookStream(t *testing.T, name string) []byte {
+	t.Helper()
+	contents, err := os.ReadFile(fromSample(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents[:8]) != string(XLS_SIGNATURE) {
+		return contents
+	}
+	cd, err := NewCompDoc(contents, nil, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem, base, size, err := cd.LocateNamedStream("Workbook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), mem[base:base+size]...)
+}
+
+// encryptStream returns a copy of a Workbook stream with a FILEPASS
+// record holding filepass inserted after the first BOF, and the data of
+// the records that follow it encrypted by encrypt.
+func encryptStream(stream, filepass []byte, encrypt func(data []byte, pos int)) []byte {
+	bofLen := 4 + int(binary.LittleEndian.Uint16(stream[2:4]))
+	fp := biffRecord(XL_FILEPASS, filepass)
+	out := append([]byte(nil), stream[:bofLen]...)
+	out = append(out, fp...)
+	out = append(out, stream[bofLen:]...)
+	for pos := bofLen + len(fp); pos+4 <= len(out); {
+		code := int(binary.LittleEndian.Uint16(out[pos : pos+2]))
+		length := int(binary.LittleEndian.Uint16(out[pos+2 : pos+4]))
+		pos += 4
+		data := out[pos : pos+length]
+		if code == XL_BOUNDSHEET {
+			offset := binary.LittleEndian.Uint32(data[0:4])
+			binary.LittleEndian.PutUint32(data[0:4], offset+uint32(len(fp)))
+		}
+		if !unencryptedRecords[code] {
+			var plyPos [4]byte
+			copy(plyPos[:], data)
+			encrypt(data, pos)
+			if code == XL_BOUNDSHEET {
+				copy(data, plyPos[:])
+			}
+		}
+		pos += length
+	}
+	return out
+}
+
+// xorEncrypt returns the inverse of xorDecrypter.decrypt.
+func xorEncrypt(d *xorDecrypter) func(data []byte, pos int) {
+	return func(data []byte, pos int) {
+		for i, c := range data {
+			data[i] = bits.RotateLeft8(c^d.key[(pos+len(data)+i)&0x0F], -3)
+		}
+	}
+}
+
+func TestXORVerifier(t *testing.T) {
+	tests := []struct {
+		password string
+		want     uint16
+	}{
+		{"a", 0xCE88},
+		{"abc", 0xCC1A},
+		{"password", 0x83AF},
+		{"VelvetSweatshop", 0x9A0A},
+	}
+	for _, tt := range tests {
+		if got := xorVerifier(xorPasswordBytes(tt.password)); got != tt.want {
+			t.Errorf("xorVerifier(%q) = 0x%04X, want 0x%04X", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestDecryptXOR(t *testing.T) {
+	const password, key = "secret", 0x5A3C
+	pw := xorPasswordBytes(password)
+	verifier := make([]byte, 4)
+	binary.LittleEndian.PutUint16(verifier[0:2], key)
+	binary.LittleEndian.PutUint16(verifier[2:4], xorVerifier(pw))
+
+	for _, tt := range []struct {
+		sample   string
+		filepass []byte
+	}{
+		{"profiles.xls", append([]byte{0, 0}, verifier...)},
+		{"biff4_no_format_no_window2.xls", verifier},
+	} {
+		t.Run(tt.sample, func(t *testing.T) {
+			want, err := OpenWorkbook(fromSample(tt.sample), nil)
+			if err != nil {
+				t.Fatalf("OpenWorkbook(%s) failed: %v", tt.sample, err)
+			}
+			data := encryptStream(workbookStream(t, tt.sample), tt.filepass, xorEncrypt(newXORDecrypter(pw, key)))
+
+			book, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data, Password: password})
+			if err != nil {
+				t.Fatalf("OpenWorkbook() with password failed: %v", err)
+			}
+			assertSameWorkbook(t, book, want)
+
+			if _, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data}); !errors.Is(err, ErrEncrypted) {
+				t.Errorf("OpenWorkbook() without password error = %v, want ErrEncrypted", err)
+			}
+			if _, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data, Password: "wrong"}); !errors.Is(err, ErrWrongPassword) {
+				t.Errorf("OpenWorkbook() with wrong password error = %v, want ErrWrongPassword", err)
+			}
+		})
+	}
+}
+
+// rc4Verifier returns the encrypted verifier and verifier hash of a
+// FILEPASS record for the block keys.
+func rc4Verifier(keys func(uint32) []byte, verifier []byte, hash func([]byte) []byte) []byte {
+	c, _ := rc4.NewCipher(keys(0))
+	buf := append(append([]byte(nil), verifier...), hash(verifier)...)
+	c.XORKeyStream(buf, buf)
+	return buf
+}
+
+func TestDecryptRC4Std(t *testing.T) {
+	want, err := OpenWorkbook(fromSample("profiles.xls"), nil)
+	if err != nil {
+		t.Fatalf("OpenWorkbook(profiles.xls) failed: %v", err)
+	}
+	salt := []byte("0123456789abcdef")
+	verifier := []byte("fedcba9876543210")
+
+	for _, tt := range []struct {
+		name, password, open string
+		wantErr              error
+	}{
+		{"password", "secret", "secret", nil},
+		{"default password", defaultPassword, "", nil},
+		{"default password given another", defaultPassword, "other", nil},
+		{"no password", "secret", "", ErrEncrypted},
+		{"wrong password", "secret", "wrong", ErrWrongPassword},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := rc4StdKeys(tt.password, salt)
+			filepass := []byte{1, 0, 1, 0, 1, 0}
+			filepass = append(filepass, salt...)
+			filepass = append(filepass, rc4Verifier(keys, verifier, md5Hash)...)
+			d := &rc4Decrypter{blockKey: keys}
+			data := encryptStream(workbookStream(t, "profiles.xls"), filepass, d.decrypt)
+
+			book, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data, Password: tt.open})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("OpenWorkbook() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("OpenWorkbook() failed: %v", err)
+			}
+			assertSameWorkbook(t, book, want)
+		})
+	}
+}
+
+func TestDecryptRC4CryptoAPI(t *testing.T) {
+	want, err := OpenWorkbook(fromSample("profiles.xls"), nil)
+	if err != nil {
+		t.Fatalf("OpenWorkbook(profiles.xls) failed: %v", err)
+	}
+	salt := []byte("0123456789abcdef")
+	verifier := []byte("fedcba9876543210")
+	csp := utf16LE("Microsoft Enhanced Cryptographic Provider v1.0\x00")
+
+	for _, tt := range []struct {
+		name, password, open string
+		keySize, keyBits     int
+		wantErr              error
+	}{
+		{"40-bit", "secret", "secret", 0, 40, nil},
+		{"128-bit", "secret", "secret", 128, 128, nil},
+		{"default password", defaultPassword, "", 128, 128, nil},
+		{"wrong password", "secret", "wrong", 128, 128, ErrWrongPassword},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := rc4CryptoAPIKeys(tt.password, salt, tt.keyBits)
+			header := make([]byte, 32)
+			binary.LittleEndian.PutUint32(header[8:12], 0x6801)  // RC4
+			binary.LittleEndian.PutUint32(header[12:16], 0x8004) // SHA-1
+			binary.LittleEndian.PutUint32(header[16:20], uint32(tt.keySize))
+			header = append(header, csp...)
+			filepass := []byte{1, 0, 2, 0, 2, 0, 4, 0, 0, 0}
+			filepass = binary.LittleEndian.AppendUint32(filepass, uint32(len(header)))
+			filepass = append(filepass, header...)
+			filepass = binary.LittleEndian.AppendUint32(filepass, uint32(len(salt)))
+			filepass = append(filepass, salt...)
+			encrypted := rc4Verifier(keys, verifier, sha1Hash)
+			filepass = append(filepass, encrypted[:16]...)
+			filepass = binary.LittleEndian.AppendUint32(filepass, 20)
+			filepass = append(filepass, encrypted[16:]...)
+			d := &rc4Decrypter{blockKey: keys}
+			data := encryptStream(workbookStream(t, "profiles.xls"), filepass, d.decrypt)
+
+			book, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data, Password: tt.open})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("OpenWorkbook() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("OpenWorkbook() failed: %v", err)
+			}
+			assertSameWorkbook(t, book, want)
+		})
+	}
+}
+
+// The encrypted_*.xls samples are profiles.xls encrypted by
+// scripts/make_encrypted_samples.py, which implements the algorithms of
+// [MS-OFFCRYPTO] separately from this package.
+func TestDecryptSamples(t *testing.T) {
+	want, err := OpenWorkbook(fromSample("profiles.xls"), nil)
+	if err != nil {
+		t.Fatalf("OpenWorkbook(profiles.xls) failed: %v", err)
+	}
+	for _, tt := range []struct {
+		sample, password string
+	}{
+		{"encrypted_xor.xls", "xlrd-go"},
+		{"encrypted_rc4.xls", "xlrd-go"},
+		{"encrypted_default.xls", ""},
+		{"encrypted_cryptoapi.xls", "xlrd-go"},
+		{"encrypted_cryptoapi40.xls", "xlrd-go"},
+		{"encrypted_cryptoapi_props.xls", "xlrd-go"},
+	} {
+		t.Run(tt.sample, func(t *testing.T) {
+			book, err := OpenWorkbook(fromSample(tt.sample), &OpenWorkbookOptions{Password: tt.password})
+			if err != nil {
+				t.Fatalf("OpenWorkbook() failed: %v", err)
+			}
+			sheet, err := book.SheetByName("PROFILEDEF")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v := sheet.CellValue(0, 0); v != "PROFIL" {
+				t.Errorf("PROFILEDEF A1 = %v, want PROFIL", v)
+			}
+			if v := sheet.CellValue(1, 1); v != 100.0 {
+				t.Errorf("PROFILEDEF B2 = %v, want 100", v)
+			}
+			assertSameWorkbook(t, book, want)
+
+			if tt.password == "" {
+				return
+			}
+			if _, err := OpenWorkbook(fromSample(tt.sample), nil); !errors.Is(err, ErrEncrypted) {
+				t.Errorf("OpenWorkbook() without password error = %v, want ErrEncrypted", err)
+			}
+			if _, err := OpenWorkbook(fromSample(tt.sample), &OpenWorkbookOptions{Password: "xlrd-gp"}); !errors.Is(err, ErrWrongPassword) {
+				t.Errorf("OpenWorkbook() with wrong password error = %v, want ErrWrongPassword", err)
+			}
+		})
+	}
+}
+
+func TestDecryptEncryptedProperties(t *testing.T) {
+	// With fDocProps clear, the DocumentSummaryInformation stream is
+	// encrypted too, and is reported rather than read.
+	book, err := OpenWorkbook(fromSample("encrypted_cryptoapi_props.xls"), &OpenWorkbookOptions{Password: "xlrd-go"})
+	if err != nil {
+		t.Fatalf("OpenWorkbook() failed: %v", err)
+	}
+	if book.Properties.Company != "" {
+		t.Errorf("Properties.Company = %q, want empty", book.Properties.Company)
+	}
+	if !hasDiagnostic(book, SeverityWarning, DiagPropertySet) {
+		t.Errorf("Diagnostics() = %v, want a %s warning", book.Diagnostics(), DiagPropertySet)
+	}
+
+	// Without property set streams, there is nothing to report.
+	book, err = OpenWorkbook(fromSample("encrypted_cryptoapi.xls"), &OpenWorkbookOptions{Password: "xlrd-go"})
+	if err != nil {
+		t.Fatalf("OpenWorkbook() failed: %v", err)
+	}
+	if hasDiagnostic(book, SeverityWarning, DiagPropertySet) {
+		t.Errorf("Diagnostics() = %v, want no %s warning", book.Diagnostics(), DiagPropertySet)
+	}
+}
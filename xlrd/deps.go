@@ -0,0 +1,481 @@
+package xlrd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// CellID identifies a cell of a book by sheet index, row and column.
+type CellID struct {
+	Sheet, Row, Col int
+}
+
+// AreaRef is a range of cells on the sheets FirstSheet to LastSheet, which
+// differ for references such as Sheet1:Sheet3!A1. A single cell is a range
+// of one row and one column.
+type AreaRef struct {
+	FirstSheet, LastSheet int
+	CellRange
+}
+
+// Contains reports whether the cell c lies in the range.
+func (a AreaRef) Contains(c CellID) bool {
+	return a.FirstSheet <= c.Sheet && c.Sheet <= a.LastSheet &&
+		a.FirstRow <= c.Row && c.Row < a.LastRow &&
+		a.FirstCol <= c.Col && c.Col < a.LastCol
+}
+
+// Precedents lists what the formula of a cell reads.
+type Precedents struct {
+	// Areas holds the cells and ranges the formula refers to, directly or
+	// through defined names, in the order they first appear. Operands of
+	// the range, union and intersection operators are listed separately.
+	Areas []AreaRef
+	// Names holds the defined names the formula uses, including those used
+	// by the formulas of these names. Names local to a sheet are qualified
+	// by it, as in Sheet1!Total.
+	Names []string
+	// External is set if the formula refers to cells or names of other
+	// workbooks, which are not listed.
+	External bool
+}
+
+// DependencyGraph relates the formula cells of the sheets loaded in a book
+// to the cells they read. It does not change when the book does.
+type DependencyGraph struct {
+	// Precedents maps each formula cell to what its formula reads.
+	Precedents map[CellID]*Precedents
+
+	// edges maps each formula cell to the formula cells it reads, in the
+	// order of cells.
+	edges map[CellID][]CellID
+	// cells holds the formula cells, sorted by sheet, row and column.
+	cells []CellID
+	book  *Book
+
+	// readers maps each cell referred to on its own to the formula cells
+	// reading it, and ranges lists by sheet the larger areas read, for
+	// Dependents.
+	readers map[CellID][]CellID
+	ranges  map[int][]areaReader
+}
+
+// areaReader is a formula cell reading an area of several cells.
+type areaReader struct {
+	area AreaRef
+	cell CellID
+}
+
+// DependencyGraph returns the precedents of every formula of the loaded
+// sheets. Formulas whose tokens cannot be read are left out, and each gets
+// a "formula" diagnostic. DependencyGraph must not run concurrently with
+// other uses of the book.
+func (b *Book) DependencyGraph() *DependencyGraph {
+	g := &DependencyGraph{
+		Precedents: make(map[CellID]*Precedents),
+		edges:      make(map[CellID][]CellID),
+		book:       b,
+		readers:    make(map[CellID][]CellID),
+		ranges:     make(map[int][]areaReader),
+	}
+	e := newEvaluator(b)
+	b.mu.Lock()
+	sheets := append([]*Sheet(nil), b.sheetList...)
+	b.mu.Unlock()
+	for _, s := range sheets {
+		if s == nil {
+			continue
+		}
+		for _, key := range sortedCells(s.formulas) {
+			c := CellID{s.number, key[0], key[1]}
+			p, err := e.precedents(s, key[0], key[1])
+			if err != nil {
+				d := Diagnostic{
+					Severity: SeverityWarning,
+					Code:     DiagFormula,
+					Sheet:    s.Name,
+					Opcode:   -1,
+					Offset:   -1,
+					Message:  fmt.Sprintf("Can't trace precedents of %s: %v", Cellname(key[0], key[1]), err),
+				}
+				s.addDiagnostic(d)
+				continue
+			}
+			g.Precedents[c] = p
+			g.cells = append(g.cells, c)
+		}
+	}
+	bySheet := make(map[int][]CellID)
+	for _, c := range g.cells {
+		bySheet[c.Sheet] = append(bySheet[c.Sheet], c)
+	}
+	for _, c := range g.cells {
+		g.edges[c] = g.formulasIn(g.Precedents[c].Areas, bySheet)
+		for _, a := range g.Precedents[c].Areas {
+			for shx := a.FirstSheet; shx <= a.LastSheet; shx++ {
+				if a.LastRow-a.FirstRow == 1 && a.LastCol-a.FirstCol == 1 {
+					cell := CellID{shx, a.FirstRow, a.FirstCol}
+					g.readers[cell] = append(g.readers[cell], c)
+				} else {
+					g.ranges[shx] = append(g.ranges[shx], areaReader{a, c})
+				}
+			}
+		}
+	}
+	return g
+}
+
+// formulasIn returns the formula cells of the graph that lie in areas,
+// given the formula cells of each sheet.
+func (g *DependencyGraph) formulasIn(areas []AreaRef, bySheet map[int][]CellID) []CellID {
+	var cells []CellID
+	seen := make(map[CellID]bool)
+	for _, a := range areas {
+		for shx := a.FirstSheet; shx <= a.LastSheet; shx++ {
+			formulas := bySheet[shx]
+			if (a.LastRow-a.FirstRow)*(a.LastCol-a.FirstCol) < len(formulas) {
+				// Look the cells of a small range up.
+				for rowx := a.FirstRow; rowx < a.LastRow; rowx++ {
+					for colx := a.FirstCol; colx < a.LastCol; colx++ {
+						c := CellID{shx, rowx, colx}
+						if _, ok := g.Precedents[c]; ok && !seen[c] {
+							seen[c] = true
+							cells = append(cells, c)
+						}
+					}
+				}
+				continue
+			}
+			for _, c := range formulas {
+				if a.Contains(c) && !seen[c] {
+					seen[c] = true
+					cells = append(cells, c)
+				}
+			}
+		}
+	}
+	sortCellIDs(cells)
+	return cells
+}
+
+// Dependents returns the formula cells that read the cell at the given
+// sheet index, row and column directly, sorted by sheet, row and column.
+// A cell with no dependents, and no formula, is an input that no formula
+// uses.
+func (g *DependencyGraph) Dependents(sheetx, rowx, colx int) []CellID {
+	target := CellID{sheetx, rowx, colx}
+	cells := append([]CellID(nil), g.readers[target]...)
+	for _, r := range g.ranges[sheetx] {
+		if r.area.Contains(target) {
+			cells = append(cells, r.cell)
+		}
+	}
+	sortCellIDs(cells)
+	return slices.Compact(cells)
+}
+
+// Cycles returns the groups of formula cells that depend on each other,
+// including single cells that read themselves. Each group is sorted by
+// sheet, row and column, and so are the groups by their first cell.
+func (g *DependencyGraph) Cycles() [][]CellID {
+	// Tarjan's algorithm finds the strongly connected components, with an
+	// explicit stack so that long chains of formulas do not exhaust the
+	// goroutine's.
+	index := make(map[CellID]int)
+	low := make(map[CellID]int)
+	onStack := make(map[CellID]bool)
+	var stack []CellID
+	var cycles [][]CellID
+	enter := func(c CellID) {
+		index[c] = len(index)
+		low[c] = index[c]
+		stack = append(stack, c)
+		onStack[c] = true
+	}
+	for _, root := range g.cells {
+		if _, ok := index[root]; ok {
+			continue
+		}
+		enter(root)
+		work := []dfsFrame{{cell: root}}
+		for len(work) > 0 {
+			f := &work[len(work)-1]
+			c := f.cell
+			if edges := g.edges[c]; f.next < len(edges) {
+				d := edges[f.next]
+				f.next++
+				if _, ok := index[d]; !ok {
+					enter(d)
+					work = append(work, dfsFrame{cell: d})
+				} else if onStack[d] {
+					low[c] = min(low[c], index[d])
+				}
+				continue
+			}
+			work = work[:len(work)-1]
+			if len(work) > 0 {
+				parent := work[len(work)-1].cell
+				low[parent] = min(low[parent], low[c])
+			}
+			if low[c] != index[c] {
+				continue
+			}
+			var scc []CellID
+			for {
+				d := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				delete(onStack, d)
+				scc = append(scc, d)
+				if d == c {
+					break
+				}
+			}
+			if len(scc) > 1 || slices.Contains(g.edges[c], c) {
+				sortCellIDs(scc)
+				cycles = append(cycles, scc)
+			}
+		}
+	}
+	sort.Slice(cycles, func(i, j int) bool { return cellIDLess(cycles[i][0], cycles[j][0]) })
+	return cycles
+}
+
+// dfsFrame is a formula cell being visited in a depth-first search of the
+// graph, with the index of the next of its edges to follow.
+type dfsFrame struct {
+	cell CellID
+	next int
+}
+
+// TopologicalOrder returns the formula cells ordered so that each comes
+// after the formula cells it reads, which is an order to recalculate them
+// in. Cells that do not depend on each other keep the order of sheet, row
+// and column. The error matches ErrCircularReference if formulas depend on
+// themselves.
+func (g *DependencyGraph) TopologicalOrder() ([]CellID, error) {
+	if cycles := g.Cycles(); len(cycles) > 0 {
+		c := cycles[0][0]
+		return nil, newXLRDError(ErrCircularReference, "%d circular references, the first through %s!%s",
+			len(cycles), quotedsheetname(g.book.sheetNames, c.Sheet), Cellname(c.Row, c.Col))
+	}
+	order := make([]CellID, 0, len(g.cells))
+	done := make(map[CellID]bool)
+	for _, root := range g.cells {
+		if done[root] {
+			continue
+		}
+		done[root] = true
+		work := []dfsFrame{{cell: root}}
+		for len(work) > 0 {
+			f := &work[len(work)-1]
+			if edges := g.edges[f.cell]; f.next < len(edges) {
+				d := edges[f.next]
+				f.next++
+				if !done[d] {
+					done[d] = true
+					work = append(work, dfsFrame{cell: d})
+				}
+				continue
+			}
+			order = append(order, f.cell)
+			work = work[:len(work)-1]
+		}
+	}
+	return order, nil
+}
+
+func cellIDLess(a, b CellID) bool {
+	if a.Sheet != b.Sheet {
+		return a.Sheet < b.Sheet
+	}
+	if a.Row != b.Row {
+		return a.Row < b.Row
+	}
+	return a.Col < b.Col
+}
+
+func sortCellIDs(cells []CellID) {
+	sort.Slice(cells, func(i, j int) bool { return cellIDLess(cells[i], cells[j]) })
+}
+
+// precedents returns what the formula of a cell reads.
+func (e *evaluator) precedents(s *Sheet, rowx, colx int) (*Precedents, error) {
+	fmla := s.formulas[[2]int{rowx, colx}]
+	fmlatype := FMLA_TYPE_CELL
+	e.cur = evalCell{s.number, rowx, colx}
+	if isExpFormula(e.book.BiffVersion, fmla) {
+		sf := s.sharedFormulaOf(rowx, colx)
+		if sf == nil {
+			return nil, e.fail(ErrMalformedFormula, "shared formula not found")
+		}
+		fmla, fmlatype = sf.rgce, FMLA_TYPE_SHARED
+		if sf.array {
+			fmlatype = FMLA_TYPE_ARRAY
+			e.cur = evalCell{s.number, sf.cells.FirstRow, sf.cells.FirstCol}
+		}
+	}
+	p := &Precedents{}
+	if err := e.collectRefs(p, fmla, fmlatype, make(map[int]bool), 0); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// collectRefs adds the references made by the token array of a formula of
+// the given type to p, following the defined names it uses. used holds the
+// indexes of the names already followed.
+func (e *evaluator) collectRefs(p *Precedents, fmla []byte, fmlatype int, used map[int]bool, level int) error {
+	if level > StackPanicLevel {
+		return e.fail(ErrMalformedFormula, "excessive indirect references in formula")
+	}
+	bk := e.book
+	bv := bk.BiffVersion
+	sztab := szdict[bv]
+	if sztab == nil {
+		return newXLRDError(ErrUnsupportedBIFF, "no formula tokens for BIFF version %d", bv)
+	}
+	reldelta := 0
+	if fmlatype&(FmlaTypeShared|FmlaTypeName|FmlaTypeCondFmt|FmlaTypeDataVal) != 0 {
+		reldelta = 1
+	}
+	addArea := func(a AreaRef) {
+		for _, b := range p.Areas {
+			if b == a {
+				return
+			}
+		}
+		p.Areas = append(p.Areas, a)
+	}
+
+	for pos := 0; pos < len(fmla); {
+		op := int(fmla[pos])
+		opcode := op & 0x1f
+		optype := (op & 0x60) >> 5
+		opx := opcode
+		if optype != 0 {
+			opx = opcode + 32
+		}
+		oname := onames[opx]
+		sz := sztab[opx]
+		if sz == -2 {
+			return e.fail(ErrMalformedFormula, "unexpected token 0x%02x (t%s)", op, oname)
+		}
+		if pos+sz > len(fmla) {
+			return e.fail(ErrMalformedFormula, "token t%s at position %d truncated", oname, pos)
+		}
+
+		if optype == 0 {
+			switch opcode {
+			case 0x17: // tStr
+				var newpos int
+				var ok bool
+				if bv <= 70 {
+					_, newpos, ok = unpackStringUpdatePos(fmla, pos+1, bk.Encoding, 1)
+				} else {
+					_, newpos, ok = unpackUnicodeUpdatePos(fmla, pos+1, 1)
+				}
+				if !ok {
+					return e.fail(ErrMalformedFormula, "token tStr at position %d truncated", pos)
+				}
+				sz = newpos - pos
+			case 0x19: // tAttr
+				if pos+4 > len(fmla) {
+					return e.fail(ErrMalformedFormula, "token tAttr at position %d truncated", pos)
+				}
+				sz = 4
+				if fmla[pos+1] == 0x04 { // Choose
+					sz = int(binary.LittleEndian.Uint16(fmla[pos+2:pos+4]))*2 + 6
+				}
+			}
+			pos += sz
+			continue
+		}
+
+		switch opcode {
+		case 0x03: // tName
+			namex := int(binary.LittleEndian.Uint16(fmla[pos+1:pos+3])) - 1
+			if err := e.collectNameRefs(p, namex, used, level); err != nil {
+				return err
+			}
+		case 0x19: // tNameX
+			tok := fmla[pos : pos+sz]
+			if bv >= 80 {
+				refx := int(binary.LittleEndian.Uint16(tok[1:3]))
+				namex := int(binary.LittleEndian.Uint16(tok[3:5])) - 1
+				switch shx, _ := getExternsheetLocalRange(bk, refx, 0); {
+				case shx == -5: // add-in function
+				case shx >= -1:
+					if err := e.collectNameRefs(p, namex, used, level); err != nil {
+						return err
+					}
+				default:
+					p.External = true
+				}
+				break
+			}
+			refx := int(int16(binary.LittleEndian.Uint16(tok[1:3])))
+			namex := int(binary.LittleEndian.Uint16(tok[11:13])) - 1
+			if refx < 0 && -refx-1 < len(bk.externsheetTypeB57) && bk.externsheetTypeB57[-refx-1] == 4 {
+				if err := e.collectNameRefs(p, namex, used, level); err != nil {
+					return err
+				}
+			} else {
+				p.External = true
+			}
+		case 0x04, 0x0C: // tRef, tRefN
+			rowx, colx := e.cellAddr(fmla, pos+1, reldelta)
+			addArea(AreaRef{e.cur.shx, e.cur.shx, CellRange{rowx, rowx + 1, colx, colx + 1}})
+		case 0x05, 0x0D: // tArea, tAreaN
+			a := e.areaAddr(e.cur.shx, fmla, pos+1, reldelta)
+			addArea(AreaRef{a.shx, a.shx, CellRange{a.r1, a.r2, a.c1, a.c2}})
+		case 0x1A, 0x1B: // tRef3d, tArea3d
+			shx1, shx2, addr := e.sheetRange(fmla, pos)
+			if shx1 == -4 {
+				p.External = true
+			}
+			if shx1 < 0 {
+				break
+			}
+			var a evalArea
+			if opcode == 0x1A {
+				rowx, colx := e.cellAddr(fmla, addr, reldelta)
+				a = evalArea{0, rowx, rowx + 1, colx, colx + 1}
+			} else {
+				a = e.areaAddr(0, fmla, addr, reldelta)
+			}
+			addArea(AreaRef{shx1, shx2, CellRange{a.r1, a.r2, a.c1, a.c2}})
+		}
+		pos += sz
+	}
+	return nil
+}
+
+// collectNameRefs adds the defined name with index namex, and the
+// references made by its formula, to p.
+func (e *evaluator) collectNameRefs(p *Precedents, namex int, used map[int]bool, level int) error {
+	bk := e.book
+	if namex < 0 || namex >= len(bk.NameObjList) {
+		return e.fail(ErrMalformedFormula, "name index %d out of range", namex+1)
+	}
+	nobj := bk.NameObjList[namex]
+	if nobj.Func != 0 && strings.HasPrefix(nobj.Name, "_xlfn.") {
+		// A function newer than the file format, such as IFERROR.
+		return nil
+	}
+	if used[namex] {
+		return nil
+	}
+	used[namex] = true
+	p.Names = append(p.Names, nameText(bk, nobj))
+	if nobj.Macro != 0 || nobj.Binary != 0 {
+		return nil
+	}
+	n := min(nobj.BasicFormulaLen, len(nobj.RawFormula))
+	if n <= 0 {
+		return nil
+	}
+	return e.collectRefs(p, nobj.RawFormula[:n], FMLA_TYPE_NAME, used, level+1)
+}
@@ -0,0 +1,181 @@
+package xlrd
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func openSynthetic(t *testing.T, sheetRecords ...[]byte) *Book {
+	t.Helper()
+	book, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: biff8Workbook(sheetRecords...), Logfile: io.Discard})
+	if err != nil {
+		t.Fatalf("OpenWorkbook() failed: %v", err)
+	}
+	return book
+}
+
+func TestDependencyGraph(t *testing.T) {
+	book := openSynthetic(t,
+		numberValueRecord(0, 0, 1), numberValueRecord(1, 0, 2), numberValueRecord(2, 0, 3),
+		// C1: SUM(B1:B2), B2: B1*2, B1: A1+A2
+		formulaRecord(0, 2, rpn(tArea(0, 1, 1, 1), tFuncVar(4, 1))...),
+		formulaRecord(1, 1, rpn(tRef(0, 1), tNum(2), tOp(tMul))...),
+		formulaRecord(0, 1, rpn(tRef(0, 0), tRef(1, 0), tOp(tAdd))...),
+	)
+	g := book.DependencyGraph()
+
+	cell := func(rowx, colx int) CellID { return CellID{0, rowx, colx} }
+	area := func(r1, c1, r2, c2 int) AreaRef { return AreaRef{0, 0, CellRange{r1, r2 + 1, c1, c2 + 1}} }
+	for c, want := range map[CellID][]AreaRef{
+		cell(0, 1): {area(0, 0, 0, 0), area(1, 0, 1, 0)},
+		cell(1, 1): {area(0, 1, 0, 1)},
+		cell(0, 2): {area(0, 1, 1, 1)},
+	} {
+		p := g.Precedents[c]
+		if p == nil {
+			t.Errorf("Precedents[%v] missing", c)
+			continue
+		}
+		if !reflect.DeepEqual(p.Areas, want) {
+			t.Errorf("Precedents[%v].Areas = %v, want %v", c, p.Areas, want)
+		}
+	}
+	if len(g.Precedents) != 3 {
+		t.Errorf("Precedents has %d cells, want 3", len(g.Precedents))
+	}
+
+	if got, want := g.Dependents(0, 0, 1), []CellID{cell(0, 2), cell(1, 1)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Dependents(B1) = %v, want %v", got, want)
+	}
+	if got := g.Dependents(0, 2, 0); len(got) != 0 {
+		t.Errorf("Dependents(A3) = %v, want none", got)
+	}
+
+	if cycles := g.Cycles(); len(cycles) != 0 {
+		t.Errorf("Cycles() = %v, want none", cycles)
+	}
+	order, err := g.TopologicalOrder()
+	if err != nil {
+		t.Fatalf("TopologicalOrder() failed: %v", err)
+	}
+	if want := []CellID{cell(0, 1), cell(1, 1), cell(0, 2)}; !reflect.DeepEqual(order, want) {
+		t.Errorf("TopologicalOrder() = %v, want %v", order, want)
+	}
+}
+
+func TestDependencyGraphCycles(t *testing.T) {
+	book := openSynthetic(t,
+		// A1: A1, B1: C1+1, C1: B1+1, D1: B1
+		formulaRecord(0, 0, tRef(0, 0)...),
+		formulaRecord(0, 1, rpn(tRef(0, 2), tNum(1), tOp(tAdd))...),
+		formulaRecord(0, 2, rpn(tRef(0, 1), tNum(1), tOp(tAdd))...),
+		formulaRecord(0, 3, tRef(0, 1)...),
+	)
+	g := book.DependencyGraph()
+	want := [][]CellID{{{0, 0, 0}}, {{0, 0, 1}, {0, 0, 2}}}
+	if got := g.Cycles(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Cycles() = %v, want %v", got, want)
+	}
+	if _, err := g.TopologicalOrder(); !errors.Is(err, ErrCircularReference) {
+		t.Errorf("TopologicalOrder() error = %v, want ErrCircularReference", err)
+	}
+}
+
+func TestDependencyGraphSamples(t *testing.T) {
+	book, err := OpenWorkbook(fromSample("namesdemo.xls"), &OpenWorkbookOptions{Logfile: io.Discard})
+	if err != nil {
+		t.Fatalf("OpenWorkbook(namesdemo.xls) failed: %v", err)
+	}
+	g := book.DependencyGraph()
+	if len(g.Precedents) == 0 {
+		t.Fatal("Precedents is empty")
+	}
+	names := 0
+	for c, p := range g.Precedents {
+		if len(p.Names) > 0 {
+			names++
+		}
+		for _, a := range p.Areas {
+			if a.FirstSheet < 0 || a.LastSheet >= book.NSheets || a.FirstRow >= a.LastRow || a.FirstCol >= a.LastCol {
+				t.Errorf("Precedents[%v] has invalid area %v", c, a)
+			}
+		}
+	}
+	if names == 0 {
+		t.Error("no formula uses a name")
+	}
+	if _, err := g.TopologicalOrder(); err != nil {
+		t.Errorf("TopologicalOrder() failed: %v", err)
+	}
+
+	// all_local_ranges refers to a LocalRange name of each of three sheets.
+	namex := -1
+	for i, nobj := range book.NameObjList {
+		if nobj.Name == "all_local_ranges" {
+			namex = i
+		}
+	}
+	if namex < 0 {
+		t.Fatal("no name all_local_ranges")
+	}
+	p := &Precedents{}
+	if err := newEvaluator(book).collectNameRefs(p, namex, make(map[int]bool), 0); err != nil {
+		t.Fatalf("collectNameRefs(all_local_ranges) failed: %v", err)
+	}
+	want := []string{"all_local_ranges", "Sheet1!LocalRange", "Sheet2!localRange", "Sheet3!Localrange"}
+	if !reflect.DeepEqual(p.Names, want) {
+		t.Errorf("Names = %v, want %v", p.Names, want)
+	}
+}
+
+func TestDependencyGraphDependents(t *testing.T) {
+	book := openSynthetic(t,
+		// B1: A1+SUM(A1:A3), B2: SUM(A1:A3), B3: A2, C1: SUM(A:B)
+		formulaRecord(0, 1, rpn(tRef(0, 0), tArea(0, 0, 2, 0), tFuncVar(4, 1), tOp(tAdd))...),
+		formulaRecord(1, 1, rpn(tArea(0, 0, 2, 0), tFuncVar(4, 1))...),
+		formulaRecord(2, 1, tRef(1, 0)...),
+		formulaRecord(0, 2, rpn(tArea(0, 0, 65535, 1), tFuncVar(4, 1))...),
+	)
+	g := book.DependencyGraph()
+	cell := func(rowx, colx int) CellID { return CellID{0, rowx, colx} }
+	for _, tt := range []struct {
+		rowx, colx int
+		want       []CellID
+	}{
+		{0, 0, []CellID{cell(0, 1), cell(0, 2), cell(1, 1)}},
+		{1, 0, []CellID{cell(0, 1), cell(0, 2), cell(1, 1), cell(2, 1)}},
+		{3, 0, []CellID{cell(0, 2)}},
+		{0, 1, []CellID{cell(0, 2)}},
+		{0, 3, nil},
+	} {
+		if got := g.Dependents(0, tt.rowx, tt.colx); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Dependents(%s) = %v, want %v", Cellname(tt.rowx, tt.colx), got, tt.want)
+		}
+	}
+}
+
+func TestDependencyGraphLongChain(t *testing.T) {
+	// Each of A1 to A20000 reads the cell below; in the second book, A20001
+	// reads A1, closing the loop.
+	const n = 20000
+	var records [][]byte
+	for rowx := 0; rowx < n; rowx++ {
+		records = append(records, formulaRecord(rowx, 0, tRef(rowx+1, 0)...))
+	}
+	book := openSynthetic(t, records...)
+	order, err := book.DependencyGraph().TopologicalOrder()
+	if err != nil {
+		t.Fatalf("TopologicalOrder() failed: %v", err)
+	}
+	if len(order) != n || order[0] != (CellID{0, n - 1, 0}) || order[n-1] != (CellID{0, 0, 0}) {
+		t.Errorf("TopologicalOrder() = %d cells from %v to %v, want %d from A%d to A1", len(order), order[0], order[len(order)-1], n, n)
+	}
+
+	book = openSynthetic(t, append(records, formulaRecord(n, 0, tRef(0, 0)...))...)
+	cycles := book.DependencyGraph().Cycles()
+	if len(cycles) != 1 || len(cycles[0]) != n+1 {
+		t.Errorf("Cycles() = %d cycles, want one of %d cells", len(cycles), n+1)
+	}
+}
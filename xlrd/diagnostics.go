@@ -0,0 +1,180 @@
+package xlrd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Severity classifies a Diagnostic.
+type Severity int
+
+// Diagnostic severities.
+const (
+	// SeverityNote reports something unusual that does not affect the data.
+	SeverityNote Severity = iota
+	// SeverityWarning reports a record that was ignored or repaired.
+	SeverityWarning
+	// SeverityError reports a record that is invalid and was skipped.
+	SeverityError
+)
+
+var severityNames = [...]string{"NOTE", "WARNING", "ERROR"}
+
+func (s Severity) String() string {
+	if s >= 0 && int(s) < len(severityNames) {
+		return severityNames[s]
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// DiagnosticCode identifies the kind of problem a Diagnostic reports.
+// The values are stable and may be used to filter diagnostics.
+type DiagnosticCode string
+
+// Diagnostic codes.
+const (
+	DiagOnDemandUnsupported DiagnosticCode = "on-demand-unsupported"
+	DiagUnmapFailed         DiagnosticCode = "unmap-failed"
+	DiagOLE2Corrupt         DiagnosticCode = "ole2-corrupt"
+	DiagOLE2StreamSize      DiagnosticCode = "ole2-stream-size"
+	DiagSalvaged            DiagnosticCode = "salvaged"
+	DiagPropertySet         DiagnosticCode = "property-set"
+	DiagEmbeddedObject      DiagnosticCode = "embedded-object"
+	DiagStyleName           DiagnosticCode = "style-name"
+	DiagStyleXF             DiagnosticCode = "style-xf"
+	DiagPaletteSize         DiagnosticCode = "palette-size"
+	DiagDuplicateName       DiagnosticCode = "duplicate-name"
+	DiagFormatConflict      DiagnosticCode = "format-conflict"
+	DiagFormatKey           DiagnosticCode = "format-key"
+	DiagColourIndex         DiagnosticCode = "colour-index"
+	DiagAmbiguousDateFormat DiagnosticCode = "ambiguous-date-format"
+	DiagConstantFormat      DiagnosticCode = "constant-format"
+	DiagStandardWidth       DiagnosticCode = "standardwidth"
+	DiagDefaultRowHeight    DiagnosticCode = "defaultrowheight"
+	DiagCondFmtIgnored      DiagnosticCode = "condfmt-ignored"
+	DiagSCL                 DiagnosticCode = "scl"
+	DiagCellAttr            DiagnosticCode = "cell-attr"
+	DiagHyperlinkExtra      DiagnosticCode = "hyperlink-extra"
+	DiagHyperlinkRange      DiagnosticCode = "hyperlink-range"
+	DiagObjectIgnored       DiagnosticCode = "object-ignored"
+	DiagFormula             DiagnosticCode = "formula"
+)
+
+// Diagnostic describes a problem noticed while reading a workbook that did
+// not stop it from being read.
+type Diagnostic struct {
+	Severity Severity
+	Code     DiagnosticCode
+	// Sheet is the name of the sheet being read, or "" for the workbook
+	// globals and the compound document.
+	Sheet string
+	// Opcode is the type of the BIFF record concerned, and Offset its
+	// offset in the Workbook stream. Both are -1 when not known.
+	Opcode  int
+	Offset  int
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s *** %s", d.Severity, d.Message)
+	if d.Sheet != "" {
+		fmt.Fprintf(&b, " [sheet %q]", d.Sheet)
+	}
+	if d.Opcode >= 0 {
+		fmt.Fprintf(&b, " [record 0x%04x %s at offset %d]", d.Opcode, recordName(d.Opcode), d.Offset)
+	}
+	return b.String()
+}
+
+// Diagnostics returns the problems noticed while reading the workbook and
+// its loaded sheets, in the order they were found. A problem found again,
+// such as when a sheet is reloaded or streamed, is listed once.
+func (b *Book) Diagnostics() []Diagnostic {
+	b.diagMu.Lock()
+	defer b.diagMu.Unlock()
+	return append([]Diagnostic(nil), b.diagnostics...)
+}
+
+// Diagnostics returns the problems noticed while reading the sheet.
+func (s *Sheet) Diagnostics() []Diagnostic {
+	s.diagMu.Lock()
+	defer s.diagMu.Unlock()
+	return append([]Diagnostic(nil), s.diagnostics...)
+}
+
+// addDiagnostic records d, and logs it if there is a logger. Otherwise it is
+// written to the logfile if verbosity is greater than zero. A diagnostic
+// already recorded is ignored.
+func (b *Book) addDiagnostic(d Diagnostic) {
+	b.diagMu.Lock()
+	if b.diagSeen[d] {
+		b.diagMu.Unlock()
+		return
+	}
+	if b.diagSeen == nil {
+		b.diagSeen = make(map[Diagnostic]bool)
+	}
+	b.diagSeen[d] = true
+	b.diagnostics = append(b.diagnostics, d)
+	b.diagMu.Unlock()
+	if b.logger != nil {
+		attrs := []any{slog.String("code", string(d.Code))}
+		if d.Sheet != "" {
+			attrs = append(attrs, slog.String("sheet", d.Sheet))
+		}
+		attrs = append(attrs, recordAttrs(d.Opcode, d.Offset)...)
+		b.logger.Log(context.Background(), d.Severity.level(), d.Message, attrs...)
+	} else if b.verbosity > 0 {
+		fmt.Fprintln(b.logfile, d)
+	}
+}
+
+// diag records a diagnostic for the workbook globals record most recently
+// read.
+func (b *Book) diag(sev Severity, code DiagnosticCode, format string, args ...interface{}) {
+	b.addDiagnostic(Diagnostic{
+		Severity: sev,
+		Code:     code,
+		Opcode:   b.recordReader.recOpcode,
+		Offset:   b.recordReader.recOffset,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// diag records a diagnostic for the sheet record most recently read.
+func (s *Sheet) diag(sev Severity, code DiagnosticCode, format string, args ...interface{}) {
+	d := Diagnostic{
+		Severity: sev,
+		Code:     code,
+		Sheet:    s.Name,
+		Opcode:   -1,
+		Offset:   -1,
+		Message:  fmt.Sprintf(format, args...),
+	}
+	if s.rdr != nil {
+		d.Opcode, d.Offset = s.rdr.recOpcode, s.rdr.recOffset
+	}
+	s.addDiagnostic(d)
+}
+
+// addDiagnostic records d for the sheet and its book, unless the sheet
+// has it already.
+func (s *Sheet) addDiagnostic(d Diagnostic) {
+	s.diagMu.Lock()
+	if s.diagSeen[d] {
+		s.diagMu.Unlock()
+		return
+	}
+	if s.diagSeen == nil {
+		s.diagSeen = make(map[Diagnostic]bool)
+	}
+	s.diagSeen[d] = true
+	s.diagnostics = append(s.diagnostics, d)
+	s.diagMu.Unlock()
+	if s.Book != nil {
+		s.Book.addDiagnostic(d)
+	}
+}
@@ -0,0 +1,93 @@
+package xlrd
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestDiagnosticsSheet(t *testing.T) {
+	data := biff8Workbook(biffRecord(XL_SCL, []byte{1, 0, 100, 0}))
+	var log bytes.Buffer
+	book, err := OpenWorkbookReaderAt(bytes.NewReader(data), int64(len(data)), &OpenWorkbookOptions{Logfile: &log})
+	if err != nil {
+		t.Fatalf("OpenWorkbookReaderAt() failed: %v", err)
+	}
+	if log.Len() != 0 {
+		t.Errorf("logfile = %q, want nothing written at verbosity 0", log.String())
+	}
+	sheet, err := book.SheetByIndex(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Diagnostic{
+		Severity: SeverityWarning,
+		Code:     DiagSCL,
+		Sheet:    "Sheet1",
+		Opcode:   XL_SCL,
+		Offset:   bytes.Index(data, []byte{0xA0, 0x00, 0x04, 0x00}),
+		Message:  "SCL rcd: should have 0.1 <= num/den <= 4; got 1/100",
+	}
+	diags := sheet.Diagnostics()
+	if len(diags) != 1 || diags[0] != want {
+		t.Errorf("Sheet.Diagnostics() = %+v, want [%+v]", diags, want)
+	}
+	if got := book.Diagnostics(); len(got) != 1 || got[0] != want {
+		t.Errorf("Book.Diagnostics() = %+v, want [%+v]", got, want)
+	}
+	if sheet.SclMagFactor != 100 {
+		t.Errorf("SclMagFactor = %d, want 100", sheet.SclMagFactor)
+	}
+}
+
+func TestDiagnosticsVerbose(t *testing.T) {
+	data := biff8Workbook(biffRecord(XL_SCL, []byte{1, 0, 100, 0}))
+	var log bytes.Buffer
+	_, err := OpenWorkbookReaderAt(bytes.NewReader(data), int64(len(data)), &OpenWorkbookOptions{Logfile: &log, Verbosity: 1})
+	if err != nil {
+		t.Fatalf("OpenWorkbookReaderAt() failed: %v", err)
+	}
+	want := `WARNING *** SCL rcd: should have 0.1 <= num/den <= 4; got 1/100 [sheet "Sheet1"]`
+	if !bytes.Contains(log.Bytes(), []byte(want)) {
+		t.Errorf("logfile = %q, want it to contain %q", log.String(), want)
+	}
+}
+
+func TestDiagnosticsCompDoc(t *testing.T) {
+	data, err := os.ReadFile(fromSample("profiles.xls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Trailing garbage leaves the file size off a sector boundary.
+	data = append(data, make([]byte, 10)...)
+	book, err := OpenWorkbookReaderAt(bytes.NewReader(data), int64(len(data)), nil)
+	if err != nil {
+		t.Fatalf("OpenWorkbookReaderAt() failed: %v", err)
+	}
+	diags := book.Diagnostics()
+	if len(diags) == 0 || diags[0].Code != DiagOLE2Corrupt || diags[0].Opcode != -1 {
+		t.Errorf("Book.Diagnostics() = %+v, want a leading %s entry", diags, DiagOLE2Corrupt)
+	}
+}
+
+func TestDiagnosticsReload(t *testing.T) {
+	data := biff8Workbook(biffRecord(XL_SCL, []byte{1, 0, 100, 0}))
+	book, err := OpenWorkbookReaderAt(bytes.NewReader(data), int64(len(data)), &OpenWorkbookOptions{OnDemand: true})
+	if err != nil {
+		t.Fatalf("OpenWorkbookReaderAt() failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := book.SheetByIndex(0); err != nil {
+			t.Fatal(err)
+		}
+		if err := book.UnloadSheet(0); err != nil {
+			t.Fatal(err)
+		}
+		if err := book.StreamSheet(0, func(int, []Cell) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := book.Diagnostics(); len(got) != 1 || got[0].Code != DiagSCL {
+		t.Errorf("Book.Diagnostics() after reloading = %+v, want one SCL diagnostic", got)
+	}
+}
@@ -10,7 +10,7 @@ import (
 // outfile: An open file, to which the dump is written.
 // unnumbered: If true, omit offsets (for meaningful diffs).
 func Dump(filename string, outfile io.Writer, unnumbered bool) error {
-	bk, err := OpenWorkbook(filename, nil)
+	bk, err := OpenWorkbook(filename, &OpenWorkbookOptions{OnDemand: true})
 	if err != nil {
 		return err
 	}
@@ -26,7 +26,7 @@ func Dump(filename string, outfile io.Writer, unnumbered bool) error {
 // filename: The path to the file to be summarised.
 // outfile: An open file, to which the summary is written.
 func CountRecords(filename string, outfile io.Writer) error {
-	bk, err := OpenWorkbook(filename, nil)
+	bk, err := OpenWorkbook(filename, &OpenWorkbookOptions{OnDemand: true})
 	if err != nil {
 		return err
 	}
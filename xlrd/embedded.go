@@ -0,0 +1,338 @@
+package xlrd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// EmbeddedObjectType is the kind of an embedded object, which determines
+// what its payload holds.
+type EmbeddedObjectType int
+
+// Embedded object types.
+const (
+	// EmbeddedOLE is an object of another kind. Its payload is its
+	// storage as a compound document.
+	EmbeddedOLE EmbeddedObjectType = iota
+	// EmbeddedPackage is a file packaged by the Object Packager. Its
+	// payload is the file, whose name is in FileName.
+	EmbeddedPackage
+	// EmbeddedOOXML is an Office Open XML document, such as a .docx or
+	// .xlsx file. Its payload is the document's zip archive.
+	EmbeddedOOXML
+	// EmbeddedWord is a Word 97-2003 document. Its payload is a .doc file.
+	EmbeddedWord
+	// EmbeddedExcel is an Excel 97-2003 workbook or chart. Its payload is
+	// an .xls file.
+	EmbeddedExcel
+	// EmbeddedPowerPoint is a PowerPoint 97-2003 presentation. Its payload
+	// is a .ppt file.
+	EmbeddedPowerPoint
+	// EmbeddedPDF is an Acrobat document. Its payload is a .pdf file.
+	EmbeddedPDF
+)
+
+var embeddedObjectTypeNames = [...]string{"ole", "package", "ooxml", "word", "excel", "powerpoint", "pdf"}
+
+func (t EmbeddedObjectType) String() string {
+	if t >= 0 && int(t) < len(embeddedObjectTypeNames) {
+		return embeddedObjectTypeNames[t]
+	}
+	return fmt.Sprintf("EmbeddedObjectType(%d)", int(t))
+}
+
+// EmbeddedObject is an OLE object embedded in a workbook, such as a Word
+// document or a packaged file.
+type EmbeddedObject struct {
+	// Storage is the name of the storage holding the object, such as
+	// "MBD0012A3B4".
+	Storage string
+
+	Type  EmbeddedObjectType
+	CLSID CLSID
+
+	// ClassName is the class name recorded by the OBJ record, such as
+	// "Word.Document.8", and FileName the name of a packaged file.
+	ClassName string
+	FileName  string
+
+	// Sheet is the name of the sheet whose OBJ record anchors the object,
+	// and ObjectID the id of that record. Sheet is "" when the record has
+	// not been found, because its sheet is not a loaded worksheet.
+	Sheet    string
+	ObjectID int
+
+	// Anchor gives the cells covered by the object's shape, or is nil if
+	// unknown.
+	Anchor *MSODrawing
+
+	book *Book
+}
+
+// Open reads the payload of the object and returns a reader for it.
+//
+// The payload is not kept by the book: each call reads it again from the
+// source the workbook was opened from. That is the FileContents slice or
+// the io.ReaderAt given to OpenWorkbookReaderAt, or, for a workbook opened
+// from a path, the file itself, which Open opens again by that path. Open
+// fails if the path no longer names the same file, or if the file's size
+// or modification time has changed since the workbook was opened.
+//
+// The size of the streams holding the payload is checked against what is
+// left of Limits.MaxAllocBytes before they are read.
+func (o *EmbeddedObject) Open() (_ io.Reader, err error) {
+	defer recoverParseError(&err)
+	b := o.book
+	if b == nil || b.embeddedDoc == nil {
+		return nil, newXLRDError(ErrStreamNotFound, "No storage %q in compound document", o.Storage)
+	}
+	b.embeddedMu.Lock()
+	defer b.embeddedMu.Unlock()
+	cd, release, err := b.embeddedDoc()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := checkLimit("MaxAllocBytes", b.limits.MaxAllocBytes, b.allocated.Load()+embeddedPayloadSize(cd, o.Storage, o.Type)); err != nil {
+		return nil, err
+	}
+	payload, err := readEmbeddedPayload(cd, o.Storage, o.Type)
+	if err != nil {
+		return nil, err
+	}
+	// The payload belongs to the caller, but must fit in what is left of
+	// the budget.
+	if err := checkLimit("MaxAllocBytes", b.limits.MaxAllocBytes, b.allocated.Load()+int64(len(payload))); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(payload), nil
+}
+
+// EmbeddedObjects returns the OLE objects embedded in the workbook, in
+// the order of their storages. The OBJ records anchoring them are only
+// known for worksheets that are loaded.
+func (b *Book) EmbeddedObjects() []EmbeddedObject {
+	objs := append([]EmbeddedObject(nil), b.embeddedObjects...)
+	index := make(map[string]int, len(objs))
+	for i, o := range objs {
+		index[strings.ToUpper(o.Storage)] = i
+	}
+	b.mu.Lock()
+	sheets := append([]*Sheet(nil), b.sheetList...)
+	b.mu.Unlock()
+	for _, sh := range sheets {
+		if sh == nil {
+			continue
+		}
+		for _, ref := range sh.embeddedRefs {
+			i, ok := index[ref.obj.storage]
+			if !ok {
+				continue
+			}
+			objs[i].Sheet = sh.Name
+			objs[i].ObjectID = ref.obj.ID
+			objs[i].ClassName = ref.obj.className
+			objs[i].Anchor = ref.anchor
+		}
+	}
+	return objs
+}
+
+// readEmbeddedObjects describes the objects held in the "MBD" storages of
+// cd; their payloads are read by EmbeddedObject.Open. An object that
+// cannot be described is skipped with a diagnostic.
+func (b *Book) readEmbeddedObjects(cd *CompDoc) {
+	if len(cd.dirList) == 0 {
+		return
+	}
+	for _, did := range cd.dirList[0].Children {
+		d := cd.dirList[did]
+		if d.EType != DirStorage || !strings.HasPrefix(strings.ToUpper(d.Name), "MBD") {
+			continue
+		}
+		o, err := describeEmbeddedObject(cd, d)
+		if err != nil {
+			b.addDiagnostic(Diagnostic{
+				Severity: SeverityWarning,
+				Code:     DiagEmbeddedObject,
+				Opcode:   -1,
+				Offset:   -1,
+				Message:  fmt.Sprintf("Can't read embedded object %s: %v", d.Name, err),
+			})
+			continue
+		}
+		o.book = b
+		b.embeddedObjects = append(b.embeddedObjects, o)
+	}
+}
+
+// ole10NativePrefix is the part of an "\x01Ole10Native" stream read to find
+// the name of the packaged file.
+const ole10NativePrefix = 64 << 10
+
+// describeEmbeddedObject detects the type of the object in storage d from
+// the streams it holds, reading only the start of the stream of a
+// packaged file for its name.
+func describeEmbeddedObject(cd *CompDoc, d *DirNode) (EmbeddedObject, error) {
+	o := EmbeddedObject{Storage: d.Name, CLSID: d.CLSID}
+	stream := func(name string) *DirNode {
+		if s := cd.dirSearch([]string{d.Name, name}, 0); s != nil && s.EType == DirStream {
+			return s
+		}
+		return nil
+	}
+
+	if s := stream("\x01Ole10Native"); s != nil {
+		data, err := cd.readStreamPrefix(s, ole10NativePrefix)
+		if err != nil {
+			return o, err
+		}
+		o.Type = EmbeddedPackage
+		o.FileName, _, _, err = parseOle10NativeHeader(data, s.TotSize)
+		return o, err
+	}
+	if stream("Package") != nil {
+		o.Type = EmbeddedOOXML
+		return o, nil
+	}
+	if s := stream("CONTENTS"); s != nil {
+		data, err := cd.readStreamPrefix(s, 4)
+		if err != nil {
+			return o, err
+		}
+		if bytes.HasPrefix(data, []byte("%PDF")) {
+			o.Type = EmbeddedPDF
+			return o, nil
+		}
+	}
+
+	o.Type = EmbeddedOLE
+	for _, kind := range []struct {
+		stream string
+		typ    EmbeddedObjectType
+	}{
+		{"WordDocument", EmbeddedWord},
+		{"Workbook", EmbeddedExcel},
+		{"Book", EmbeddedExcel},
+		{"PowerPoint Document", EmbeddedPowerPoint},
+	} {
+		if cd.dirSearch([]string{d.Name, kind.stream}, 0) != nil {
+			o.Type = kind.typ
+			break
+		}
+	}
+	return o, nil
+}
+
+// embeddedPayloadSize returns the total size of the streams that
+// readEmbeddedPayload reads for the object of type typ in the storage with
+// the given name.
+func embeddedPayloadSize(cd *CompDoc, storage string, typ EmbeddedObjectType) int64 {
+	var name string
+	switch typ {
+	case EmbeddedPackage:
+		name = "\x01Ole10Native"
+	case EmbeddedOOXML:
+		name = "Package"
+	case EmbeddedPDF:
+		name = "CONTENTS"
+	}
+	if name != "" {
+		if d := cd.dirSearch([]string{storage, name}, 0); d != nil {
+			return int64(d.TotSize)
+		}
+		return 0
+	}
+	st := cd.dirSearch([]string{storage}, 0)
+	if st == nil {
+		return 0
+	}
+	var size int64
+	var add func(d *DirNode)
+	add = func(d *DirNode) {
+		for _, did := range d.Children {
+			switch c := cd.dirList[did]; c.EType {
+			case DirStream:
+				size += int64(c.TotSize)
+			case DirStorage:
+				add(c)
+			}
+		}
+	}
+	add(st)
+	return size
+}
+
+// readEmbeddedPayload reads the payload of the object of type typ in the
+// storage with the given name.
+func readEmbeddedPayload(cd *CompDoc, storage string, typ EmbeddedObjectType) ([]byte, error) {
+	switch typ {
+	case EmbeddedPackage:
+		data, err := cd.OpenStream(storage, "\x01Ole10Native")
+		if err != nil {
+			return nil, err
+		}
+		_, contents, err := parseOle10Native(data)
+		return contents, err
+	case EmbeddedOOXML:
+		return cd.OpenStream(storage, "Package")
+	case EmbeddedPDF:
+		return cd.OpenStream(storage, "CONTENTS")
+	}
+	return cd.ExtractStorage(storage)
+}
+
+// parseOle10Native returns the name and contents of the file in an
+// "\x01Ole10Native" stream.
+func parseOle10Native(data []byte) (name string, contents []byte, err error) {
+	name, pos, size, err := parseOle10NativeHeader(data, len(data))
+	if err != nil {
+		return "", nil, err
+	}
+	return name, data[pos : pos+size], nil
+}
+
+// parseOle10NativeHeader returns the name of the file in an
+// "\x01Ole10Native" stream of total bytes, as written by the Object
+// Packager, and the position and size of its contents; data is the start
+// of the stream, at least up to the contents. The stream holds its size,
+// flags, the file's label and path, flags, the path of a temporary copy,
+// and the contents.
+func parseOle10NativeHeader(data []byte, total int) (name string, pos, size int, err error) {
+	pos = 6
+	cstring := func() (string, error) {
+		if pos > len(data) {
+			return "", errors.New("Ole10Native stream truncated")
+		}
+		i := bytes.IndexByte(data[pos:], 0)
+		if i < 0 {
+			return "", errors.New("Ole10Native stream truncated")
+		}
+		s := decodeCodepage(data[pos:pos+i], 1252)
+		pos += i + 1
+		return s, nil
+	}
+	if name, err = cstring(); err != nil {
+		return "", 0, 0, err
+	}
+	if _, err = cstring(); err != nil {
+		return "", 0, 0, err
+	}
+	pos += 8
+	if _, err = cstring(); err != nil {
+		return "", 0, 0, err
+	}
+	if pos+4 > len(data) {
+		return "", 0, 0, errors.New("Ole10Native stream truncated")
+	}
+	size = int(binary.LittleEndian.Uint32(data[pos:]))
+	pos += 4
+	if size < 0 || size > total-pos {
+		return "", 0, 0, fmt.Errorf("Ole10Native file size %d out of range", size)
+	}
+	return name, pos, size, nil
+}
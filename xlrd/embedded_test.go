@@ -0,0 +1,307 @@
+package xlrd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// embeddedObjRecords returns the MSO_DRAWING record anchoring a shape at
+// the given cells and the OBJ record of an embedded object of the given
+// class held in storage MBD<id>.
+func embeddedObjRecords(objID int, id uint32, className string, rowLo, colLo, rowHi, colHi int) []byte {
+	anchor := make([]byte, 18)
+	binary.LittleEndian.PutUint16(anchor[2:4], uint16(colLo))
+	binary.LittleEndian.PutUint16(anchor[6:8], uint16(rowLo))
+	binary.LittleEndian.PutUint16(anchor[10:12], uint16(colHi))
+	binary.LittleEndian.PutUint16(anchor[14:16], uint16(rowHi))
+	officeArt := func(ver uint16, fbt uint16, data []byte) []byte {
+		rec := binary.LittleEndian.AppendUint16(nil, ver)
+		rec = binary.LittleEndian.AppendUint16(rec, fbt)
+		rec = binary.LittleEndian.AppendUint32(rec, uint32(len(data)))
+		return append(rec, data...)
+	}
+	sp := officeArt(0, 0xF00A, make([]byte, 8))
+	sp = append(sp, officeArt(0, 0xF010, anchor)...)
+	sp = append(sp, officeArt(0, 0xF011, nil)...)
+	drawing := officeArt(0x000F, 0xF004, sp)
+
+	subrecord := func(ft uint16, data []byte) []byte {
+		rec := binary.LittleEndian.AppendUint16(nil, ft)
+		rec = binary.LittleEndian.AppendUint16(rec, uint16(len(data)))
+		return append(rec, data...)
+	}
+	cmo := make([]byte, 18)
+	binary.LittleEndian.PutUint16(cmo[0:2], 0x08)
+	binary.LittleEndian.PutUint16(cmo[2:4], uint16(objID))
+	fmla := []byte{5, 0, 0, 0, 0, 0, 0x02, 0, 0, 0, 0, 0x03, byte(len(className)), 0, 0}
+	fmla = append(fmla, className...)
+	if len(fmla)%2 != 0 {
+		fmla = append(fmla, 0)
+	}
+	pictFmla := binary.LittleEndian.AppendUint16(nil, uint16(len(fmla)))
+	pictFmla = append(pictFmla, fmla...)
+	pictFmla = binary.LittleEndian.AppendUint32(pictFmla, id)
+	obj := subrecord(0x15, cmo)
+	obj = append(obj, subrecord(0x08, []byte{0x01, 0x00})...)
+	obj = append(obj, subrecord(0x09, pictFmla)...)
+	obj = append(obj, subrecord(0x00, nil)...)
+
+	return append(biffRecord(XL_MSO_DRAWING, drawing), biffRecord(XL_OBJ, obj)...)
+}
+
+// ole10Native returns an "\x01Ole10Native" stream packaging a file.
+func ole10Native(name string, contents []byte) []byte {
+	var data []byte
+	data = append(data, 2, 0)
+	data = append(data, name+"\x00"...)
+	data = append(data, `C:\`+name+"\x00"...)
+	data = append(data, 0, 0, 3, 0)
+	tmp := `C:\Temp\` + name + "\x00"
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(tmp)))
+	data = append(data, tmp...)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(contents)))
+	data = append(data, contents...)
+	return append(binary.LittleEndian.AppendUint32(nil, uint32(len(data))), data...)
+}
+
+func TestEmbeddedObjects(t *testing.T) {
+	word := bytes.Repeat([]byte("WordDocument"), 500)
+	data := compoundFile(map[string][]byte{
+		"Workbook":                    biff8Workbook(embeddedObjRecords(3, 0x00A1B2C3, "Package", 1, 2, 5, 4)),
+		"MBD00A1B2C3/\x01Ole10Native": ole10Native("notes.txt", []byte("hello")),
+		"MBD00A1B2C3/\x01CompObj":     []byte("compobj"),
+		"MBD00D4E5F6/WordDocument":    word,
+		"MBD00D4E5F6/1Table":          []byte("table"),
+		"MBD00D4E5F6/ObjectPool/_1/x": []byte("nested"),
+		"MBD00000007/\x01Ole10Native": []byte("corrupt"),
+		"_VBA_PROJECT_CUR/VBA/dir":    []byte("not an embedded object"),
+	})
+	book, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data})
+	if err != nil {
+		t.Fatalf("OpenWorkbook() failed: %v", err)
+	}
+	objs := book.EmbeddedObjects()
+	if len(objs) != 2 {
+		t.Fatalf("EmbeddedObjects() returned %d objects, want 2", len(objs))
+	}
+
+	pkg := objs[0]
+	if pkg.Storage != "MBD00A1B2C3" || pkg.Type != EmbeddedPackage || pkg.FileName != "notes.txt" || pkg.ClassName != "Package" {
+		t.Errorf("package = %+v", pkg)
+	}
+	if pkg.Sheet != "Sheet1" || pkg.ObjectID != 3 {
+		t.Errorf("package Sheet, ObjectID = %q, %d, want Sheet1, 3", pkg.Sheet, pkg.ObjectID)
+	}
+	if a := pkg.Anchor; a == nil || a.AnchorRowLo != 1 || a.AnchorColLo != 2 || a.AnchorRowHi != 5 || a.AnchorColHi != 4 {
+		t.Errorf("package Anchor = %+v, want rows 1-5, columns 2-4", a)
+	}
+	if got := readPayload(t, pkg); string(got) != "hello" {
+		t.Errorf("package payload = %q, want hello", got)
+	}
+
+	doc := objs[1]
+	if doc.Storage != "MBD00D4E5F6" || doc.Type != EmbeddedWord || doc.Sheet != "" || doc.Anchor != nil {
+		t.Errorf("document = %+v", doc)
+	}
+	cd, err := NewCompDoc(readPayload(t, doc), nil, 0, false)
+	if err != nil {
+		t.Fatalf("NewCompDoc(payload) failed: %v", err)
+	}
+	for path, want := range map[string]string{"WordDocument": string(word), "1Table": "table", "ObjectPool/_1/x": "nested"} {
+		if got, err := cd.OpenStream(strings.Split(path, "/")...); err != nil || string(got) != want {
+			t.Errorf("payload OpenStream(%s) = %.20q, %v, want %.20q", path, got, err, want)
+		}
+	}
+
+	n := 0
+	for _, d := range book.Diagnostics() {
+		if d.Code == DiagEmbeddedObject {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("got %d %s diagnostics, want 1", n, DiagEmbeddedObject)
+	}
+}
+
+// readPayload returns the payload of o.
+func readPayload(t *testing.T, o EmbeddedObject) []byte {
+	t.Helper()
+	r, err := o.Open()
+	if err != nil {
+		t.Fatalf("Open() of %s failed: %v", o.Storage, err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestEmbeddedObjectsFile(t *testing.T) {
+	data := compoundFile(map[string][]byte{
+		"Workbook":                    biff8Workbook(embeddedObjRecords(3, 0x00A1B2C3, "Package", 1, 2, 5, 4)),
+		"MBD00A1B2C3/\x01Ole10Native": ole10Native("notes.txt", []byte("hello")),
+	})
+	path := filepath.Join(t.TempDir(), "embedded.xls")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, mmap := range []bool{false, true} {
+		book, err := OpenWorkbook(path, &OpenWorkbookOptions{UseMmap: mmap})
+		if err != nil {
+			t.Fatalf("OpenWorkbook(UseMmap: %v) failed: %v", mmap, err)
+		}
+		book.ReleaseResources()
+		objs := book.EmbeddedObjects()
+		if len(objs) != 1 || objs[0].FileName != "notes.txt" {
+			t.Fatalf("EmbeddedObjects() = %+v, want notes.txt", objs)
+		}
+		// The payload is read from the file when it is opened.
+		if got := readPayload(t, objs[0]); string(got) != "hello" {
+			t.Errorf("payload with UseMmap %v = %q, want hello", mmap, got)
+		}
+	}
+
+	book, err := OpenWorkbook(path, nil)
+	if err != nil {
+		t.Fatalf("OpenWorkbook() failed: %v", err)
+	}
+	if err := os.WriteFile(path, data[:len(data)-512], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := book.EmbeddedObjects()[0].Open(); err == nil {
+		t.Error("Open() after the file was truncated succeeded")
+	}
+
+	// A file of the same size put in place of the workbook, or the
+	// workbook modified in place, is not read either.
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	book, err = OpenWorkbook(path, nil)
+	if err != nil {
+		t.Fatalf("OpenWorkbook() failed: %v", err)
+	}
+	other := filepath.Join(t.TempDir(), "other.xls")
+	if err := os.WriteFile(other, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(other, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(other, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := book.EmbeddedObjects()[0].Open(); err == nil {
+		t.Error("Open() after the file was replaced succeeded")
+	}
+	book, err = OpenWorkbook(path, nil)
+	if err != nil {
+		t.Fatalf("OpenWorkbook() failed: %v", err)
+	}
+	later := fi.ModTime().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := book.EmbeddedObjects()[0].Open(); err == nil {
+		t.Error("Open() after the file was modified succeeded")
+	}
+}
+
+func TestEmbeddedObjectsLimit(t *testing.T) {
+	data := compoundFile(map[string][]byte{
+		"Workbook":                    biff8Workbook(),
+		"MBD00A1B2C3/\x01Ole10Native": ole10Native("notes.txt", []byte("hello")),
+	})
+	book, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data})
+	if err != nil {
+		t.Fatalf("OpenWorkbook() failed: %v", err)
+	}
+	objs := book.EmbeddedObjects()
+	if len(objs) != 1 {
+		t.Fatalf("EmbeddedObjects() returned %d objects, want 1", len(objs))
+	}
+	// The packaged file fits in the budget, but the stream holding it is
+	// checked before it is read.
+	book.limits.MaxAllocBytes = book.allocated.Load() + 10
+	_, err = objs[0].Open()
+	var le *LimitError
+	if !errors.As(err, &le) || le.Limit != "MaxAllocBytes" {
+		t.Errorf("Open() error = %v, want MaxAllocBytes LimitError", err)
+	}
+	book.limits.MaxAllocBytes = 0
+	if got := readPayload(t, objs[0]); string(got) != "hello" {
+		t.Errorf("payload = %q, want hello", got)
+	}
+}
+
+func TestEmbeddedObjectsNoStorage(t *testing.T) {
+	// Without formatting information, OBJ records are only read to anchor
+	// embedded objects, and a workbook that is not a compound document
+	// has none.
+	data := biff8Workbook(embeddedObjRecords(3, 0x00A1B2C3, "Package", 1, 2, 5, 4))
+	for _, fmtInfo := range []bool{false, true} {
+		book, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data, FormattingInfo: fmtInfo})
+		if err != nil {
+			t.Fatalf("OpenWorkbook() failed: %v", err)
+		}
+		sheet, err := book.SheetByIndex(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(sheet.embeddedRefs) > 0; got != fmtInfo {
+			t.Errorf("FormattingInfo %v: OBJ records read = %v, want %v", fmtInfo, got, fmtInfo)
+		}
+	}
+}
+
+func TestWriteCompDoc(t *testing.T) {
+	root := &cdfEntry{DirNode: &DirNode{Name: "Root Entry", EType: DirRoot, CLSID: CLSID{1, 2, 3}}}
+	entries := []*cdfEntry{root}
+	want := make(map[string][]byte)
+	for i, size := range []int{0, 1, 64, 65, 4095, 4096, 8 << 20, 10, 100, 1000} {
+		name := fmt.Sprintf("%s%d", strings.Repeat("s", 10-i), i)
+		data := bytes.Repeat([]byte{byte(i + 1)}, size)
+		entries = append(entries, &cdfEntry{DirNode: &DirNode{Name: name, EType: DirStream}, data: data})
+		root.kids = append(root.kids, len(entries)-1)
+		want[name] = data
+	}
+	cd, err := NewCompDoc(writeCompDoc(entries), nil, 0, false)
+	if err != nil {
+		t.Fatalf("NewCompDoc() failed: %v", err)
+	}
+	if diags := cd.Diagnostics(); len(diags) != 0 {
+		t.Errorf("Diagnostics() = %v", diags)
+	}
+	if got := cd.Entries()[0].CLSID; got != root.CLSID {
+		t.Errorf("root CLSID = %v, want %v", got, root.CLSID)
+	}
+	for name, data := range want {
+		if got, err := cd.OpenStream(name); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("OpenStream(%s) returned %d bytes, %v, want %d bytes", name, len(got), err, len(data))
+		}
+	}
+
+	// The directory tree is ordered by name length, then name.
+	var prev string
+	cd.Walk(func(path []string, entry DirNode) error {
+		if name := entry.Name; len(name) < len(prev) || len(name) == len(prev) && name < prev {
+			t.Errorf("Walk() visited %q after %q", name, prev)
+		}
+		prev = entry.Name
+		return nil
+	})
+}
@@ -0,0 +1,203 @@
+package xlrd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Sentinel errors classifying the failures reported by this package.
+// Test for them with errors.Is; the returned errors are *XLRDError,
+// *CompDocError, *FormulaError, *XLDateError, *UnsupportedFormatError,
+// *LimitError, *RecalcError or *NameRefError values that keep the detailed
+// message.
+var (
+	// ErrEncrypted is reported for workbooks protected by a password, when
+	// no password is given or the encryption method is not supported.
+	ErrEncrypted = errors.New("xlrd: workbook is encrypted")
+	// ErrWrongPassword is reported when the password given for an
+	// encrypted workbook is wrong.
+	ErrWrongPassword = errors.New("xlrd: wrong password")
+	// ErrUnsupportedFormat is reported for files that are not BIFF
+	// workbooks, such as xlsx, ods or workspace files.
+	ErrUnsupportedFormat = errors.New("xlrd: unsupported file format")
+	// ErrUnsupportedBIFF is reported for unknown or unsupported BIFF versions.
+	ErrUnsupportedBIFF = errors.New("xlrd: unsupported BIFF version")
+	// ErrCorruptCompDoc is reported for damaged OLE2 compound documents.
+	ErrCorruptCompDoc = errors.New("xlrd: corrupt OLE2 compound document")
+	// ErrCorruptRecord is reported for BIFF records that cannot be parsed.
+	ErrCorruptRecord = errors.New("xlrd: corrupt BIFF record")
+	// ErrMalformedFormula is reported for formulas that cannot be decoded.
+	ErrMalformedFormula = errors.New("xlrd: malformed formula")
+	// ErrStreamNotFound is reported when a stream does not exist in a
+	// compound document.
+	ErrStreamNotFound = errors.New("xlrd: stream not found")
+	// ErrSheetNotFound is reported when a sheet name or index does not exist.
+	ErrSheetNotFound = errors.New("xlrd: sheet not found")
+	// ErrResourcesReleased is reported when sheets are loaded after
+	// Book.ReleaseResources.
+	ErrResourcesReleased = errors.New("xlrd: resources released")
+	// ErrInvalidDate is reported by the xldate conversion functions.
+	ErrInvalidDate = errors.New("xlrd: invalid date")
+	// ErrLimitExceeded is reported when a workbook exceeds one of the
+	// Limits given in OpenWorkbookOptions.
+	ErrLimitExceeded = errors.New("xlrd: resource limit exceeded")
+	// ErrUnsupportedFunction is reported when a formula being evaluated
+	// calls a function, or uses a feature such as a reference to another
+	// workbook, that the evaluator does not implement.
+	ErrUnsupportedFunction = errors.New("xlrd: unsupported function")
+	// ErrCircularReference is reported when a formula being evaluated
+	// depends on its own result.
+	ErrCircularReference = errors.New("xlrd: circular reference")
+	// ErrNotReference is reported by Name.Cell and Name.Area2D for names
+	// that do not refer to one area of a sheet in the workbook.
+	ErrNotReference = errors.New("xlrd: name is not a reference to one area")
+)
+
+// UnsupportedFormatError tells that a file is recognised as a format this
+// package does not read. It matches ErrUnsupportedFormat. OpenWorkbook
+// returns it wrapped in an *XLRDError with the same message, so get it with
+// errors.As.
+type UnsupportedFormatError struct {
+	// Format is the result of InspectFormat, such as "xlsx" or "ods".
+	Format string
+}
+
+func (e *UnsupportedFormatError) Error() string {
+	return fmt.Sprintf("%s; not supported", FileFormatDescriptions[e.Format])
+}
+
+// Is reports whether target is ErrUnsupportedFormat.
+func (e *UnsupportedFormatError) Is(target error) bool {
+	return target == ErrUnsupportedFormat
+}
+
+// unsupportedFormatError returns the *XLRDError reported for a file in
+// format, wrapping an *UnsupportedFormatError.
+func unsupportedFormatError(format string) *XLRDError {
+	ufe := &UnsupportedFormatError{Format: format}
+	e := NewXLRDError("%s", ufe.Error())
+	e.Err = ufe
+	return e
+}
+
+// RecalcError is returned by Book.Recalculate when formulas could not be
+// evaluated; their cells keep the results cached by Excel. It matches the
+// errors of those cells, such as ErrUnsupportedFunction.
+type RecalcError struct {
+	// Cells maps each cell not recalculated, such as "Sheet1!B2", to the
+	// error evaluating its formula.
+	Cells map[string]error
+	// Unsupported lists the functions called by those formulas that the
+	// evaluator does not implement, sorted by name.
+	Unsupported []string
+}
+
+func (e *RecalcError) Error() string {
+	msg := fmt.Sprintf("xlrd: %d formulas not recalculated", len(e.Cells))
+	if len(e.Unsupported) > 0 {
+		msg += "; unsupported functions: " + strings.Join(e.Unsupported, ", ")
+	}
+	return msg
+}
+
+// Unwrap returns the errors of the cells not recalculated.
+func (e *RecalcError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Cells))
+	for _, err := range e.Cells {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// NameRefProblem tells why a defined name cannot be resolved to cells.
+type NameRefProblem int
+
+// Reasons for a NameRefError.
+const (
+	// NameNotReference is a name whose formula gives a value, such as a
+	// constant, rather than a reference.
+	NameNotReference NameRefProblem = iota
+	// NameMultiArea is a name referring to several areas, or to an area on
+	// several sheets.
+	NameMultiArea
+	// NameRelative is a name whose reference is relative to the cell using
+	// it.
+	NameRelative
+	// NameExternal is a name referring to cells of another workbook.
+	NameExternal
+	// NameBadSheet is a name referring to a deleted sheet or a macro sheet.
+	NameBadSheet
+	// NameNotCell is a name given to Name.Cell that refers to an area of
+	// more than one cell.
+	NameNotCell
+)
+
+var nameRefProblemTexts = [...]string{
+	"is not a reference",
+	"refers to several areas or sheets",
+	"holds a relative reference",
+	"refers to another workbook",
+	"refers to a deleted or macro sheet",
+	"does not refer to a single cell",
+}
+
+// NameRefError is returned by Name.Cell and Name.Area2D when a name cannot
+// be resolved to cells of a sheet. It matches ErrNotReference.
+type NameRefError struct {
+	// Name is the name of the defined name.
+	Name    string
+	Problem NameRefProblem
+}
+
+func (e *NameRefError) Error() string {
+	text := "is not usable"
+	if e.Problem >= 0 && int(e.Problem) < len(nameRefProblemTexts) {
+		text = nameRefProblemTexts[e.Problem]
+	}
+	return fmt.Sprintf("xlrd: name %q %s", e.Name, text)
+}
+
+// Is reports whether target is ErrNotReference.
+func (e *NameRefError) Is(target error) bool {
+	return target == ErrNotReference
+}
+
+// newXLRDError creates an XLRDError classified by the sentinel kind.
+func newXLRDError(kind error, format string, args ...interface{}) *XLRDError {
+	e := NewXLRDError(format, args...)
+	e.Err = kind
+	return e
+}
+
+// newRecordError creates an XLRDError classified by kind for the record
+// with the given opcode at offset in the Workbook stream.
+func newRecordError(kind error, opcode, offset int, format string, args ...interface{}) *XLRDError {
+	e := newXLRDError(kind, format, args...)
+	e.HasRecord = true
+	e.Opcode = opcode
+	e.Offset = offset
+	return e
+}
+
+// recordError adds the opcode and stream offset of the record being parsed
+// to err. An *XLRDError without record context is updated in place; other
+// errors are wrapped so that errors.Is and errors.As still see them.
+func recordError(err error, opcode, offset int) error {
+	if err == nil {
+		return nil
+	}
+	if xe, ok := err.(*XLRDError); ok {
+		if !xe.HasRecord {
+			xe.HasRecord = true
+			xe.Opcode = opcode
+			xe.Offset = offset
+		}
+		return xe
+	}
+	var xe *XLRDError
+	if errors.As(err, &xe) && xe.HasRecord {
+		return err
+	}
+	return &XLRDError{Message: err.Error(), Err: err, HasRecord: true, Opcode: opcode, Offset: offset}
+}
@@ -0,0 +1,103 @@
+package xlrd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestErrorsUnsupportedFormat(t *testing.T) {
+	_, err := OpenWorkbook(fromSample("sample.xlsx"), nil)
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("OpenWorkbook(sample.xlsx) error = %v, want ErrUnsupportedFormat", err)
+	}
+	var ufe *UnsupportedFormatError
+	if !errors.As(err, &ufe) || ufe.Format != "xlsx" {
+		t.Errorf("OpenWorkbook(sample.xlsx) error = %#v, want UnsupportedFormatError with Format xlsx", err)
+	}
+	xe, ok := err.(*XLRDError)
+	if !ok || xe.Error() != ufe.Error() {
+		t.Errorf("OpenWorkbook(sample.xlsx) error = %#v, want *XLRDError with message %q", err, ufe.Error())
+	}
+	data, err := os.ReadFile(fromSample("sample.ods"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenWorkbookReaderAt(bytes.NewReader(data), int64(len(data)), nil)
+	if !errors.As(err, &xe) || !errors.As(err, &ufe) || ufe.Format != "ods" {
+		t.Errorf("OpenWorkbookReaderAt(sample.ods) error = %#v, want *XLRDError wrapping UnsupportedFormatError with Format ods", err)
+	}
+}
+
+func TestErrorsSheetNotFound(t *testing.T) {
+	book, err := OpenWorkbook(fromSample("profiles.xls"), &OpenWorkbookOptions{OnDemand: true})
+	if err != nil {
+		t.Fatalf("Failed to open workbook: %v", err)
+	}
+	if _, err := book.SheetByName("no such sheet"); !errors.Is(err, ErrSheetNotFound) {
+		t.Errorf("SheetByName() error = %v, want ErrSheetNotFound", err)
+	}
+	if _, err := book.SheetByIndex(99); !errors.Is(err, ErrSheetNotFound) {
+		t.Errorf("SheetByIndex(99) error = %v, want ErrSheetNotFound", err)
+	}
+	book.ReleaseResources()
+	if _, err := book.SheetByIndex(1); !errors.Is(err, ErrResourcesReleased) {
+		t.Errorf("SheetByIndex(1) after ReleaseResources error = %v, want ErrResourcesReleased", err)
+	}
+}
+
+func TestErrorsEncrypted(t *testing.T) {
+	data := append(biff8BOF(XL_WORKBOOK_GLOBALS), biffRecord(XL_FILEPASS, make([]byte, 6))...)
+	_, err := OpenWorkbookReaderAt(bytes.NewReader(data), int64(len(data)), &OpenWorkbookOptions{Logfile: io.Discard})
+	if !errors.Is(err, ErrEncrypted) {
+		t.Fatalf("OpenWorkbookReaderAt() error = %v, want ErrEncrypted", err)
+	}
+	var xe *XLRDError
+	if !errors.As(err, &xe) || xe.Opcode != XL_FILEPASS || xe.Offset != 20 {
+		t.Errorf("OpenWorkbookReaderAt() error = %#v, want FILEPASS record at offset 20", err)
+	}
+}
+
+func TestErrorsCorruptRecord(t *testing.T) {
+	data := biffRecord(0x1234, make([]byte, 4))
+	_, err := OpenWorkbookReaderAt(bytes.NewReader(data), int64(len(data)), &OpenWorkbookOptions{Logfile: io.Discard})
+	if !errors.Is(err, ErrCorruptRecord) {
+		t.Fatalf("OpenWorkbookReaderAt() error = %v, want ErrCorruptRecord", err)
+	}
+	var xe *XLRDError
+	if !errors.As(err, &xe) || xe.Opcode != 0x1234 || xe.Offset != 0 {
+		t.Errorf("OpenWorkbookReaderAt() error = %#v, want record 0x1234 at offset 0", err)
+	}
+}
+
+func TestXLRDErrorWithoutRecord(t *testing.T) {
+	for _, e := range []*XLRDError{{Message: "bad"}, NewXLRDError("bad")} {
+		if got := e.Error(); got != "bad" {
+			t.Errorf("%#v.Error() = %q, want %q", e, got, "bad")
+		}
+	}
+	e := newRecordError(ErrCorruptRecord, 0, 4, "bad")
+	if got, want := e.Error(), "bad (record 0x0000 "+recordName(0)+" at offset 4)"; got != want {
+		t.Errorf("newRecordError(0, 4).Error() = %q, want %q", got, want)
+	}
+}
+
+func TestErrorsCorruptCompDoc(t *testing.T) {
+	_, err := OpenWorkbook(fromSample("corrupted_error.xls"), &OpenWorkbookOptions{Logfile: io.Discard})
+	if !errors.Is(err, ErrCorruptCompDoc) {
+		t.Errorf("OpenWorkbook(corrupted_error.xls) error = %v, want ErrCorruptCompDoc", err)
+	}
+}
+
+func TestErrorsInvalidDate(t *testing.T) {
+	_, _, _, _, _, _, err := XldateAsTuple(-1, 0)
+	if !errors.Is(err, ErrInvalidDate) {
+		t.Errorf("XldateAsTuple(-1, 0) error = %v, want ErrInvalidDate", err)
+	}
+	var neg *XLDateNegative
+	if !errors.As(err, &neg) {
+		t.Errorf("XldateAsTuple(-1, 0) error = %T, want *XLDateNegative", err)
+	}
+}
@@ -0,0 +1,1117 @@
+package xlrd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The evaluator works on the token arrays of formulas. The values it
+// computes are nil for an empty cell, a float64, string or bool, an
+// evalError, or an evalRef for a reference to cells, which operators and
+// functions dereference as they need. evalMissing stands for an omitted
+// function argument.
+
+// evalError is an Excel error value, such as #DIV/0!, identified by its
+// code as in errorTextFromCode. It implements error so that the helpers
+// converting arguments can return it; the evaluator turns it back into a
+// value.
+type evalError int
+
+// Excel error values.
+const (
+	errNull  evalError = 0x00
+	errDiv0  evalError = 0x07
+	errValue evalError = 0x0F
+	errRef   evalError = 0x17
+	errName  evalError = 0x1D
+	errNum   evalError = 0x24
+	errNA    evalError = 0x2A
+)
+
+func (e evalError) Error() string {
+	return errorTextFromCode[int(e)]
+}
+
+// evalArea is a rectangle of cells on sheet shx; the rows r1 to r2 and the
+// columns c1 to c2 are half-open ranges.
+type evalArea struct {
+	shx, r1, r2, c1, c2 int
+}
+
+// evalRef is a reference to one or more areas.
+type evalRef []evalArea
+
+// evalMissing is an argument left out of a function call.
+type evalMissing struct{}
+
+// evalFuncName is the name of an add-in or newer function, such as
+// IFERROR, passed as the first argument of a CALL_ADDIN call.
+type evalFuncName string
+
+// evalCell identifies a cell of the book.
+type evalCell struct {
+	shx, rowx, colx int
+}
+
+// evaluator evaluates the formulas of a book. Results are cached for its
+// lifetime, so that each formula is evaluated once.
+type evaluator struct {
+	book *Book
+
+	// values and errs cache the result of each formula cell evaluated, and
+	// active holds the cells being evaluated, to detect circular
+	// references.
+	values map[evalCell]interface{}
+	errs   map[evalCell]error
+	active map[evalCell]bool
+
+	// cur is the formula cell being evaluated, which relative references
+	// and implicit intersections are resolved against.
+	cur evalCell
+
+	// unsupported collects the names of the functions that could not be
+	// evaluated.
+	unsupported map[string]bool
+}
+
+func newEvaluator(b *Book) *evaluator {
+	return &evaluator{
+		book:        b,
+		values:      make(map[evalCell]interface{}),
+		errs:        make(map[evalCell]error),
+		active:      make(map[evalCell]bool),
+		unsupported: make(map[string]bool),
+	}
+}
+
+// EvaluateCell computes the value of the cell at the given row and column
+// from its formula. The formulas it depends on are evaluated as well,
+// rather than taking the results Excel cached for them, and sheets they
+// refer to are loaded if needed. A cell without a formula gives its stored
+// value. The error matches ErrUnsupportedFunction for formulas using
+// functions or features the evaluator lacks, and ErrCircularReference for
+// formulas that depend on themselves.
+func (s *Sheet) EvaluateCell(rowx, colx int) (*Cell, error) {
+	e := newEvaluator(s.Book)
+	v, err := e.cellValue(s.number, rowx, colx)
+	if err != nil {
+		return nil, err
+	}
+	ctype, value := cellResult(v)
+	if _, ok := s.formulas[[2]int{rowx, colx}]; !ok {
+		ctype, value = s.RawCellType(rowx, colx), s.RawCellValue(rowx, colx)
+	}
+	return &Cell{CType: ctype, Value: value, XFIndex: s.CellXFIndex(rowx, colx)}, nil
+}
+
+// Recalculate evaluates the formulas of the loaded sheets, as EvaluateCell
+// does, and stores their results in place of those cached by Excel. Cells
+// whose formula cannot be evaluated keep their cached result; each gets a
+// "formula" diagnostic, and a *RecalcError lists them. Recalculate must
+// not run concurrently with other uses of the book.
+func (b *Book) Recalculate() error {
+	e := newEvaluator(b)
+	b.mu.Lock()
+	sheets := append([]*Sheet(nil), b.sheetList...)
+	b.mu.Unlock()
+
+	type result struct {
+		sheet      *Sheet
+		rowx, colx int
+		value      interface{}
+	}
+	var results []result
+	var rerr *RecalcError
+	for _, s := range sheets {
+		if s == nil {
+			continue
+		}
+		for _, key := range sortedCells(s.formulas) {
+			v, err := e.cellValue(s.number, key[0], key[1])
+			if err != nil {
+				if rerr == nil {
+					rerr = &RecalcError{Cells: make(map[string]error)}
+				}
+				rerr.Cells[e.cellLabel(evalCell{s.number, key[0], key[1]})] = err
+				d := Diagnostic{
+					Severity: SeverityWarning,
+					Code:     DiagFormula,
+					Sheet:    s.Name,
+					Opcode:   -1,
+					Offset:   -1,
+					Message:  fmt.Sprintf("Can't recalculate %s: %v", Cellname(key[0], key[1]), err),
+				}
+				s.addDiagnostic(d)
+				continue
+			}
+			results = append(results, result{s, key[0], key[1], v})
+		}
+	}
+	for _, r := range results {
+		ctype, value := cellResult(r.value)
+		r.sheet.setCellResult(r.rowx, r.colx, ctype, value)
+	}
+	if rerr == nil {
+		return nil
+	}
+	for name := range e.unsupported {
+		rerr.Unsupported = append(rerr.Unsupported, name)
+	}
+	sort.Strings(rerr.Unsupported)
+	return rerr
+}
+
+// sortedCells returns the keys of formulas in row-major order.
+func sortedCells(formulas map[[2]int][]byte) [][2]int {
+	keys := make([][2]int, 0, len(formulas))
+	for key := range formulas {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
+
+// setCellResult replaces the value of an existing cell, keeping its XF.
+func (s *Sheet) setCellResult(rowx, colx, ctype int, value interface{}) {
+	if rowx >= len(s.cellValues) || colx >= len(s.cellValues[rowx]) {
+		return
+	}
+	s.cellTypes[rowx][colx] = ctype
+	s.cellValues[rowx][colx] = value
+}
+
+// cellResult returns the cell type and value storing the result v of a
+// formula, as read from FORMULA records.
+func cellResult(v interface{}) (int, interface{}) {
+	switch v := v.(type) {
+	case float64:
+		return XL_CELL_NUMBER, v
+	case string:
+		return XL_CELL_TEXT, v
+	case bool:
+		if v {
+			return XL_CELL_BOOLEAN, 1
+		}
+		return XL_CELL_BOOLEAN, 0
+	case evalError:
+		return XL_CELL_ERROR, int(v)
+	}
+	return XL_CELL_NUMBER, 0.0
+}
+
+// cellLabel returns the name of cell c qualified by its sheet, such as
+// "Sheet1!B2".
+func (e *evaluator) cellLabel(c evalCell) string {
+	return quotedsheetname(e.book.sheetNames, c.shx) + "!" + Cellname(c.rowx, c.colx)
+}
+
+// fail returns an error of the given kind about the formula being
+// evaluated.
+func (e *evaluator) fail(kind error, format string, args ...interface{}) error {
+	return newXLRDError(kind, "%s: %s", e.cellLabel(e.cur), fmt.Sprintf(format, args...))
+}
+
+// unsupportedFunction records and reports a call to a function the
+// evaluator does not implement.
+func (e *evaluator) unsupportedFunction(name string) error {
+	e.unsupported[name] = true
+	return e.fail(ErrUnsupportedFunction, "function %s is not supported", name)
+}
+
+// cellValue returns the value of a cell, evaluating its formula if it has
+// one.
+func (e *evaluator) cellValue(shx, rowx, colx int) (interface{}, error) {
+	s, err := e.book.SheetByIndex(shx)
+	if err != nil {
+		return nil, err
+	}
+	fmla, ok := s.formulas[[2]int{rowx, colx}]
+	if !ok {
+		return storedValue(s, rowx, colx), nil
+	}
+	c := evalCell{shx, rowx, colx}
+	if v, ok := e.values[c]; ok {
+		return v, nil
+	}
+	if err := e.errs[c]; err != nil {
+		return nil, err
+	}
+	if e.active[c] {
+		return nil, e.fail(ErrCircularReference, "circular reference to %s", e.cellLabel(c))
+	}
+	// active holds the chain of formulas being evaluated, each needing the
+	// value of the next.
+	maxDepth := e.book.limits.MaxEvalDepth
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxEvalDepth
+	}
+	if len(e.active) >= maxDepth {
+		return nil, &LimitError{Limit: "MaxEvalDepth", Max: int64(maxDepth), Value: int64(len(e.active) + 1)}
+	}
+	e.active[c] = true
+	saved := e.cur
+	e.cur = c
+	v, err := e.evalCellFormula(s, rowx, colx, fmla)
+	e.cur = saved
+	delete(e.active, c)
+	if err != nil {
+		e.errs[c] = err
+		return nil, err
+	}
+	e.values[c] = v
+	return v, nil
+}
+
+// evalCellFormula evaluates the formula of a cell to a single value.
+func (e *evaluator) evalCellFormula(s *Sheet, rowx, colx int, fmla []byte) (interface{}, error) {
+	fmlatype := FMLA_TYPE_CELL
+	if isExpFormula(e.book.BiffVersion, fmla) {
+		sf := s.sharedFormulaOf(rowx, colx)
+		switch {
+		case sf == nil:
+			return nil, e.fail(ErrMalformedFormula, "shared formula not found")
+		case sf.array:
+			return nil, e.fail(ErrUnsupportedFunction, "array formulas are not supported")
+		}
+		fmla, fmlatype = sf.rgce, FMLA_TYPE_SHARED
+	}
+	v, err := e.eval(fmla, fmlatype, 0)
+	if err != nil {
+		return nil, err
+	}
+	v, err = e.scalar(v)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		v = 0.0
+	}
+	return v, nil
+}
+
+// storedValue returns the value stored in a cell without a formula.
+func storedValue(s *Sheet, rowx, colx int) interface{} {
+	value := s.RawCellValue(rowx, colx)
+	switch s.RawCellType(rowx, colx) {
+	case XL_CELL_NUMBER, XL_CELL_DATE:
+		if f, ok := value.(float64); ok {
+			return f
+		}
+	case XL_CELL_TEXT:
+		if str, ok := value.(string); ok {
+			return str
+		}
+	case XL_CELL_BOOLEAN:
+		if i, ok := value.(int); ok {
+			return i != 0
+		}
+	case XL_CELL_ERROR:
+		if i, ok := value.(int); ok {
+			return evalError(i)
+		}
+	}
+	return nil
+}
+
+// eval evaluates the token array of a formula of the given type in the
+// context of the cell e.cur. The result may be a reference.
+func (e *evaluator) eval(fmla []byte, fmlatype int, level int) (interface{}, error) {
+	if level > StackPanicLevel {
+		return nil, e.fail(ErrMalformedFormula, "excessive indirect references in formula")
+	}
+	bk := e.book
+	bv := bk.BiffVersion
+	sztab := szdict[bv]
+	if sztab == nil {
+		return nil, newXLRDError(ErrUnsupportedBIFF, "no formula tokens for BIFF version %d", bv)
+	}
+	reldelta := 0
+	if fmlatype&(FmlaTypeShared|FmlaTypeName|FmlaTypeCondFmt|FmlaTypeDataVal) != 0 {
+		reldelta = 1
+	}
+	var stack []interface{}
+	pop := func(n int) []interface{} {
+		args := append([]interface{}(nil), stack[len(stack)-n:]...)
+		stack = stack[:len(stack)-n]
+		return args
+	}
+
+	for pos := 0; pos < len(fmla); {
+		op := int(fmla[pos])
+		opcode := op & 0x1f
+		optype := (op & 0x60) >> 5
+		opx := opcode
+		if optype != 0 {
+			opx = opcode + 32
+		}
+		oname := onames[opx]
+		sz := sztab[opx]
+		if sz == -2 {
+			return nil, e.fail(ErrMalformedFormula, "unexpected token 0x%02x (t%s)", op, oname)
+		}
+		if pos+sz > len(fmla) {
+			return nil, e.fail(ErrMalformedFormula, "token t%s at position %d truncated", oname, pos)
+		}
+		need := 0
+		switch {
+		case optype == 0 && 0x03 <= opcode && opcode <= 0x11:
+			need = 2
+		case optype == 0 && 0x12 <= opcode && opcode <= 0x14:
+			need = 1
+		}
+		if len(stack) < need {
+			return nil, e.fail(ErrMalformedFormula, "stack underflow at token t%s", oname)
+		}
+
+		if optype == 0 {
+			switch {
+			case opcode == 0x01 || opcode == 0x02: // tExp, tTbl
+				return nil, e.fail(ErrUnsupportedFunction, "t%s tokens are not supported", oname)
+			case 0x03 <= opcode && opcode <= 0x0E: // tAdd ... tNE
+				args := pop(2)
+				v, err := e.binop(opcode, args[0], args[1])
+				if err != nil {
+					return nil, err
+				}
+				stack = append(stack, v)
+			case opcode == 0x0F || opcode == 0x10 || opcode == 0x11: // tIsect, tList, tRange
+				args := pop(2)
+				stack = append(stack, refOp(opcode, args[0], args[1]))
+			case 0x12 <= opcode && opcode <= 0x14: // tUplus, tUminus, tPercent
+				args := pop(1)
+				v, err := e.unop(opcode, args[0])
+				if err != nil {
+					return nil, err
+				}
+				stack = append(stack, v)
+			case opcode == 0x15: // tParen
+			case opcode == 0x16: // tMissArg
+				stack = append(stack, evalMissing{})
+			case opcode == 0x17: // tStr
+				var strg string
+				var newpos int
+				var ok bool
+				if bv <= 70 {
+					strg, newpos, ok = unpackStringUpdatePos(fmla, pos+1, bk.Encoding, 1)
+				} else {
+					strg, newpos, ok = unpackUnicodeUpdatePos(fmla, pos+1, 1)
+				}
+				if !ok {
+					return nil, e.fail(ErrMalformedFormula, "token tStr at position %d truncated", pos)
+				}
+				sz = newpos - pos
+				stack = append(stack, strg)
+			case opcode == 0x19: // tAttr
+				if pos+4 > len(fmla) {
+					return nil, e.fail(ErrMalformedFormula, "token tAttr at position %d truncated", pos)
+				}
+				subop := fmla[pos+1]
+				nc := int(binary.LittleEndian.Uint16(fmla[pos+2 : pos+4]))
+				sz = 4
+				switch subop {
+				case 0x02: // If
+					if len(stack) < 1 {
+						return nil, e.fail(ErrMalformedFormula, "stack underflow at token tAttrIf")
+					}
+					next, v, err := e.attrIf(fmla, pos, pop(1)[0])
+					if err != nil {
+						return nil, err
+					}
+					if v != nil {
+						stack = append(stack, v)
+					}
+					sz = next - pos
+				case 0x04: // Choose
+					if pos+nc*2+6 > len(fmla) {
+						return nil, e.fail(ErrMalformedFormula, "token tAttrChoose at position %d truncated", pos)
+					}
+					if len(stack) < 1 {
+						return nil, e.fail(ErrMalformedFormula, "stack underflow at token tAttrChoose")
+					}
+					next, v, err := e.attrChoose(fmla, pos, nc, pop(1)[0])
+					if err != nil {
+						return nil, err
+					}
+					if v != nil {
+						stack = append(stack, v)
+					}
+					sz = next - pos
+				case 0x08: // Skip
+					// The argument of IF or CHOOSE taken is evaluated: jump
+					// past the function, offset by one as Excel counts.
+					sz = nc + 5
+					if n := len(stack); n > 0 {
+						stack[n-1] = missingAsZero(stack[n-1])
+					}
+				case 0x10: // Sum
+					if len(stack) < 1 {
+						return nil, e.fail(ErrMalformedFormula, "stack underflow at token tAttrSum")
+					}
+					v, err := e.call("SUM", pop(1))
+					if err != nil {
+						return nil, err
+					}
+					stack = append(stack, v)
+				}
+				if pos+sz > len(fmla) {
+					return nil, e.fail(ErrMalformedFormula, "tAttr jump at position %d out of range", pos)
+				}
+			case 0x1C <= opcode && opcode <= 0x1F: // tErr, tBool, tInt, tNum
+				switch opcode {
+				case 0x1C:
+					stack = append(stack, evalError(fmla[pos+1]))
+				case 0x1D:
+					stack = append(stack, fmla[pos+1] != 0)
+				case 0x1E:
+					stack = append(stack, float64(binary.LittleEndian.Uint16(fmla[pos+1:pos+3])))
+				case 0x1F:
+					stack = append(stack, math.Float64frombits(binary.LittleEndian.Uint64(fmla[pos+1:pos+9])))
+				}
+			default: // tExtended, tSheet, tEndSheet
+				return nil, e.fail(ErrUnsupportedFunction, "t%s tokens are not supported", oname)
+			}
+			pos += sz
+			continue
+		}
+
+		switch opcode {
+		case 0x01, 0x02: // tFunc, tFuncVar
+			nb := 1
+			if bv >= 40 {
+				nb = 2
+			}
+			var funcx, nargs int
+			if opcode == 0x01 {
+				funcx = int(fmla[pos+1])
+				if nb == 2 {
+					funcx = int(binary.LittleEndian.Uint16(fmla[pos+1 : pos+3]))
+				}
+				if fd, ok := funcDefs[funcx]; ok {
+					nargs = fd.minArgs
+				}
+			} else {
+				nargs = int(fmla[pos+1] & 0x7F)
+				funcx = int(fmla[pos+2])
+				if nb == 2 {
+					funcx = int(binary.LittleEndian.Uint16(fmla[pos+2:pos+4]) & 0x7FFF)
+				}
+			}
+			if len(stack) < nargs {
+				return nil, e.fail(ErrMalformedFormula, "stack underflow at token t%s", oname)
+			}
+			args := pop(nargs)
+			var name string
+			if funcx == 255 && nargs >= 1 {
+				// CALL_ADDIN: the first argument names the function.
+				fn, ok := args[0].(evalFuncName)
+				if !ok {
+					return nil, e.fail(ErrUnsupportedFunction, "add-in functions are not supported")
+				}
+				name, args = string(fn), args[1:]
+			} else if fd, ok := funcDefs[funcx]; ok {
+				if nargs < fd.minArgs {
+					return nil, e.fail(ErrMalformedFormula, "%s takes at least %d arguments, not %d", fd.name, fd.minArgs, nargs)
+				}
+				name = fd.name
+			} else {
+				return nil, e.fail(ErrUnsupportedFunction, "unknown function number %d", funcx)
+			}
+			v, err := e.call(name, args)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, v)
+		case 0x03: // tName
+			namex := int(binary.LittleEndian.Uint16(fmla[pos+1:pos+3])) - 1
+			v, err := e.name(namex, level)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, v)
+		case 0x19: // tNameX
+			v, err := e.nameX(fmla[pos:pos+sz], level)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, v)
+		case 0x04, 0x0C: // tRef, tRefN
+			rowx, colx := e.cellAddr(fmla, pos+1, reldelta)
+			stack = append(stack, evalRef{{e.cur.shx, rowx, rowx + 1, colx, colx + 1}})
+		case 0x05, 0x0D: // tArea, tAreaN
+			stack = append(stack, evalRef{e.areaAddr(e.cur.shx, fmla, pos+1, reldelta)})
+		case 0x1A, 0x1B: // tRef3d, tArea3d
+			shx1, shx2, addr := e.sheetRange(fmla, pos)
+			if shx1 < 0 {
+				v, err := e.badSheet(shx1)
+				if err != nil {
+					return nil, err
+				}
+				stack = append(stack, v)
+				break
+			}
+			var a evalArea
+			if opcode == 0x1A {
+				rowx, colx := e.cellAddr(fmla, addr, reldelta)
+				a = evalArea{0, rowx, rowx + 1, colx, colx + 1}
+			} else {
+				a = e.areaAddr(0, fmla, addr, reldelta)
+			}
+			var ref evalRef
+			for shx := shx1; shx <= shx2; shx++ {
+				a.shx = shx
+				ref = append(ref, a)
+			}
+			stack = append(stack, ref)
+		case 0x06, 0x07, 0x08, 0x09, 0x0E, 0x0F:
+			// tMemArea, tMemErr, tMemNoMem, tMemFunc, tMemAreaN and
+			// tMemNoMemN precede the tokens of a reference expression and
+			// hold no value of their own.
+		case 0x0A, 0x0B, 0x1C, 0x1D: // tRefErr, tAreaErr, tRefErr3d, tAreaErr3d
+			stack = append(stack, errRef)
+		default: // tArray, tFuncCE
+			return nil, e.fail(ErrUnsupportedFunction, "t%s tokens are not supported", oname)
+		}
+		pos += sz
+	}
+	if len(stack) != 1 {
+		return nil, e.fail(ErrMalformedFormula, "formula leaves %d values on the stack", len(stack))
+	}
+	return stack[0], nil
+}
+
+// attrIf evaluates the condition cond of the IF function whose tAttrIf
+// token is at pos in fmla, and returns the position of the argument to
+// evaluate next, along with the result of the function if it is already
+// known. The true argument follows the token; the false argument, if
+// any, follows the tAttrSkip token ending the true one.
+func (e *evaluator) attrIf(fmla []byte, pos int, cond interface{}) (int, interface{}, error) {
+	falsePos := pos + 4 + int(binary.LittleEndian.Uint16(fmla[pos+2:pos+4]))
+	skip := falsePos - 4
+	if skip < pos+4 || falsePos > len(fmla) || fmla[skip] != 0x19 || fmla[skip+1] != 0x08 {
+		return 0, nil, e.fail(ErrMalformedFormula, "tAttrIf at position %d jumps to no tAttrSkip", pos)
+	}
+	b, err := e.boolean(cond)
+	var xe evalError
+	switch {
+	case errors.As(err, &xe):
+		// The result is the error: take the tAttrSkip past the function.
+		return skip, xe, nil
+	case err != nil:
+		return 0, nil, err
+	case b:
+		return pos + 4, nil, nil
+	}
+	if funcx, sz := e.funcAt(fmla, falsePos); funcx == 1 {
+		// IF without a false argument.
+		return falsePos + sz, false, nil
+	}
+	return falsePos, nil, nil
+}
+
+// attrChoose evaluates the index of the CHOOSE function whose
+// tAttrChoose token, with a jump table of nc+1 offsets, is at pos in fmla,
+// and returns the position of the argument to evaluate next, along with
+// the result of the function if it is already known. The last offset is
+// that of the function token.
+func (e *evaluator) attrChoose(fmla []byte, pos, nc int, index interface{}) (int, interface{}, error) {
+	jump := func(k int) int {
+		return pos + 4 + int(binary.LittleEndian.Uint16(fmla[pos+4+2*k:]))
+	}
+	f, err := e.num(index)
+	i := 0
+	if err == nil {
+		i, err = truncArg(f, 1, nc)
+	}
+	var xe evalError
+	switch {
+	case errors.As(err, &xe):
+		// The result is the error: jump past the function.
+		end := jump(nc)
+		if funcx, sz := e.funcAt(fmla, end); funcx == 100 && end >= pos+nc*2+6 {
+			return end + sz, xe, nil
+		}
+		return 0, nil, e.fail(ErrMalformedFormula, "tAttrChoose at position %d jumps to no CHOOSE", pos)
+	case err != nil:
+		return 0, nil, err
+	}
+	next := jump(i - 1)
+	if next < pos+nc*2+6 || next > len(fmla) {
+		return 0, nil, e.fail(ErrMalformedFormula, "tAttrChoose jump at position %d out of range", pos)
+	}
+	return next, nil, nil
+}
+
+// funcAt returns the function number and size of the tFunc or tFuncVar
+// token at pos in fmla, or -1 and 0 if there is none.
+func (e *evaluator) funcAt(fmla []byte, pos int) (int, int) {
+	bv := e.book.BiffVersion
+	if pos >= len(fmla) || fmla[pos]&0x60 == 0 {
+		return -1, 0
+	}
+	opcode := int(fmla[pos] & 0x1f)
+	if opcode != 0x01 && opcode != 0x02 {
+		return -1, 0
+	}
+	sz := szdict[bv][opcode+32]
+	if sz < 0 || pos+sz > len(fmla) {
+		return -1, 0
+	}
+	p := pos + opcode // the function number follows the argument count of tFuncVar
+	if bv >= 40 {
+		return int(binary.LittleEndian.Uint16(fmla[p:p+2]) & 0x7FFF), sz
+	}
+	return int(fmla[p]), sz
+}
+
+// cellAddr returns the cell addressed by the reference at pos in fmla.
+// With reldelta set, relative rows and columns are offsets from e.cur.
+func (e *evaluator) cellAddr(fmla []byte, pos, reldelta int) (int, int) {
+	rowx, colx, rowRel, colRel := getCellAddr(fmla, pos, e.book.BiffVersion, reldelta, nil, nil)
+	return e.absAddr(rowx, colx, rowRel, colRel, reldelta)
+}
+
+// areaAddr returns the area on sheet shx addressed by the range reference
+// at pos in fmla.
+func (e *evaluator) areaAddr(shx int, fmla []byte, pos, reldelta int) evalArea {
+	res1, res2 := getCellRangeAddr(fmla, pos, e.book.BiffVersion, reldelta, nil, nil)
+	r1, c1 := e.absAddr(res1[0], res1[1], res1[2], res1[3], reldelta)
+	r2, c2 := e.absAddr(res2[0], res2[1], res2[2], res2[3], reldelta)
+	return evalArea{shx, min(r1, r2), max(r1, r2) + 1, min(c1, c2), max(c1, c2) + 1}
+}
+
+func (e *evaluator) absAddr(rowx, colx, rowRel, colRel, reldelta int) (int, int) {
+	if reldelta == 0 {
+		return rowx, colx
+	}
+	nrows := 16384
+	if e.book.BiffVersion >= 80 {
+		nrows = 65536
+	}
+	if rowRel != 0 {
+		rowx = ((e.cur.rowx+rowx)%nrows + nrows) % nrows
+	}
+	if colRel != 0 {
+		colx = ((e.cur.colx+colx)%256 + 256) % 256
+	}
+	return rowx, colx
+}
+
+// sheetRange returns the sheets referred to by the tRef3d or tArea3d
+// token at pos in fmla, and the position of its cell address.
+func (e *evaluator) sheetRange(fmla []byte, pos int) (shx1, shx2, addr int) {
+	bk := e.book
+	if bk.BiffVersion >= 80 {
+		refx := int(binary.LittleEndian.Uint16(fmla[pos+1 : pos+3]))
+		shx1, shx2 = getExternsheetLocalRange(bk, refx, 0)
+		return shx1, shx2, pos + 3
+	}
+	rawExtshtx := int(int16(binary.LittleEndian.Uint16(fmla[pos+1 : pos+3])))
+	rawShx1 := int(int16(binary.LittleEndian.Uint16(fmla[pos+11 : pos+13])))
+	rawShx2 := int(int16(binary.LittleEndian.Uint16(fmla[pos+13 : pos+15])))
+	shx1, shx2 = getExternsheetLocalRangeB57(bk, rawExtshtx, rawShx1, rawShx2, 0)
+	return shx1, shx2, pos + 15
+}
+
+// badSheet returns the value of a 3D reference whose sheet index shx, as
+// returned by getExternsheetLocalRange, is negative.
+func (e *evaluator) badSheet(shx int) (interface{}, error) {
+	switch shx {
+	case -4:
+		return nil, e.fail(ErrUnsupportedFunction, "references to other workbooks are not supported")
+	case -5:
+		return nil, e.fail(ErrUnsupportedFunction, "add-in functions are not supported")
+	}
+	return errRef, nil
+}
+
+// name returns the value of the defined name with index namex.
+func (e *evaluator) name(namex, level int) (interface{}, error) {
+	bk := e.book
+	if namex < 0 || namex >= len(bk.NameObjList) {
+		return nil, e.fail(ErrMalformedFormula, "name index %d out of range", namex+1)
+	}
+	nobj := bk.NameObjList[namex]
+	if nobj.Func != 0 && strings.HasPrefix(nobj.Name, "_xlfn.") {
+		// A function newer than the file format, such as IFERROR.
+		return evalFuncName(strings.TrimPrefix(nobj.Name, "_xlfn.")), nil
+	}
+	if nobj.Macro != 0 || nobj.Binary != 0 {
+		return nil, e.fail(ErrUnsupportedFunction, "macro name %s is not supported", nobj.Name)
+	}
+	n := nobj.BasicFormulaLen
+	if n > len(nobj.RawFormula) {
+		n = len(nobj.RawFormula)
+	}
+	if n <= 0 {
+		return errName, nil
+	}
+	return e.eval(nobj.RawFormula[:n], FMLA_TYPE_NAME, level+1)
+}
+
+// nameX returns the value of the tNameX token tok: a defined name of the
+// workbook, or the name of an add-in function.
+func (e *evaluator) nameX(tok []byte, level int) (interface{}, error) {
+	bk := e.book
+	if bk.BiffVersion >= 80 {
+		refx := int(binary.LittleEndian.Uint16(tok[1:3]))
+		namex := int(binary.LittleEndian.Uint16(tok[3:5])) - 1
+		shx, _ := getExternsheetLocalRange(bk, refx, 0)
+		switch {
+		case shx == -5 && namex >= 0 && namex < len(bk.addinFuncNames):
+			return evalFuncName(strings.TrimPrefix(bk.addinFuncNames[namex], "_xlfn.")), nil
+		case shx >= -1:
+			return e.name(namex, level)
+		}
+		return nil, e.fail(ErrUnsupportedFunction, "names in other workbooks are not supported")
+	}
+	refx := int(int16(binary.LittleEndian.Uint16(tok[1:3])))
+	namex := int(binary.LittleEndian.Uint16(tok[11:13])) - 1
+	if refx < 0 && -refx-1 < len(bk.externsheetTypeB57) && bk.externsheetTypeB57[-refx-1] == 4 {
+		return e.name(namex, level)
+	}
+	return nil, e.fail(ErrUnsupportedFunction, "names in other workbooks are not supported")
+}
+
+// refOp applies the reference operator tIsect, tList or tRange.
+func refOp(opcode int, a, b interface{}) interface{} {
+	if err, ok := a.(evalError); ok {
+		return err
+	}
+	if err, ok := b.(evalError); ok {
+		return err
+	}
+	ra, aok := a.(evalRef)
+	rb, bok := b.(evalRef)
+	if !aok || !bok {
+		return errValue
+	}
+	if opcode == 0x10 { // tList
+		return append(append(evalRef(nil), ra...), rb...)
+	}
+	if len(ra) != 1 || len(rb) != 1 || ra[0].shx != rb[0].shx {
+		return errValue
+	}
+	x, y := ra[0], rb[0]
+	if opcode == 0x11 { // tRange
+		return evalRef{{x.shx, min(x.r1, y.r1), max(x.r2, y.r2), min(x.c1, y.c1), max(x.c2, y.c2)}}
+	}
+	r := evalArea{x.shx, max(x.r1, y.r1), min(x.r2, y.r2), max(x.c1, y.c1), min(x.c2, y.c2)}
+	if r.r1 >= r.r2 || r.c1 >= r.c2 {
+		return errNull
+	}
+	return evalRef{r}
+}
+
+// binop applies the binary operator with the given opcode.
+func (e *evaluator) binop(opcode int, a, b interface{}) (interface{}, error) {
+	v, err := e.binopValue(opcode, a, b)
+	var xe evalError
+	if errors.As(err, &xe) {
+		return xe, nil
+	}
+	return v, err
+}
+
+func (e *evaluator) binopValue(opcode int, a, b interface{}) (interface{}, error) {
+	a, err := e.scalar(a)
+	if err != nil {
+		return nil, err
+	}
+	b, err = e.scalar(b)
+	if err != nil {
+		return nil, err
+	}
+	if xe, ok := a.(evalError); ok {
+		return xe, nil
+	}
+	if xe, ok := b.(evalError); ok {
+		return xe, nil
+	}
+	switch opcode {
+	case 0x08: // tConcat
+		x, err := e.str(a)
+		if err != nil {
+			return nil, err
+		}
+		y, err := e.str(b)
+		if err != nil {
+			return nil, err
+		}
+		return x + y, nil
+	case 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E: // tLT, tLE, tEQ, tGE, tGT, tNE
+		c := compareValues(a, b)
+		return [...]bool{c < 0, c <= 0, c == 0, c >= 0, c > 0, c != 0}[opcode-0x09], nil
+	}
+	x, err := e.num(a)
+	if err != nil {
+		return nil, err
+	}
+	y, err := e.num(b)
+	if err != nil {
+		return nil, err
+	}
+	var r float64
+	switch opcode {
+	case 0x03: // tAdd
+		r = x + y
+	case 0x04: // tSub
+		r = x - y
+	case 0x05: // tMul
+		r = x * y
+	case 0x06: // tDiv
+		if y == 0 {
+			return errDiv0, nil
+		}
+		r = x / y
+	default: // tPower
+		return power(x, y)
+	}
+	if math.IsInf(r, 0) {
+		return errNum, nil
+	}
+	return r, nil
+}
+
+// power returns x raised to the power y, as the ^ operator and POWER do.
+func power(x, y float64) (interface{}, error) {
+	if x == 0 && y < 0 {
+		return errDiv0, nil
+	}
+	r := math.Pow(x, y)
+	if math.IsNaN(r) || math.IsInf(r, 0) {
+		return errNum, nil
+	}
+	return r, nil
+}
+
+// unop applies the unary operator with the given opcode.
+func (e *evaluator) unop(opcode int, a interface{}) (interface{}, error) {
+	a, err := e.scalar(a)
+	if err != nil {
+		return nil, err
+	}
+	if opcode == 0x12 { // tUplus
+		return a, nil
+	}
+	x, err := e.num(a)
+	var xe evalError
+	if errors.As(err, &xe) {
+		return xe, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if opcode == 0x13 { // tUminus
+		return -x, nil
+	}
+	return x / 100, nil // tPercent
+}
+
+// scalar returns v with a reference replaced by the value of the cell it
+// designates. A reference to several cells designates the one in the row
+// or column of the formula cell, or gives #VALUE!.
+func (e *evaluator) scalar(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case evalRef:
+		if len(v) != 1 {
+			return errValue, nil
+		}
+		a := v[0]
+		rowx, colx := a.r1, a.c1
+		switch {
+		case a.r2-a.r1 == 1 && a.c2-a.c1 == 1:
+		case a.c2-a.c1 == 1 && a.r1 <= e.cur.rowx && e.cur.rowx < a.r2:
+			rowx = e.cur.rowx
+		case a.r2-a.r1 == 1 && a.c1 <= e.cur.colx && e.cur.colx < a.c2:
+			colx = e.cur.colx
+		default:
+			return errValue, nil
+		}
+		return e.cellValue(a.shx, rowx, colx)
+	case evalMissing, evalFuncName:
+		return nil, nil
+	}
+	return v, nil
+}
+
+// num converts v to a number. An error value is returned as the error,
+// and #NUM! for a value that is not finite, which no cell holds in Excel.
+func (e *evaluator) num(v interface{}) (float64, error) {
+	v, err := e.scalar(v)
+	if err != nil {
+		return 0, err
+	}
+	switch v := v.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return 0, errNum
+		}
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		if f, ok := parseNumber(v); ok {
+			return f, nil
+		}
+		return 0, errValue
+	case evalError:
+		return 0, v
+	}
+	return 0, errValue
+}
+
+// parseNumber parses text as a number, as Excel converts text operands.
+func parseNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	percent := strings.HasSuffix(s, "%")
+	s = strings.TrimSuffix(s, "%")
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || s == "" || strings.ContainsAny(s, "xXpP_") || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, false
+	}
+	if percent {
+		f /= 100
+	}
+	return f, true
+}
+
+// str converts v to text. An error value is returned as the error.
+func (e *evaluator) str(v interface{}) (string, error) {
+	v, err := e.scalar(v)
+	if err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case float64:
+		return formatNumber(v), nil
+	case bool:
+		if v {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	case string:
+		return v, nil
+	case evalError:
+		return "", v
+	}
+	return "", errValue
+}
+
+// formatNumber formats f as Excel's General format does for text
+// conversion, with up to 15 significant digits.
+func formatNumber(f float64) string {
+	if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'G', 15, 64)
+}
+
+// boolean converts v to a logical value. An error value is returned as
+// the error.
+func (e *evaluator) boolean(v interface{}) (bool, error) {
+	v, err := e.scalar(v)
+	if err != nil {
+		return false, err
+	}
+	switch v := v.(type) {
+	case nil:
+		return false, nil
+	case float64:
+		return v != 0, nil
+	case bool:
+		return v, nil
+	case string:
+		switch strings.ToUpper(v) {
+		case "TRUE":
+			return true, nil
+		case "FALSE":
+			return false, nil
+		}
+		return false, errValue
+	case evalError:
+		return false, v
+	}
+	return false, errValue
+}
+
+// compareValues compares two scalar values as Excel's comparison operators
+// do: numbers sort before text, and text before logical values; text is
+// compared without regard to case, and an empty value equals 0, "" or
+// FALSE.
+func compareValues(a, b interface{}) int {
+	if a == nil {
+		a = zeroLike(b)
+	}
+	if b == nil {
+		b = zeroLike(a)
+	}
+	ta, tb := typeRank(a), typeRank(b)
+	if ta != tb {
+		return cmpInt(ta, tb)
+	}
+	switch x := a.(type) {
+	case float64:
+		y := b.(float64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(strings.ToLower(x), strings.ToLower(b.(string)))
+	case bool:
+		return cmpInt(boolToInt(x), boolToInt(b.(bool)))
+	}
+	return 0
+}
+
+func zeroLike(v interface{}) interface{} {
+	switch v.(type) {
+	case string:
+		return ""
+	case bool:
+		return false
+	}
+	return 0.0
+}
+
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case float64:
+		return 0
+	case string:
+		return 1
+	case bool:
+		return 2
+	}
+	return 3
+}
+
+func cmpInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,469 @@
+package xlrd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Builders for BIFF8 records and formula tokens.
+
+func numberValueRecord(rowx, colx int, value float64) []byte {
+	data := make([]byte, 14)
+	binary.LittleEndian.PutUint16(data[0:2], uint16(rowx))
+	binary.LittleEndian.PutUint16(data[2:4], uint16(colx))
+	binary.LittleEndian.PutUint64(data[6:14], math.Float64bits(value))
+	return biffRecord(XL_NUMBER, data)
+}
+
+func labelRecord(rowx, colx int, value string) []byte {
+	data := make([]byte, 9, 9+len(value))
+	binary.LittleEndian.PutUint16(data[0:2], uint16(rowx))
+	binary.LittleEndian.PutUint16(data[2:4], uint16(colx))
+	binary.LittleEndian.PutUint16(data[6:8], uint16(len(value)))
+	return biffRecord(XL_LABEL, append(data, value...))
+}
+
+func rpn(tokens ...[]byte) []byte {
+	var fmla []byte
+	for _, tok := range tokens {
+		fmla = append(fmla, tok...)
+	}
+	return fmla
+}
+
+func tRef(rowx, colx int) []byte {
+	return []byte{0x24, byte(rowx), byte(rowx >> 8), byte(colx), 0xC0}
+}
+
+func tArea(r1, c1, r2, c2 int) []byte {
+	return []byte{0x25, byte(r1), byte(r1 >> 8), byte(r2), byte(r2 >> 8), byte(c1), 0xC0, byte(c2), 0xC0}
+}
+
+func tNum(f float64) []byte {
+	return binary.LittleEndian.AppendUint64([]byte{0x1F}, math.Float64bits(f))
+}
+
+func tStr(s string) []byte {
+	return append([]byte{0x17, byte(len(s)), 0}, s...)
+}
+
+func tFuncVar(funcx, nargs int) []byte {
+	return []byte{0x42, byte(nargs), byte(funcx), byte(funcx >> 8)}
+}
+
+func tOp(opcode byte) []byte {
+	return []byte{opcode}
+}
+
+var tBoolFalse = []byte{0x1D, 0}
+
+func tAttr(subop byte, n int) []byte {
+	return []byte{0x19, subop, byte(n), byte(n >> 8)}
+}
+
+// ifTokens returns the tokens of IF(cond,a) or IF(cond,a,b) with the
+// jumps Excel writes, so that only one argument is evaluated.
+func ifTokens(cond, a []byte, b ...[]byte) []byte {
+	fmla := rpn(cond, tAttr(0x02, len(a)+4), a)
+	if len(b) == 0 {
+		return rpn(fmla, tAttr(0x08, 4-1), tFuncVar(1, 2))
+	}
+	return rpn(fmla, tAttr(0x08, len(b[0])+4+4-1), b[0], tAttr(0x08, 4-1), tFuncVar(1, 3))
+}
+
+// chooseTokens returns the tokens of CHOOSE(index,args...) with the jump
+// table Excel writes.
+func chooseTokens(index []byte, args ...[]byte) []byte {
+	table := make([]byte, 0, 2*len(args)+2)
+	jump := 2*len(args) + 2
+	for _, arg := range args {
+		table = binary.LittleEndian.AppendUint16(table, uint16(jump))
+		jump += len(arg) + 4
+	}
+	table = binary.LittleEndian.AppendUint16(table, uint16(jump))
+	fmla := rpn(index, tAttr(0x04, len(args)), table)
+	for i, arg := range args {
+		rest := 4 - 1
+		for _, next := range args[i+1:] {
+			rest += len(next) + 4
+		}
+		fmla = rpn(fmla, arg, tAttr(0x08, rest))
+	}
+	return rpn(fmla, tFuncVar(100, len(args)+1))
+}
+
+func TestEvaluateCell(t *testing.T) {
+	data := biff8Workbook(
+		labelRecord(0, 0, "apple"), numberValueRecord(0, 1, 1.5),
+		labelRecord(1, 0, "banana"), numberValueRecord(1, 1, 2),
+		labelRecord(2, 0, "cherry"), numberValueRecord(2, 1, 3),
+		labelRecord(3, 0, "date"), numberValueRecord(3, 1, 4),
+		// D1: SUM(B1:B4)
+		formulaRecord(0, 3, rpn(tArea(0, 1, 3, 1), tFuncVar(4, 1))...),
+		// D2: VLOOKUP("cherry",A1:B4,2,FALSE)
+		formulaRecord(1, 3, rpn(tStr("cherry"), tArea(0, 0, 3, 1), tNum(2), tBoolFalse, tFuncVar(102, 4))...),
+		// D3: INDEX(B1:B4,MATCH("banana",A1:A4,0))
+		formulaRecord(2, 3, rpn(tArea(0, 1, 3, 1), tStr("banana"), tArea(0, 0, 3, 0), tNum(0),
+			tFuncVar(64, 3), tFuncVar(29, 2))...),
+		// D4: IF(D1>10,"big","small")
+		formulaRecord(3, 3, rpn(tRef(0, 3), tNum(10), tOp(tGT), tStr("big"), tStr("small"), tFuncVar(1, 3))...),
+		// D5: DATE(2024,2,29)
+		formulaRecord(4, 3, rpn(tNum(2024), tNum(2), tNum(29), tFuncVar(65, 3))...),
+		// D6: YEAR(D5)&"-"&MONTH(D5)
+		formulaRecord(5, 3, rpn(tRef(4, 3), tFuncVar(69, 1), tStr("-"), tOp(tConcat), tRef(4, 3), tFuncVar(68, 1), tOp(tConcat))...),
+		// D7: LEFT(A2,3)&UPPER(RIGHT(A3,2))
+		formulaRecord(6, 3, rpn(tRef(1, 0), tNum(3), tFuncVar(115, 2), tRef(2, 0), tNum(2), tFuncVar(116, 2),
+			tFuncVar(113, 1), tOp(tConcat))...),
+		// D8: SUMIF(B1:B4,">2")
+		formulaRecord(7, 3, rpn(tArea(0, 1, 3, 1), tStr(">2"), tFuncVar(345, 2))...),
+		// D9: COUNTIF(A1:A4,"*an*")
+		formulaRecord(8, 3, rpn(tArea(0, 0, 3, 0), tStr("*an*"), tFuncVar(346, 2))...),
+		// D10: ROUND(D1/4,1)
+		formulaRecord(9, 3, rpn(tRef(0, 3), tNum(4), tOp(tDiv), tNum(1), tFuncVar(27, 2))...),
+		// D11: 1/0
+		formulaRecord(10, 3, rpn(tNum(1), tNum(0), tOp(tDiv))...),
+		// D12: ISERROR(D11)
+		formulaRecord(11, 3, rpn(tRef(10, 3), tFuncVar(3, 1))...),
+		// D13: D1*2, whose cached result of 0 is stale like D1's.
+		formulaRecord(12, 3, rpn(tRef(0, 3), tNum(2), tOp(tMul))...),
+	)
+	book, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data, Logfile: io.Discard})
+	if err != nil {
+		t.Fatalf("OpenWorkbook() failed: %v", err)
+	}
+	sheet, err := book.SheetByIndex(0)
+	if err != nil {
+		t.Fatalf("SheetByIndex(0) failed: %v", err)
+	}
+	for _, tt := range []struct {
+		rowx  int
+		ctype int
+		value interface{}
+	}{
+		{0, XL_CELL_NUMBER, 10.5},
+		{1, XL_CELL_NUMBER, 3.0},
+		{2, XL_CELL_NUMBER, 2.0},
+		{3, XL_CELL_TEXT, "big"},
+		{4, XL_CELL_NUMBER, 45351.0},
+		{5, XL_CELL_TEXT, "2024-2"},
+		{6, XL_CELL_TEXT, "banRY"},
+		{7, XL_CELL_NUMBER, 7.0},
+		{8, XL_CELL_NUMBER, 1.0},
+		{9, XL_CELL_NUMBER, 2.6},
+		{10, XL_CELL_ERROR, 0x07},
+		{11, XL_CELL_BOOLEAN, 1},
+		{12, XL_CELL_NUMBER, 21.0},
+	} {
+		cell, err := sheet.EvaluateCell(tt.rowx, 3)
+		if err != nil {
+			t.Errorf("EvaluateCell(%d, 3) failed: %v", tt.rowx, err)
+			continue
+		}
+		if cell.CType != tt.ctype || cell.Value != tt.value {
+			t.Errorf("EvaluateCell(%d, 3) = %d %#v, want %d %#v", tt.rowx, cell.CType, cell.Value, tt.ctype, tt.value)
+		}
+	}
+	if cell, err := sheet.EvaluateCell(0, 0); err != nil || cell.Value != "apple" {
+		t.Errorf("EvaluateCell(0, 0) = %v, %v, want apple", cell, err)
+	}
+
+	if got := sheet.CellValue(12, 3); got != 0.0 {
+		t.Fatalf("CellValue(12, 3) = %v before Recalculate, want the cached 0", got)
+	}
+	if err := book.Recalculate(); err != nil {
+		t.Fatalf("Recalculate() failed: %v", err)
+	}
+	if got := sheet.CellValue(12, 3); got != 21.0 {
+		t.Errorf("CellValue(12, 3) = %v after Recalculate, want 21", got)
+	}
+	if got := sheet.CellType(3, 3); got != XL_CELL_TEXT {
+		t.Errorf("CellType(3, 3) = %d after Recalculate, want %d", got, XL_CELL_TEXT)
+	}
+}
+
+func TestRecalculateErrors(t *testing.T) {
+	data := biff8Workbook(
+		numberValueRecord(0, 0, 1),
+		// B1: A1+1
+		formulaRecord(0, 1, rpn(tRef(0, 0), tNum(1), tOp(tAdd))...),
+		// B2: OFFSET(A1,1,0)
+		formulaRecord(1, 1, rpn(tRef(0, 0), tNum(1), tNum(0), tFuncVar(78, 3))...),
+		// B3: B4+1 and B4: B3+1
+		formulaRecord(2, 1, rpn(tRef(3, 1), tNum(1), tOp(tAdd))...),
+		formulaRecord(3, 1, rpn(tRef(2, 1), tNum(1), tOp(tAdd))...),
+	)
+	book, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data, Logfile: io.Discard})
+	if err != nil {
+		t.Fatalf("OpenWorkbook() failed: %v", err)
+	}
+	sheet, err := book.SheetByIndex(0)
+	if err != nil {
+		t.Fatalf("SheetByIndex(0) failed: %v", err)
+	}
+	if _, err := sheet.EvaluateCell(1, 1); !errors.Is(err, ErrUnsupportedFunction) {
+		t.Errorf("EvaluateCell(1, 1) error = %v, want ErrUnsupportedFunction", err)
+	}
+	if _, err := sheet.EvaluateCell(2, 1); !errors.Is(err, ErrCircularReference) {
+		t.Errorf("EvaluateCell(2, 1) error = %v, want ErrCircularReference", err)
+	}
+
+	err = book.Recalculate()
+	var rerr *RecalcError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("Recalculate() error = %v, want a *RecalcError", err)
+	}
+	if !errors.Is(err, ErrUnsupportedFunction) || !errors.Is(err, ErrCircularReference) {
+		t.Errorf("Recalculate() error = %v, want it to match ErrUnsupportedFunction and ErrCircularReference", err)
+	}
+	if want := []string{"OFFSET"}; !reflect.DeepEqual(rerr.Unsupported, want) {
+		t.Errorf("Unsupported = %v, want %v", rerr.Unsupported, want)
+	}
+	var cells []string
+	for cell := range rerr.Cells {
+		cells = append(cells, cell)
+	}
+	if len(cells) != 3 || rerr.Cells["Sheet1!B2"] == nil || rerr.Cells["Sheet1!B3"] == nil || rerr.Cells["Sheet1!B4"] == nil {
+		t.Errorf("Cells = %v, want Sheet1!B2, B3 and B4", rerr.Cells)
+	}
+	if got := sheet.CellValue(0, 1); got != 2.0 {
+		t.Errorf("CellValue(0, 1) = %v after Recalculate, want 2", got)
+	}
+	if !hasDiagnostic(book, SeverityWarning, DiagFormula) {
+		t.Errorf("Diagnostics() = %v, want a %s warning", book.Diagnostics(), DiagFormula)
+	}
+}
+
+func TestEvaluateCellJumps(t *testing.T) {
+	offset := rpn(tRef(0, 0), tNum(1), tNum(0), tFuncVar(78, 3))
+	yes, no := rpn(tNum(1), tNum(0), tOp(tGT)), rpn(tNum(1), tNum(0), tOp(tLT))
+	book := openSynthetic(t,
+		numberValueRecord(0, 0, 1),
+		// B1: IF(1>0,"yes",OFFSET(A1,1,0))
+		formulaRecord(0, 1, ifTokens(yes, tStr("yes"), offset)...),
+		// B2: IF(1<0,B2,"no")
+		formulaRecord(1, 1, ifTokens(no, tRef(1, 1), tStr("no"))...),
+		// B3: IF(1<0,1)
+		formulaRecord(2, 1, ifTokens(no, tNum(1))...),
+		// B4: IF(1/0,B4,B4)
+		formulaRecord(3, 1, ifTokens(rpn(tNum(1), tNum(0), tOp(tDiv)), tRef(3, 1), tRef(3, 1))...),
+		// B5: CHOOSE(2,OFFSET(A1,1,0),"two",B5)
+		formulaRecord(4, 1, chooseTokens(tNum(2), offset, tStr("two"), tRef(4, 1))...),
+		// B6: CHOOSE(5,B6,2)
+		formulaRecord(5, 1, chooseTokens(tNum(5), tRef(5, 1), tNum(2))...),
+		// B7: IF(1>0,,1)
+		formulaRecord(6, 1, ifTokens(yes, []byte{0x16}, tNum(1))...),
+		// B8: IF(1<0,10,20)*CHOOSE(1,2,B8)
+		formulaRecord(7, 1, rpn(ifTokens(no, tNum(10), tNum(20)), chooseTokens(tNum(1), tNum(2), tRef(7, 1)), tOp(tMul))...),
+	)
+	sheet, err := book.SheetByIndex(0)
+	if err != nil {
+		t.Fatalf("SheetByIndex(0) failed: %v", err)
+	}
+	for _, tt := range []struct {
+		rowx  int
+		ctype int
+		value interface{}
+	}{
+		{0, XL_CELL_TEXT, "yes"},
+		{1, XL_CELL_TEXT, "no"},
+		{2, XL_CELL_BOOLEAN, 0},
+		{3, XL_CELL_ERROR, 0x07},
+		{4, XL_CELL_TEXT, "two"},
+		{5, XL_CELL_ERROR, 0x0F},
+		{6, XL_CELL_NUMBER, 0.0},
+		{7, XL_CELL_NUMBER, 40.0},
+	} {
+		cell, err := sheet.EvaluateCell(tt.rowx, 1)
+		if err != nil {
+			t.Errorf("EvaluateCell(%d, 1) failed: %v", tt.rowx, err)
+			continue
+		}
+		if cell.CType != tt.ctype || cell.Value != tt.value {
+			t.Errorf("EvaluateCell(%d, 1) = %d %#v, want %d %#v", tt.rowx, cell.CType, cell.Value, tt.ctype, tt.value)
+		}
+	}
+	if err := book.Recalculate(); err != nil {
+		t.Errorf("Recalculate() failed: %v", err)
+	}
+}
+
+func TestEvaluateCellLargeArguments(t *testing.T) {
+	book := openSynthetic(t,
+		// A1: MID("abc",1E300,1), A2: MID("abc",1,1E300)
+		formulaRecord(0, 0, rpn(tStr("abc"), tNum(1e300), tNum(1), tFuncVar(31, 3))...),
+		formulaRecord(1, 0, rpn(tStr("abc"), tNum(1), tNum(1e300), tFuncVar(31, 3))...),
+		// A3: LEFT("abc",1E300), A4: RIGHT("abc",1E300)
+		formulaRecord(2, 0, rpn(tStr("abc"), tNum(1e300), tFuncVar(115, 2))...),
+		formulaRecord(3, 0, rpn(tStr("abc"), tNum(1e300), tFuncVar(116, 2))...),
+		// A5: REPT("",1E300), A6: REPT("ab",3)
+		formulaRecord(4, 0, rpn(tStr(""), tNum(1e300), tFuncVar(30, 2))...),
+		formulaRecord(5, 0, rpn(tStr("ab"), tNum(3), tFuncVar(30, 2))...),
+		// A7: DATE(2000,1E300,1), A8: DATE(9999,13,1)
+		formulaRecord(6, 0, rpn(tNum(2000), tNum(1e300), tNum(1), tFuncVar(65, 3))...),
+		formulaRecord(7, 0, rpn(tNum(9999), tNum(13), tNum(1), tFuncVar(65, 3))...),
+		// A9: FIND("b","abc",1E300), A10: 1E300*1E300
+		formulaRecord(8, 0, rpn(tStr("b"), tStr("abc"), tNum(1e300), tFuncVar(124, 3))...),
+		formulaRecord(9, 0, rpn(tNum(1e300), tNum(1e300), tOp(tMul))...),
+		// A11: YEAR(1E300)
+		formulaRecord(10, 0, rpn(tNum(1e300), tFuncVar(69, 1))...),
+	)
+	sheet, err := book.SheetByIndex(0)
+	if err != nil {
+		t.Fatalf("SheetByIndex(0) failed: %v", err)
+	}
+	for rowx, want := range []interface{}{0x0F, 0x0F, 0x0F, 0x0F, 0x0F, "ababab", 0x24, 0x24, 0x0F, 0x24, 0x24} {
+		cell, err := sheet.EvaluateCell(rowx, 0)
+		if err != nil {
+			t.Errorf("EvaluateCell(%d, 0) failed: %v", rowx, err)
+			continue
+		}
+		if cell.Value != want {
+			t.Errorf("EvaluateCell(%d, 0) = %d %#v, want %#v", rowx, cell.CType, cell.Value, want)
+		}
+	}
+}
+
+func TestEvaluateCellDates(t *testing.T) {
+	// Columns A to D: YEAR, MONTH, DAY and WEEKDAY of the serial number.
+	funcs := []int{69, 68, 67, 70}
+	tests := []struct {
+		serial float64
+		want   [4]float64
+	}{
+		{0, [4]float64{1900, 1, 0, 7}},
+		{59, [4]float64{1900, 2, 28, 3}},
+		{60, [4]float64{1900, 2, 29, 4}},
+		{61, [4]float64{1900, 3, 1, 5}},
+	}
+	var records [][]byte
+	for rowx, tt := range tests {
+		for colx, funcx := range funcs {
+			records = append(records, formulaRecord(rowx, colx, rpn(tNum(tt.serial), tFuncVar(funcx, 1))...))
+		}
+	}
+	sheet, err := openSynthetic(t, records...).SheetByIndex(0)
+	if err != nil {
+		t.Fatalf("SheetByIndex(0) failed: %v", err)
+	}
+	for rowx, tt := range tests {
+		for colx, want := range tt.want {
+			cell, err := sheet.EvaluateCell(rowx, colx)
+			if err != nil {
+				t.Errorf("EvaluateCell(%d, %d) failed: %v", rowx, colx, err)
+				continue
+			}
+			if cell.Value != want {
+				t.Errorf("serial %v: EvaluateCell(%d, %d) = %#v, want %v", tt.serial, rowx, colx, cell.Value, want)
+			}
+		}
+	}
+}
+
+func TestEvaluateCellDepth(t *testing.T) {
+	// Each of A1 to A100 adds 1 to the cell below.
+	var records [][]byte
+	for rowx := 0; rowx < 100; rowx++ {
+		records = append(records, formulaRecord(rowx, 0, rpn(tRef(rowx+1, 0), tNum(1), tOp(tAdd))...))
+	}
+	data := biff8Workbook(records...)
+	for _, tt := range []struct {
+		max  int
+		want error
+	}{
+		{0, nil},
+		{100, nil},
+		{99, ErrLimitExceeded},
+	} {
+		book, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data, Logfile: io.Discard,
+			Limits: Limits{MaxEvalDepth: tt.max}})
+		if err != nil {
+			t.Fatalf("OpenWorkbook() failed: %v", err)
+		}
+		sheet, err := book.SheetByIndex(0)
+		if err != nil {
+			t.Fatalf("SheetByIndex(0) failed: %v", err)
+		}
+		cell, err := sheet.EvaluateCell(0, 0)
+		if !errors.Is(err, tt.want) || err == nil && cell.Value != 100.0 {
+			t.Errorf("MaxEvalDepth %d: EvaluateCell(0, 0) = %v, %v, want 100, %v", tt.max, cell, err, tt.want)
+		}
+	}
+}
+
+func TestWildcardMatch(t *testing.T) {
+	long := strings.Repeat("a", 50)
+	for _, tt := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"", "", true},
+		{"*", "", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abcd", false},
+		{"?b*", "abc", true},
+		{"?", "", false},
+		{"~*", "*", true},
+		{"~*", "a", false},
+		{"a~?", "a?", true},
+		{"a~", "a~", true},
+		{"*a*b", "xaybzb", true},
+		{strings.Repeat("*a", 25) + "b", long, false},
+		{strings.Repeat("*a", 25), long, true},
+	} {
+		if got := wildcardMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("wildcardMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+// TestEvaluateCellSamples checks that formulas evaluate to the results
+// cached by Excel.
+func TestEvaluateCellSamples(t *testing.T) {
+	for _, file := range []string{"formula_test_sjmachin.xls", "formula_test_names.xls", "namesdemo.xls", "profiles.xls"} {
+		book, err := OpenWorkbook(fromSample(file), &OpenWorkbookOptions{Logfile: io.Discard})
+		if err != nil {
+			t.Fatalf("OpenWorkbook(%s) failed: %v", file, err)
+		}
+		n := 0
+		for i := 0; i < book.NSheets; i++ {
+			sheet, err := book.SheetByIndex(i)
+			if err != nil {
+				t.Fatalf("SheetByIndex(%d) failed: %v", i, err)
+			}
+			for _, key := range sortedCells(sheet.formulas) {
+				rowx, colx := key[0], key[1]
+				if f, _ := sheet.CellFormula(rowx, colx); f == "TODAY()" {
+					continue
+				}
+				got, err := sheet.EvaluateCell(rowx, colx)
+				if errors.Is(err, ErrUnsupportedFunction) {
+					continue
+				}
+				if err != nil {
+					t.Errorf("%s %s!%s: EvaluateCell() failed: %v", file, sheet.Name, Cellname(rowx, colx), err)
+					continue
+				}
+				n++
+				want := sheet.Cell(rowx, colx)
+				same := got.CType == want.CType && got.Value == want.Value
+				if x, ok := got.Value.(float64); ok {
+					if y, ok := want.Value.(float64); ok && math.Abs(x-y) <= 1e-9*math.Max(1, math.Abs(y)) {
+						same = true
+					}
+				}
+				if !same {
+					t.Errorf("%s %s!%s: EvaluateCell() = %d %#v, want %d %#v", file, sheet.Name, Cellname(rowx, colx),
+						got.CType, got.Value, want.CType, want.Value)
+				}
+			}
+		}
+		if n == 0 {
+			t.Errorf("%s: no formula evaluated", file)
+		}
+	}
+}
@@ -0,0 +1,1223 @@
+package xlrd
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// evalFunc implements a worksheet function. It receives its arguments as
+// evaluated, references included, and may return an Excel error value as
+// its error.
+type evalFunc func(e *evaluator, args []interface{}) (interface{}, error)
+
+// evalFuncs holds the functions the evaluator implements, by name. It is
+// filled by init, since the functions call back into the evaluator.
+var evalFuncs map[string]evalFunc
+
+// timeNow returns the current time for TODAY and NOW.
+var timeNow = time.Now
+
+// call calls the function with the given name.
+func (e *evaluator) call(name string, args []interface{}) (interface{}, error) {
+	fn, ok := evalFuncs[name]
+	if !ok {
+		return nil, e.unsupportedFunction(name)
+	}
+	v, err := fn(e, args)
+	var xe evalError
+	if errors.As(err, &xe) {
+		return xe, nil
+	}
+	return v, err
+}
+
+func init() {
+	evalFuncs = map[string]evalFunc{
+		// Aggregates.
+		"SUM": func(e *evaluator, args []interface{}) (interface{}, error) {
+			sum := 0.0
+			err := e.numbers(args, func(f float64) { sum += f })
+			return sum, err
+		},
+		"PRODUCT": func(e *evaluator, args []interface{}) (interface{}, error) {
+			product, n := 1.0, 0
+			err := e.numbers(args, func(f float64) { product *= f; n++ })
+			if n == 0 {
+				product = 0
+			}
+			return product, err
+		},
+		"AVERAGE": func(e *evaluator, args []interface{}) (interface{}, error) {
+			sum, n := 0.0, 0
+			if err := e.numbers(args, func(f float64) { sum += f; n++ }); err != nil {
+				return nil, err
+			}
+			if n == 0 {
+				return nil, errDiv0
+			}
+			return sum / float64(n), nil
+		},
+		"MIN": func(e *evaluator, args []interface{}) (interface{}, error) {
+			return e.extreme(args, -1)
+		},
+		"MAX": func(e *evaluator, args []interface{}) (interface{}, error) {
+			return e.extreme(args, 1)
+		},
+		"COUNT": func(e *evaluator, args []interface{}) (interface{}, error) {
+			n := 0
+			err := e.each(args, func(v interface{}, inRef bool) error {
+				switch v := v.(type) {
+				case float64:
+					n++
+				case bool:
+					if !inRef {
+						n++
+					}
+				case string:
+					if _, ok := parseNumber(v); ok && !inRef {
+						n++
+					}
+				}
+				return nil
+			})
+			return float64(n), err
+		},
+		"COUNTA": func(e *evaluator, args []interface{}) (interface{}, error) {
+			n := 0
+			err := e.each(args, func(v interface{}, inRef bool) error {
+				if v != nil {
+					n++
+				}
+				return nil
+			})
+			return float64(n), err
+		},
+		"COUNTBLANK": func(e *evaluator, args []interface{}) (interface{}, error) {
+			n := 0
+			err := e.each(args, func(v interface{}, inRef bool) error {
+				if v == nil || v == "" {
+					n++
+				}
+				return nil
+			})
+			return float64(n), err
+		},
+		"SUMIF": func(e *evaluator, args []interface{}) (interface{}, error) {
+			sum := 0.0
+			err := e.ifs(args, func(v interface{}) {
+				if f, ok := v.(float64); ok {
+					sum += f
+				}
+			})
+			return sum, err
+		},
+		"COUNTIF": func(e *evaluator, args []interface{}) (interface{}, error) {
+			n := 0
+			err := e.ifs(args, func(interface{}) { n++ })
+			return float64(n), err
+		},
+		"SUMPRODUCT": sumproduct,
+
+		// Mathematics.
+		"ABS":   math1(math.Abs),
+		"INT":   math1(math.Floor),
+		"SQRT":  math1(math.Sqrt),
+		"EXP":   math1(math.Exp),
+		"LN":    math1(math.Log),
+		"LOG10": math1(math.Log10),
+		"SIGN": math1(func(f float64) float64 {
+			switch {
+			case f > 0:
+				return 1
+			case f < 0:
+				return -1
+			}
+			return 0
+		}),
+		"PI": func(e *evaluator, args []interface{}) (interface{}, error) {
+			return math.Pi, nil
+		},
+		"MOD": func(e *evaluator, args []interface{}) (interface{}, error) {
+			x, y, err := e.num2(args[0], args[1])
+			if err != nil {
+				return nil, err
+			}
+			if y == 0 {
+				return nil, errDiv0
+			}
+			return x - y*math.Floor(x/y), nil
+		},
+		"POWER": func(e *evaluator, args []interface{}) (interface{}, error) {
+			x, y, err := e.num2(args[0], args[1])
+			if err != nil {
+				return nil, err
+			}
+			return power(x, y)
+		},
+		"ROUND": roundFunc(func(f float64) float64 {
+			return math.Round(f)
+		}),
+		"ROUNDUP": roundFunc(func(f float64) float64 {
+			return math.Copysign(math.Ceil(math.Abs(f)), f)
+		}),
+		"ROUNDDOWN": roundFunc(math.Trunc),
+
+		// Logical functions.
+		"IF": func(e *evaluator, args []interface{}) (interface{}, error) {
+			cond, err := e.boolean(args[0])
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case cond && len(args) >= 2:
+				return missingAsZero(args[1]), nil
+			case !cond && len(args) == 3:
+				return missingAsZero(args[2]), nil
+			}
+			return false, nil
+		},
+		"IFERROR": func(e *evaluator, args []interface{}) (interface{}, error) {
+			if len(args) != 2 {
+				return nil, e.fail(ErrMalformedFormula, "IFERROR takes 2 arguments, not %d", len(args))
+			}
+			v, err := e.scalar(args[0])
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := v.(evalError); ok {
+				return missingAsZero(args[1]), nil
+			}
+			return args[0], nil
+		},
+		"AND": func(e *evaluator, args []interface{}) (interface{}, error) {
+			return e.logical(args, true)
+		},
+		"OR": func(e *evaluator, args []interface{}) (interface{}, error) {
+			return e.logical(args, false)
+		},
+		"NOT": func(e *evaluator, args []interface{}) (interface{}, error) {
+			b, err := e.boolean(args[0])
+			return !b, err
+		},
+		"TRUE": func(e *evaluator, args []interface{}) (interface{}, error) {
+			return true, nil
+		},
+		"FALSE": func(e *evaluator, args []interface{}) (interface{}, error) {
+			return false, nil
+		},
+
+		// Information functions.
+		"ISERROR": is(func(v interface{}) bool {
+			_, ok := v.(evalError)
+			return ok
+		}),
+		"ISERR": is(func(v interface{}) bool {
+			xe, ok := v.(evalError)
+			return ok && xe != errNA
+		}),
+		"ISNA": is(func(v interface{}) bool {
+			return v == errNA
+		}),
+		"ISBLANK": is(func(v interface{}) bool {
+			return v == nil
+		}),
+		"ISNUMBER": is(func(v interface{}) bool {
+			_, ok := v.(float64)
+			return ok
+		}),
+		"ISTEXT": is(func(v interface{}) bool {
+			_, ok := v.(string)
+			return ok
+		}),
+		"ISNONTEXT": is(func(v interface{}) bool {
+			_, ok := v.(string)
+			return !ok
+		}),
+		"ISLOGICAL": is(func(v interface{}) bool {
+			_, ok := v.(bool)
+			return ok
+		}),
+		"NA": func(e *evaluator, args []interface{}) (interface{}, error) {
+			return errNA, nil
+		},
+
+		// Lookup and reference functions.
+		"VLOOKUP": func(e *evaluator, args []interface{}) (interface{}, error) {
+			return e.lookup(args, true)
+		},
+		"HLOOKUP": func(e *evaluator, args []interface{}) (interface{}, error) {
+			return e.lookup(args, false)
+		},
+		"MATCH":  match,
+		"INDEX":  index,
+		"CHOOSE": choose,
+		"ROW": func(e *evaluator, args []interface{}) (interface{}, error) {
+			a, err := e.refArg(args, 0)
+			if err != nil {
+				return nil, err
+			}
+			return float64(a.r1 + 1), nil
+		},
+		"COLUMN": func(e *evaluator, args []interface{}) (interface{}, error) {
+			a, err := e.refArg(args, 0)
+			if err != nil {
+				return nil, err
+			}
+			return float64(a.c1 + 1), nil
+		},
+		"ROWS": func(e *evaluator, args []interface{}) (interface{}, error) {
+			a, err := e.refArg(args, 0)
+			if err != nil {
+				return nil, err
+			}
+			return float64(a.r2 - a.r1), nil
+		},
+		"COLUMNS": func(e *evaluator, args []interface{}) (interface{}, error) {
+			a, err := e.refArg(args, 0)
+			if err != nil {
+				return nil, err
+			}
+			return float64(a.c2 - a.c1), nil
+		},
+
+		// Text functions.
+		"LEN": func(e *evaluator, args []interface{}) (interface{}, error) {
+			s, err := e.str(args[0])
+			return float64(len([]rune(s))), err
+		},
+		"LEFT": func(e *evaluator, args []interface{}) (interface{}, error) {
+			s, n, err := e.textCount(args)
+			if err != nil {
+				return nil, err
+			}
+			return string(s[:n]), nil
+		},
+		"RIGHT": func(e *evaluator, args []interface{}) (interface{}, error) {
+			s, n, err := e.textCount(args)
+			if err != nil {
+				return nil, err
+			}
+			return string(s[len(s)-n:]), nil
+		},
+		"MID": func(e *evaluator, args []interface{}) (interface{}, error) {
+			s, err := e.str(args[0])
+			if err != nil {
+				return nil, err
+			}
+			start, n, err := e.num2(args[1], args[2])
+			if err != nil {
+				return nil, err
+			}
+			i, err := truncArg(start, 1, math.MaxInt32)
+			if err != nil {
+				return nil, err
+			}
+			count, err := truncArg(n, 0, math.MaxInt32)
+			if err != nil {
+				return nil, err
+			}
+			r := []rune(s)
+			i = min(i-1, len(r))
+			return string(r[i:min(i+count, len(r))]), nil
+		},
+		"UPPER": text1(strings.ToUpper),
+		"LOWER": text1(strings.ToLower),
+		"TRIM": text1(func(s string) string {
+			return strings.Join(strings.FieldsFunc(s, func(r rune) bool { return r == ' ' }), " ")
+		}),
+		"PROPER": text1(func(s string) string {
+			r := []rune(strings.ToLower(s))
+			for i := range r {
+				if i == 0 || !unicode.IsLetter(r[i-1]) {
+					r[i] = unicode.ToUpper(r[i])
+				}
+			}
+			return string(r)
+		}),
+		"CONCATENATE": func(e *evaluator, args []interface{}) (interface{}, error) {
+			var b strings.Builder
+			for _, arg := range args {
+				s, err := e.str(arg)
+				if err != nil {
+					return nil, err
+				}
+				b.WriteString(s)
+			}
+			return b.String(), nil
+		},
+		"REPT": func(e *evaluator, args []interface{}) (interface{}, error) {
+			s, err := e.str(args[0])
+			if err != nil {
+				return nil, err
+			}
+			n, err := e.num(args[1])
+			if err != nil {
+				return nil, err
+			}
+			count, err := truncArg(n, 0, maxTextLen)
+			if err != nil {
+				return nil, err
+			}
+			if len(s)*count > maxTextLen {
+				return nil, errValue
+			}
+			return strings.Repeat(s, count), nil
+		},
+		"EXACT": func(e *evaluator, args []interface{}) (interface{}, error) {
+			a, err := e.str(args[0])
+			if err != nil {
+				return nil, err
+			}
+			b, err := e.str(args[1])
+			return a == b, err
+		},
+		"VALUE": func(e *evaluator, args []interface{}) (interface{}, error) {
+			v, err := e.scalar(args[0])
+			if err != nil {
+				return nil, err
+			}
+			if s, ok := v.(string); ok {
+				if f, ok := parseNumber(s); ok {
+					return f, nil
+				}
+				return nil, errValue
+			}
+			return e.num(v)
+		},
+		"FIND": func(e *evaluator, args []interface{}) (interface{}, error) {
+			return e.find(args, false)
+		},
+		"SEARCH": func(e *evaluator, args []interface{}) (interface{}, error) {
+			return e.find(args, true)
+		},
+		"SUBSTITUTE": substitute,
+
+		// Date and time functions.
+		"DATE": func(e *evaluator, args []interface{}) (interface{}, error) {
+			var ymd [3]int
+			for i := range ymd {
+				f, err := e.num(args[i])
+				if err != nil {
+					return nil, err
+				}
+				// Beyond this, the date is out of range whatever the
+				// other parts.
+				if math.Abs(f) >= 1e7 {
+					return nil, errNum
+				}
+				ymd[i] = int(f)
+			}
+			if ymd[0] < 1900 {
+				ymd[0] += 1900
+			}
+			if ymd[0] < 1900 || ymd[0] > 9999 {
+				return nil, errNum
+			}
+			t := time.Date(ymd[0], time.Month(ymd[1]), ymd[2], 0, 0, 0, 0, time.UTC)
+			serial := e.dateSerial(t)
+			if serial < 0 || t.Year() > 9999 {
+				return nil, errNum
+			}
+			return serial, nil
+		},
+		"TIME": func(e *evaluator, args []interface{}) (interface{}, error) {
+			secs := 0.0
+			for i, unit := range []float64{3600, 60, 1} {
+				f, err := e.num(args[i])
+				if err != nil {
+					return nil, err
+				}
+				secs += math.Trunc(f) * unit
+			}
+			if !(secs >= 0) || math.IsInf(secs, 0) {
+				return nil, errNum
+			}
+			return math.Mod(secs, 86400) / 86400, nil
+		},
+		"YEAR":   dayPart(0),
+		"MONTH":  dayPart(1),
+		"DAY":    dayPart(2),
+		"HOUR":   datePart(func(t time.Time) int { return t.Hour() }),
+		"MINUTE": datePart(func(t time.Time) int { return t.Minute() }),
+		"SECOND": datePart(func(t time.Time) int { return t.Second() }),
+		"WEEKDAY": func(e *evaluator, args []interface{}) (interface{}, error) {
+			t, serial, err := e.dateArg(args[0])
+			if err != nil {
+				return nil, err
+			}
+			if e.book.Datemode != 1 && serial < 61 {
+				// Counting 29 February 1900 puts the earlier
+				// weekdays a day behind.
+				t = t.AddDate(0, 0, -1)
+			}
+			kind := 1.0
+			if len(args) > 1 {
+				if kind, err = e.num(args[1]); err != nil {
+					return nil, err
+				}
+			}
+			wd := int(t.Weekday())
+			switch kind {
+			case 1:
+				return float64(wd + 1), nil
+			case 2:
+				return float64((wd+6)%7 + 1), nil
+			case 3:
+				return float64((wd + 6) % 7), nil
+			}
+			return nil, errNum
+		},
+		"TODAY": func(e *evaluator, args []interface{}) (interface{}, error) {
+			now := timeNow()
+			return e.dateSerial(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)), nil
+		},
+		"NOW": func(e *evaluator, args []interface{}) (interface{}, error) {
+			now := timeNow()
+			t := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second(), 0, time.UTC)
+			return e.dateSerial(t), nil
+		},
+	}
+}
+
+// maxTextLen is the maximum length of a text value.
+const maxTextLen = 32767
+
+// truncArg truncates a numeric argument to an integer, giving #VALUE!
+// unless it lies between lo and hi.
+func truncArg(f float64, lo, hi int) (int, error) {
+	f = math.Trunc(f)
+	if !(f >= float64(lo) && f <= float64(hi)) {
+		return 0, errValue
+	}
+	return int(f), nil
+}
+
+// missingAsZero returns v, or 0 for an omitted argument.
+func missingAsZero(v interface{}) interface{} {
+	if _, ok := v.(evalMissing); ok {
+		return 0.0
+	}
+	return v
+}
+
+// each calls fn with every value among args: the cells of references, with
+// inRef set, and the other arguments themselves. Omitted arguments are
+// skipped.
+func (e *evaluator) each(args []interface{}, fn func(v interface{}, inRef bool) error) error {
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case evalRef:
+			if err := e.eachCell(arg, func(_, _ int, v interface{}) error { return fn(v, true) }); err != nil {
+				return err
+			}
+		case evalMissing:
+		default:
+			if err := fn(arg, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// eachCell calls fn with the offset and value of every cell of ref that
+// lies within its sheet's used area; cells beyond it are empty.
+func (e *evaluator) eachCell(ref evalRef, fn func(i, j int, v interface{}) error) error {
+	for _, a := range ref {
+		s, err := e.book.SheetByIndex(a.shx)
+		if err != nil {
+			return err
+		}
+		for rowx := a.r1; rowx < min(a.r2, s.NRows); rowx++ {
+			for colx := a.c1; colx < min(a.c2, s.NCols); colx++ {
+				v, err := e.cellValue(a.shx, rowx, colx)
+				if err != nil {
+					return err
+				}
+				if err := fn(rowx-a.r1, colx-a.c1, v); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// numbers calls fn with each number among args, as SUM sees them: the
+// numbers in referenced cells, and the other arguments converted to
+// numbers. Error values, from cells or arguments, are returned.
+func (e *evaluator) numbers(args []interface{}, fn func(float64)) error {
+	return e.each(args, func(v interface{}, inRef bool) error {
+		if xe, ok := v.(evalError); ok {
+			return xe
+		}
+		if inRef {
+			if f, ok := v.(float64); ok {
+				fn(f)
+			}
+			return nil
+		}
+		f, err := e.num(v)
+		if err == nil {
+			fn(f)
+		}
+		return err
+	})
+}
+
+// extreme returns the smallest (sign -1) or largest (sign 1) of the
+// numbers among args, or 0 if there are none.
+func (e *evaluator) extreme(args []interface{}, sign float64) (interface{}, error) {
+	best, found := 0.0, false
+	err := e.numbers(args, func(f float64) {
+		if !found || (f-best)*sign > 0 {
+			best, found = f, true
+		}
+	})
+	return best, err
+}
+
+// logical computes AND (all set) or OR of the logical values among args.
+func (e *evaluator) logical(args []interface{}, all bool) (interface{}, error) {
+	result, found := all, false
+	err := e.each(args, func(v interface{}, inRef bool) error {
+		if _, ok := v.(string); ok && inRef || v == nil {
+			return nil
+		}
+		b, err := e.boolean(v)
+		if err != nil {
+			return err
+		}
+		found = true
+		if b != all {
+			result = !all
+		}
+		return nil
+	})
+	if err == nil && !found {
+		return nil, errValue
+	}
+	return result, err
+}
+
+// num2 converts two arguments to numbers.
+func (e *evaluator) num2(a, b interface{}) (float64, float64, error) {
+	x, err := e.num(a)
+	if err != nil {
+		return 0, 0, err
+	}
+	y, err := e.num(b)
+	return x, y, err
+}
+
+// math1 returns a function of one number, giving #NUM! for results that
+// are not finite.
+func math1(f func(float64) float64) evalFunc {
+	return func(e *evaluator, args []interface{}) (interface{}, error) {
+		x, err := e.num(args[0])
+		if err != nil {
+			return nil, err
+		}
+		r := f(x)
+		if math.IsNaN(r) || math.IsInf(r, 0) {
+			return nil, errNum
+		}
+		return r, nil
+	}
+}
+
+// roundFunc returns ROUND, ROUNDUP or ROUNDDOWN given how they round to
+// an integer.
+func roundFunc(round func(float64) float64) evalFunc {
+	return func(e *evaluator, args []interface{}) (interface{}, error) {
+		x, digits, err := e.num2(args[0], args[1])
+		if err != nil {
+			return nil, err
+		}
+		p := math.Pow(10, math.Max(-308, math.Min(308, math.Trunc(digits))))
+		if math.IsInf(x*p, 0) {
+			// x has no digits that far right of the point.
+			return x, nil
+		}
+		// Keep 15 significant digits, as Excel does, so that 2.675 is
+		// rounded as written rather than as stored.
+		scaled, _ := strconv.ParseFloat(strconv.FormatFloat(x*p, 'g', 15, 64), 64)
+		return round(scaled) / p, nil
+	}
+}
+
+// is returns an IS function testing its argument's value.
+func is(test func(v interface{}) bool) evalFunc {
+	return func(e *evaluator, args []interface{}) (interface{}, error) {
+		v, err := e.scalar(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return test(v), nil
+	}
+}
+
+// text1 returns a function transforming a text.
+func text1(f func(string) string) evalFunc {
+	return func(e *evaluator, args []interface{}) (interface{}, error) {
+		s, err := e.str(args[0])
+		return f(s), err
+	}
+}
+
+// textCount returns the text and character count arguments of LEFT and
+// RIGHT, the count limited to the length of the text.
+func (e *evaluator) textCount(args []interface{}) ([]rune, int, error) {
+	s, err := e.str(args[0])
+	if err != nil {
+		return nil, 0, err
+	}
+	n := 1.0
+	if len(args) > 1 {
+		if n, err = e.num(args[1]); err != nil {
+			return nil, 0, err
+		}
+	}
+	count, err := truncArg(n, 0, math.MaxInt32)
+	if err != nil {
+		return nil, 0, err
+	}
+	r := []rune(s)
+	return r, min(count, len(r)), nil
+}
+
+// find implements FIND and, with fold set, SEARCH, which ignores case.
+func (e *evaluator) find(args []interface{}, fold bool) (interface{}, error) {
+	needle, err := e.str(args[0])
+	if err != nil {
+		return nil, err
+	}
+	haystack, err := e.str(args[1])
+	if err != nil {
+		return nil, err
+	}
+	start := 1.0
+	if len(args) > 2 {
+		if start, err = e.num(args[2]); err != nil {
+			return nil, err
+		}
+	}
+	r := []rune(haystack)
+	first, err := truncArg(start, 1, len(r)+1)
+	if err != nil {
+		return nil, err
+	}
+	if fold {
+		needle, r = strings.ToLower(needle), []rune(strings.ToLower(haystack))
+	}
+	i := strings.Index(string(r[first-1:]), needle)
+	if i < 0 {
+		return nil, errValue
+	}
+	return float64(first + len([]rune(string(r[first-1:])[:i]))), nil
+}
+
+func substitute(e *evaluator, args []interface{}) (interface{}, error) {
+	var s [3]string
+	for i := range s {
+		var err error
+		if s[i], err = e.str(args[i]); err != nil {
+			return nil, err
+		}
+	}
+	if s[1] == "" {
+		return s[0], nil
+	}
+	if len(args) < 4 {
+		return strings.ReplaceAll(s[0], s[1], s[2]), nil
+	}
+	f, err := e.num(args[3])
+	if err != nil {
+		return nil, err
+	}
+	n, err := truncArg(f, 1, math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	pos := 0
+	for i := 1; ; i++ {
+		j := strings.Index(s[0][pos:], s[1])
+		if j < 0 {
+			return s[0], nil
+		}
+		pos += j
+		if i == n {
+			return s[0][:pos] + s[2] + s[0][pos+len(s[1]):], nil
+		}
+		pos += len(s[1])
+	}
+}
+
+// area returns the single area of a reference argument.
+func (e *evaluator) area(v interface{}) (evalArea, error) {
+	if xe, ok := v.(evalError); ok {
+		return evalArea{}, xe
+	}
+	ref, ok := v.(evalRef)
+	if !ok || len(ref) != 1 {
+		return evalArea{}, errValue
+	}
+	return ref[0], nil
+}
+
+// refArg returns the area of argument i of ROW, COLUMN, ROWS or COLUMNS,
+// which defaults to the formula cell.
+func (e *evaluator) refArg(args []interface{}, i int) (evalArea, error) {
+	if i >= len(args) {
+		c := e.cur
+		return evalArea{c.shx, c.rowx, c.rowx + 1, c.colx, c.colx + 1}, nil
+	}
+	return e.area(args[i])
+}
+
+// areaValue returns the value of the cell at offset i, j in area a.
+func (e *evaluator) areaValue(a evalArea, i, j int) (interface{}, error) {
+	return e.cellValue(a.shx, a.r1+i, a.c1+j)
+}
+
+// lookup implements VLOOKUP and, with vertical unset, HLOOKUP.
+func (e *evaluator) lookup(args []interface{}, vertical bool) (interface{}, error) {
+	key, err := e.scalar(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if xe, ok := key.(evalError); ok {
+		return nil, xe
+	}
+	table, err := e.area(args[1])
+	if err != nil {
+		return nil, err
+	}
+	n, err := e.num(args[2])
+	if err != nil {
+		return nil, err
+	}
+	approx := true
+	if len(args) > 3 {
+		if _, ok := args[3].(evalMissing); !ok {
+			if approx, err = e.boolean(args[3]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	length, width := table.r2-table.r1, table.c2-table.c1
+	if !vertical {
+		length, width = width, length
+	}
+	if n < 1 {
+		return nil, errValue
+	}
+	if n >= float64(width)+1 {
+		return nil, errRef
+	}
+	at := func(i, j int) (interface{}, error) {
+		if vertical {
+			return e.areaValue(table, i, j)
+		}
+		return e.areaValue(table, j, i)
+	}
+	i, err := e.search(key, length, approx, 1, func(i int) (interface{}, error) { return at(i, 0) })
+	if err != nil {
+		return nil, err
+	}
+	return at(i, int(n)-1)
+}
+
+// search returns the position of key among n values, as MATCH does with
+// the given match type: 0 for an exact match, 1 for the largest value not
+// greater than key in ascending values, and -1 for the smallest value not
+// less than key in descending values. When approx is false, the match is
+// exact whatever the type.
+func (e *evaluator) search(key interface{}, n int, approx bool, matchType int, value func(i int) (interface{}, error)) (int, error) {
+	if !approx {
+		matchType = 0
+	}
+	found := -1
+	for i := 0; i < n; i++ {
+		v, err := value(i)
+		if err != nil {
+			return 0, err
+		}
+		if v == nil || typeRank(v) != typeRank(key) {
+			continue
+		}
+		c := compareValues(v, key)
+		switch {
+		case matchType == 0 && c == 0:
+			return i, nil
+		case matchType == 0:
+		case c*matchType <= 0:
+			found = i
+		default:
+			// Past the key in sorted values.
+			i = n
+		}
+	}
+	if found < 0 {
+		return 0, errNA
+	}
+	return found, nil
+}
+
+func match(e *evaluator, args []interface{}) (interface{}, error) {
+	key, err := e.scalar(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if xe, ok := key.(evalError); ok {
+		return nil, xe
+	}
+	a, err := e.area(args[1])
+	if err != nil {
+		return nil, err
+	}
+	matchType := 1.0
+	if len(args) > 2 {
+		if matchType, err = e.num(args[2]); err != nil {
+			return nil, err
+		}
+	}
+	rows, cols := a.r2-a.r1, a.c2-a.c1
+	if rows != 1 && cols != 1 {
+		return nil, errNA
+	}
+	mt := 0
+	if matchType > 0 {
+		mt = 1
+	} else if matchType < 0 {
+		mt = -1
+	}
+	i, err := e.search(key, rows*cols, true, mt, func(i int) (interface{}, error) {
+		if cols == 1 {
+			return e.areaValue(a, i, 0)
+		}
+		return e.areaValue(a, 0, i)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return float64(i + 1), nil
+}
+
+// index implements the reference form of INDEX: it returns a reference to
+// a cell, or to a whole row or column when the other index is 0.
+func index(e *evaluator, args []interface{}) (interface{}, error) {
+	if xe, ok := args[0].(evalError); ok {
+		return nil, xe
+	}
+	ref, ok := args[0].(evalRef)
+	if !ok {
+		return nil, errValue
+	}
+	var idx [3]int
+	idx[2] = 1
+	for i := 1; i < len(args) && i <= 3; i++ {
+		if _, ok := args[i].(evalMissing); ok {
+			continue
+		}
+		f, err := e.num(args[i])
+		if err != nil {
+			return nil, err
+		}
+		if idx[i-1], err = truncArg(f, 0, math.MaxInt32); err != nil {
+			return nil, err
+		}
+	}
+	if idx[2] < 1 || idx[2] > len(ref) {
+		return nil, errRef
+	}
+	a := ref[idx[2]-1]
+	row, col := idx[0], idx[1]
+	if len(args) == 2 && a.r2-a.r1 == 1 {
+		// INDEX(row_range, n) picks along the row.
+		row, col = 0, row
+	}
+	if row < 0 || col < 0 || row > a.r2-a.r1 || col > a.c2-a.c1 {
+		return nil, errRef
+	}
+	if row > 0 {
+		a.r1, a.r2 = a.r1+row-1, a.r1+row
+	}
+	if col > 0 {
+		a.c1, a.c2 = a.c1+col-1, a.c1+col
+	}
+	return evalRef{a}, nil
+}
+
+func choose(e *evaluator, args []interface{}) (interface{}, error) {
+	f, err := e.num(args[0])
+	if err != nil {
+		return nil, err
+	}
+	i, err := truncArg(f, 1, len(args)-1)
+	if err != nil {
+		return nil, err
+	}
+	return missingAsZero(args[i]), nil
+}
+
+// ifs applies SUMIF or COUNTIF: fn is called with the value matching each
+// cell of the range that meets the criterion, taken from the sum range if
+// there is one.
+func (e *evaluator) ifs(args []interface{}, fn func(v interface{})) error {
+	a, err := e.area(args[0])
+	if err != nil {
+		return err
+	}
+	crit, err := e.criterion(args[1])
+	if err != nil {
+		return err
+	}
+	target := a
+	if len(args) > 2 {
+		if target, err = e.area(args[2]); err != nil {
+			return err
+		}
+	}
+	return e.eachCell(evalRef{a}, func(i, j int, v interface{}) error {
+		if !crit(v) {
+			return nil
+		}
+		tv, err := e.areaValue(target, i, j)
+		if err == nil {
+			fn(tv)
+		}
+		return err
+	})
+}
+
+// criterion returns the test described by a SUMIF or COUNTIF criterion: a
+// value to equal, or text such as ">=10" or "<>x" comparing with a value.
+// Text may use the wildcards * and ?.
+func (e *evaluator) criterion(v interface{}) (func(interface{}) bool, error) {
+	v, err := e.scalar(v)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return func(x interface{}) bool {
+			return x != nil && typeRank(x) == typeRank(v) && compareValues(x, v) == 0
+		}, nil
+	}
+	op := ""
+	for _, prefix := range []string{"<>", "<=", ">=", "<", ">", "="} {
+		if strings.HasPrefix(s, prefix) {
+			op, s = prefix, s[len(prefix):]
+			break
+		}
+	}
+	var want interface{} = s
+	if f, ok := parseNumber(s); ok {
+		want = f
+	} else if b := strings.ToUpper(s); b == "TRUE" || b == "FALSE" {
+		want = b == "TRUE"
+	}
+	return func(x interface{}) bool {
+		if op == "" || op == "=" || op == "<>" {
+			eq := false
+			if ws, ok := want.(string); ok {
+				xs, isText := x.(string)
+				eq = isText && wildcardMatch(strings.ToLower(ws), strings.ToLower(xs)) ||
+					ws == "" && x == nil
+			} else {
+				eq = x != nil && typeRank(x) == typeRank(want) && compareValues(x, want) == 0
+			}
+			return eq != (op == "<>")
+		}
+		if x == nil || typeRank(x) != typeRank(want) {
+			return false
+		}
+		c := compareValues(x, want)
+		switch op {
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		}
+		return c >= 0
+	}, nil
+}
+
+// Pattern runes standing for the wildcards ? and *.
+const (
+	wildcardAny  rune = -1
+	wildcardText rune = -2
+)
+
+// wildcardMatch reports whether s matches pattern, in which * matches any
+// text, ? any character, and ~ escapes the next character.
+func wildcardMatch(pattern, s string) bool {
+	var p []rune
+	pr := []rune(pattern)
+	for i := 0; i < len(pr); i++ {
+		switch {
+		case pr[i] == '~' && i+1 < len(pr):
+			i++
+			p = append(p, pr[i])
+		case pr[i] == '?':
+			p = append(p, wildcardAny)
+		case pr[i] == '*':
+			p = append(p, wildcardText)
+		default:
+			p = append(p, pr[i])
+		}
+	}
+	// Match one rune at a time; on a mismatch, let the last * seen match
+	// one more rune and resume after it. Earlier stars need not be
+	// retried, since the last one can absorb any text they would.
+	r := []rune(s)
+	i, j, star, mark := 0, 0, -1, 0
+	for j < len(r) {
+		switch {
+		case i < len(p) && (p[i] == wildcardAny || p[i] == r[j]):
+			i++
+			j++
+		case i < len(p) && p[i] == wildcardText:
+			star, mark = i, j
+			i++
+		case star >= 0:
+			mark++
+			i, j = star+1, mark
+		default:
+			return false
+		}
+	}
+	for i < len(p) && p[i] == wildcardText {
+		i++
+	}
+	return i == len(p)
+}
+
+func sumproduct(e *evaluator, args []interface{}) (interface{}, error) {
+	var areas []evalArea
+	for _, arg := range args {
+		a, err := e.area(arg)
+		if err != nil {
+			return nil, err
+		}
+		if len(areas) > 0 && (a.r2-a.r1 != areas[0].r2-areas[0].r1 || a.c2-a.c1 != areas[0].c2-areas[0].c1) {
+			return nil, errValue
+		}
+		areas = append(areas, a)
+	}
+	// Products involving cells beyond the used area of a sheet are 0.
+	rows, cols := areas[0].r2-areas[0].r1, areas[0].c2-areas[0].c1
+	for _, a := range areas {
+		s, err := e.book.SheetByIndex(a.shx)
+		if err != nil {
+			return nil, err
+		}
+		rows, cols = min(rows, s.NRows-a.r1), min(cols, s.NCols-a.c1)
+	}
+	sum := 0.0
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			product := 1.0
+			for _, a := range areas {
+				v, err := e.areaValue(a, i, j)
+				if err != nil {
+					return nil, err
+				}
+				if xe, ok := v.(evalError); ok {
+					return nil, xe
+				}
+				f, _ := v.(float64)
+				product *= f
+			}
+			sum += product
+		}
+	}
+	return sum, nil
+}
+
+// Dates are serial numbers counting days from the epoch of the book's
+// date system. In the 1900 system, Excel counts the nonexistent 29
+// February 1900 as day 60.
+var (
+	serialEpoch1900 = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	serialEpoch1904 = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// dateSerial returns the serial number of t, a time in UTC.
+func (e *evaluator) dateSerial(t time.Time) float64 {
+	if e.book.Datemode == 1 {
+		return t.Sub(serialEpoch1904).Hours() / 24
+	}
+	serial := t.Sub(serialEpoch1900).Hours() / 24
+	if serial < 61 {
+		serial--
+	}
+	return serial
+}
+
+// dateArg converts a serial number argument to a time in UTC, and returns
+// the serial number with it. Serials 0 and 60 of the 1900 system give
+// 1899-12-31 and 1900-03-01.
+func (e *evaluator) dateArg(v interface{}) (time.Time, float64, error) {
+	serial, err := e.num(v)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if serial < 0 || serial >= 1e7 {
+		return time.Time{}, 0, errNum
+	}
+	days := math.Floor(serial)
+	secs := math.Round((serial - days) * 86400)
+	epoch := serialEpoch1904
+	if e.book.Datemode != 1 {
+		epoch = serialEpoch1900
+		if days < 61 {
+			days++
+		}
+	}
+	t := epoch.AddDate(0, 0, int(days)).Add(time.Duration(secs) * time.Second)
+	if t.Year() > 9999 {
+		return time.Time{}, 0, errNum
+	}
+	return t, serial, nil
+}
+
+// datePart returns a function extracting part of a time.
+func datePart(part func(time.Time) int) evalFunc {
+	return func(e *evaluator, args []interface{}) (interface{}, error) {
+		t, _, err := e.dateArg(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return float64(part(t)), nil
+	}
+}
+
+// dayPart returns a function extracting the year (i = 0), month (1) or
+// day (2) of a date. In the 1900 system, Excel shows serial 0 as
+// 1900-01-00 and serial 60 as 1900-02-29, which time.Time cannot hold.
+func dayPart(i int) evalFunc {
+	return func(e *evaluator, args []interface{}) (interface{}, error) {
+		t, serial, err := e.dateArg(args[0])
+		if err != nil {
+			return nil, err
+		}
+		ymd := [3]int{t.Year(), int(t.Month()), t.Day()}
+		if e.book.Datemode != 1 {
+			switch math.Floor(serial) {
+			case 0:
+				ymd = [3]int{1900, 1, 0}
+			case 60:
+				ymd = [3]int{1900, 2, 29}
+			}
+		}
+		return float64(ymd[i]), nil
+	}
+}
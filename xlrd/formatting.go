@@ -509,10 +509,7 @@ func checkColourIndexesInObj(book *Book, obj interface{}, origIndex int) {
 				book.ColourIndexesUsed[val] = true
 				continue
 			}
-			if book.verbosity > 0 {
-				oname := t.Name()
-				fmt.Fprintf(book.logfile, "*** xf #%d : %s.%s =  0x%04x (unknown)\n", origIndex, oname, fieldName, val)
-			}
+			book.diag(SeverityNote, DiagColourIndex, "xf #%d : %s.%s = 0x%04x (unknown colour index)", origIndex, t.Name(), fieldName, val)
 			continue
 		}
 		switch field.Kind() {
@@ -596,14 +593,11 @@ func IsDateFormatString(book *Book, formatStr string) bool {
 		return false
 	}
 	if dateCount > 0 {
-		if book.verbosity >= 1 {
-			fmt.Fprintf(book.logfile,
-				"WARNING *** is_date_format: ambiguous d=%d n=%d fmt=%q\n",
-				dateCount, numCount, formatStr)
-		}
+		book.diag(SeverityNote, DiagAmbiguousDateFormat,
+			"is_date_format: ambiguous d=%d n=%d fmt=%q", dateCount, numCount, formatStr)
 	}
-	if !gotSep && dateCount == 0 && book.verbosity >= 1 {
-		fmt.Fprintf(book.logfile, "WARNING *** format %q produces constant result\n", formatStr)
+	if !gotSep && dateCount == 0 {
+		book.diag(SeverityNote, DiagConstantFormat, "format %q produces constant result", formatStr)
 	}
 	return dateCount > numCount
 }
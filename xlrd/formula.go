@@ -4,18 +4,14 @@ package xlrd
 import (
 	"encoding/binary"
 	"fmt"
-	"os"
+	"io"
+	"math"
 	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
 )
 
-// assert checks a condition and panics if false
-func assert(condition bool) {
-	if !condition {
-		panic("assertion failed")
-	}
-}
-
 // unpack unpacks binary data according to format string
 func unpack(format string, data []byte) (interface{}, error) {
 	if strings.HasPrefix(format, "<") {
@@ -47,7 +43,7 @@ func unpack(format string, data []byte) (interface{}, error) {
 			}
 			return []interface{}{binary.LittleEndian.Uint16(data[:2]), binary.LittleEndian.Uint16(data[2:])}, nil
 		case "hxxxxxxxxhh":
-			if len(data) < 15 {
+			if len(data) < 14 {
 				return nil, fmt.Errorf("not enough data")
 			}
 			return []interface{}{
@@ -55,21 +51,29 @@ func unpack(format string, data []byte) (interface{}, error) {
 				int16(binary.LittleEndian.Uint16(data[10:12])),
 				int16(binary.LittleEndian.Uint16(data[12:14])),
 			}, nil
+		case "hxxxxxxxxH":
+			if len(data) < 12 {
+				return nil, fmt.Errorf("not enough data")
+			}
+			return []interface{}{
+				int16(binary.LittleEndian.Uint16(data[:2])),
+				binary.LittleEndian.Uint16(data[10:12]),
+			}, nil
 		case "d":
 			if len(data) < 8 {
 				return nil, fmt.Errorf("not enough data")
 			}
-			return binary.LittleEndian.Uint64(data), nil
+			return math.Float64frombits(binary.LittleEndian.Uint64(data)), nil
 		case "x2H":
-			if len(data) < 4 {
+			if len(data) < 5 {
 				return nil, fmt.Errorf("not enough data")
 			}
-			return []interface{}{binary.LittleEndian.Uint16(data[2:4])}, nil
+			return []interface{}{binary.LittleEndian.Uint16(data[1:3]), binary.LittleEndian.Uint16(data[3:5])}, nil
 		case "xHB":
 			if len(data) < 4 {
 				return nil, fmt.Errorf("not enough data")
 			}
-			return []interface{}{binary.LittleEndian.Uint16(data[2:4]), uint8(data[3])}, nil
+			return []interface{}{binary.LittleEndian.Uint16(data[1:3]), uint8(data[3])}, nil
 		default:
 			return nil, fmt.Errorf("unsupported format: %s", format)
 		}
@@ -77,6 +81,20 @@ func unpack(format string, data []byte) (interface{}, error) {
 	return nil, fmt.Errorf("unsupported endianness: %s", format)
 }
 
+// operandInt returns the value of a constant operand as an int, and
+// whether it is a whole number.
+func operandInt(op *Operand) (int, bool) {
+	switch v := op.value.(type) {
+	case int:
+		return v, true
+	case uint8:
+		return int(v), true
+	case float64:
+		return int(v), v == math.Trunc(v) && math.Abs(v) < 1<<31
+	}
+	return 0, false
+}
+
 // copyOperand creates a deep copy of an Operand
 func copyOperand(op *Operand) *Operand {
 	if op == nil {
@@ -94,8 +112,26 @@ func copyOperand(op *Operand) *Operand {
 }
 
 // evaluateNameFormula evaluates a named formula recursively
-func evaluateNameFormula(bk *Book, tgtobj *Name, tgtnamex int, blah int, level int) {
-	EvaluateNameFormula(bk, tgtobj, tgtnamex, blah, level)
+func evaluateNameFormula(bk *Book, tgtobj *Name, tgtnamex int, blah int, level int) error {
+	return EvaluateNameFormula(bk, tgtobj, tgtnamex, blah, level)
+}
+
+// malformedToken returns the error for a formula token whose operands are
+// inconsistent with its definition.
+func malformedToken(op int, oname string, pos int) error {
+	return &FormulaError{message: fmt.Sprintf("Malformed formula: token 0x%02x (%s) at position %d", op, oname, pos)}
+}
+
+// recoverFormulaError turns a run-time panic caused by malformed formula
+// bytes (such as an index out of range) into an error.
+func recoverFormulaError(err *error) {
+	if r := recover(); r != nil {
+		re, ok := r.(runtime.Error)
+		if !ok {
+			panic(r)
+		}
+		*err = &FormulaError{message: fmt.Sprintf("Malformed formula: %v", re)}
+	}
 }
 
 // errorTextFromCode returns error text from error code
@@ -154,25 +190,35 @@ func getExternsheetLocalRangeB57(bk *Book, rawExtshtx, rawShx1, rawShx2 int, bla
 	return xlrdSheetx1, xlrdSheetx2
 }
 
+// sheetLabel returns the name of sheet shx, or a placeholder for the
+// special negative indexes and for indexes past the last sheet.
+func sheetLabel(bk *Book, shx int) string {
+	shnames := bk.SheetNames()
+	if shx >= 0 && shx < len(shnames) {
+		return shnames[shx]
+	}
+	return quotedsheetname(shnames, shx)
+}
+
 // rangename3d generates a range name for 3D reference
 func rangename3d(bk *Book, ref3d *Ref3D) string {
 	if ref3d.shtxlo == ref3d.shtxhi-1 {
-		shname := bk.SheetNames()[ref3d.shtxlo]
+		shname := sheetLabel(bk, ref3d.shtxlo)
 		return fmt.Sprintf("%s!%s", shname, cellrange(ref3d.rlo, ref3d.clo, ref3d.rhi-1, ref3d.chi-1))
 	}
-	shname1 := bk.SheetNames()[ref3d.shtxlo]
-	shname2 := bk.SheetNames()[ref3d.shtxhi-1]
+	shname1 := sheetLabel(bk, ref3d.shtxlo)
+	shname2 := sheetLabel(bk, ref3d.shtxhi-1)
 	return fmt.Sprintf("%s:%s!%s", shname1, shname2, cellrange(ref3d.rlo, ref3d.clo, ref3d.rhi-1, ref3d.chi-1))
 }
 
 // rangename3drel generates a relative range name for 3D reference
 func rangename3drel(bk *Book, ref3d *Ref3D, r1c1 int) string {
 	if ref3d.shtxlo == ref3d.shtxhi-1 {
-		shname := bk.SheetNames()[ref3d.shtxlo]
+		shname := sheetLabel(bk, ref3d.shtxlo)
 		return fmt.Sprintf("%s!%s", shname, cellrange_r1c1(ref3d.rlo, ref3d.clo, ref3d.rhi-1, ref3d.chi-1, ref3d.relflags))
 	}
-	shname1 := bk.SheetNames()[ref3d.shtxlo]
-	shname2 := bk.SheetNames()[ref3d.shtxhi-1]
+	shname1 := sheetLabel(bk, ref3d.shtxlo)
+	shname2 := sheetLabel(bk, ref3d.shtxhi-1)
 	return fmt.Sprintf("%s:%s!%s", shname1, shname2, cellrange_r1c1(ref3d.rlo, ref3d.clo, ref3d.rhi-1, ref3d.chi-1, ref3d.relflags))
 }
 
@@ -226,7 +272,7 @@ func colname(col int) string {
 }
 
 // hexCharDump dumps hex and character representation of data
-func hexCharDump(data []byte, ofs, dlen int, fout *os.File) {
+func hexCharDump(data []byte, ofs, dlen int, fout io.Writer) {
 	endpos := min(ofs+dlen, len(data))
 	pos := ofs
 	for pos < endpos {
@@ -261,7 +307,10 @@ func hexCharDump(data []byte, ofs, dlen int, fout *os.File) {
 }
 
 // unpackStringUpdatePos unpacks string and updates position
-func unpackStringUpdatePos(data []byte, pos int, encoding string, lenlen int) (string, int) {
+func unpackStringUpdatePos(data []byte, pos int, encoding string, lenlen int) (string, int, bool) {
+	if pos+lenlen > len(data) {
+		return "", pos, false
+	}
 	var strlen int
 	if lenlen == 1 {
 		strlen = int(data[pos])
@@ -270,37 +319,19 @@ func unpackStringUpdatePos(data []byte, pos int, encoding string, lenlen int) (s
 		strlen = int(binary.LittleEndian.Uint16(data[pos : pos+2]))
 		pos += 2
 	}
+	if pos+strlen > len(data) {
+		return "", pos, false
+	}
 	strbytes := data[pos : pos+strlen]
 	pos += strlen
 	// For simplicity, assume UTF-8 encoding
-	return string(strbytes), pos
+	return string(strbytes), pos, true
 }
 
 // unpackUnicodeUpdatePos unpacks unicode string and updates position
-func unpackUnicodeUpdatePos(data []byte, pos int, lenlen int) (string, int) {
-	var strlen int
-	if lenlen == 1 {
-		strlen = int(data[pos])
-		pos++
-	} else {
-		strlen = int(binary.LittleEndian.Uint16(data[pos : pos+2]))
-		pos += 2
-	}
-	// Unicode strings in Excel are UTF-16LE
-	strbytes := data[pos : pos+strlen*2]
-	pos += strlen * 2
-
-	// Convert UTF-16LE to string
-	utf16 := make([]uint16, strlen)
-	for i := 0; i < strlen; i++ {
-		utf16[i] = binary.LittleEndian.Uint16(strbytes[i*2 : i*2+2])
-	}
-
-	runes := make([]rune, 0, strlen)
-	for _, r := range utf16 {
-		runes = append(runes, rune(r))
-	}
-	return string(runes), pos
+func unpackUnicodeUpdatePos(data []byte, pos int, lenlen int) (string, int, bool) {
+	strg, newpos, err := UnpackUnicodeUpdatePos(data, pos, lenlen, nil)
+	return strg, newpos, err == nil
 }
 
 // min returns the minimum of two integers
@@ -450,21 +481,284 @@ type funcDef struct {
 
 // Function definitions
 var funcDefs = map[int]funcDef{
-	0: {"COUNT", 0, 30, 0x04, 1, "V", "R"},
-	1: {"IF", 2, 3, 0x04, 3, "V", "VRR"},
-	2: {"ISNA", 1, 1, 0x02, 1, "V", "V"},
-	3: {"ISERROR", 1, 1, 0x02, 1, "V", "V"},
-	4: {"SUM", 0, 30, 0x04, 1, "V", "R"},
-	5: {"AVERAGE", 1, 30, 0x04, 1, "V", "R"},
-	6: {"MIN", 1, 30, 0x04, 1, "V", "R"},
-	7: {"MAX", 1, 30, 0x04, 1, "V", "R"},
-	8: {"ROW", 0, 1, 0x04, 1, "V", "R"},
+	0:   {"COUNT", 0, 30, 0x04, 1, "V", "R"},
+	1:   {"IF", 2, 3, 0x04, 3, "V", "VRR"},
+	2:   {"ISNA", 1, 1, 0x02, 1, "V", "V"},
+	3:   {"ISERROR", 1, 1, 0x02, 1, "V", "V"},
+	4:   {"SUM", 0, 30, 0x04, 1, "V", "R"},
+	5:   {"AVERAGE", 1, 30, 0x04, 1, "V", "R"},
+	6:   {"MIN", 1, 30, 0x04, 1, "V", "R"},
+	7:   {"MAX", 1, 30, 0x04, 1, "V", "R"},
+	8:   {"ROW", 0, 1, 0x04, 1, "V", "R"},
+	9:   {"COLUMN", 0, 1, 0x04, 1, "V", "R"},
+	10:  {"NA", 0, 0, 0x02, 0, "V", ""},
+	11:  {"NPV", 2, 30, 0x04, 2, "V", "VR"},
+	12:  {"STDEV", 1, 30, 0x04, 1, "V", "R"},
+	13:  {"DOLLAR", 1, 2, 0x04, 1, "V", "V"},
+	14:  {"FIXED", 2, 3, 0x04, 3, "V", "VVV"},
+	15:  {"SIN", 1, 1, 0x02, 1, "V", "V"},
+	16:  {"COS", 1, 1, 0x02, 1, "V", "V"},
+	17:  {"TAN", 1, 1, 0x02, 1, "V", "V"},
+	18:  {"ATAN", 1, 1, 0x02, 1, "V", "V"},
+	19:  {"PI", 0, 0, 0x02, 0, "V", ""},
+	20:  {"SQRT", 1, 1, 0x02, 1, "V", "V"},
+	21:  {"EXP", 1, 1, 0x02, 1, "V", "V"},
+	22:  {"LN", 1, 1, 0x02, 1, "V", "V"},
+	23:  {"LOG10", 1, 1, 0x02, 1, "V", "V"},
+	24:  {"ABS", 1, 1, 0x02, 1, "V", "V"},
+	25:  {"INT", 1, 1, 0x02, 1, "V", "V"},
+	26:  {"SIGN", 1, 1, 0x02, 1, "V", "V"},
+	27:  {"ROUND", 2, 2, 0x02, 2, "V", "VV"},
+	28:  {"LOOKUP", 2, 3, 0x04, 2, "V", "VR"},
+	29:  {"INDEX", 2, 4, 0x0c, 4, "R", "RVVV"},
+	30:  {"REPT", 2, 2, 0x02, 2, "V", "VV"},
+	31:  {"MID", 3, 3, 0x02, 3, "V", "VVV"},
+	32:  {"LEN", 1, 1, 0x02, 1, "V", "V"},
+	33:  {"VALUE", 1, 1, 0x02, 1, "V", "V"},
+	34:  {"TRUE", 0, 0, 0x02, 0, "V", ""},
+	35:  {"FALSE", 0, 0, 0x02, 0, "V", ""},
+	36:  {"AND", 1, 30, 0x04, 1, "V", "R"},
+	37:  {"OR", 1, 30, 0x04, 1, "V", "R"},
+	38:  {"NOT", 1, 1, 0x02, 1, "V", "V"},
+	39:  {"MOD", 2, 2, 0x02, 2, "V", "VV"},
+	40:  {"DCOUNT", 3, 3, 0x02, 3, "V", "RRR"},
+	41:  {"DSUM", 3, 3, 0x02, 3, "V", "RRR"},
+	42:  {"DAVERAGE", 3, 3, 0x02, 3, "V", "RRR"},
+	43:  {"DMIN", 3, 3, 0x02, 3, "V", "RRR"},
+	44:  {"DMAX", 3, 3, 0x02, 3, "V", "RRR"},
+	45:  {"DSTDEV", 3, 3, 0x02, 3, "V", "RRR"},
+	46:  {"VAR", 1, 30, 0x04, 1, "V", "R"},
+	47:  {"DVAR", 3, 3, 0x02, 3, "V", "RRR"},
+	48:  {"TEXT", 2, 2, 0x02, 2, "V", "VV"},
+	49:  {"LINEST", 1, 4, 0x04, 4, "A", "RRVV"},
+	50:  {"TREND", 1, 4, 0x04, 4, "A", "RRRV"},
+	51:  {"LOGEST", 1, 4, 0x04, 4, "A", "RRVV"},
+	52:  {"GROWTH", 1, 4, 0x04, 4, "A", "RRRV"},
+	56:  {"PV", 3, 5, 0x04, 5, "V", "VVVVV"},
+	57:  {"FV", 3, 5, 0x04, 5, "V", "VVVVV"},
+	58:  {"NPER", 3, 5, 0x04, 5, "V", "VVVVV"},
+	59:  {"PMT", 3, 5, 0x04, 5, "V", "VVVVV"},
+	60:  {"RATE", 3, 6, 0x04, 6, "V", "VVVVVV"},
+	61:  {"MIRR", 3, 3, 0x02, 3, "V", "RVV"},
+	62:  {"IRR", 1, 2, 0x04, 2, "V", "RV"},
+	63:  {"RAND", 0, 0, 0x0a, 0, "V", ""},
+	64:  {"MATCH", 2, 3, 0x04, 3, "V", "VRR"},
+	65:  {"DATE", 3, 3, 0x02, 3, "V", "VVV"},
+	66:  {"TIME", 3, 3, 0x02, 3, "V", "VVV"},
+	67:  {"DAY", 1, 1, 0x02, 1, "V", "V"},
+	68:  {"MONTH", 1, 1, 0x02, 1, "V", "V"},
+	69:  {"YEAR", 1, 1, 0x02, 1, "V", "V"},
+	70:  {"WEEKDAY", 1, 2, 0x04, 2, "V", "VV"},
+	71:  {"HOUR", 1, 1, 0x02, 1, "V", "V"},
+	72:  {"MINUTE", 1, 1, 0x02, 1, "V", "V"},
+	73:  {"SECOND", 1, 1, 0x02, 1, "V", "V"},
+	74:  {"NOW", 0, 0, 0x0a, 0, "V", ""},
+	75:  {"AREAS", 1, 1, 0x02, 1, "V", "R"},
+	76:  {"ROWS", 1, 1, 0x02, 1, "V", "R"},
+	77:  {"COLUMNS", 1, 1, 0x02, 1, "V", "R"},
+	78:  {"OFFSET", 3, 5, 0x04, 5, "R", "RVVVV"},
+	82:  {"SEARCH", 2, 3, 0x04, 3, "V", "VVV"},
+	83:  {"TRANSPOSE", 1, 1, 0x02, 1, "A", "A"},
+	86:  {"TYPE", 1, 1, 0x02, 1, "V", "V"},
+	92:  {"SERIESSUM", 4, 4, 0x02, 4, "V", "VVVA"},
+	97:  {"ATAN2", 2, 2, 0x02, 2, "V", "VV"},
+	98:  {"ASIN", 1, 1, 0x02, 1, "V", "V"},
+	99:  {"ACOS", 1, 1, 0x02, 1, "V", "V"},
+	100: {"CHOOSE", 2, 30, 0x04, 2, "V", "VR"},
+	101: {"HLOOKUP", 3, 4, 0x04, 4, "V", "VRRV"},
+	102: {"VLOOKUP", 3, 4, 0x04, 4, "V", "VRRV"},
+	105: {"ISREF", 1, 1, 0x02, 1, "V", "R"},
+	109: {"LOG", 1, 2, 0x04, 2, "V", "VV"},
+	111: {"CHAR", 1, 1, 0x02, 1, "V", "V"},
+	112: {"LOWER", 1, 1, 0x02, 1, "V", "V"},
+	113: {"UPPER", 1, 1, 0x02, 1, "V", "V"},
+	114: {"PROPER", 1, 1, 0x02, 1, "V", "V"},
+	115: {"LEFT", 1, 2, 0x04, 2, "V", "VV"},
+	116: {"RIGHT", 1, 2, 0x04, 2, "V", "VV"},
+	117: {"EXACT", 2, 2, 0x02, 2, "V", "VV"},
+	118: {"TRIM", 1, 1, 0x02, 1, "V", "V"},
+	119: {"REPLACE", 4, 4, 0x02, 4, "V", "VVVV"},
+	120: {"SUBSTITUTE", 3, 4, 0x04, 4, "V", "VVVV"},
+	121: {"CODE", 1, 1, 0x02, 1, "V", "V"},
+	124: {"FIND", 2, 3, 0x04, 3, "V", "VVV"},
+	125: {"CELL", 1, 2, 0x0c, 2, "V", "VR"},
+	126: {"ISERR", 1, 1, 0x02, 1, "V", "V"},
+	127: {"ISTEXT", 1, 1, 0x02, 1, "V", "V"},
+	128: {"ISNUMBER", 1, 1, 0x02, 1, "V", "V"},
+	129: {"ISBLANK", 1, 1, 0x02, 1, "V", "V"},
+	130: {"T", 1, 1, 0x02, 1, "V", "R"},
+	131: {"N", 1, 1, 0x02, 1, "V", "R"},
+	140: {"DATEVALUE", 1, 1, 0x02, 1, "V", "V"},
+	141: {"TIMEVALUE", 1, 1, 0x02, 1, "V", "V"},
+	142: {"SLN", 3, 3, 0x02, 3, "V", "VVV"},
+	143: {"SYD", 4, 4, 0x02, 4, "V", "VVVV"},
+	144: {"DDB", 4, 5, 0x04, 5, "V", "VVVVV"},
+	148: {"INDIRECT", 1, 2, 0x0c, 2, "R", "VV"},
+	162: {"CLEAN", 1, 1, 0x02, 1, "V", "V"},
+	163: {"MDETERM", 1, 1, 0x02, 1, "V", "A"},
+	164: {"MINVERSE", 1, 1, 0x02, 1, "A", "A"},
+	165: {"MMULT", 2, 2, 0x02, 2, "A", "AA"},
+	167: {"IPMT", 4, 6, 0x04, 6, "V", "VVVVVV"},
+	168: {"PPMT", 4, 6, 0x04, 6, "V", "VVVVVV"},
+	169: {"COUNTA", 0, 30, 0x04, 1, "V", "R"},
+	183: {"PRODUCT", 0, 30, 0x04, 1, "V", "R"},
+	184: {"FACT", 1, 1, 0x02, 1, "V", "V"},
+	189: {"DPRODUCT", 3, 3, 0x02, 3, "V", "RRR"},
+	190: {"ISNONTEXT", 1, 1, 0x02, 1, "V", "V"},
+	193: {"STDEVP", 1, 30, 0x04, 1, "V", "R"},
+	194: {"VARP", 1, 30, 0x04, 1, "V", "R"},
+	195: {"DSTDEVP", 3, 3, 0x02, 3, "V", "RRR"},
+	196: {"DVARP", 3, 3, 0x02, 3, "V", "RRR"},
+	197: {"TRUNC", 1, 2, 0x04, 2, "V", "VV"},
+	198: {"ISLOGICAL", 1, 1, 0x02, 1, "V", "V"},
+	199: {"DCOUNTA", 3, 3, 0x02, 3, "V", "RRR"},
+	204: {"USDOLLAR", 1, 2, 0x04, 2, "V", "VV"},
+	205: {"FINDB", 2, 3, 0x04, 3, "V", "VVV"},
+	206: {"SEARCHB", 2, 3, 0x04, 3, "V", "VVV"},
+	207: {"REPLACEB", 4, 4, 0x02, 4, "V", "VVVV"},
+	208: {"LEFTB", 1, 2, 0x04, 2, "V", "VV"},
+	209: {"RIGHTB", 1, 2, 0x04, 2, "V", "VV"},
+	210: {"MIDB", 3, 3, 0x02, 3, "V", "VVV"},
+	211: {"LENB", 1, 1, 0x02, 1, "V", "V"},
+	212: {"ROUNDUP", 2, 2, 0x02, 2, "V", "VV"},
+	213: {"ROUNDDOWN", 2, 2, 0x02, 2, "V", "VV"},
+	214: {"ASC", 1, 1, 0x02, 1, "V", "V"},
+	215: {"DBCS", 1, 1, 0x02, 1, "V", "V"},
+	216: {"RANK", 2, 3, 0x04, 3, "V", "VRV"},
+	219: {"ADDRESS", 2, 5, 0x04, 5, "V", "VVVVV"},
+	220: {"DAYS360", 2, 3, 0x04, 3, "V", "VVV"},
+	221: {"TODAY", 0, 0, 0x0a, 0, "V", ""},
+	222: {"VDB", 5, 7, 0x04, 7, "V", "VVVVVVV"},
+	227: {"MEDIAN", 1, 30, 0x04, 1, "V", "R"},
+	228: {"SUMPRODUCT", 1, 30, 0x04, 1, "V", "A"},
+	229: {"SINH", 1, 1, 0x02, 1, "V", "V"},
+	230: {"COSH", 1, 1, 0x02, 1, "V", "V"},
+	231: {"TANH", 1, 1, 0x02, 1, "V", "V"},
+	232: {"ASINH", 1, 1, 0x02, 1, "V", "V"},
+	233: {"ACOSH", 1, 1, 0x02, 1, "V", "V"},
+	234: {"ATANH", 1, 1, 0x02, 1, "V", "V"},
+	235: {"DGET", 3, 3, 0x02, 3, "V", "RRR"},
+	244: {"INFO", 1, 1, 0x02, 1, "V", "V"},
+	247: {"DB", 4, 5, 0x04, 5, "V", "VVVVV"},
+	252: {"FREQUENCY", 2, 2, 0x02, 2, "A", "RR"},
+	261: {"ERROR.TYPE", 1, 1, 0x02, 1, "V", "V"},
+	269: {"AVEDEV", 1, 30, 0x04, 1, "V", "R"},
+	270: {"BETADIST", 3, 5, 0x04, 1, "V", "V"},
+	271: {"GAMMALN", 1, 1, 0x02, 1, "V", "V"},
+	272: {"BETAINV", 3, 5, 0x04, 1, "V", "V"},
+	273: {"BINOMDIST", 4, 4, 0x02, 4, "V", "VVVV"},
+	274: {"CHIDIST", 2, 2, 0x02, 2, "V", "VV"},
+	275: {"CHIINV", 2, 2, 0x02, 2, "V", "VV"},
+	276: {"COMBIN", 2, 2, 0x02, 2, "V", "VV"},
+	277: {"CONFIDENCE", 3, 3, 0x02, 3, "V", "VVV"},
+	278: {"CRITBINOM", 3, 3, 0x02, 3, "V", "VVV"},
+	279: {"EVEN", 1, 1, 0x02, 1, "V", "V"},
+	280: {"EXPONDIST", 3, 3, 0x02, 3, "V", "VVV"},
+	281: {"FDIST", 3, 3, 0x02, 3, "V", "VVV"},
+	282: {"FINV", 3, 3, 0x02, 3, "V", "VVV"},
+	283: {"FISHER", 1, 1, 0x02, 1, "V", "V"},
+	284: {"FISHERINV", 1, 1, 0x02, 1, "V", "V"},
+	285: {"FLOOR", 2, 2, 0x02, 2, "V", "VV"},
+	286: {"GAMMADIST", 4, 4, 0x02, 4, "V", "VVVV"},
+	287: {"GAMMAINV", 3, 3, 0x02, 3, "V", "VVV"},
+	288: {"CEILING", 2, 2, 0x02, 2, "V", "VV"},
+	289: {"HYPGEOMDIST", 4, 4, 0x02, 4, "V", "VVVV"},
+	290: {"LOGNORMDIST", 3, 3, 0x02, 3, "V", "VVV"},
+	291: {"LOGINV", 3, 3, 0x02, 3, "V", "VVV"},
+	292: {"NEGBINOMDIST", 3, 3, 0x02, 3, "V", "VVV"},
+	293: {"NORMDIST", 4, 4, 0x02, 4, "V", "VVVV"},
+	294: {"NORMSDIST", 1, 1, 0x02, 1, "V", "V"},
+	295: {"NORMINV", 3, 3, 0x02, 3, "V", "VVV"},
+	296: {"NORMSINV", 1, 1, 0x02, 1, "V", "V"},
+	297: {"STANDARDIZE", 3, 3, 0x02, 3, "V", "VVV"},
+	298: {"ODD", 1, 1, 0x02, 1, "V", "V"},
+	299: {"PERMUT", 2, 2, 0x02, 2, "V", "VV"},
+	300: {"POISSON", 3, 3, 0x02, 3, "V", "VVV"},
+	301: {"TDIST", 3, 3, 0x02, 3, "V", "VVV"},
+	302: {"WEIBULL", 4, 4, 0x02, 4, "V", "VVVV"},
+	303: {"SUMXMY2", 2, 2, 0x02, 2, "V", "AA"},
+	304: {"SUMX2MY2", 2, 2, 0x02, 2, "V", "AA"},
+	305: {"SUMX2PY2", 2, 2, 0x02, 2, "V", "AA"},
+	306: {"CHITEST", 2, 2, 0x02, 2, "V", "AA"},
+	307: {"CORREL", 2, 2, 0x02, 2, "V", "AA"},
+	308: {"COVAR", 2, 2, 0x02, 2, "V", "AA"},
+	309: {"FORECAST", 3, 3, 0x02, 3, "V", "VAA"},
+	310: {"FTEST", 2, 2, 0x02, 2, "V", "AA"},
+	311: {"INTERCEPT", 2, 2, 0x02, 2, "V", "AA"},
+	312: {"PEARSON", 2, 2, 0x02, 2, "V", "AA"},
+	313: {"RSQ", 2, 2, 0x02, 2, "V", "AA"},
+	314: {"STEYX", 2, 2, 0x02, 2, "V", "AA"},
+	315: {"SLOPE", 2, 2, 0x02, 2, "V", "AA"},
+	316: {"TTEST", 4, 4, 0x02, 4, "V", "AAVV"},
+	317: {"PROB", 3, 4, 0x04, 3, "V", "AAV"},
+	318: {"DEVSQ", 1, 30, 0x04, 1, "V", "R"},
+	319: {"GEOMEAN", 1, 30, 0x04, 1, "V", "R"},
+	320: {"HARMEAN", 1, 30, 0x04, 1, "V", "R"},
+	321: {"SUMSQ", 0, 30, 0x04, 1, "V", "R"},
+	322: {"KURT", 1, 30, 0x04, 1, "V", "R"},
+	323: {"SKEW", 1, 30, 0x04, 1, "V", "R"},
+	324: {"ZTEST", 2, 3, 0x04, 2, "V", "RV"},
+	325: {"LARGE", 2, 2, 0x02, 2, "V", "RV"},
+	326: {"SMALL", 2, 2, 0x02, 2, "V", "RV"},
+	327: {"QUARTILE", 2, 2, 0x02, 2, "V", "RV"},
+	328: {"PERCENTILE", 2, 2, 0x02, 2, "V", "RV"},
+	329: {"PERCENTRANK", 2, 3, 0x04, 2, "V", "RV"},
+	330: {"MODE", 1, 30, 0x04, 1, "V", "A"},
+	331: {"TRIMMEAN", 2, 2, 0x02, 2, "V", "RV"},
+	332: {"TINV", 2, 2, 0x02, 2, "V", "VV"},
+	336: {"CONCATENATE", 0, 30, 0x04, 1, "V", "V"},
+	337: {"POWER", 2, 2, 0x02, 2, "V", "VV"},
+	342: {"RADIANS", 1, 1, 0x02, 1, "V", "V"},
+	343: {"DEGREES", 1, 1, 0x02, 1, "V", "V"},
+	344: {"SUBTOTAL", 2, 30, 0x04, 2, "V", "VR"},
+	345: {"SUMIF", 2, 3, 0x04, 3, "V", "RVR"},
+	346: {"COUNTIF", 2, 2, 0x02, 2, "V", "RV"},
+	347: {"COUNTBLANK", 1, 1, 0x02, 1, "V", "R"},
+	350: {"ISPMT", 4, 4, 0x02, 4, "V", "VVVV"},
+	351: {"DATEDIF", 3, 3, 0x02, 3, "V", "VVV"},
+	352: {"DATESTRING", 1, 1, 0x02, 1, "V", "V"},
+	353: {"NUMBERSTRING", 2, 2, 0x02, 2, "V", "VV"},
+	354: {"ROMAN", 1, 2, 0x04, 2, "V", "VV"},
+	358: {"GETPIVOTDATA", 2, 2, 0x02, 2, "V", "RV"},
+	359: {"HYPERLINK", 1, 2, 0x04, 2, "V", "VV"},
+	360: {"PHONETIC", 1, 1, 0x02, 1, "V", "V"},
+	361: {"AVERAGEA", 1, 30, 0x04, 1, "V", "R"},
+	362: {"MAXA", 1, 30, 0x04, 1, "V", "R"},
+	363: {"MINA", 1, 30, 0x04, 1, "V", "R"},
+	364: {"STDEVPA", 1, 30, 0x04, 1, "V", "R"},
+	365: {"VARPA", 1, 30, 0x04, 1, "V", "R"},
+	366: {"STDEVA", 1, 30, 0x04, 1, "V", "R"},
+	367: {"VARA", 1, 30, 0x04, 1, "V", "R"},
+	368: {"BAHTTEXT", 1, 1, 0x02, 1, "V", "V"},
+	369: {"THAIDAYOFWEEK", 1, 1, 0x02, 1, "V", "V"},
+	370: {"THAIDIGIT", 1, 1, 0x02, 1, "V", "V"},
+	371: {"THAIMONTHOFYEAR", 1, 1, 0x02, 1, "V", "V"},
+	372: {"THAINUMSOUND", 1, 1, 0x02, 1, "V", "V"},
+	373: {"THAINUMSTRING", 1, 1, 0x02, 1, "V", "V"},
+	374: {"THAISTRINGLENGTH", 1, 1, 0x02, 1, "V", "V"},
+	375: {"ISTHAIDIGIT", 1, 1, 0x02, 1, "V", "V"},
+	376: {"ROUNDBAHTDOWN", 1, 1, 0x02, 1, "V", "V"},
+	377: {"ROUNDBAHTUP", 1, 1, 0x02, 1, "V", "V"},
+	378: {"THAIYEAR", 1, 1, 0x02, 1, "V", "V"},
+	379: {"RTD", 2, 5, 0x04, 1, "V", "V"},
 }
 
 // Arithmetic argument dictionary
 var arithArgdict = map[int]interface{}{
 	oNUM:  nop,
-	oSTRG: func(x interface{}) interface{} { return x.(float64) },
+	oSTRG: strg2num,
+}
+
+// strg2num converts a string operand to a number, as Python's float does,
+// or returns nil if it does not hold one. Unlike Python, strconv accepts
+// hexadecimal numbers such as 0x1p3, which are rejected.
+func strg2num(x interface{}) interface{} {
+	s := strings.TrimSpace(x.(string))
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || strings.ContainsAny(s, "xX") {
+		return nil
+	}
+	return f
 }
 
 // Comparison argument dictionary
@@ -755,7 +1049,7 @@ func absInt(val int) int {
 // cellnamerel function
 func cellnamerel(rowx int, colx int, rowxrel int, colxrel int, browx *int, bcolx *int, r1c1 int) string {
 	if rowxrel == 0 && colxrel == 0 {
-		return cellnameabs(rowx, colx, r1c1)
+		return Cellnameabs(rowx, colx, r1c1)
 	}
 	if (rowxrel != 0 && browx == nil) || (colxrel != 0 && bcolx == nil) {
 		// must flip the whole cell into R1C1 mode
@@ -773,13 +1067,10 @@ func cellnamerel(rowx int, colx int, rowxrel int, colxrel int, browx *int, bcolx
 
 // rangename2d function
 func rangename2d(rlo int, rhi int, clo int, chi int, r1c1 int) string {
-	if r1c1 != 0 {
-		return ""
-	}
 	if rhi == rlo+1 && chi == clo+1 {
-		return cellnameabs(rlo, clo, r1c1)
+		return Cellnameabs(rlo, clo, r1c1)
 	}
-	return fmt.Sprintf("%s:%s", cellnameabs(rlo, clo, r1c1), cellnameabs(rhi-1, chi-1, r1c1))
+	return fmt.Sprintf("%s:%s", Cellnameabs(rlo, clo, r1c1), Cellnameabs(rhi-1, chi-1, r1c1))
 }
 
 // rangename2drel function
@@ -792,6 +1083,9 @@ func rangename2drel(rloRhiCloChi []int, rlorelRhirelClorelChirel []int, browx *i
 	if (clorel != 0 || chirel != 0) && bcolx == nil {
 		r1c1 = 1
 	}
+	if rhi == rlo+1 && chi == clo+1 && rlorel == rhirel && clorel == chirel {
+		return cellnamerel(rlo, clo, rlorel, clorel, browx, bcolx, r1c1)
+	}
 	return fmt.Sprintf("%s:%s",
 		cellnamerel(rlo, clo, rlorel, clorel, browx, bcolx, r1c1),
 		cellnamerel(rhi-1, chi-1, rhirel, chirel, browx, bcolx, r1c1),
@@ -800,30 +1094,37 @@ func rangename2drel(rloRhiCloChi []int, rlorelRhirelClorelChirel []int, browx *i
 
 // Rangename3d function
 func Rangename3d(book interface{}, ref3d interface{}) string {
-	r3d := ref3d.(*Ref3D)
+	return rangename3dabs(book, ref3d.(*Ref3D), 0)
+}
+
+// rangename3dabs is Rangename3d in A1 or R1C1 notation.
+func rangename3dabs(book interface{}, r3d *Ref3D, r1c1 int) string {
 	coords := r3d.coords
 	return fmt.Sprintf("%s!%s",
 		sheetrange(book, coords[0], coords[1]),
-		rangename2d(coords[2], coords[3], coords[4], coords[5], 0))
+		rangename2d(coords[2], coords[3], coords[4], coords[5], r1c1))
 }
 
 // Rangename3drel function
-func Rangename3drel(book interface{}, ref3d interface{}, browx *int, bcolx *int, r1c1 int) string {
+func Rangename3drel(book interface{}, ref3d interface{}, browx *int, bcolx *int, r1c1 int) (string, error) {
 	r3d := ref3d.(*Ref3D)
 	coords := r3d.coords
 	relflags := r3d.relflags
-	shdesc := sheetrangerel(book, coords[:2], relflags[:2])
+	shdesc, err := sheetrangerel(book, coords[:2], relflags[:2])
+	if err != nil {
+		return "", err
+	}
 	rngdesc := rangename2drel(coords[2:6], relflags[2:6], browx, bcolx, r1c1)
 	if shdesc == "" {
-		return rngdesc
+		return rngdesc, nil
 	}
-	return fmt.Sprintf("%s!%s", shdesc, rngdesc)
+	return fmt.Sprintf("%s!%s", shdesc, rngdesc), nil
 }
 
 // quotedsheetname function
 func quotedsheetname(shnames []string, shx int) string {
 	var shname string
-	if shx >= 0 {
+	if shx >= 0 && shx < len(shnames) {
 		shname = shnames[shx]
 	} else {
 		switch shx {
@@ -848,6 +1149,15 @@ func quotedsheetname(shnames []string, shx int) string {
 	return shname
 }
 
+// nameText returns how a formula refers to the defined name nobj: its
+// name, qualified by its sheet if it is local to one.
+func nameText(bk *Book, nobj *Name) string {
+	if nobj.Scope < 0 {
+		return nobj.Name
+	}
+	return quotedsheetname(bk.sheetNames, nobj.Scope) + "!" + nobj.Name
+}
+
 // sheetrange function
 func sheetrange(book interface{}, slo int, shi int) string {
 	bk := book.(*Book)
@@ -860,19 +1170,18 @@ func sheetrange(book interface{}, slo int, shi int) string {
 }
 
 // sheetrangerel function
-func sheetrangerel(book interface{}, srange interface{}, srangerel interface{}) string {
+func sheetrangerel(book interface{}, srange interface{}, srangerel interface{}) (string, error) {
 	sr := srange.([]int)
 	srr := srangerel.([]int)
 	slo, shi := sr[0], sr[1]
 	slorel, shirel := srr[0], srr[1]
 	if slorel == 0 && shirel == 0 {
-		return sheetrange(book, slo, shi)
+		return sheetrange(book, slo, shi), nil
 	}
-	// assert (slo == 0 == shi-1) and slorel and shirel
 	if !(slo == 0 && shi-1 == 0 && slorel != 0 && shirel != 0) {
-		panic("Assertion failed in sheetrangerel")
+		return "", &FormulaError{message: fmt.Sprintf("Invalid relative sheet range %d:%d", slo, shi)}
 	}
-	return ""
+	return "", nil
 }
 
 // ===== CLASSES/STRUCTS =====
@@ -886,6 +1195,11 @@ func (e *FormulaError) Error() string {
 	return e.message
 }
 
+// Is reports whether target is ErrMalformedFormula.
+func (e *FormulaError) Is(target error) bool {
+	return target == ErrMalformedFormula
+}
+
 // Operand represents an operand in a formula
 type Operand struct {
 	kind  int
@@ -1383,7 +1697,9 @@ func getExternsheetLocalRange(bk *Book, refx, blah int) (int, int) {
 }
 
 // EvaluateNameFormula evaluates a named formula.
-func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
+// It returns an error if the formula is malformed.
+func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) (err error) {
+	defer recoverFormulaError(&err)
 	if level > StackAlarmLevel {
 		blah = 1
 	}
@@ -1395,14 +1711,24 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 	if blah != 0 {
 		fmt.Fprintf(bk.logfile, "::: evaluate_name_formula %d %q %d %d %v level=%d\n",
 			namex, nobj.Name, fmlalen, bv, data, level)
-		hexCharDump(data, 0, fmlalen, bk.logfile.(*os.File))
+		hexCharDump(data, 0, fmlalen, bk.logfile)
 	}
 
-	if level > StackPanicLevel {
-		panic(NewXLRDError("Excessive indirect references in NAME formula"))
+	if maxDepth := bk.limits.MaxNameDepth; maxDepth > 0 {
+		if err := checkLimit("MaxNameDepth", int64(maxDepth), int64(level)); err != nil {
+			return err
+		}
+	} else if level > StackPanicLevel {
+		return newXLRDError(ErrMalformedFormula, "Excessive indirect references in NAME formula")
+	}
+	if fmlalen < 0 || fmlalen > len(data) {
+		return newXLRDError(ErrMalformedFormula, "NAME formula length %d exceeds %d bytes of data", fmlalen, len(data))
 	}
 
 	sztab := szdict[bv]
+	if sztab == nil {
+		return newXLRDError(ErrUnsupportedBIFF, "no formula tokens for BIFF version %d", bv)
+	}
 	pos := 0
 	stack := []interface{}{}
 	anyRel := 0
@@ -1467,6 +1793,11 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 
 		bval := bconv(bop.value)
 		aval := aconv(aop.value)
+		if bval == nil || aval == nil {
+			stack = stack[:len(stack)-2]
+			stack = append(stack, resop)
+			return
+		}
 		result := fn(aval, bval)
 		if resultType == oBOOL {
 			if result.(bool) {
@@ -1510,9 +1841,9 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 		stack = append(stack, res)
 	}
 
-	notInNameFormula := func(opArg int, onameArg string) {
+	notInNameFormula := func(opArg int, onameArg string) error {
 		msg := fmt.Sprintf("ERROR *** Token 0x%02x (%s) found in NAME formula", opArg, onameArg)
-		panic(&FormulaError{message: msg})
+		return &FormulaError{message: msg}
 	}
 
 	if fmlalen == 0 {
@@ -1538,12 +1869,15 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 
 		if sz == -2 {
 			msg := fmt.Sprintf(`ERROR *** Unexpected token 0x%02x ("%s"); biff_version=%d`, op, oname, bv)
-			panic(&FormulaError{message: msg})
+			return &FormulaError{message: msg}
+		}
+		if pos+sz > fmlalen {
+			return malformedToken(op, oname, pos)
 		}
 
 		if optype == 0 {
 			if 0x00 <= opcode && opcode <= 0x02 { // unk_opnd, tExp, tTbl
-				notInNameFormula(op, oname)
+				return notInNameFormula(op, oname)
 			} else if 0x03 <= opcode && opcode <= 0x0E { // Add, Sub, Mul, Div, Power, tConcat, tLT, ..., tNE
 				doBinop(opcode)
 			} else if opcode == 0x0F { // tIsect
@@ -1551,7 +1885,7 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 					fmt.Fprintf(bk.logfile, "tIsect pre %v\n", stack)
 				}
 				if len(stack) < 2 {
-					continue
+					return malformedToken(op, oname, pos)
 				}
 				bop := stack[len(stack)-1].(*Operand)
 				aop := stack[len(stack)-2].(*Operand)
@@ -1586,16 +1920,18 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 					// res.kind = oREF
 				} else if bop.kind == oREF && aop.kind == oREF {
 					if aop.value != nil && bop.value != nil {
-						assert(len(aop.value.([]*Ref3D)) == 1)
-						assert(len(bop.value.([]*Ref3D)) == 1)
+						if !(len(aop.value.([]*Ref3D)) == 1 && len(bop.value.([]*Ref3D)) == 1) {
+							return malformedToken(op, oname, pos)
+						}
 						coords := doBoxFuncs(tIsectFuncs, aop.value.([]*Ref3D)[0], bop.value.([]*Ref3D)[0])
 						res.value = []*Ref3D{NewRef3D(coords...)}
 					}
 				} else if bop.kind == oREL && aop.kind == oREL {
 					res.kind = oREL
 					if aop.value != nil && bop.value != nil {
-						assert(len(aop.value.([]*Ref3D)) == 1)
-						assert(len(bop.value.([]*Ref3D)) == 1)
+						if !(len(aop.value.([]*Ref3D)) == 1 && len(bop.value.([]*Ref3D)) == 1) {
+							return malformedToken(op, oname, pos)
+						}
 						coords := doBoxFuncs(tIsectFuncs, aop.value.([]*Ref3D)[0], bop.value.([]*Ref3D)[0])
 						relfa := aop.value.([]*Ref3D)[0].relflags
 						relfb := bop.value.([]*Ref3D)[0].relflags
@@ -1616,7 +1952,7 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 					fmt.Fprintf(bk.logfile, "tList pre %v\n", stack)
 				}
 				if len(stack) < 2 {
-					continue
+					return malformedToken(op, oname, pos)
 				}
 				bop := stack[len(stack)-1].(*Operand)
 				aop := stack[len(stack)-2].(*Operand)
@@ -1650,8 +1986,9 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 					if aop.value != nil && bop.value != nil {
 						aopVal := aop.value.([]*Ref3D)
 						bopVal := bop.value.([]*Ref3D)
-						assert(len(aopVal) >= 1)
-						assert(len(bopVal) == 1)
+						if !(len(aopVal) >= 1 && len(bopVal) == 1) {
+							return malformedToken(op, oname, pos)
+						}
 						res.value = append(aopVal, bopVal...)
 					}
 				}
@@ -1665,7 +2002,7 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 					fmt.Fprintf(bk.logfile, "tRange pre %v\n", stack)
 				}
 				if len(stack) < 2 {
-					continue
+					return malformedToken(op, oname, pos)
 				}
 				bop := stack[len(stack)-1].(*Operand)
 				aop := stack[len(stack)-2].(*Operand)
@@ -1693,16 +2030,18 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 					res.kind = oERR
 				} else if bop.kind == oREF && aop.kind == oREF {
 					if aop.value != nil && bop.value != nil {
-						assert(len(aop.value.([]*Ref3D)) == 1)
-						assert(len(bop.value.([]*Ref3D)) == 1)
+						if !(len(aop.value.([]*Ref3D)) == 1 && len(bop.value.([]*Ref3D)) == 1) {
+							return malformedToken(op, oname, pos)
+						}
 						coords := doBoxFuncs(tRangeFuncs, aop.value.([]*Ref3D)[0], bop.value.([]*Ref3D)[0])
 						res.value = []*Ref3D{NewRef3D(coords...)}
 					}
 				} else if bop.kind == oREL && aop.kind == oREL {
 					res.kind = oREL
 					if aop.value != nil && bop.value != nil {
-						assert(len(aop.value.([]*Ref3D)) == 1)
-						assert(len(bop.value.([]*Ref3D)) == 1)
+						if !(len(aop.value.([]*Ref3D)) == 1 && len(bop.value.([]*Ref3D)) == 1) {
+							return malformedToken(op, oname, pos)
+						}
 						coords := doBoxFuncs(tRangeFuncs, aop.value.([]*Ref3D)[0], bop.value.([]*Ref3D)[0])
 						relfa := aop.value.([]*Ref3D)[0].relflags
 						relfb := bop.value.([]*Ref3D)[0].relflags
@@ -1727,10 +2066,14 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 			} else if opcode == 0x17 { // tStr
 				var strg string
 				var newpos int
+				var ok bool
 				if bv <= 70 {
-					strg, newpos = unpackStringUpdatePos(data, pos+1, bk.Encoding, 1)
+					strg, newpos, ok = unpackStringUpdatePos(data, pos+1, bk.Encoding, 1)
 				} else {
-					strg, newpos = unpackUnicodeUpdatePos(data, pos+1, 1)
+					strg, newpos, ok = unpackUnicodeUpdatePos(data, pos+1, 1)
+				}
+				if !ok {
+					return malformedToken(op, oname, pos)
 				}
 				sz = newpos - pos
 				if blah != 0 {
@@ -1740,11 +2083,11 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 				spush(&Operand{kind: oSTRG, value: strg, _rank: LeafRank, text: text})
 			} else if opcode == 0x18 { // tExtended
 				// new with BIFF 8
-				panic(&FormulaError{message: "tExtended token not implemented"})
+				return &FormulaError{message: "tExtended token not implemented"}
 			} else if opcode == 0x19 { // tAttr
 				result, err := unpack("<BH", data[pos+1:pos+4])
 				if err != nil {
-					panic(err)
+					return err
 				}
 				values := result.([]interface{})
 				subop := values[0].(uint8)
@@ -1769,8 +2112,7 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 					fmt.Fprintf(bk.logfile, "   subop=%02xh subname=%s sz=%d nc=%02xh\n", subop, subname, sz, nc)
 				}
 			} else if 0x1A <= opcode && opcode <= 0x1B { // tSheet, tEndSheet
-				assert(bv < 50)
-				panic(&FormulaError{message: "tSheet & tEndsheet tokens not implemented"})
+				return &FormulaError{message: "tSheet & tEndsheet tokens not implemented"}
 			} else if 0x1C <= opcode && opcode <= 0x1F { // tErr, tBool, tInt, tNum
 				inx := opcode - 0x1C
 				nb := []int{1, 1, 2, 8}[inx]
@@ -1778,7 +2120,7 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 				value, _ := unpack([]string{"<B", "<B", "<H", "<d"}[inx], data[pos+1:pos+1+nb])
 				var text string
 				if inx == 2 { // tInt
-					value = float64(value.(int16))
+					value = float64(value.(uint16))
 					text = fmt.Sprintf("%v", value)
 				} else if inx == 3 { // tNum
 					text = fmt.Sprintf("%v", value)
@@ -1793,10 +2135,10 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 				}
 				spush(&Operand{kind: kind, value: value, _rank: LeafRank, text: text})
 			} else {
-				panic(&FormulaError{message: fmt.Sprintf("Unhandled opcode: 0x%02x", opcode)})
+				return &FormulaError{message: fmt.Sprintf("Unhandled opcode: 0x%02x", opcode)}
 			}
 			if sz <= 0 {
-				panic(&FormulaError{message: fmt.Sprintf("Size not set for opcode 0x%02x", opcode)})
+				return &FormulaError{message: fmt.Sprintf("Size not set for opcode 0x%02x", opcode)}
 			}
 			pos += sz
 			continue
@@ -1809,8 +2151,11 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 			if bv >= 40 {
 				nb = 2
 			}
-			funcx, _ := unpack(fmt.Sprintf("<%sH", []string{"", "B"}[nb-1]), data[pos+1:pos+1+nb])
-			funcAttrs, ok := funcDefs[funcx.(int)]
+			funcx := int(data[pos+1])
+			if nb == 2 {
+				funcx = int(binary.LittleEndian.Uint16(data[pos+1 : pos+3]))
+			}
+			funcAttrs, ok := funcDefs[funcx]
 			if !ok {
 				fmt.Fprintf(bk.logfile, "*** formula/tFunc unknown FuncID:%d\n", funcx)
 				spush(unkOpnd)
@@ -1820,7 +2165,9 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 				if blah != 0 {
 					fmt.Fprintf(bk.logfile, "    FuncID=%d name=%s nargs=%d\n", funcx, funcName, nargs)
 				}
-				assert(len(stack) >= nargs)
+				if !(len(stack) >= nargs) {
+					return malformedToken(op, oname, pos)
+				}
 				var otext string
 				if nargs > 0 {
 					argtext := make([]string, nargs)
@@ -1842,9 +2189,11 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 			if bv >= 40 {
 				nb = 2
 			}
-			nargs_funcx, _ := unpack(fmt.Sprintf("<B%sH", []string{"", "B"}[nb-1]), data[pos+1:pos+2+nb])
-			nargs := nargs_funcx.([]interface{})[0].(uint8)
-			funcx := nargs_funcx.([]interface{})[1].(uint16)
+			nargs := data[pos+1]
+			funcx := uint16(data[pos+2])
+			if nb == 2 {
+				funcx = binary.LittleEndian.Uint16(data[pos+2 : pos+4])
+			}
 			prompt := nargs >> 7
 			nargs &= 0x7F
 			macro := funcx >> 15
@@ -1863,9 +2212,9 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 				if blah != 0 {
 					fmt.Fprintf(bk.logfile, "    name: %s, min~max args: %d~%d\n", funcName, minargs, maxargs)
 				}
-				assert(minargs <= int(nargs) && int(nargs) <= maxargs)
-				assert(len(stack) >= int(nargs))
-				assert(len(stack) >= int(nargs))
+				if !(minargs <= int(nargs) && int(nargs) <= maxargs && len(stack) >= int(nargs)) {
+					return malformedToken(op, oname, pos)
+				}
 				argtext := make([]string, nargs)
 				for i := 0; i < int(nargs); i++ {
 					argtext[i] = stack[len(stack)-int(nargs)+i].(*Operand).text
@@ -1874,21 +2223,22 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 				res := &Operand{kind: oUNK, value: nil, _rank: FuncRank, text: otext}
 				if funcx == 1 { // IF
 					testarg := stack[len(stack)-int(nargs)].(*Operand)
+					testval, isInt := operandInt(testarg)
 					if testarg.kind != oNUM && testarg.kind != oBOOL {
 						if blah != 0 && testarg.kind != oUNK {
 							fmt.Fprintf(bk.logfile, "IF testarg kind?\n")
 						}
-					} else if testarg.value != 0 && testarg.value != 1 {
+					} else if !isInt || testval != 0 && testval != 1 {
 						if blah != 0 && testarg.value != nil {
 							fmt.Fprintf(bk.logfile, "IF testarg value?\n")
 						}
 					} else {
-						if int(nargs) == 2 && testarg.value == 0 {
+						if int(nargs) == 2 && testval == 0 {
 							// IF(FALSE, tv) => FALSE
 							res.kind = oBOOL
 							res.value = 0
 						} else {
-							respos := len(stack) - int(nargs) + 2 - int(testarg.value.(int))
+							respos := len(stack) - int(nargs) + 2 - testval
 							chosen := stack[respos].(*Operand)
 							if chosen.kind == oMSNG {
 								res.kind = oNUM
@@ -1904,9 +2254,9 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 					}
 				} else if funcx == 100 { // CHOOSE
 					testarg := stack[len(stack)-int(nargs)].(*Operand)
-					if testarg.kind == oNUM {
-						if 1 <= testarg.value.(int) && testarg.value.(int) < int(nargs) {
-							chosen := stack[len(stack)-int(nargs)+testarg.value.(int)].(*Operand)
+					if testval, isInt := operandInt(testarg); testarg.kind == oNUM && isInt {
+						if 1 <= testval && testval < int(nargs) {
+							chosen := stack[len(stack)-int(nargs)+testval].(*Operand)
 							if chosen.kind == oMSNG {
 								res.kind = oNUM
 								res.value = 0
@@ -1928,10 +2278,15 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 			if blah != 0 {
 				fmt.Fprintf(bk.logfile, "   tgtnamex=%d\n", tgtnamex)
 			}
+			if tgtnamex < 0 || tgtnamex >= len(bk.NameObjList) {
+				return malformedToken(op, oname, pos)
+			}
 			tgtobj := bk.NameObjList[tgtnamex]
 			if !tgtobj.Evaluated {
 				// recursive
-				evaluateNameFormula(bk, tgtobj, tgtnamex, blah, level+1)
+				if err := evaluateNameFormula(bk, tgtobj, tgtnamex, blah, level+1); err != nil {
+					return err
+				}
 			}
 			var res *Operand
 			if tgtobj.Macro != 0 || tgtobj.Binary != 0 || tgtobj.AnyErr != 0 {
@@ -1942,11 +2297,13 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 				anyErr = boolToInt(anyErr != 0 || tgtobj.Macro != 0 || tgtobj.Binary != 0 || tgtobj.AnyErr != 0)
 				anyRel = boolToInt(anyRel != 0 || tgtobj.AnyRel != 0)
 			} else {
-				assert(len(tgtobj.Stack) == 1)
+				if !(len(tgtobj.Stack) == 1) {
+					return malformedToken(op, oname, pos)
+				}
 				res = copyOperand(tgtobj.Stack[0])
 			}
 			res._rank = LeafRank
-			if tgtobj.Scope == -1 {
+			if tgtobj.Scope < 0 || tgtobj.Scope >= len(bk.SheetNames()) {
 				res.text = tgtobj.Name
 			} else {
 				res.text = bk.SheetNames()[tgtobj.Scope] + "!" + tgtobj.Name
@@ -1996,17 +2353,17 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 			}
 			spush(resOp)
 		} else if opcode == 0x06 { // tMemArea
-			notInNameFormula(op, oname)
+			return notInNameFormula(op, oname)
 		} else if opcode == 0x09 { // tMemFunc
-			nb, _ := unpack("<H", data[pos+1:pos+3])
-			if blah != 0 {
+			if blah != 0 && pos+3 <= fmlalen {
+				nb := binary.LittleEndian.Uint16(data[pos+1 : pos+3])
 				fmt.Fprintf(bk.logfile, "  %d bytes of cell ref formula\n", nb)
 			}
 			// no effect on stack
 		} else if opcode == 0x0C { // tRefN
-			notInNameFormula(op, oname)
+			return notInNameFormula(op, oname)
 		} else if opcode == 0x0D { // tAreaN
-			notInNameFormula(op, oname)
+			return notInNameFormula(op, oname)
 		} else if opcode == 0x1A { // tRef3d
 			var refx int
 			var rowx, colx, rowRel, colRel int
@@ -2112,7 +2469,7 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 			} else {
 				result, _ := unpack("<hxxxxxxxxH", data[pos+1:pos+13])
 				values := result.([]interface{})
-				refx := int(values[0].(int16))
+				refx = int(values[0].(int16))
 				tgtnamex = int(values[1].(uint16)) - 1
 				origrefx = refx
 				if refx > 0 {
@@ -2139,7 +2496,10 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 				} else if origrefx > 0 {
 					shx1, _ = -4, -4 // external ref
 				} else {
-					exty := bk.externsheetTypeB57[refx]
+					exty := 0
+					if refx >= 0 && refx < len(bk.externsheetTypeB57) {
+						exty = bk.externsheetTypeB57[refx]
+					}
 					if exty == 4 { // non-specific sheet in own doc't
 						shx1, _ = -1, -1 // internal, any sheet
 					} else {
@@ -2150,10 +2510,15 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 					otext := fmt.Sprintf("<<Name #%d in external(?) file #%d>>", tgtnamex, origrefx)
 					res = &Operand{kind: oUNK, value: nil, _rank: LeafRank, text: otext}
 				} else {
+					if tgtnamex < 0 || tgtnamex >= len(bk.NameObjList) {
+						return malformedToken(op, oname, pos)
+					}
 					tgtobj := bk.NameObjList[tgtnamex]
 					if !tgtobj.Evaluated {
 						// recursive
-						evaluateNameFormula(bk, tgtobj, tgtnamex, blah, level+1)
+						if err := evaluateNameFormula(bk, tgtobj, tgtnamex, blah, level+1); err != nil {
+							return err
+						}
 					}
 					if tgtobj.Macro != 0 || tgtobj.Binary != 0 || tgtobj.AnyErr != 0 {
 						if blah != 0 {
@@ -2163,11 +2528,13 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 						anyErr = boolToInt(anyErr != 0 || tgtobj.Macro != 0 || tgtobj.Binary != 0 || tgtobj.AnyErr != 0)
 						anyRel = boolToInt(anyRel != 0 || tgtobj.AnyRel != 0)
 					} else {
-						assert(len(tgtobj.Stack) == 1)
+						if !(len(tgtobj.Stack) == 1) {
+							return malformedToken(op, oname, pos)
+						}
 						res = copyOperand(tgtobj.Stack[0])
 					}
 					res._rank = LeafRank
-					if tgtobj.Scope == -1 {
+					if tgtobj.Scope < 0 || tgtobj.Scope >= len(bk.SheetNames()) {
 						res.text = tgtobj.Name
 					} else {
 						res.text = bk.SheetNames()[tgtobj.Scope] + "!" + tgtobj.Name
@@ -2188,7 +2555,7 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 			anyErr = 1
 		}
 		if sz <= 0 {
-			panic(&FormulaError{message: "Fatal: token size is not positive"})
+			return &FormulaError{message: "Fatal: token size is not positive"}
 		}
 		pos += sz
 	}
@@ -2214,10 +2581,13 @@ func EvaluateNameFormula(bk *Book, nobj *Name, namex int, blah int, level int) {
 	nobj.AnyErr = anyErr
 	nobj.AnyExternal = anyExternal
 	nobj.Evaluated = true
+	return nil
 }
 
 // DecompileFormula decompiles a formula.
-func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, bcolx interface{}, blah int, level int, r1c1 int) string {
+// It returns an error if the formula is malformed.
+func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, bcolx interface{}, blah int, level int, r1c1 int) (_ string, err error) {
+	defer recoverFormulaError(&err)
 	if level > StackAlarmLevel {
 		blah = 1
 	}
@@ -2248,18 +2618,24 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 	if blah != 0 {
 		fmt.Fprintf(bk.logfile, "::: decompile_formula len=%d fmlatype=%d browx=%v bcolx=%v reldelta=%d r1c1=%d level=%d\n",
 			fmlalen, fmlatype, browx, bcolx, reldelta, r1c1, level)
-		hexCharDump(data, 0, fmlalen, bk.logfile.(*os.File))
+		hexCharDump(data, 0, fmlalen, bk.logfile)
 	}
 	if level > StackPanicLevel {
-		panic(NewXLRDError("Excessive indirect references in formula"))
+		return "", newXLRDError(ErrMalformedFormula, "Excessive indirect references in formula")
+	}
+	if fmlalen < 0 || fmlalen > len(data) {
+		return "", newXLRDError(ErrMalformedFormula, "formula length %d exceeds %d bytes of data", fmlalen, len(data))
 	}
 	sztab := szdict[bv]
+	if sztab == nil {
+		return "", newXLRDError(ErrUnsupportedBIFF, "no formula tokens for BIFF version %d", bv)
+	}
 	pos := 0
 	stack := []interface{}{}
 	anyRel := 0
 	anyErr := 0
 	unkOpnd := &Operand{kind: oUNK, value: nil}
-	errorOpnd := &Operand{kind: oERR, value: nil}
+	errorOpnd := &Operand{kind: oERR, value: nil, _rank: LeafRank, text: "#REF!"}
 	spush := func(item interface{}) {
 		stack = append(stack, item)
 	}
@@ -2353,7 +2729,10 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 
 		if sz == -2 {
 			msg := fmt.Sprintf(`ERROR *** Unexpected token 0x%02x ("%s"); biff_version=%d`, op, oname, bv)
-			panic(&FormulaError{message: msg})
+			return "", &FormulaError{message: msg}
+		}
+		if pos+sz > fmlalen {
+			return "", malformedToken(op, oname, pos)
 		}
 
 		if tokenMask, ok := tokenNotAllowed[opx]; ok && (tokenMask&fmlatype) != 0 {
@@ -2368,7 +2747,9 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 				} else {
 					fmtStr = "<xHB"
 				}
-				assert(pos == 0 && fmlalen == sz && len(stack) == 0)
+				if !(pos == 0 && fmlalen == sz && len(stack) == 0) {
+					return "", malformedToken(op, oname, pos)
+				}
 				result, _ := unpack(fmtStr, data)
 				values := result.([]interface{})
 				rowx := int(values[0].(uint16))
@@ -2385,7 +2766,7 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 					fmt.Fprintf(bk.logfile, "tIsect pre %v\n", stack)
 				}
 				if len(stack) < 2 {
-					continue
+					return "", malformedToken(op, oname, pos)
 				}
 				bop := stack[len(stack)-1].(*Operand)
 				aop := stack[len(stack)-2].(*Operand)
@@ -2416,16 +2797,18 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 					// This can happen with undefined labels
 				} else if bop.kind == oREF && aop.kind == oREF {
 					if aop.value != nil && bop.value != nil {
-						assert(len(aop.value.([]*Ref3D)) == 1)
-						assert(len(bop.value.([]*Ref3D)) == 1)
+						if !(len(aop.value.([]*Ref3D)) == 1 && len(bop.value.([]*Ref3D)) == 1) {
+							return "", malformedToken(op, oname, pos)
+						}
 						coords := doBoxFuncs(tIsectFuncs, aop.value.([]*Ref3D)[0], bop.value.([]*Ref3D)[0])
 						res.value = []*Ref3D{NewRef3D(coords...)}
 					}
 				} else if bop.kind == oREL && aop.kind == oREL {
 					res.kind = oREL
 					if aop.value != nil && bop.value != nil {
-						assert(len(aop.value.([]*Ref3D)) == 1)
-						assert(len(bop.value.([]*Ref3D)) == 1)
+						if !(len(aop.value.([]*Ref3D)) == 1 && len(bop.value.([]*Ref3D)) == 1) {
+							return "", malformedToken(op, oname, pos)
+						}
 						coords := doBoxFuncs(tIsectFuncs, aop.value.([]*Ref3D)[0], bop.value.([]*Ref3D)[0])
 						relfa := aop.value.([]*Ref3D)[0].relflags
 						relfb := bop.value.([]*Ref3D)[0].relflags
@@ -2446,7 +2829,7 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 					fmt.Fprintf(bk.logfile, "tList pre %v\n", stack)
 				}
 				if len(stack) < 2 {
-					continue
+					return "", malformedToken(op, oname, pos)
 				}
 				bop := stack[len(stack)-1].(*Operand)
 				aop := stack[len(stack)-2].(*Operand)
@@ -2480,8 +2863,9 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 					if aop.value != nil && bop.value != nil {
 						aopVal := aop.value.([]*Ref3D)
 						bopVal := bop.value.([]*Ref3D)
-						assert(len(aopVal) >= 1)
-						assert(len(bopVal) == 1)
+						if !(len(aopVal) >= 1 && len(bopVal) == 1) {
+							return "", malformedToken(op, oname, pos)
+						}
 						res.value = append(aopVal, bopVal...)
 					}
 				}
@@ -2495,7 +2879,7 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 					fmt.Fprintf(bk.logfile, "tRange pre %v\n", stack)
 				}
 				if len(stack) < 2 {
-					continue
+					return "", malformedToken(op, oname, pos)
 				}
 				bop := stack[len(stack)-1].(*Operand)
 				aop := stack[len(stack)-2].(*Operand)
@@ -2523,16 +2907,18 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 					res.kind = oERR
 				} else if bop.kind == oREF && aop.kind == oREF {
 					if aop.value != nil && bop.value != nil {
-						assert(len(aop.value.([]*Ref3D)) == 1)
-						assert(len(bop.value.([]*Ref3D)) == 1)
+						if !(len(aop.value.([]*Ref3D)) == 1 && len(bop.value.([]*Ref3D)) == 1) {
+							return "", malformedToken(op, oname, pos)
+						}
 						coords := doBoxFuncs(tRangeFuncs, aop.value.([]*Ref3D)[0], bop.value.([]*Ref3D)[0])
 						res.value = []*Ref3D{NewRef3D(coords...)}
 					}
 				} else if bop.kind == oREL && aop.kind == oREL {
 					res.kind = oREL
 					if aop.value != nil && bop.value != nil {
-						assert(len(aop.value.([]*Ref3D)) == 1)
-						assert(len(bop.value.([]*Ref3D)) == 1)
+						if !(len(aop.value.([]*Ref3D)) == 1 && len(bop.value.([]*Ref3D)) == 1) {
+							return "", malformedToken(op, oname, pos)
+						}
 						coords := doBoxFuncs(tRangeFuncs, aop.value.([]*Ref3D)[0], bop.value.([]*Ref3D)[0])
 						relfa := aop.value.([]*Ref3D)[0].relflags
 						relfb := bop.value.([]*Ref3D)[0].relflags
@@ -2557,10 +2943,14 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 			} else if opcode == 0x17 { // tStr
 				var strg string
 				var newpos int
+				var ok bool
 				if bv <= 70 {
-					strg, newpos = unpackStringUpdatePos(data, pos+1, bk.Encoding, 1)
+					strg, newpos, ok = unpackStringUpdatePos(data, pos+1, bk.Encoding, 1)
 				} else {
-					strg, newpos = unpackUnicodeUpdatePos(data, pos+1, 1)
+					strg, newpos, ok = unpackUnicodeUpdatePos(data, pos+1, 1)
+				}
+				if !ok {
+					return "", malformedToken(op, oname, pos)
 				}
 				sz = newpos - pos
 				if blah != 0 {
@@ -2570,12 +2960,11 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 				spush(&Operand{kind: oSTRG, value: nil, _rank: LeafRank, text: text})
 				} else if opcode == 0x18 { // tExtended
 					// new with BIFF 8
-					assert(bv >= 80)
-					panic(&FormulaError{message: "tExtended token not implemented"})
+					return "", &FormulaError{message: "tExtended token not implemented"}
 			} else if opcode == 0x19 { // tAttr
 				result, err := unpack("<BH", data[pos+1:pos+4])
 				if err != nil {
-					panic(err)
+					return "", err
 				}
 				values := result.([]interface{})
 				subop := values[0].(uint8)
@@ -2600,8 +2989,7 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 					fmt.Fprintf(bk.logfile, "   subop=%02xh subname=t%s sz=%d nc=%02xh\n", subop, subname, sz, nc)
 				}
 				} else if 0x1A <= opcode && opcode <= 0x1B { // tSheet, tEndSheet
-					assert(bv < 50)
-					panic(&FormulaError{message: "tSheet & tEndsheet tokens not implemented"})
+					return "", &FormulaError{message: "tSheet & tEndsheet tokens not implemented"}
 			} else if 0x1C <= opcode && opcode <= 0x1F { // tErr, tBool, tInt, tNum
 				inx := opcode - 0x1C
 				nb := []int{1, 1, 2, 8}[inx]
@@ -2609,7 +2997,7 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 				value, _ := unpack([]string{"<B", "<B", "<H", "<d"}[inx], data[pos+1:pos+1+nb])
 				var text string
 				if inx == 2 { // tInt
-					value = float64(value.(int16))
+					value = float64(value.(uint16))
 					text = fmt.Sprintf("%v", value)
 				} else if inx == 3 { // tNum
 					text = fmt.Sprintf("%v", value)
@@ -2620,14 +3008,14 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 						text = "FALSE"
 					}
 				} else {
-					text = "\"" + errorTextFromCode[int(value.(uint8))] + "\""
+					text = errorTextFromCode[int(value.(uint8))]
 				}
 				spush(&Operand{kind: kind, value: value, _rank: LeafRank, text: text})
 				} else {
-					panic(&FormulaError{message: fmt.Sprintf("Unhandled opcode: 0x%02x", opcode)})
+					return "", &FormulaError{message: fmt.Sprintf("Unhandled opcode: 0x%02x", opcode)}
 				}
 				if sz <= 0 {
-					panic(&FormulaError{message: fmt.Sprintf("Size not set for opcode 0x%02x", opcode)})
+					return "", &FormulaError{message: fmt.Sprintf("Size not set for opcode 0x%02x", opcode)}
 				}
 			pos += sz
 			continue
@@ -2641,13 +3029,11 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 			if bv >= 40 {
 				nb = 2
 			}
-			fmtStr := "<"
+			funcx := int(data[pos+1])
 			if nb == 2 {
-				fmtStr += "B"
+				funcx = int(binary.LittleEndian.Uint16(data[pos+1 : pos+3]))
 			}
-			fmtStr += "H"
-			funcx, _ := unpack(fmtStr, data[pos+1:pos+1+nb])
-			funcAttrs, ok := funcDefs[funcx.(int)]
+			funcAttrs, ok := funcDefs[funcx]
 			if !ok {
 				fmt.Fprintf(bk.logfile, "*** formula/tFunc unknown FuncID:%d\n", funcx)
 				spush(unkOpnd)
@@ -2657,7 +3043,9 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 				if blah != 0 {
 					fmt.Fprintf(bk.logfile, "    FuncID=%d name=%s nargs=%d\n", funcx, funcName, nargs)
 				}
-				assert(len(stack) >= nargs)
+				if !(len(stack) >= nargs) {
+					return "", malformedToken(op, oname, pos)
+				}
 				var otext string
 				if nargs > 0 {
 					argtext := make([]string, nargs)
@@ -2679,14 +3067,11 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 			if bv >= 40 {
 				nb = 2
 			}
-			fmtStr := "<B"
+			nargs := data[pos+1]
+			funcx := uint16(data[pos+2])
 			if nb == 2 {
-				fmtStr += "B"
+				funcx = binary.LittleEndian.Uint16(data[pos+2 : pos+4])
 			}
-			fmtStr += "H"
-			nargs_funcx, _ := unpack(fmtStr, data[pos+1:pos+2+nb])
-			nargs := nargs_funcx.([]interface{})[0].(uint8)
-			funcx := nargs_funcx.([]interface{})[1].(uint16)
 			prompt := nargs >> 7
 			nargs &= 0x7F
 			macro := funcx >> 15
@@ -2695,6 +3080,9 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 				fmt.Fprintf(bk.logfile, "   FuncID=%d nargs=%d macro=%d prompt=%d\n", funcx, nargs, macro, prompt)
 			}
 			funcAttrs, ok := funcDefs[int(funcx)]
+			if funcx == 255 { // call add-in function
+				funcAttrs, ok = funcDef{name: "CALL_ADDIN", minArgs: 1, maxArgs: 30}, true
+			}
 			if !ok {
 				fmt.Fprintf(bk.logfile, "*** formula/tFuncVar unknown FuncID:%d\n", funcx)
 				spush(unkOpnd)
@@ -2705,32 +3093,37 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 				if blah != 0 {
 					fmt.Fprintf(bk.logfile, "    name: %s, min~max args: %d~%d\n", funcName, minargs, maxargs)
 				}
-				assert(minargs <= int(nargs) && int(nargs) <= maxargs)
-				assert(len(stack) >= int(nargs))
-				assert(len(stack) >= int(nargs))
+				if !(minargs <= int(nargs) && int(nargs) <= maxargs && len(stack) >= int(nargs)) {
+					return "", malformedToken(op, oname, pos)
+				}
 				argtext := make([]string, nargs)
 				for i := 0; i < int(nargs); i++ {
 					argtext[i] = stack[len(stack)-int(nargs)+i].(*Operand).text
 				}
 				otext := funcName + "(" + strings.Join(argtext, listsep) + ")"
+				if funcx == 255 {
+					// The first argument names the add-in function.
+					otext = argtext[0] + "(" + strings.Join(argtext[1:], listsep) + ")"
+				}
 				res := &Operand{kind: oUNK, value: nil, _rank: FuncRank, text: otext}
 				if funcx == 1 { // IF
 					testarg := stack[len(stack)-int(nargs)].(*Operand)
+					testval, isInt := operandInt(testarg)
 					if testarg.kind != oNUM && testarg.kind != oBOOL {
 						if blah != 0 && testarg.kind != oUNK {
 							fmt.Fprintf(bk.logfile, "IF testarg kind?\n")
 						}
-					} else if testarg.value != 0 && testarg.value != 1 {
+					} else if !isInt || testval != 0 && testval != 1 {
 						if blah != 0 && testarg.value != nil {
 							fmt.Fprintf(bk.logfile, "IF testarg value?\n")
 						}
 					} else {
-						if int(nargs) == 2 && testarg.value == 0 {
+						if int(nargs) == 2 && testval == 0 {
 							// IF(FALSE, tv) => FALSE
 							res.kind = oBOOL
 							res.value = 0
 						} else {
-							respos := len(stack) - int(nargs) + 2 - int(testarg.value.(int))
+							respos := len(stack) - int(nargs) + 2 - testval
 							chosen := stack[respos].(*Operand)
 							if chosen.kind == oMSNG {
 								res.kind = oNUM
@@ -2746,9 +3139,9 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 					}
 				} else if funcx == 100 { // CHOOSE
 					testarg := stack[len(stack)-int(nargs)].(*Operand)
-					if testarg.kind == oNUM {
-						if 1 <= testarg.value.(int) && testarg.value.(int) < int(nargs) {
-							chosen := stack[len(stack)-int(nargs)+testarg.value.(int)].(*Operand)
+					if testval, isInt := operandInt(testarg); testarg.kind == oNUM && isInt {
+						if 1 <= testval && testval < int(nargs) {
+							chosen := stack[len(stack)-int(nargs)+testval].(*Operand)
 							if chosen.kind == oMSNG {
 								res.kind = oNUM
 								res.value = 0
@@ -2770,29 +3163,11 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 			if blah != 0 {
 				fmt.Fprintf(bk.logfile, "   tgtnamex=%d\n", tgtnamex)
 			}
-			tgtobj := bk.NameObjList[tgtnamex]
-			if !tgtobj.Evaluated {
-				// recursive
-				evaluateNameFormula(bk, tgtobj, tgtnamex, blah, level+1)
-			}
-			var res *Operand
-			if tgtobj.Macro != 0 || tgtobj.Binary != 0 || tgtobj.AnyErr != 0 {
-				if blah != 0 {
-					tgtobj.Dump(bk.logfile, "!!! tgtobj has problems!!!", "-----------       --------", 0)
-				}
-				res = &Operand{kind: oUNK, value: nil}
-				anyErr = boolToInt(anyErr != 0 || tgtobj.Macro != 0 || tgtobj.Binary != 0 || tgtobj.AnyErr != 0)
-				anyRel = boolToInt(anyRel != 0 || tgtobj.AnyRel != 0)
-			} else {
-				assert(len(tgtobj.Stack) == 1)
-				res = copyOperand(tgtobj.Stack[0])
-			}
-			res._rank = LeafRank
-			if tgtobj.Scope == -1 {
-				res.text = tgtobj.Name
-			} else {
-				res.text = bk.SheetNames()[tgtobj.Scope] + "!" + tgtobj.Name
+			if tgtnamex < 0 || tgtnamex >= len(bk.NameObjList) {
+				return "", malformedToken(op, oname, pos)
 			}
+			tgtobj := bk.NameObjList[tgtnamex]
+			res := &Operand{kind: oUNK, value: tgtobj.Name, _rank: LeafRank, text: nameText(bk, tgtobj)}
 			if blah != 0 {
 				fmt.Fprintf(bk.logfile, "    tName: setting text to %q\n", res.text)
 			}
@@ -2802,30 +3177,13 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 			if blah != 0 {
 				fmt.Fprintf(bk.logfile, "  (%d, %d, %d, %d)\n", rowx, colx, rowRel, colRel)
 			}
-			shx1 := 0
-			shx2 := 0 // N.B. relative to the CURRENT SHEET #######
 			anyRel = boolToInt(anyRel != 0 || rowRel != 0 || colRel != 0)
-			coords := []int{shx1, shx2 + 1, rowx, rowx + 1, colx, colx + 1}
-			if blah != 0 {
-				fmt.Fprintf(bk.logfile, "   %v\n", coords)
-			}
-			resOp := &Operand{kind: oUNK, value: nil}
-			var ref3d *Ref3D
-			if optype == 1 {
-				relflags := []int{1, 1, rowRel, rowRel, colRel, colRel}
-				ref3d = NewRef3D(append(coords, relflags...)...)
-				resOp.kind = oREL
-				resOp.text = rangename3drel(bk, ref3d, r1c1)
-			} else {
-				ref3d = NewRef3D(coords...)
-				resOp.kind = oREF
-				resOp.text = rangename3d(bk, ref3d)
-			}
-			resOp._rank = LeafRank
-			if optype == 1 {
-				resOp.value = []*Ref3D{ref3d}
+			okind := oREF
+			if rowRel != 0 || colRel != 0 {
+				okind = oREL
 			}
-			spush(resOp)
+			otext := cellnamerel(rowx, colx, rowRel, colRel, browxPtr, bcolxPtr, r1c1)
+			spush(&Operand{kind: okind, value: nil, _rank: LeafRank, text: otext})
 		} else if opcode == 0x05 { // tArea
 			res1, res2 := getCellRangeAddr(data, pos+1, bv, reldelta, browx, bcolx)
 			if blah != 0 {
@@ -2833,35 +3191,23 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 			}
 			rowx1, colx1, rowRel1, colRel1 := res1[0], res1[1], res1[2], res1[3]
 			rowx2, colx2, rowRel2, colRel2 := res2[0], res2[1], res2[2], res2[3]
-			shx1 := 0
-			shx2 := 0 // N.B. relative to the CURRENT SHEET #######
+			coords := []int{rowx1, rowx2 + 1, colx1, colx2 + 1}
+			relflags := []int{rowRel1, rowRel2, colRel1, colRel2}
 			anyRel = boolToInt(anyRel != 0 || rowRel1 != 0 || colRel1 != 0 || rowRel2 != 0 || colRel2 != 0)
-			coords := []int{shx1, shx2 + 1, rowx1, rowx2 + 1, colx1, colx2 + 1}
-			if blah != 0 {
-				fmt.Fprintf(bk.logfile, "   %v\n", coords)
-			}
-			resOp := &Operand{kind: oUNK, value: nil}
-			var ref3d *Ref3D
-			if optype == 1 {
-				relflags := []int{1, 1, rowRel1, rowRel2, colRel1, colRel2}
-				ref3d = NewRef3D(append(coords, relflags...)...)
-				resOp.kind = oREL
-				resOp.text = rangename3drel(bk, ref3d, r1c1)
-			} else {
-				ref3d = NewRef3D(coords...)
-				resOp.kind = oREF
-				resOp.text = rangename3d(bk, ref3d)
+			okind := oREF
+			if rowRel1 != 0 || colRel1 != 0 || rowRel2 != 0 || colRel2 != 0 {
+				okind = oREL
 			}
-			resOp._rank = LeafRank
-			if optype == 1 {
-				resOp.value = []*Ref3D{ref3d}
+			if blah != 0 {
+				fmt.Fprintf(bk.logfile, "   %v %v\n", coords, relflags)
 			}
-			spush(resOp)
+			otext := rangename2drel(coords, relflags, browxPtr, bcolxPtr, r1c1)
+			spush(&Operand{kind: okind, value: nil, _rank: LeafRank, text: otext})
 		} else if opcode == 0x06 { // tMemArea
 			// Not used for decompiling; skip.
 		} else if opcode == 0x09 { // tMemFunc
-			nb, _ := unpack("<H", data[pos+1:pos+3])
-			if blah != 0 {
+			if blah != 0 && pos+3 <= fmlalen {
+				nb := binary.LittleEndian.Uint16(data[pos+1 : pos+3])
 				fmt.Fprintf(bk.logfile, "  %d bytes of cell ref formula\n", nb)
 			}
 			// no effect on stack
@@ -2931,11 +3277,15 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 				relflags := []int{0, 0, rowRel, rowRel, colRel, colRel}
 				ref3d = NewRef3D(append(coords, relflags...)...)
 				resOp.kind = oREL
-				resOp.text = rangename3drel(bk, ref3d, r1c1)
+				text, err := Rangename3drel(bk, ref3d, browxPtr, bcolxPtr, r1c1)
+				if err != nil {
+					return "", err
+				}
+				resOp.text = text
 			} else {
 				ref3d = NewRef3D(coords...)
 				resOp.kind = oREF
-				resOp.text = rangename3d(bk, ref3d)
+				resOp.text = rangename3dabs(bk, ref3d, r1c1)
 			}
 			resOp._rank = LeafRank
 			if optype == 1 {
@@ -2978,11 +3328,15 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 				relflags := []int{0, 0, rowRel1, rowRel2, colRel1, colRel2}
 				ref3d = NewRef3D(append(coords, relflags...)...)
 				resOp.kind = oREL
-				resOp.text = rangename3drel(bk, ref3d, r1c1)
+				text, err := Rangename3drel(bk, ref3d, browxPtr, bcolxPtr, r1c1)
+				if err != nil {
+					return "", err
+				}
+				resOp.text = text
 			} else {
 				ref3d = NewRef3D(coords...)
 				resOp.kind = oREF
-				resOp.text = rangename3d(bk, ref3d)
+				resOp.text = rangename3dabs(bk, ref3d, r1c1)
 			}
 			resOp._rank = LeafRank
 			if optype == 1 {
@@ -3002,7 +3356,7 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 			} else {
 				result, _ := unpack("<hxxxxxxxxH", data[pos+1:pos+13])
 				values := result.([]interface{})
-				refx := int(values[0].(int16))
+				refx = int(values[0].(int16))
 				tgtnamex = int(values[1].(uint16)) - 1
 				origrefx = refx
 				if refx > 0 {
@@ -3026,39 +3380,27 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 				} else if origrefx > 0 {
 					shx1, _ = -4, -4 // external ref
 				} else {
-					exty := bk.externsheetTypeB57[refx]
+					exty := 0
+					if refx >= 0 && refx < len(bk.externsheetTypeB57) {
+						exty = bk.externsheetTypeB57[refx]
+					}
 					if exty == 4 { // non-specific sheet in own doc't
 						shx1, _ = -1, -1 // internal, any sheet
 					} else {
 						shx1, _ = -666, -666
 					}
 				}
-				if dodgy != 0 || shx1 < -1 {
+				if shx1 == -5 && tgtnamex >= 0 && tgtnamex < len(bk.addinFuncNames) { // add-in function name
+					res = &Operand{kind: oUNK, value: nil, _rank: LeafRank, text: bk.addinFuncNames[tgtnamex]}
+				} else if dodgy != 0 || shx1 < -1 {
 					otext := fmt.Sprintf("<<Name #%d in external(?) file #%d>>", tgtnamex, origrefx)
 					res = &Operand{kind: oUNK, value: nil, _rank: LeafRank, text: otext}
 				} else {
-					tgtobj := bk.NameObjList[tgtnamex]
-					if !tgtobj.Evaluated {
-						// recursive
-						evaluateNameFormula(bk, tgtobj, tgtnamex, blah, level+1)
-					}
-					if tgtobj.Macro != 0 || tgtobj.Binary != 0 || tgtobj.AnyErr != 0 {
-						if blah != 0 {
-							tgtobj.Dump(bk.logfile, "!!! bad tgtobj !!!", "------------------", 0)
-						}
-						res = &Operand{kind: oUNK, value: nil}
-						anyErr = boolToInt(anyErr != 0 || tgtobj.Macro != 0 || tgtobj.Binary != 0 || tgtobj.AnyErr != 0)
-						anyRel = boolToInt(anyRel != 0 || tgtobj.AnyRel != 0)
-					} else {
-						assert(len(tgtobj.Stack) == 1)
-						res = copyOperand(tgtobj.Stack[0])
-					}
-					res._rank = LeafRank
-					if tgtobj.Scope == -1 {
-						res.text = tgtobj.Name
-					} else {
-						res.text = bk.SheetNames()[tgtobj.Scope] + "!" + tgtobj.Name
+					if tgtnamex < 0 || tgtnamex >= len(bk.NameObjList) {
+						return "", malformedToken(op, oname, pos)
 					}
+					tgtobj := bk.NameObjList[tgtnamex]
+					res = &Operand{kind: oUNK, value: tgtobj.Name, _rank: LeafRank, text: nameText(bk, tgtobj)}
 					if blah != 0 {
 						fmt.Fprintf(bk.logfile, "    tNameX: setting text to %q\n", res.text)
 					}
@@ -3075,7 +3417,7 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 			anyErr = 1
 		}
 		if sz <= 0 {
-			panic(&FormulaError{message: "Fatal: token size is not positive"})
+			return "", &FormulaError{message: "Fatal: token size is not positive"}
 		}
 		pos += sz
 	}
@@ -3091,7 +3433,7 @@ func DecompileFormula(bk *Book, fmla []byte, fmlalen int, fmlatype int, browx, b
 
 	if len(stack) == 1 {
 		result := stack[0].(*Operand)
-		return result.text
+		return result.text, nil
 	}
-	return "<<Stack underflow>>"
+	return "<<Stack underflow>>", nil
 }
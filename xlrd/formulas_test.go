@@ -1,8 +1,13 @@
 package xlrd
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"strings"
+	"sync"
 	"testing"
 	"unicode"
 )
@@ -232,3 +237,297 @@ func TestEvaluateNameFormulaWithInvalidOperand(t *testing.T) {
 		t.Errorf("cell.Value is not an int, got %T", cell.Value)
 	}
 }
+
+func TestNameCellAndArea2D(t *testing.T) {
+	book, err := OpenWorkbook(fromSample("namesdemo.xls"), &OpenWorkbookOptions{Logfile: io.Discard})
+	if err != nil {
+		t.Fatalf("Failed to open workbook: %v", err)
+	}
+	name := func(name string, scope int) *Name {
+		for _, nobj := range book.NameObjList {
+			if nobj.Name == name && nobj.Scope == scope {
+				return nobj
+			}
+		}
+		t.Fatalf("name %q with scope %d not found", name, scope)
+		return nil
+	}
+
+	cell, err := name("BottomLine", -1).Cell()
+	if err != nil {
+		t.Fatalf("BottomLine.Cell() failed: %v", err)
+	}
+	if cell.CType != XL_CELL_NUMBER || cell.Value != 9876.0 {
+		t.Errorf("BottomLine.Cell() = %d %v, want a number 9876", cell.CType, cell.Value)
+	}
+
+	for _, tt := range []struct {
+		name               string
+		scope              int
+		clipped            bool
+		sheet              string
+		rlo, rhi, clo, chi int
+	}{
+		{"Expenses", -1, true, "Sheet3", 2, 3, 1, 14},
+		{"Union", -1, false, "Sheet3", 8, 11, 0, 6},
+		{"localRange", 1, false, "Sheet2", 1, 2, 1, 2},
+		{"localRange", 1, true, "Sheet2", 0, 0, 0, 0},
+	} {
+		sh, rlo, rhi, clo, chi, err := name(tt.name, tt.scope).Area2D(tt.clipped)
+		if err != nil {
+			t.Errorf("%s.Area2D(%v) failed: %v", tt.name, tt.clipped, err)
+			continue
+		}
+		if sh.Name != tt.sheet || rlo != tt.rlo || rhi != tt.rhi || clo != tt.clo || chi != tt.chi {
+			t.Errorf("%s.Area2D(%v) = %s %d %d %d %d, want %s %d %d %d %d", tt.name, tt.clipped,
+				sh.Name, rlo, rhi, clo, chi, tt.sheet, tt.rlo, tt.rhi, tt.clo, tt.chi)
+		}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		problem NameRefProblem
+	}{
+		{"Expenses", NameNotCell},
+		{"A1Z10", NameRelative},
+		{"List", NameMultiArea},
+		{"PosInt", NameNotReference},
+		{"addnumstr", NameNotReference},
+	} {
+		_, err := name(tt.name, -1).Cell()
+		var nerr *NameRefError
+		if !errors.As(err, &nerr) || nerr.Problem != tt.problem || !errors.Is(err, ErrNotReference) {
+			t.Errorf("%s.Cell() error = %v, want a NameRefError with problem %d", tt.name, err, tt.problem)
+		}
+	}
+}
+
+func TestNameArea2DConcurrent(t *testing.T) {
+	book, err := OpenWorkbook(fromSample("namesdemo.xls"), &OpenWorkbookOptions{Logfile: io.Discard, OnDemand: true})
+	if err != nil {
+		t.Fatalf("Failed to open workbook: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		for _, nobj := range book.NameObjList {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				nobj.Area2D(true)
+				nobj.Cell()
+			}()
+		}
+	}
+	wg.Wait()
+	sh, rlo, rhi, clo, chi, err := book.nameMap["expenses"][0].Area2D(false)
+	if err != nil || sh.Name != "Sheet3" || rlo != 2 || rhi != 3 || clo != 1 || chi != 14 {
+		t.Errorf("Expenses.Area2D(false) = %v %d %d %d %d, %v, want Sheet3 2 3 1 14", sh, rlo, rhi, clo, chi, err)
+	}
+}
+
+func TestStrg2num(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want interface{}
+	}{
+		{" 12.5 ", 12.5},
+		{"1e3", 1000.0},
+		{"inf", math.Inf(1)},
+		{"0x1p3", nil},
+		{"0X10", nil},
+		{"12abc", nil},
+		{"", nil},
+	} {
+		if got := strg2num(tt.s); got != tt.want {
+			t.Errorf("strg2num(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestDecompileFormulaMalformed(t *testing.T) {
+	book, err := OpenWorkbook(fromSample("formula_test_sjmachin.xls"), &OpenWorkbookOptions{Logfile: io.Discard})
+	if err != nil {
+		t.Fatalf("Failed to open workbook: %v", err)
+	}
+	tests := []struct {
+		name string
+		fmla []byte
+	}{
+		{"truncated tAttr", []byte{0x19, 0x01}},
+		{"tExtended", []byte{0x18, 0x00, 0x00}},
+		{"truncated tRef", []byte{0x24, 0x01}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecompileFormula(book, tt.fmla, len(tt.fmla), FMLA_TYPE_CELL, 0, 0, 1, 0, 0)
+			var fe *FormulaError
+			if !errors.As(err, &fe) {
+				t.Errorf("DecompileFormula() error = %v, want *FormulaError", err)
+			}
+		})
+	}
+}
+
+// formulaRecord returns a FORMULA record for the cell at rowx, colx with
+// the given token array and a cached result of 0.
+func formulaRecord(rowx, colx int, rgce ...byte) []byte {
+	data := make([]byte, 22, 22+len(rgce))
+	binary.LittleEndian.PutUint16(data[0:2], uint16(rowx))
+	binary.LittleEndian.PutUint16(data[2:4], uint16(colx))
+	binary.LittleEndian.PutUint16(data[20:22], uint16(len(rgce)))
+	return biffRecord(XL_FORMULA, append(data, rgce...))
+}
+
+func TestCellFormula(t *testing.T) {
+	data := biff8Workbook(
+		// C3: $A$1+B2
+		formulaRecord(2, 2, 0x24, 0, 0, 0, 0, 0x24, 1, 0, 1, 0xC0, 0x03),
+		// C4: SUM(A1:A3)*-2
+		formulaRecord(3, 2, 0x25, 0, 0, 2, 0, 0, 0xC0, 0, 0xC0, 0x22, 1, 4, 0, 0x1E, 2, 0, 0x13, 0x05),
+		// C5: IF(A1>=0.5,"yes",#DIV/0!)
+		formulaRecord(4, 2, 0x24, 0, 0, 0, 0xC0, 0x1F, 0, 0, 0, 0, 0, 0, 0xE0, 0x3F, 0x0C,
+			0x17, 3, 0, 'y', 'e', 's', 0x1C, 0x07, 0x42, 3, 1, 0),
+		numberRecord(5, 2),
+		// C7 holds a tExtended token, which cannot be decompiled.
+		formulaRecord(6, 2, 0x18, 0, 0),
+	)
+	book, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data, Logfile: io.Discard})
+	if err != nil {
+		t.Fatalf("OpenWorkbook() failed: %v", err)
+	}
+	sheet, err := book.SheetByIndex(0)
+	if err != nil {
+		t.Fatalf("SheetByIndex(0) failed: %v", err)
+	}
+	for _, tt := range []struct {
+		rowx, colx int
+		a1, r1c1   string
+	}{
+		{2, 2, "$A$1+B2", "R1C1+R[-1]C[-1]"},
+		{3, 2, "SUM(A1:A3)*-2", "SUM(R[-3]C[-2]:R[-1]C[-2])*-2"},
+		{4, 2, `IF(A1>=0.5,"yes",#DIV/0!)`, `IF(R[-4]C[-2]>=0.5,"yes",#DIV/0!)`},
+	} {
+		if got, ok := sheet.CellFormula(tt.rowx, tt.colx); !ok || got != tt.a1 {
+			t.Errorf("CellFormula(%d, %d) = %q, %v, want %q, true", tt.rowx, tt.colx, got, ok, tt.a1)
+		}
+		if got, ok := sheet.CellFormulaR1C1(tt.rowx, tt.colx); !ok || got != tt.r1c1 {
+			t.Errorf("CellFormulaR1C1(%d, %d) = %q, %v, want %q, true", tt.rowx, tt.colx, got, ok, tt.r1c1)
+		}
+	}
+	if got, ok := sheet.CellFormula(5, 2); ok {
+		t.Errorf("CellFormula(5, 2) = %q, true for a constant", got)
+	}
+	if got, ok := sheet.CellFormula(6, 2); !ok || got != "" {
+		t.Errorf("CellFormula(6, 2) = %q, %v, want \"\", true", got, ok)
+	}
+	if !hasFormulaDiagnostic(sheet, "C7") {
+		t.Errorf("Diagnostics() = %v, want a %s warning for C7", sheet.Diagnostics(), DiagFormula)
+	}
+}
+
+// hasFormulaDiagnostic reports whether sheet has a DiagFormula warning
+// about the named cell.
+func hasFormulaDiagnostic(sheet *Sheet, cell string) bool {
+	for _, d := range sheet.Diagnostics() {
+		if d.Severity == SeverityWarning && d.Code == DiagFormula && d.Sheet == sheet.Name &&
+			strings.Contains(d.Message, " "+cell+":") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCellFormulaSamples(t *testing.T) {
+	for _, tt := range []struct {
+		file, sheet string
+		rowx, colx  int
+		want        string
+	}{
+		{"formula_test_sjmachin.xls", "Sheet1", 3, 1, `"ABC"&"DEF"`},
+		{"formula_test_sjmachin.xls", "Sheet1", 4, 1, `REPT("foo",0)`},
+		{"formula_test_sjmachin.xls", "Sheet1", 7, 1, "B2"},
+		{"formula_test_names.xls", "Sheet1", 1, 1, "unaryminus"},
+		{"namesdemo.xls", "Sheet1", 11, 0, "SUM(Apostrophe)"},
+		{"namesdemo.xls", "Sheet3", 13, 0, "SUM(rectangle1 rectangle2)"},
+		{"namesdemo.xls", "Sheet3", 24, 2, "12.34&56.789"},
+		{"profiles.xls", "PROFILELEVELS", 1, 3, "C2-B2*(TRAVERSALCHAINAGE!J2-TRAVERSALCHAINAGE!I2)"},
+	} {
+		t.Run(fmt.Sprintf("%s/%s", tt.file, Cellname(tt.rowx, tt.colx)), func(t *testing.T) {
+			book, err := OpenWorkbook(fromSample(tt.file), &OpenWorkbookOptions{Logfile: io.Discard})
+			if err != nil {
+				t.Fatalf("OpenWorkbook(%s) failed: %v", tt.file, err)
+			}
+			sheet, err := book.SheetByName(tt.sheet)
+			if err != nil {
+				t.Fatalf("SheetByName(%s) failed: %v", tt.sheet, err)
+			}
+			if got, ok := sheet.CellFormula(tt.rowx, tt.colx); !ok || got != tt.want {
+				t.Errorf("CellFormula() = %q, %v, want %q, true", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestSharedAndArrayFormulas(t *testing.T) {
+	// C1:C3 share A1+B1*$D$1; C1 has a string result, so the SHRFMLA
+	// record comes between its FORMULA and STRING records.
+	c1 := formulaRecord(0, 2, 0x01, 0, 0, 2, 0)
+	c1[4+12], c1[4+13] = 0xFF, 0xFF
+	shared := []byte{0, 0, 2, 0, 2, 2, 0, 3, 17, 0,
+		0x2C, 0, 0, 0xFE, 0xC0, 0x2C, 0, 0, 0xFF, 0xC0, 0x2C, 0, 0, 3, 0, 0x05, 0x03}
+	// E1:E2 hold the array formula A1:A2*2.
+	array := []byte{0, 0, 1, 0, 4, 4, 0, 0, 0, 0, 0, 0, 13, 0,
+		0x25, 0, 0, 1, 0, 0, 0xC0, 0, 0xC0, 0x1E, 2, 0, 0x05}
+	data := biff8Workbook(
+		c1,
+		biffRecord(XL_SHRFMLA, shared),
+		biffRecord(XL_STRING, []byte{1, 0, 0, 'x'}),
+		formulaRecord(0, 4, 0x01, 0, 0, 4, 0),
+		biffRecord(XL_ARRAY, array),
+		formulaRecord(1, 2, 0x01, 0, 0, 2, 0),
+		formulaRecord(1, 4, 0x01, 0, 0, 4, 0),
+		formulaRecord(2, 2, 0x01, 0, 0, 2, 0),
+		// C4 refers to a shared formula that does not cover it.
+		formulaRecord(3, 2, 0x01, 0, 0, 2, 0),
+	)
+	book, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data, Logfile: io.Discard})
+	if err != nil {
+		t.Fatalf("OpenWorkbook() failed: %v", err)
+	}
+	sheet, err := book.SheetByIndex(0)
+	if err != nil {
+		t.Fatalf("SheetByIndex(0) failed: %v", err)
+	}
+	if got := sheet.CellValue(0, 2); got != "x" {
+		t.Errorf("CellValue(0, 2) = %v, want x", got)
+	}
+	for _, tt := range []struct {
+		rowx, colx int
+		a1, r1c1   string
+		array      bool
+	}{
+		{0, 2, "A1+B1*$D$1", "RC[-2]+RC[-1]*R1C4", false},
+		{1, 2, "A2+B2*$D$1", "RC[-2]+RC[-1]*R1C4", false},
+		{2, 2, "A3+B3*$D$1", "RC[-2]+RC[-1]*R1C4", false},
+		{3, 2, "", "", false},
+		{0, 4, "A1:A2*2", "RC[-4]:R[1]C[-4]*2", true},
+		{1, 4, "A1:A2*2", "RC[-4]:R[1]C[-4]*2", true},
+	} {
+		if got, ok := sheet.CellFormula(tt.rowx, tt.colx); !ok || got != tt.a1 {
+			t.Errorf("CellFormula(%d, %d) = %q, %v, want %q, true", tt.rowx, tt.colx, got, ok, tt.a1)
+		}
+		if got, ok := sheet.CellFormulaR1C1(tt.rowx, tt.colx); !ok || got != tt.r1c1 {
+			t.Errorf("CellFormulaR1C1(%d, %d) = %q, %v, want %q, true", tt.rowx, tt.colx, got, ok, tt.r1c1)
+		}
+		cells, ok := sheet.ArrayFormulaRange(tt.rowx, tt.colx)
+		if ok != tt.array {
+			t.Errorf("ArrayFormulaRange(%d, %d) ok = %v, want %v", tt.rowx, tt.colx, ok, tt.array)
+		}
+		if want := (CellRange{FirstRow: 0, LastRow: 2, FirstCol: 4, LastCol: 5}); ok && cells != want {
+			t.Errorf("ArrayFormulaRange(%d, %d) = %+v, want %+v", tt.rowx, tt.colx, cells, want)
+		}
+	}
+	if !hasFormulaDiagnostic(sheet, "C4") {
+		t.Errorf("Diagnostics() = %v, want a %s warning for C4", sheet.Diagnostics(), DiagFormula)
+	}
+}
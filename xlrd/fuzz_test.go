@@ -0,0 +1,201 @@
+package xlrd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// addSampleSeeds adds each .xls file in testdata/samples to the corpus of f.
+func addSampleSeeds(f *testing.F) [][]byte {
+	paths, err := filepath.Glob(fromSample("*.xls"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	var seeds [][]byte
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		seeds = append(seeds, data)
+	}
+	return seeds
+}
+
+// biffVersions lists the BIFF versions with formula token tables.
+var biffVersions = []int{20, 21, 30, 40, 45, 50, 70, 80}
+
+// checkRecovered fails t if err reports a runtime panic that was recovered,
+// which means a bounds check is missing.
+func checkRecovered(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && strings.Contains(err.Error(), "runtime error") {
+		t.Errorf("recovered panic: %v", err)
+	}
+}
+
+func FuzzOpenWorkbook(f *testing.F) {
+	for _, data := range addSampleSeeds(f) {
+		f.Add(data, false)
+		f.Add(data, true)
+	}
+	f.Add(biff8Workbook(biffRecord(XL_SCL, []byte{1, 0, 100, 0})), true)
+	f.Fuzz(func(t *testing.T, data []byte, formattingInfo bool) {
+		options := &OpenWorkbookOptions{FormattingInfo: formattingInfo}
+		book, err := OpenWorkbookReaderAt(bytes.NewReader(data), int64(len(data)), options)
+		checkRecovered(t, err)
+		if err != nil {
+			return
+		}
+		for namex, nobj := range book.NameObjList {
+			checkRecovered(t, EvaluateNameFormula(book, nobj, namex, 0, 0))
+		}
+		for _, sheet := range book.Sheets() {
+			for rowx := 0; rowx < sheet.NRows; rowx++ {
+				for colx := 0; colx < sheet.RowLen(rowx); colx++ {
+					sheet.Cell(rowx, colx)
+				}
+			}
+		}
+	})
+}
+
+func FuzzSheet(f *testing.F) {
+	hlink := make([]byte, 32)
+	copy(hlink[8:24], []byte{0xD0, 0xC9, 0xEA, 0x79, 0xF9, 0xBA, 0xCE, 0x11, 0x8C, 0x82, 0x00, 0xAA, 0x00, 0x4B, 0xA9, 0x0B})
+	binary.LittleEndian.PutUint32(hlink[24:28], 2)
+	binary.LittleEndian.PutUint32(hlink[28:32], 0x14)
+	f.Add(biffRecord(XL_HLINK, hlink))
+	f.Add(biffRecord(XL_SCL, []byte{1, 0, 100, 0}))
+	f.Add(append(biffRecord(XL_NUMBER, make([]byte, 14)), biffRecord(XL_LABELSST, make([]byte, 10))...))
+	obj := []byte{0x15, 0x00, 0x12, 0x00, 0x19, 0x00, 0x01, 0x00, 0x11, 0x60, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x00, 0x00, 0x00, 0x00}
+	txo := make([]byte, 18)
+	binary.LittleEndian.PutUint16(txo[10:12], 2)
+	binary.LittleEndian.PutUint16(txo[12:14], 16)
+	note := []byte{0, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 'x'}
+	var seed []byte
+	seed = append(seed, biffRecord(XL_OBJ, obj)...)
+	seed = append(seed, biffRecord(XL_TXO, txo)...)
+	seed = append(seed, biffRecord(XL_CONTINUE, []byte{0, 'h', 'i'})...)
+	seed = append(seed, biffRecord(XL_CONTINUE, make([]byte, 16))...)
+	seed = append(seed, biffRecord(XL_NOTE, note)...)
+	f.Add(seed)
+	f.Fuzz(func(t *testing.T, records []byte) {
+		data := biff8Workbook(records)
+		options := &OpenWorkbookOptions{FormattingInfo: true}
+		_, err := OpenWorkbookReaderAt(bytes.NewReader(data), int64(len(data)), options)
+		checkRecovered(t, err)
+	})
+}
+
+func FuzzCompDoc(f *testing.F) {
+	for _, data := range addSampleSeeds(f) {
+		f.Add(data)
+	}
+	f.Add(compoundFile(map[string][]byte{"Workbook": biff8Workbook(), "MBD00000001/WordDocument": []byte("doc")}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cd, err := NewCompDoc(data, nil, 0, true)
+		checkRecovered(t, err)
+		if err == nil {
+			_, _, _, err = cd.LocateNamedStream("Workbook")
+			checkRecovered(t, err)
+			cd.Walk(func(path []string, entry DirNode) error {
+				if entry.EType == DirStorage {
+					cd.ExtractStorage(path...)
+				}
+				return nil
+			})
+		}
+		cd, err = NewCompDocReaderAt(bytes.NewReader(data), int64(len(data)), nil, 0, false)
+		checkRecovered(t, err)
+		if err == nil {
+			_, _, _, err = cd.LocateNamedStream("Workbook")
+			checkRecovered(t, err)
+		}
+		_, err = OpenWorkbookReaderAt(bytes.NewReader(data), int64(len(data)), &OpenWorkbookOptions{Salvage: true})
+		checkRecovered(t, err)
+	})
+}
+
+func FuzzUnpackSSTTable(f *testing.F) {
+	f.Add([]byte{3, 0, 0, 'a', 'b', 'c', 2, 0, 1, 'x', 0, 'y', 0}, 5, 2)
+	f.Add([]byte{4, 0, 0x0C, 1, 0, 4, 0, 0, 0, 'a', 'b', 'c', 'd', 0, 0, 1, 0}, 12, 1)
+	f.Fuzz(func(t *testing.T, data []byte, split int, nstrings int) {
+		datatab := [][]byte{data}
+		if split > 0 && split < len(data) {
+			datatab = [][]byte{data[:split], data[split:]}
+		}
+		UnpackSSTTable(datatab, nstrings)
+	})
+}
+
+func FuzzUnpackUnicodeUpdatePos(f *testing.F) {
+	f.Add([]byte{3, 0, 0, 'a', 'b', 'c'}, 0, 2)
+	f.Add([]byte{2, 1, 'x', 0, 'y', 0}, 0, 1)
+	f.Add([]byte{0, 1, 0x0C, 1, 0, 'a', 0, 0, 0, 0}, 0, 1)
+	f.Fuzz(func(t *testing.T, data []byte, pos int, lenlen int) {
+		UnpackUnicodeUpdatePos(data, pos, lenlen, nil)
+	})
+}
+
+func FuzzDecompileFormula(f *testing.F) {
+	book, err := OpenWorkbook(fromSample("formula_test_names.xls"), nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, nobj := range book.NameObjList {
+		f.Add(nobj.RawFormula, uint8(len(biffVersions)-1))
+	}
+	f.Add([]byte{0x24, 0x01, 0x00, 0x02, 0xC0}, uint8(len(biffVersions)-1))
+	f.Add([]byte{0x3A, 0xFF, 0xFF, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 2, 0}, uint8(5))
+	f.Fuzz(func(t *testing.T, fmla []byte, version uint8) {
+		book.BiffVersion = biffVersions[int(version)%len(biffVersions)]
+		_, err := DecompileFormula(book, fmla, len(fmla), FMLA_TYPE_CELL, 0, 0, 0, 0, 0)
+		checkRecovered(t, err)
+		_, err = DecompileFormula(book, fmla, len(fmla), FMLA_TYPE_NAME, nil, nil, 0, 0, 1)
+		checkRecovered(t, err)
+		nobj := &Name{Book: book, Name: "fuzz", RawFormula: fmla, BasicFormulaLen: len(fmla), Scope: -1}
+		checkRecovered(t, EvaluateNameFormula(book, nobj, len(book.NameObjList), 0, 0))
+	})
+}
+
+func FuzzEvaluateCell(f *testing.F) {
+	f.Add(rpn(tStr("abc"), tNum(1e300), tNum(1), tFuncVar(31, 3)))
+	f.Add(rpn(tStr(""), tNum(1e300), tFuncVar(30, 2)))
+	f.Add(rpn(tNum(2000), tNum(1e300), tNum(1), tFuncVar(65, 3)))
+	f.Add(rpn(tArea(0, 0, 1, 1), tStr("*a*?~*"), tFuncVar(346, 2)))
+	f.Add(ifTokens(rpn(tRef(0, 0), tNum(1), tOp(tGT)), tRef(2, 0), tStr("no")))
+	f.Add(chooseTokens(tRef(0, 0), tRef(1, 1), tRef(2, 0), tNum(3)))
+	f.Fuzz(func(t *testing.T, fmla []byte) {
+		if len(fmla) > 8000 {
+			return
+		}
+		data := biff8Workbook(
+			numberValueRecord(0, 0, 1), labelRecord(0, 1, "banana"), numberValueRecord(1, 0, 1e300),
+			formulaRecord(1, 1, rpn(tRef(0, 0), tNum(1), tOp(tAdd))...),
+			formulaRecord(2, 0, fmla...),
+		)
+		book, err := OpenWorkbookReaderAt(bytes.NewReader(data), int64(len(data)), nil)
+		if err != nil {
+			return
+		}
+		sheet, err := book.SheetByIndex(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sheet.EvaluateCell(2, 0)
+		book.Recalculate()
+	})
+}
+
+func FuzzDecompressVBA(f *testing.F) {
+	f.Add([]byte{0x01, 0x03, 0xB0, 0x02, 0x61, 0x45, 0x00})
+	f.Add(vbaCompress([]byte("Attribute VB_Name = \"Module1\"\r\n")))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decompressVBA(data)
+	})
+}
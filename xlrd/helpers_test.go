@@ -1,8 +1,11 @@
 package xlrd
 
 import (
+	"encoding/binary"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
 )
 
 // fromSample returns the path to a test sample file.
@@ -12,3 +15,173 @@ func fromSample(filename string) string {
 	projectRoot := filepath.Join(testDir, "..")
 	return filepath.Join(projectRoot, "testdata", "samples", filename)
 }
+
+// biffRecord returns a BIFF record with the given opcode and data.
+func biffRecord(opcode int, data []byte) []byte {
+	rec := make([]byte, 4, 4+len(data))
+	binary.LittleEndian.PutUint16(rec[0:2], uint16(opcode))
+	binary.LittleEndian.PutUint16(rec[2:4], uint16(len(data)))
+	return append(rec, data...)
+}
+
+// biff8BOF returns a BIFF8 BOF record for a stream of the given type.
+func biff8BOF(streamType int) []byte {
+	data := make([]byte, 16)
+	binary.LittleEndian.PutUint16(data[0:2], 0x0600)
+	binary.LittleEndian.PutUint16(data[2:4], uint16(streamType))
+	binary.LittleEndian.PutUint16(data[4:6], 0x0DBB)
+	binary.LittleEndian.PutUint16(data[6:8], 1996)
+	return biffRecord(XL_BOF, data)
+}
+
+// biff8Workbook returns a raw BIFF8 workbook stream with one worksheet
+// named "Sheet1" holding the given records between its BOF and EOF.
+func biff8Workbook(sheetRecords ...[]byte) []byte {
+	return biff8WorkbookGlobals(nil, sheetRecords...)
+}
+
+// biff8WorkbookGlobals is biff8Workbook with globalsRecords added to the
+// workbook globals after the BOUNDSHEET record.
+func biff8WorkbookGlobals(globalsRecords [][]byte, sheetRecords ...[]byte) []byte {
+	boundsheet := func(offset int) []byte {
+		data := make([]byte, 6, 14)
+		binary.LittleEndian.PutUint32(data[0:4], uint32(offset))
+		return biffRecord(XL_BOUNDSHEET, append(data, 6, 0, 'S', 'h', 'e', 'e', 't', '1'))
+	}
+	globalsLen := len(biff8BOF(XL_WORKBOOK_GLOBALS)) + len(boundsheet(0)) + len(biffRecord(XL_EOF, nil))
+	for _, rec := range globalsRecords {
+		globalsLen += len(rec)
+	}
+	stream := biff8BOF(XL_WORKBOOK_GLOBALS)
+	stream = append(stream, boundsheet(globalsLen)...)
+	for _, rec := range globalsRecords {
+		stream = append(stream, rec...)
+	}
+	stream = append(stream, biffRecord(XL_EOF, nil)...)
+	stream = append(stream, biff8BOF(XL_WORKSHEET)...)
+	for _, rec := range sheetRecords {
+		stream = append(stream, rec...)
+	}
+	return append(stream, biffRecord(XL_EOF, nil)...)
+}
+
+// compoundFile returns an OLE2 compound document holding the given
+// streams, keyed by their slash-separated paths below the root storage;
+// storages are created as needed. Every stream is kept in 512-byte
+// sectors, so the document has no short streams.
+func compoundFile(streams map[string][]byte) []byte {
+	type entry struct {
+		name     string
+		etype    int
+		data     []byte
+		children []int
+	}
+	entries := []*entry{{name: "Root Entry", etype: DirRoot}}
+	paths := make([]string, 0, len(streams))
+	for path := range streams {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		did := 0
+		names := strings.Split(path, "/")
+		for i, name := range names {
+			child := -1
+			for _, c := range entries[did].children {
+				if entries[c].name == name {
+					child = c
+				}
+			}
+			if child < 0 {
+				child = len(entries)
+				etype := DirStorage
+				if i == len(names)-1 {
+					etype = DirStream
+				}
+				entries = append(entries, &entry{name: name, etype: etype})
+				entries[did].children = append(entries[did].children, child)
+			}
+			did = child
+		}
+		entries[did].data = streams[path]
+	}
+
+	// Sector 0 holds the SAT, followed by the directory and the streams.
+	const secSize = 512
+	putSID := func(b []byte, sid int32) {
+		binary.LittleEndian.PutUint32(b, uint32(sid))
+	}
+	sat := []int32{SATSID}
+	chain := func(size int) int32 {
+		n := (size + secSize - 1) / secSize
+		if n == 0 {
+			return EOCSID
+		}
+		first := int32(len(sat))
+		for i := 1; i < n; i++ {
+			sat = append(sat, int32(len(sat)+1))
+		}
+		sat = append(sat, EOCSID)
+		return first
+	}
+	dir := make([]byte, len(entries)*128)
+	dirSID := chain(len(dir))
+	dir = append(dir, make([]byte, -len(dir)&(secSize-1))...)
+	var data []byte
+	right := make([]int32, len(entries))
+	for i := range right {
+		right[i] = FREESID
+	}
+	for _, e := range entries {
+		for i := 1; i < len(e.children); i++ {
+			right[e.children[i-1]] = int32(e.children[i])
+		}
+	}
+	for did, e := range entries {
+		dent := dir[did*128 : (did+1)*128]
+		name := utf16LE(e.name + "\x00")
+		copy(dent, name)
+		binary.LittleEndian.PutUint16(dent[64:66], uint16(len(name)))
+		dent[66] = byte(e.etype)
+		child := int32(FREESID)
+		if len(e.children) > 0 {
+			child = int32(e.children[0])
+		}
+		putSID(dent[68:72], FREESID)
+		putSID(dent[72:76], right[did])
+		putSID(dent[76:80], child)
+		putSID(dent[116:120], chain(len(e.data)))
+		binary.LittleEndian.PutUint32(dent[120:124], uint32(len(e.data)))
+		data = append(data, e.data...)
+		data = append(data, make([]byte, -len(data)&(secSize-1))...)
+	}
+	if len(sat) > secSize/4 {
+		panic("compoundFile: streams too large")
+	}
+
+	hdr := make([]byte, 512)
+	copy(hdr, XLS_SIGNATURE)
+	binary.LittleEndian.PutUint16(hdr[24:26], 0x3E)
+	binary.LittleEndian.PutUint16(hdr[26:28], 3)
+	hdr[28], hdr[29] = 0xFE, 0xFF
+	binary.LittleEndian.PutUint16(hdr[30:32], 9)
+	binary.LittleEndian.PutUint16(hdr[32:34], 6)
+	binary.LittleEndian.PutUint32(hdr[44:48], 1)
+	putSID(hdr[48:52], dirSID)
+	putSID(hdr[60:64], EOCSID)
+	putSID(hdr[68:72], EOCSID)
+	for i := 1; i < 109; i++ {
+		putSID(hdr[76+4*i:], FREESID)
+	}
+	satSector := make([]byte, secSize)
+	for i := range secSize / 4 {
+		sid := int32(FREESID)
+		if i < len(sat) {
+			sid = sat[i]
+		}
+		putSID(satSector[4*i:], sid)
+	}
+	out := append(hdr, satSector...)
+	out = append(out, dir...)
+	return append(out, data...)
+}
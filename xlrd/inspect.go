@@ -102,26 +102,56 @@ func InspectFormat(path string, content []byte) (string, error) {
 			return "", err
 		}
 
-		// Workaround for some third party files that use forward slashes and
-		// lower case names. We map the expected name in lowercase to the
-		// actual filename in the zip container.
-		componentNames := make(map[string]string)
-		for _, name := range zf.File {
-			lowerName := strings.ToLower(strings.ReplaceAll(name.Name, "\\", "/"))
-			componentNames[lowerName] = name.Name
-		}
+		return zipFormat(zf), nil
+	}
 
-		if _, ok := componentNames["xl/workbook.xml"]; ok {
-			return "xlsx", nil
-		}
-		if _, ok := componentNames["xl/workbook.bin"]; ok {
-			return "xlsb", nil
-		}
-		if _, ok := componentNames["content.xml"]; ok {
-			return "ods", nil
+	return "", nil
+}
+
+// inspectReaderAt is like InspectFormat, but reads from r, which holds size bytes.
+func inspectReaderAt(r io.ReaderAt, size int64) (string, error) {
+	if size < PEEK_SIZE {
+		return "", nil
+	}
+	peek := make([]byte, PEEK_SIZE)
+	if _, err := r.ReadAt(peek, 0); err != nil && err != io.EOF {
+		return "", err
+	}
+
+	if bytes.HasPrefix(peek, XLS_SIGNATURE) {
+		return "xls", nil
+	}
+
+	if bytes.HasPrefix(peek, ZIP_SIGNATURE) {
+		zf, err := zip.NewReader(r, size)
+		if err != nil {
+			return "", err
 		}
-		return "zip", nil
+		return zipFormat(zf), nil
 	}
 
 	return "", nil
 }
+
+// zipFormat determines the type of a ZIP-based spreadsheet file.
+func zipFormat(zf *zip.Reader) string {
+	// Workaround for some third party files that use forward slashes and
+	// lower case names. We map the expected name in lowercase to the
+	// actual filename in the zip container.
+	componentNames := make(map[string]string)
+	for _, name := range zf.File {
+		lowerName := strings.ToLower(strings.ReplaceAll(name.Name, "\\", "/"))
+		componentNames[lowerName] = name.Name
+	}
+
+	if _, ok := componentNames["xl/workbook.xml"]; ok {
+		return "xlsx"
+	}
+	if _, ok := componentNames["xl/workbook.bin"]; ok {
+		return "xlsb"
+	}
+	if _, ok := componentNames["content.xml"]; ok {
+		return "ods"
+	}
+	return "zip"
+}
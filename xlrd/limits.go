@@ -0,0 +1,109 @@
+package xlrd
+
+import "fmt"
+
+// Limits bounds the resources used to read a workbook, for example one
+// uploaded by an untrusted user. A field left at zero imposes no limit.
+// When a limit is exceeded, loading stops with a *LimitError, which
+// matches ErrLimitExceeded.
+type Limits struct {
+	// MaxCells is the maximum number of cell records read from one sheet.
+	MaxCells int
+
+	// MaxRows and MaxCols bound the row and column indexes of a sheet,
+	// including the extent declared by its DIMENSION record.
+	MaxRows int
+	MaxCols int
+
+	// MaxSSTStrings is the maximum number of strings declared by the
+	// shared string table.
+	MaxSSTStrings int
+
+	// MaxSSTBytes is the maximum total size in bytes of the decoded
+	// shared strings.
+	MaxSSTBytes int
+
+	// MaxContinueRecords is the maximum number of CONTINUE records that
+	// may follow the SST record. It is the only record read together with
+	// an open-ended run of CONTINUE records; a TXO record takes at most two.
+	MaxContinueRecords int
+
+	// MaxNameDepth is the maximum depth of names referring to other names
+	// in EvaluateNameFormula. When zero, StackPanicLevel applies.
+	MaxNameDepth int
+
+	// MaxEvalDepth is the maximum number of formulas EvaluateCell and
+	// Recalculate evaluate one within another, each needing the value of
+	// the next. When zero, DefaultMaxEvalDepth applies.
+	MaxEvalDepth int
+
+	// MaxAllocBytes is an approximate budget, in bytes, for the memory
+	// allocated for the whole workbook: the Workbook stream, the shared
+	// strings and the cell arrays of the loaded sheets. The memory of a
+	// sheet is returned to the budget when it is unloaded.
+	MaxAllocBytes int64
+}
+
+// DefaultMaxEvalDepth is the depth of formula evaluation allowed when
+// Limits.MaxEvalDepth is zero.
+const DefaultMaxEvalDepth = 10000
+
+// LimitError is returned when a workbook exceeds one of its Limits.
+// It matches ErrLimitExceeded.
+type LimitError struct {
+	// Limit is the name of the Limits field, such as "MaxRows".
+	Limit string
+	// Max is the configured limit and Value the amount that exceeded it.
+	Max   int64
+	Value int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("xlrd: %s limit of %d exceeded (%d)", e.Limit, e.Max, e.Value)
+}
+
+// Is reports whether target is ErrLimitExceeded.
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+// checkLimit returns a LimitError if value exceeds the limit max, unless max
+// is zero.
+func checkLimit(limit string, max, value int64) error {
+	if max > 0 && value > max {
+		return &LimitError{Limit: limit, Max: max, Value: value}
+	}
+	return nil
+}
+
+// checkExtent checks a sheet extent of nrows by ncols against MaxRows and
+// MaxCols.
+func (l *Limits) checkExtent(nrows, ncols int) error {
+	if err := checkLimit("MaxRows", int64(l.MaxRows), int64(nrows)); err != nil {
+		return err
+	}
+	return checkLimit("MaxCols", int64(l.MaxCols), int64(ncols))
+}
+
+// Approximate sizes of the cell arrays kept by a Sheet: one interface,
+// type and XF index per cell, and one slice header of each per row.
+const (
+	cellSlotBytes = 16 + 8 + 8
+	rowSlotBytes  = 3 * 24
+)
+
+// charge adds n bytes to the workbook's allocation budget, returning a
+// LimitError once Limits.MaxAllocBytes is exceeded.
+func (b *Book) charge(n int) error {
+	total := b.allocated.Add(int64(n))
+	return checkLimit("MaxAllocBytes", b.limits.MaxAllocBytes, total)
+}
+
+// refund returns the bytes charged for the sheet s to the budget, once s
+// is unloaded, replaced or failed to load.
+func (b *Book) refund(s *Sheet) {
+	if s != nil {
+		b.allocated.Add(-s.allocated)
+		s.allocated = 0
+	}
+}
@@ -0,0 +1,135 @@
+package xlrd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+// numberRecord returns a NUMBER record for the cell at rowx, colx.
+func numberRecord(rowx, colx int) []byte {
+	data := make([]byte, 14)
+	binary.LittleEndian.PutUint16(data[0:2], uint16(rowx))
+	binary.LittleEndian.PutUint16(data[2:4], uint16(colx))
+	return biffRecord(XL_NUMBER, data)
+}
+
+// sstRecord returns an SST record holding the given compressed strings.
+func sstRecord(strs ...string) []byte {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint32(data[0:4], uint32(len(strs)))
+	binary.LittleEndian.PutUint32(data[4:8], uint32(len(strs)))
+	for _, str := range strs {
+		data = binary.LittleEndian.AppendUint16(data, uint16(len(str)))
+		data = append(data, 0)
+		data = append(data, str...)
+	}
+	return biffRecord(XL_SST, data)
+}
+
+func TestLimits(t *testing.T) {
+	dimension := make([]byte, 14)
+	binary.LittleEndian.PutUint32(dimension[4:8], 1000000)
+	binary.LittleEndian.PutUint16(dimension[10:12], 10)
+	cont := biffRecord(XL_CONTINUE, []byte{0})
+
+	tests := []struct {
+		name    string
+		limits  Limits
+		globals [][]byte
+		cells   [][]byte
+		limit   string
+	}{
+		{"rows", Limits{MaxRows: 1000}, nil, [][]byte{numberRecord(65535, 0)}, "MaxRows"},
+		{"cols", Limits{MaxCols: 100}, nil, [][]byte{numberRecord(0, 255)}, "MaxCols"},
+		{"cells", Limits{MaxCells: 2}, nil, [][]byte{numberRecord(0, 0), numberRecord(0, 1), numberRecord(0, 2)}, "MaxCells"},
+		{"dimension", Limits{MaxRows: 65536}, nil, [][]byte{biffRecord(XL_DIMENSION2, dimension)}, "MaxRows"},
+		{"alloc", Limits{MaxAllocBytes: 1 << 20}, nil, [][]byte{numberRecord(65535, 255)}, "MaxAllocBytes"},
+		{"sst strings", Limits{MaxSSTStrings: 1}, [][]byte{sstRecord("ab", "cd")}, nil, "MaxSSTStrings"},
+		{"sst bytes", Limits{MaxSSTBytes: 3}, [][]byte{sstRecord("ab", "cd")}, nil, "MaxSSTBytes"},
+		{"continue", Limits{MaxContinueRecords: 1}, [][]byte{sstRecord("ab"), cont, cont}, nil, "MaxContinueRecords"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := biff8WorkbookGlobals(tt.globals, tt.cells...)
+			opts := &OpenWorkbookOptions{Logfile: io.Discard, Limits: tt.limits}
+			_, err := OpenWorkbookReaderAt(bytes.NewReader(data), int64(len(data)), opts)
+			if !errors.Is(err, ErrLimitExceeded) {
+				t.Fatalf("OpenWorkbookReaderAt() error = %v, want ErrLimitExceeded", err)
+			}
+			var le *LimitError
+			if !errors.As(err, &le) || le.Limit != tt.limit {
+				t.Errorf("OpenWorkbookReaderAt() error = %#v, want %s LimitError", err, tt.limit)
+			}
+
+			// The same workbook loads without limits.
+			opts.Limits = Limits{}
+			if _, err := OpenWorkbookReaderAt(bytes.NewReader(data), int64(len(data)), opts); err != nil {
+				t.Errorf("OpenWorkbookReaderAt() without limits error = %v", err)
+			}
+		})
+	}
+}
+
+func TestLimitsSample(t *testing.T) {
+	book, err := OpenWorkbook(fromSample("profiles.xls"), &OpenWorkbookOptions{
+		Limits: Limits{MaxCells: 10000, MaxRows: 65536, MaxCols: 256, MaxAllocBytes: 16 << 20},
+	})
+	if err != nil {
+		t.Fatalf("OpenWorkbook() with generous limits error = %v", err)
+	}
+	book.ReleaseResources()
+}
+
+func TestLimitsNameDepth(t *testing.T) {
+	book := &Book{BiffVersion: 80, logfile: io.Discard, limits: Limits{MaxNameDepth: 2}}
+	nobj := &Name{Book: book}
+	if err := EvaluateNameFormula(book, nobj, 0, 0, 3); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("EvaluateNameFormula() at level 3 error = %v, want ErrLimitExceeded", err)
+	}
+	if err := EvaluateNameFormula(book, nobj, 0, 0, 2); err != nil {
+		t.Errorf("EvaluateNameFormula() at level 2 error = %v", err)
+	}
+}
+
+func TestLimitsAllocRefund(t *testing.T) {
+	data, err := os.ReadFile(fromSample("profiles.xls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	book, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data, OnDemand: true,
+		Limits: Limits{MaxAllocBytes: 1 << 30}})
+	if err != nil {
+		t.Fatalf("OpenWorkbook() failed: %v", err)
+	}
+	base := book.allocated.Load()
+	if _, err := book.SheetByIndex(0); err != nil {
+		t.Fatal(err)
+	}
+	sheet := book.allocated.Load() - base
+	if sheet <= 0 {
+		t.Fatalf("loading a sheet charged %d bytes, want more than 0", sheet)
+	}
+
+	// A budget that fits the globals and one sheet allows loading the
+	// sheet again and again, as long as it is unloaded in between.
+	book, err = OpenWorkbook("", &OpenWorkbookOptions{FileContents: data, OnDemand: true,
+		Limits: Limits{MaxAllocBytes: base + sheet}})
+	if err != nil {
+		t.Fatalf("OpenWorkbook() failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := book.SheetByIndex(0); err != nil {
+			t.Fatalf("SheetByIndex(0), load %d: %v", i+1, err)
+		}
+		if err := book.UnloadSheet(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := book.allocated.Load(); got != base {
+		t.Errorf("budget used after unloading = %d, want %d", got, base)
+	}
+}
@@ -0,0 +1,87 @@
+package xlrd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"sync"
+)
+
+// logWriter is the logfile used when OpenWorkbookOptions.Logger is set.
+// Each line of trace text written to it is logged at debug level, with
+// the opcode and offset of the record most recently read by rdr.
+type logWriter struct {
+	logger *slog.Logger
+	rdr    *recordReader // may be nil
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(bytes.TrimRight(w.buf[:i], " \r"))
+		w.buf = w.buf[i+1:]
+		if line == "" {
+			continue
+		}
+		var attrs []any
+		if w.rdr != nil {
+			attrs = recordAttrs(w.rdr.recOpcode, w.rdr.recOffset)
+		}
+		w.logger.Debug(line, attrs...)
+	}
+	return len(p), nil
+}
+
+// recordAttrs returns the log attributes identifying a BIFF record.
+func recordAttrs(opcode, offset int) []any {
+	if opcode < 0 {
+		return nil
+	}
+	return []any{
+		slog.Int("opcode", opcode),
+		slog.String("record", recordName(opcode)),
+		slog.Int("offset", offset),
+	}
+}
+
+// traceRecord logs a record at debug level, as BiffDump would list it.
+// The row and column are included for cell records.
+func traceRecord(logger *slog.Logger, opcode, offset int, data []byte) {
+	if logger == nil || !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	attrs := append(recordAttrs(opcode, offset), slog.Int("length", len(data)))
+	if IsCellOpcode(opcode) && len(data) >= 4 {
+		attrs = append(attrs,
+			slog.Int("row", int(binary.LittleEndian.Uint16(data[0:2]))),
+			slog.Int("col", int(binary.LittleEndian.Uint16(data[2:4]))))
+	}
+	logger.Debug("record", attrs...)
+}
+
+// level returns the slog level at which diagnostics of severity s are logged.
+func (s Severity) level() slog.Level {
+	switch s {
+	case SeverityNote:
+		return slog.LevelInfo
+	case SeverityWarning:
+		return slog.LevelWarn
+	}
+	return slog.LevelError
+}
+
+// setLogger makes logger the destination of the workbook's trace material.
+func (b *Book) setLogger(logger *slog.Logger) {
+	b.logger = logger
+	b.logfile = &logWriter{logger: logger, rdr: &b.recordReader}
+}
@@ -0,0 +1,74 @@
+package xlrd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	number := make([]byte, 14)
+	binary.LittleEndian.PutUint16(number[0:2], 3)
+	binary.LittleEndian.PutUint16(number[2:4], 2)
+	data := biff8Workbook(
+		biffRecord(XL_NUMBER, number),
+		biffRecord(XL_SCL, []byte{1, 0, 100, 0}),
+	)
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	book, err := OpenWorkbookReaderAt(bytes.NewReader(data), int64(len(data)), &OpenWorkbookOptions{Logger: logger})
+	if err != nil {
+		t.Fatalf("OpenWorkbookReaderAt() failed: %v", err)
+	}
+	if len(book.Diagnostics()) != 1 {
+		t.Fatalf("Book.Diagnostics() = %+v, want one entry", book.Diagnostics())
+	}
+
+	var cell, warning map[string]any
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var entry map[string]any
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		switch {
+		case entry["msg"] == "record" && entry["record"] == "NUMBER":
+			cell = entry
+		case entry["level"] == "WARN":
+			warning = entry
+		}
+	}
+
+	if cell == nil {
+		t.Fatalf("no NUMBER record logged in %s", buf.String())
+	}
+	for key, want := range map[string]any{
+		"level":  "DEBUG",
+		"sheet":  "Sheet1",
+		"biff":   "8",
+		"opcode": float64(XL_NUMBER),
+		"offset": float64(bytes.Index(data, []byte{0x03, 0x02, 0x0e, 0x00})),
+		"row":    float64(3),
+		"col":    float64(2),
+	} {
+		if cell[key] != want {
+			t.Errorf("NUMBER record %s = %v, want %v", key, cell[key], want)
+		}
+	}
+
+	if warning == nil {
+		t.Fatalf("no diagnostic logged in %s", buf.String())
+	}
+	for key, want := range map[string]any{
+		"msg":    "SCL rcd: should have 0.1 <= num/den <= 4; got 1/100",
+		"code":   string(DiagSCL),
+		"sheet":  "Sheet1",
+		"record": "SCL",
+		"offset": float64(bytes.Index(data, []byte{0xA0, 0x00, 0x04, 0x00})),
+	} {
+		if warning[key] != want {
+			t.Errorf("diagnostic %s = %v, want %v", key, warning[key], want)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build linux
+
+package xlrd
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps size bytes of f read-only into memory.
+// The mapping stays valid after f is closed, until unmap is called.
+func mmapFile(f *os.File, size int64) (data []byte, unmap func() error, err error) {
+	if size <= 0 || size > int64(int(^uint(0)>>1)) {
+		return nil, nil, NewXLRDError("can't mmap file of size %d", size)
+	}
+	data, err = syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
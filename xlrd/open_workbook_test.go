@@ -1,6 +1,11 @@
 package xlrd
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
 	"strings"
 	"testing"
 )
@@ -75,3 +80,267 @@ func TestOpenUnknown(t *testing.T) {
 		t.Logf("OpenWorkbook(sample.txt) correctly returned error: %v", err)
 	}
 }
+
+func TestOpenWorkbookReaderAt(t *testing.T) {
+	want, err := OpenWorkbook(fromSample("profiles.xls"), nil)
+	if err != nil {
+		t.Fatalf("OpenWorkbook(profiles.xls) failed: %v", err)
+	}
+
+	f, err := os.Open(fromSample("profiles.xls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	book, err := OpenWorkbookReaderAt(f, fi.Size(), nil)
+	if err != nil {
+		t.Fatalf("OpenWorkbookReaderAt(profiles.xls) failed: %v", err)
+	}
+	assertSameWorkbook(t, book, want)
+}
+
+func TestOpenWorkbookReader(t *testing.T) {
+	want, err := OpenWorkbook(fromSample("namesdemo.xls"), nil)
+	if err != nil {
+		t.Fatalf("OpenWorkbook(namesdemo.xls) failed: %v", err)
+	}
+
+	content, err := os.ReadFile(fromSample("namesdemo.xls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Hide the io.ReaderAt implementation of bytes.Reader.
+	r := struct{ io.Reader }{bytes.NewReader(content)}
+	book, err := OpenWorkbookReader(r, nil)
+	if err != nil {
+		t.Fatalf("OpenWorkbookReader(namesdemo.xls) failed: %v", err)
+	}
+	assertSameWorkbook(t, book, want)
+}
+
+func TestOpenWorkbookReaderAtXlsx(t *testing.T) {
+	content, err := os.ReadFile(fromSample("sample.xlsx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenWorkbookReaderAt(bytes.NewReader(content), int64(len(content)), nil)
+	if err == nil || !strings.Contains(err.Error(), "Excel xlsx file; not supported") {
+		t.Errorf("OpenWorkbookReaderAt(sample.xlsx) error = %v, want error containing 'Excel xlsx file; not supported'", err)
+	}
+}
+
+func assertSameWorkbook(t *testing.T, got, want *Book) {
+	t.Helper()
+	if strings.Join(got.SheetNames(), ",") != strings.Join(want.SheetNames(), ",") {
+		t.Fatalf("SheetNames() = %v, want %v", got.SheetNames(), want.SheetNames())
+	}
+	for i := 0; i < want.NSheets; i++ {
+		gs, err := got.SheetByIndex(i)
+		if err != nil {
+			t.Fatalf("SheetByIndex(%d) failed: %v", i, err)
+		}
+		ws, _ := want.SheetByIndex(i)
+		if gs.NRows != ws.NRows || gs.NCols != ws.NCols {
+			t.Fatalf("sheet %d size = %dx%d, want %dx%d", i, gs.NRows, gs.NCols, ws.NRows, ws.NCols)
+		}
+		for rowx := 0; rowx < ws.NRows; rowx++ {
+			for colx := 0; colx < ws.RowLen(rowx); colx++ {
+				if gs.CellValue(rowx, colx) != ws.CellValue(rowx, colx) {
+					t.Errorf("sheet %d cell (%d, %d) = %v, want %v", i, rowx, colx,
+						gs.CellValue(rowx, colx), ws.CellValue(rowx, colx))
+				}
+			}
+		}
+	}
+}
+
+func TestOpenWorkbookUseMmap(t *testing.T) {
+	want, err := OpenWorkbook(fromSample("profiles.xls"), nil)
+	if err != nil {
+		t.Fatalf("OpenWorkbook(profiles.xls) failed: %v", err)
+	}
+
+	book, err := OpenWorkbook(fromSample("profiles.xls"), &OpenWorkbookOptions{UseMmap: true})
+	if err != nil {
+		t.Fatalf("OpenWorkbook(profiles.xls) with UseMmap failed: %v", err)
+	}
+	assertSameWorkbook(t, book, want)
+
+	book, err = OpenWorkbook(fromSample("profiles.xls"), &OpenWorkbookOptions{UseMmap: true, OnDemand: true})
+	if err != nil {
+		t.Fatalf("OpenWorkbook(profiles.xls) with UseMmap and OnDemand failed: %v", err)
+	}
+	sheets := book.Sheets()
+	book.Exit()
+	// Loaded sheets must not refer to the unmapped file.
+	for i, sheet := range sheets {
+		ws, _ := want.SheetByIndex(i)
+		for rowx := 0; rowx < ws.NRows; rowx++ {
+			for colx := 0; colx < ws.RowLen(rowx); colx++ {
+				if sheet.CellValue(rowx, colx) != ws.CellValue(rowx, colx) {
+					t.Errorf("sheet %d cell (%d, %d) = %v, want %v", i, rowx, colx,
+						sheet.CellValue(rowx, colx), ws.CellValue(rowx, colx))
+				}
+			}
+		}
+	}
+}
+
+// TestOpenWorkbookUseMmapNames checks that names and formulas stay usable
+// after the file has been unmapped.
+func TestOpenWorkbookUseMmapNames(t *testing.T) {
+	want, err := OpenWorkbook(fromSample("namesdemo.xls"), &OpenWorkbookOptions{Logfile: io.Discard})
+	if err != nil {
+		t.Fatalf("OpenWorkbook(namesdemo.xls) failed: %v", err)
+	}
+	for _, onDemand := range []bool{false, true} {
+		book, err := OpenWorkbook(fromSample("namesdemo.xls"), &OpenWorkbookOptions{UseMmap: true, OnDemand: onDemand, Logfile: io.Discard})
+		if err != nil {
+			t.Fatalf("OpenWorkbook(namesdemo.xls) with UseMmap failed: %v", err)
+		}
+		sheets := book.Sheets()
+		book.ReleaseResources()
+
+		for i, nobj := range book.NameObjList {
+			if !bytes.Equal(nobj.RawFormula, want.NameObjList[i].RawFormula) {
+				t.Errorf("name %s: RawFormula = % x, want % x", nobj.Name, nobj.RawFormula, want.NameObjList[i].RawFormula)
+			}
+			_, _, _, _, _, err := nobj.Area2D(false)
+			_, _, _, _, _, wantErr := want.NameObjList[i].Area2D(false)
+			if (err == nil) != (wantErr == nil) {
+				t.Errorf("name %s: Area2D() error = %v, want %v", nobj.Name, err, wantErr)
+			}
+		}
+		for i, sheet := range sheets {
+			ws, _ := want.SheetByIndex(i)
+			for _, key := range sortedCells(ws.formulas) {
+				got, _ := sheet.CellFormula(key[0], key[1])
+				if f, _ := ws.CellFormula(key[0], key[1]); got != f {
+					t.Errorf("sheet %d cell (%d, %d) formula = %q, want %q", i, key[0], key[1], got, f)
+				}
+				sheet.EvaluateCell(key[0], key[1])
+			}
+		}
+		book.DependencyGraph()
+	}
+}
+
+func TestOpenWorkbookCorruptData(t *testing.T) {
+	data, err := os.ReadFile(fromSample("profiles.xls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Damaged copies must produce a workbook or an error, never a panic.
+	for off := 512; off < len(data); off += 61 {
+		for _, b := range []byte{0x00, 0xFF} {
+			d := append([]byte(nil), data...)
+			for i := off; i < off+8 && i < len(d); i++ {
+				d[i] = b
+			}
+			OpenWorkbookReaderAt(bytes.NewReader(d), int64(len(d)), &OpenWorkbookOptions{Logfile: io.Discard, FormattingInfo: true})
+		}
+		OpenWorkbookReaderAt(bytes.NewReader(data[:off]), int64(off), &OpenWorkbookOptions{Logfile: io.Discard})
+	}
+}
+
+// countdownContext is a context that reports itself cancelled once Err
+// has been called n times.
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (c *countdownContext) Err() error {
+	if c.n--; c.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestOpenWorkbookContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := OpenWorkbookContext(ctx, fromSample("profiles.xls"), nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("OpenWorkbookContext() with cancelled context error = %v, want context.Canceled", err)
+	}
+
+	// Cancellation is noticed within a sheet's records.
+	records := make([][]byte, 1000)
+	for i := range records {
+		records[i] = numberRecord(i, 0)
+	}
+	data := biff8Workbook(records...)
+	ctx = &countdownContext{Context: context.Background(), n: 2}
+	_, err := OpenWorkbookContext(ctx, "", &OpenWorkbookOptions{FileContents: data})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("OpenWorkbookContext() cancelled while reading sheet error = %v, want context.Canceled", err)
+	}
+}
+
+func TestOpenWorkbookReaderContext(t *testing.T) {
+	data, err := os.ReadFile(fromSample("profiles.xls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := OpenWorkbookReaderAtContext(ctx, bytes.NewReader(data), int64(len(data)), nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("OpenWorkbookReaderAtContext() with cancelled context error = %v, want context.Canceled", err)
+	}
+	// A plain io.Reader is read to the end first; cancellation stops that too.
+	r := struct{ io.Reader }{bytes.NewReader(data)}
+	if _, err := OpenWorkbookReaderContext(ctx, r, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("OpenWorkbookReaderContext() with cancelled context error = %v, want context.Canceled", err)
+	}
+	if _, err := OpenWorkbookReaderContext(context.Background(), r, nil); err != nil {
+		t.Errorf("OpenWorkbookReaderContext() error = %v", err)
+	}
+}
+
+func TestStreamSheetContext(t *testing.T) {
+	records := make([][]byte, 1000)
+	for i := range records {
+		records[i] = numberRecord(i, 0)
+	}
+	book, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: biff8Workbook(records...), OnDemand: true})
+	if err != nil {
+		t.Fatalf("OpenWorkbook() failed: %v", err)
+	}
+	ctx := &countdownContext{Context: context.Background(), n: 1}
+	rows := 0
+	err = book.StreamSheetContext(ctx, 0, func(int, []Cell) error {
+		rows++
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("StreamSheetContext() error = %v, want context.Canceled", err)
+	}
+	if rows >= len(records) {
+		t.Errorf("StreamSheetContext() delivered all %d rows after cancellation", rows)
+	}
+}
+
+func TestSheetByIndexContext(t *testing.T) {
+	book, err := OpenWorkbookContext(context.Background(), fromSample("profiles.xls"), &OpenWorkbookOptions{OnDemand: true})
+	if err != nil {
+		t.Fatalf("OpenWorkbookContext(profiles.xls) failed: %v", err)
+	}
+	defer book.ReleaseResources()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := book.SheetByIndexContext(ctx, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("SheetByIndexContext() with cancelled context error = %v, want context.Canceled", err)
+	}
+	if loaded, _ := book.SheetLoaded(0); loaded {
+		t.Errorf("SheetLoaded(0) = true after cancelled load")
+	}
+	sheet, err := book.SheetByIndexContext(context.Background(), 0)
+	if err != nil || sheet == nil {
+		t.Fatalf("SheetByIndexContext() after cancelled load = %v, %v", sheet, err)
+	}
+}
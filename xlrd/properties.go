@@ -0,0 +1,433 @@
+package xlrd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+// Properties holds the document properties of a workbook, read from the
+// "\x05SummaryInformation" and "\x05DocumentSummaryInformation" streams
+// of its compound document. Properties that are not recorded are left
+// empty.
+type Properties struct {
+	Title       string
+	Subject     string
+	Author      string
+	Keywords    string
+	Comments    string
+	Template    string
+	LastAuthor  string
+	Revision    string
+	Application string
+
+	// Created, Modified and LastPrinted are the creation, last save and
+	// last printing times, in UTC.
+	Created     time.Time
+	Modified    time.Time
+	LastPrinted time.Time
+
+	Category string
+	Manager  string
+	Company  string
+
+	// Custom maps the names of user-defined properties to their values,
+	// each a string, int64, float64, bool or time.Time.
+	Custom map[string]interface{}
+}
+
+// Format identifiers of the property sets [MS-OLEPS 3.1].
+const (
+	fmtidSummaryInformation    = "{F29F85E0-4FF9-1068-AB91-08002B27B3D9}"
+	fmtidDocSummaryInformation = "{D5CDD502-2E9C-101B-9397-08002B2CF9AE}"
+	fmtidUserDefinedProperties = "{D5CDD505-2E9C-101B-9397-08002B2CF9AE}"
+)
+
+// Property identifiers with a special meaning in every section.
+const (
+	pidDictionary = 0x00000000
+	pidCodepage   = 0x00000001
+	pidLocale     = 0x80000000
+	pidBehavior   = 0x80000003
+)
+
+// Property types [MS-OLEPS 2.15].
+const (
+	vtI2       = 0x0002
+	vtI4       = 0x0003
+	vtR4       = 0x0004
+	vtR8       = 0x0005
+	vtCY       = 0x0006
+	vtDate     = 0x0007
+	vtBool     = 0x000B
+	vtI1       = 0x0010
+	vtUI1      = 0x0011
+	vtUI2      = 0x0012
+	vtUI4      = 0x0013
+	vtI8       = 0x0014
+	vtUI8      = 0x0015
+	vtInt      = 0x0016
+	vtUInt     = 0x0017
+	vtLPStr    = 0x001E
+	vtLPWStr   = 0x001F
+	vtFiletime = 0x0040
+)
+
+// propertySection is one section of a property set stream: its format
+// identifier, and the values and dictionary names of its properties.
+type propertySection struct {
+	fmtid  string
+	values map[uint32]interface{}
+	names  map[uint32]string
+}
+
+// readProperties reads the document properties from the property set
+// streams of cd. A stream that cannot be parsed is skipped with a
+// diagnostic.
+func (b *Book) readProperties(cd *CompDoc) error {
+	for _, name := range []string{"\x05SummaryInformation", "\x05DocumentSummaryInformation"} {
+		data, err := cd.OpenStream(name)
+		if errors.Is(err, ErrStreamNotFound) {
+			continue
+		}
+		if err == nil {
+			if err := b.charge(len(data)); err != nil {
+				return err
+			}
+			var sections []propertySection
+			if sections, err = parsePropertySetStream(data); err == nil {
+				for _, sec := range sections {
+					b.Properties.addSection(sec)
+				}
+				continue
+			}
+		}
+		b.addDiagnostic(Diagnostic{
+			Severity: SeverityWarning,
+			Code:     DiagPropertySet,
+			Opcode:   -1,
+			Offset:   -1,
+			Message:  fmt.Sprintf("Can't read %s property set: %v", strings.TrimPrefix(name, "\x05"), err),
+		})
+	}
+	return nil
+}
+
+// skipEncryptedProperties warns that the property set streams of cd,
+// which RC4 CryptoAPI encryption covers unless fDocProps is set, are not
+// read.
+func (b *Book) skipEncryptedProperties(cd *CompDoc) {
+	for _, name := range []string{"\x05SummaryInformation", "\x05DocumentSummaryInformation"} {
+		if cd.dirSearch([]string{name}, 0) == nil {
+			continue
+		}
+		b.addDiagnostic(Diagnostic{
+			Severity: SeverityWarning,
+			Code:     DiagPropertySet,
+			Opcode:   -1,
+			Offset:   -1,
+			Message:  "Document properties are encrypted with the workbook and were not read",
+		})
+		return
+	}
+}
+
+// addSection sets the properties found in a section.
+func (p *Properties) addSection(sec propertySection) {
+	str := func(dst *string, pid uint32) {
+		if s, ok := sec.values[pid].(string); ok {
+			*dst = s
+		}
+	}
+	tm := func(dst *time.Time, pid uint32) {
+		if t, ok := sec.values[pid].(time.Time); ok {
+			*dst = t
+		}
+	}
+	switch sec.fmtid {
+	case fmtidSummaryInformation:
+		str(&p.Title, 0x02)
+		str(&p.Subject, 0x03)
+		str(&p.Author, 0x04)
+		str(&p.Keywords, 0x05)
+		str(&p.Comments, 0x06)
+		str(&p.Template, 0x07)
+		str(&p.LastAuthor, 0x08)
+		str(&p.Revision, 0x09)
+		tm(&p.LastPrinted, 0x0B)
+		tm(&p.Created, 0x0C)
+		tm(&p.Modified, 0x0D)
+		str(&p.Application, 0x12)
+	case fmtidDocSummaryInformation:
+		str(&p.Category, 0x02)
+		str(&p.Manager, 0x0E)
+		str(&p.Company, 0x0F)
+	case fmtidUserDefinedProperties:
+		for pid, v := range sec.values {
+			name, ok := sec.names[pid]
+			if !ok || pid == pidCodepage || pid == pidLocale || pid == pidBehavior {
+				continue
+			}
+			if p.Custom == nil {
+				p.Custom = make(map[string]interface{})
+			}
+			p.Custom[name] = v
+		}
+	}
+}
+
+// parsePropertySetStream parses a property set stream [MS-OLEPS 2.21].
+// Properties of types other than the scalar and string types are skipped.
+func parsePropertySetStream(data []byte) ([]propertySection, error) {
+	if len(data) < 28 || binary.LittleEndian.Uint16(data[0:2]) != 0xFFFE {
+		return nil, errors.New("not a property set stream")
+	}
+	nsections := int(binary.LittleEndian.Uint32(data[24:28]))
+	if nsections > 2 || 28+20*nsections > len(data) {
+		return nil, fmt.Errorf("invalid number of sections (%d)", nsections)
+	}
+	sections := make([]propertySection, 0, nsections)
+	for i := 0; i < nsections; i++ {
+		entry := data[28+20*i : 48+20*i]
+		var fmtid CLSID
+		copy(fmtid[:], entry[0:16])
+		offset := int(binary.LittleEndian.Uint32(entry[16:20]))
+		sec, err := parsePropertySection(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		sec.fmtid = fmtid.String()
+		sections = append(sections, sec)
+	}
+	return sections, nil
+}
+
+// parsePropertySection parses the section at offset in a property set
+// stream.
+func parsePropertySection(data []byte, offset int) (propertySection, error) {
+	sec := propertySection{values: make(map[uint32]interface{})}
+	if offset < 0 || offset > len(data)-8 {
+		return sec, fmt.Errorf("section offset %d out of range", offset)
+	}
+	size := int(binary.LittleEndian.Uint32(data[offset : offset+4]))
+	if size < 8 || size > len(data)-offset {
+		return sec, fmt.Errorf("section size %d out of range", size)
+	}
+	data = data[offset : offset+size]
+	nprops := int(binary.LittleEndian.Uint32(data[4:8]))
+	if nprops > (size-8)/8 {
+		return sec, fmt.Errorf("invalid number of properties (%d)", nprops)
+	}
+
+	// The codepage is needed to decode the other strings, and the
+	// dictionary is read last.
+	codepage := 1252
+	offsets := make(map[uint32]int, nprops)
+	for i := 0; i < nprops; i++ {
+		pid := binary.LittleEndian.Uint32(data[8+8*i:])
+		off := int(binary.LittleEndian.Uint32(data[12+8*i:]))
+		if off < 8 || off > size-4 {
+			return sec, fmt.Errorf("property 0x%X offset %d out of range", pid, off)
+		}
+		offsets[pid] = off
+		if pid == pidCodepage && binary.LittleEndian.Uint16(data[off:]) == vtI2 && off+6 <= size {
+			codepage = int(binary.LittleEndian.Uint16(data[off+4:]))
+		}
+	}
+	for pid, off := range offsets {
+		if pid == pidDictionary {
+			continue
+		}
+		v, err := readPropertyValue(data, off, codepage)
+		if err != nil {
+			return sec, fmt.Errorf("property 0x%X: %v", pid, err)
+		}
+		if v != nil {
+			sec.values[pid] = v
+		}
+	}
+	if off, ok := offsets[pidDictionary]; ok {
+		names, err := readPropertyDictionary(data, off, codepage)
+		if err != nil {
+			return sec, fmt.Errorf("dictionary: %v", err)
+		}
+		sec.names = names
+	}
+	return sec, nil
+}
+
+// readPropertyValue reads the typed value at off in a section. It
+// returns nil for types that are not supported.
+func readPropertyValue(data []byte, off, codepage int) (interface{}, error) {
+	vt := binary.LittleEndian.Uint16(data[off:])
+	v := data[off+4:]
+	need := func(n int) error {
+		if n > len(v) {
+			return errors.New("value truncated")
+		}
+		return nil
+	}
+	switch vt {
+	case vtI1, vtUI1:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		if vt == vtI1 {
+			return int64(int8(v[0])), nil
+		}
+		return int64(v[0]), nil
+	case vtI2, vtUI2, vtBool:
+		if err := need(2); err != nil {
+			return nil, err
+		}
+		n := binary.LittleEndian.Uint16(v)
+		switch vt {
+		case vtI2:
+			return int64(int16(n)), nil
+		case vtBool:
+			return n != 0, nil
+		}
+		return int64(n), nil
+	case vtI4, vtInt, vtUI4, vtUInt, vtR4:
+		if err := need(4); err != nil {
+			return nil, err
+		}
+		n := binary.LittleEndian.Uint32(v)
+		switch vt {
+		case vtI4, vtInt:
+			return int64(int32(n)), nil
+		case vtR4:
+			return float64(math.Float32frombits(n)), nil
+		}
+		return int64(n), nil
+	case vtI8, vtUI8, vtR8, vtCY, vtDate, vtFiletime:
+		if err := need(8); err != nil {
+			return nil, err
+		}
+		n := binary.LittleEndian.Uint64(v)
+		switch vt {
+		case vtR8:
+			return math.Float64frombits(n), nil
+		case vtCY:
+			return float64(int64(n)) / 10000, nil
+		case vtDate:
+			// Days since 1899-12-30, as an OLE Automation date.
+			days := math.Float64frombits(n)
+			return time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC).Add(time.Duration(days * 24 * float64(time.Hour))), nil
+		case vtFiletime:
+			return filetimeToTime(n), nil
+		}
+		return int64(n), nil
+	case vtLPStr, vtLPWStr:
+		if err := need(4); err != nil {
+			return nil, err
+		}
+		n := int(binary.LittleEndian.Uint32(v))
+		if vt == vtLPWStr {
+			if n > (len(v)-4)/2 {
+				return nil, errors.New("string truncated")
+			}
+			return decodeCodepage(v[4:4+2*n], 1200), nil
+		}
+		if n > len(v)-4 {
+			return nil, errors.New("string truncated")
+		}
+		return decodeCodepage(v[4:4+n], codepage), nil
+	}
+	return nil, nil
+}
+
+// readPropertyDictionary reads the names of the properties of a section
+// from its dictionary at off [MS-OLEPS 2.17].
+func readPropertyDictionary(data []byte, off, codepage int) (map[uint32]string, error) {
+	n := int(binary.LittleEndian.Uint32(data[off:]))
+	pos := off + 4
+	names := make(map[uint32]string)
+	for i := 0; i < n; i++ {
+		if pos+8 > len(data) {
+			return nil, errors.New("entry truncated")
+		}
+		pid := binary.LittleEndian.Uint32(data[pos:])
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		pos += 8
+		if codepage == 1200 {
+			length *= 2
+		}
+		if length < 0 || length > len(data)-pos {
+			return nil, errors.New("name truncated")
+		}
+		names[pid] = decodeCodepage(data[pos:pos+length], codepage)
+		pos += length
+		if codepage == 1200 {
+			pos = (pos + 3) &^ 3
+		}
+	}
+	return names, nil
+}
+
+// codepageEncodings are the encodings of the ANSI codepages that property
+// sets are commonly written in, other than Latin-1, UTF-16 and UTF-8.
+var codepageEncodings = map[int]encoding.Encoding{
+	437:   charmap.CodePage437,
+	850:   charmap.CodePage850,
+	852:   charmap.CodePage852,
+	866:   charmap.CodePage866,
+	874:   charmap.Windows874,
+	932:   japanese.ShiftJIS,
+	936:   simplifiedchinese.GBK,
+	949:   korean.EUCKR,
+	950:   traditionalchinese.Big5,
+	1250:  charmap.Windows1250,
+	1251:  charmap.Windows1251,
+	1252:  charmap.Windows1252,
+	1253:  charmap.Windows1253,
+	1254:  charmap.Windows1254,
+	1255:  charmap.Windows1255,
+	1256:  charmap.Windows1256,
+	1257:  charmap.Windows1257,
+	1258:  charmap.Windows1258,
+	10000: charmap.Macintosh,
+}
+
+// decodeCodepage decodes a string in the given codepage, up to the first
+// NUL. Unknown codepages are decoded as Latin-1.
+func decodeCodepage(b []byte, codepage int) string {
+	switch codepage {
+	case 1200:
+		words := make([]uint16, len(b)/2)
+		for i := range words {
+			words[i] = binary.LittleEndian.Uint16(b[2*i:])
+		}
+		for i, w := range words {
+			if w == 0 {
+				words = words[:i]
+				break
+			}
+		}
+		return string(utf16.Decode(words))
+	case 65001:
+		s, _, _ := strings.Cut(string(b), "\x00")
+		return s
+	}
+	if i := strings.IndexByte(string(b), 0); i >= 0 {
+		b = b[:i]
+	}
+	if enc, ok := codepageEncodings[codepage]; ok {
+		if s, err := enc.NewDecoder().Bytes(b); err == nil {
+			return string(s)
+		}
+	}
+	s, _ := charmap.ISO8859_1.NewDecoder().Bytes(b)
+	return string(s)
+}
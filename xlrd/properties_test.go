@@ -0,0 +1,92 @@
+package xlrd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProperties(t *testing.T) {
+	book, err := OpenWorkbook(fromSample("namesdemo.xls"), nil)
+	if err != nil {
+		t.Fatalf("OpenWorkbook(namesdemo.xls) failed: %v", err)
+	}
+	p := book.Properties
+	if p.Author != "John Machin" || p.LastAuthor != "John Machin" {
+		t.Errorf("Author, LastAuthor = %q, %q, want John Machin", p.Author, p.LastAuthor)
+	}
+	if p.Application != "Microsoft Excel" {
+		t.Errorf("Application = %q, want Microsoft Excel", p.Application)
+	}
+	if p.Company != "Lingfo Pty Ltd" {
+		t.Errorf("Company = %q, want Lingfo Pty Ltd", p.Company)
+	}
+	if want := time.Date(2006, 9, 1, 12, 58, 55, 0, time.UTC); !p.Created.Equal(want) {
+		t.Errorf("Created = %v, want %v", p.Created, want)
+	}
+	if want := time.Date(2006, 12, 10, 9, 28, 56, 0, time.UTC); !p.Modified.Equal(want) {
+		t.Errorf("Modified = %v, want %v", p.Modified, want)
+	}
+	if !p.LastPrinted.IsZero() || p.Custom != nil {
+		t.Errorf("LastPrinted, Custom = %v, %v, want zero", p.LastPrinted, p.Custom)
+	}
+}
+
+func TestPropertiesCustom(t *testing.T) {
+	book, err := OpenWorkbook(fromSample("invalid_formula.xls"), nil)
+	if err != nil {
+		t.Fatalf("OpenWorkbook(invalid_formula.xls) failed: %v", err)
+	}
+	want := map[string]interface{}{
+		"ICV":                "859A7B7E04EF4229AD7228AD53E5E8B4_13",
+		"KSOProductBuildVer": "2052-12.1.0.17900",
+		"KSOReadingLayout":   true,
+	}
+	if got := book.Properties.Custom; !reflect.DeepEqual(got, want) {
+		t.Errorf("Custom = %v, want %v", got, want)
+	}
+}
+
+func TestPropertiesCorrupt(t *testing.T) {
+	data := compoundFile(map[string][]byte{
+		"Workbook":                       biff8Workbook(),
+		"\x05SummaryInformation":         []byte("not a property set"),
+		"\x05DocumentSummaryInformation": {0xFE, 0xFF},
+	})
+	book, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data})
+	if err != nil {
+		t.Fatalf("OpenWorkbook() failed: %v", err)
+	}
+	if !reflect.DeepEqual(book.Properties, Properties{}) {
+		t.Errorf("Properties = %+v, want zero", book.Properties)
+	}
+	n := 0
+	for _, d := range book.Diagnostics() {
+		if d.Code == DiagPropertySet {
+			n++
+		}
+	}
+	if n != 2 {
+		t.Errorf("got %d %s diagnostics, want 2", n, DiagPropertySet)
+	}
+}
+
+func TestDecodeCodepage(t *testing.T) {
+	tests := []struct {
+		data     []byte
+		codepage int
+		want     string
+	}{
+		{[]byte("caf\xe9\x00junk"), 1252, "café"},
+		{[]byte("\xcf\xf0\xe8\xe2\xe5\xf2\x00"), 1251, "Привет"},
+		{[]byte("\x93\xfa\x96\x7b"), 932, "日本"},
+		{[]byte("caf\xc3\xa9\x00"), 65001, "café"},
+		{[]byte("a\x00b\x00\x00\x00c\x00"), 1200, "ab"},
+		{[]byte("\xe9"), 99999, "é"},
+	}
+	for _, tt := range tests {
+		if got := decodeCodepage(tt.data, tt.codepage); got != tt.want {
+			t.Errorf("decodeCodepage(%q, %d) = %q, want %q", tt.data, tt.codepage, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package xlrd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxBIFFRecordLen is the largest data length of a BIFF8 record.
+const maxBIFFRecordLen = 8224
+
+// salvageWorkbookStream rebuilds the Workbook stream of a compound
+// document whose directory or sector allocation table is unusable. It
+// starts at the first sector of the Workbook stream named by the
+// directory, if that sector holds the BOF record of workbook globals, and
+// otherwise at the first sector in the file that does; a workbook embedded
+// in the file may come before the stream itself. It gathers the sectors
+// from there on: along the SAT chain of cd when that chain is intact, and
+// in file order otherwise. The result is
+// cut after the last complete substream, or after the last complete
+// record if the stream is truncated. It returns nil if no workbook
+// globals are found; cd may be nil.
+func (b *Book) salvageWorkbookStream(src io.ReaderAt, size int, cd *CompDoc) []byte {
+	secSize := 512
+	if cd != nil {
+		secSize = cd.secSize
+	}
+	nsecs := (size - 512 + secSize - 1) / secSize
+	sector := func(sid int) []byte {
+		off := 512 + sid*secSize
+		buf := make([]byte, minInt(secSize, size-off))
+		n, _ := src.ReadAt(buf, int64(off))
+		return buf[:n]
+	}
+
+	start := -1
+	if sid := workbookStreamStart(cd); sid >= 0 && sid < nsecs && isGlobalsBOF(sector(sid)) {
+		start = sid
+	}
+	for sid := 0; sid < nsecs && start < 0; sid++ {
+		if isGlobalsBOF(sector(sid)) {
+			start = sid
+		}
+	}
+	if start < 0 {
+		return nil
+	}
+
+	sids, chained := salvageChain(cd, start, nsecs)
+	if !chained {
+		sids = sids[:0]
+		for sid := start; sid < nsecs; sid++ {
+			sids = append(sids, sid)
+		}
+	}
+	var data []byte
+	for _, sid := range sids {
+		data = append(data, sector(sid)...)
+	}
+	end, complete := biffStreamEnd(data)
+	data = data[:end]
+
+	how := "following the sector allocation table"
+	if !chained {
+		how = "reading sectors in file order"
+	}
+	b.addDiagnostic(Diagnostic{
+		Severity: SeverityWarning,
+		Code:     DiagSalvaged,
+		Opcode:   -1,
+		Offset:   -1,
+		Message:  fmt.Sprintf("Workbook stream of %d bytes salvaged from sector %d, %s", len(data), start, how),
+	})
+	if !complete {
+		b.addDiagnostic(Diagnostic{
+			Severity: SeverityError,
+			Code:     DiagSalvaged,
+			Opcode:   -1,
+			Offset:   end,
+			Message:  fmt.Sprintf("Salvaged Workbook stream is truncated after %d bytes", end),
+		})
+	}
+	return data
+}
+
+// workbookStreamStart returns the first sector of the Workbook stream as
+// recorded by the directory of cd, or -1 if cd has no such stream kept in
+// regular sectors.
+func workbookStreamStart(cd *CompDoc) int {
+	if cd == nil {
+		return -1
+	}
+	for _, qname := range []string{"Workbook", "Book"} {
+		if d := cd.dirSearch([]string{qname}, 0); d != nil && d.TotSize >= cd.minSizeStdStream {
+			return d.FirstSID
+		}
+	}
+	return -1
+}
+
+// salvageChain returns the sectors of the SAT chain of cd starting at
+// sector start, and whether the chain is intact: it ends with EOCSID
+// without leaving the file or visiting a sector twice.
+func salvageChain(cd *CompDoc, start, nsecs int) ([]int, bool) {
+	if cd == nil {
+		return nil, false
+	}
+	var sids []int
+	seen := make(map[int]bool)
+	for sid := start; sid != EOCSID; sid = cd.SAT[sid] {
+		if sid < 0 || sid >= nsecs || sid >= len(cd.SAT) || seen[sid] {
+			return sids, false
+		}
+		seen[sid] = true
+		sids = append(sids, sid)
+	}
+	return sids, true
+}
+
+// isGlobalsBOF reports whether data starts with the BOF record of the
+// workbook globals of a BIFF5, BIFF7 or BIFF8 Workbook stream.
+func isGlobalsBOF(data []byte) bool {
+	if len(data) < 8 || binary.LittleEndian.Uint16(data) != XL_BOF {
+		return false
+	}
+	length := binary.LittleEndian.Uint16(data[2:])
+	version := binary.LittleEndian.Uint16(data[4:])
+	return length >= 4 && (version == 0x0500 || version == 0x0600) &&
+		binary.LittleEndian.Uint16(data[6:]) == XL_WORKBOOK_GLOBALS
+}
+
+// isWholeWorkbookStream reports whether data starts with workbook globals
+// and holds complete substreams.
+func isWholeWorkbookStream(data []byte) bool {
+	_, complete := biffStreamEnd(data)
+	return isGlobalsBOF(data) && complete
+}
+
+// biffStreamEnd returns the length of the sequence of BOF...EOF
+// substreams at the start of data, and whether it is complete. When a
+// substream is cut short, the length covers its complete records.
+func biffStreamEnd(data []byte) (end int, complete bool) {
+	depth := 0
+	pos := 0
+	for pos+4 <= len(data) {
+		code := binary.LittleEndian.Uint16(data[pos:])
+		length := int(binary.LittleEndian.Uint16(data[pos+2:]))
+		if depth == 0 && code != XL_BOF {
+			break
+		}
+		if length > maxBIFFRecordLen || pos+4+length > len(data) {
+			break
+		}
+		pos += 4 + length
+		switch code {
+		case XL_BOF:
+			depth++
+		case XL_EOF:
+			depth--
+		}
+		if depth == 0 {
+			end = pos
+		}
+	}
+	if depth > 0 {
+		return pos, false
+	}
+	return end, true
+}
+
+// readSalvaging reads the sheet like read. When salvaging, a sheet that
+// is cut short or holds a corrupt record keeps the cells read before it.
+func (s *Sheet) readSalvaging(ctx context.Context, bk *Book) error {
+	if !bk.salvage {
+		return s.read(ctx, bk)
+	}
+	err := func() (err error) {
+		defer recoverParseError(&err)
+		return s.read(ctx, bk)
+	}()
+	if errors.Is(err, ErrCorruptRecord) {
+		s.diag(SeverityError, DiagSalvaged, "Sheet %q is damaged; keeping the cells read before: %v", s.Name, err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,157 @@
+package xlrd
+
+import (
+	"bytes"
+	"testing"
+)
+
+// hasDiagnostic reports whether book has a diagnostic with the given
+// severity and code.
+func hasDiagnostic(book *Book, sev Severity, code DiagnosticCode) bool {
+	for _, d := range book.Diagnostics() {
+		if d.Severity == sev && d.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSalvage(t *testing.T) {
+	want, err := OpenWorkbook(fromSample("profiles.xls"), nil)
+	if err != nil {
+		t.Fatalf("OpenWorkbook(profiles.xls) failed: %v", err)
+	}
+	stream := workbookStream(t, "profiles.xls")
+	file := compoundFile(map[string][]byte{"Workbook": stream})
+
+	for _, tt := range []struct {
+		name    string
+		corrupt func(file []byte)
+	}{
+		// Sector 0 holds the SAT, and sector 1 the directory.
+		{"directory", func(file []byte) { clear(file[1024:1536]) }},
+		{"SAT", func(file []byte) { copy(file[512:1024], bytes.Repeat([]byte{2, 0, 0, 0}, 128)) }},
+		{"header", func(file []byte) { file[28] = 0 }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append([]byte(nil), file...)
+			tt.corrupt(data)
+			if _, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data}); err == nil {
+				t.Error("OpenWorkbook() without Salvage succeeded")
+			}
+
+			book, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data, Salvage: true})
+			if err != nil {
+				t.Fatalf("OpenWorkbook() with Salvage failed: %v", err)
+			}
+			assertSameWorkbook(t, book, want)
+			if !hasDiagnostic(book, SeverityWarning, DiagSalvaged) {
+				t.Errorf("Diagnostics() = %v, want a %s warning", book.Diagnostics(), DiagSalvaged)
+			}
+		})
+	}
+
+	t.Run("not found", func(t *testing.T) {
+		data := compoundFile(map[string][]byte{"Workbook": []byte("not a workbook")})
+		clear(data[1024:1536])
+		if _, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data, Salvage: true}); err == nil {
+			t.Error("OpenWorkbook() with Salvage succeeded without a workbook")
+		}
+	})
+}
+
+func TestSalvageEmbeddedWorkbook(t *testing.T) {
+	want, err := OpenWorkbook(fromSample("profiles.xls"), nil)
+	if err != nil {
+		t.Fatalf("OpenWorkbook(profiles.xls) failed: %v", err)
+	}
+	// The sectors of the embedded workbook come first in the file.
+	file := compoundFile(map[string][]byte{
+		"MBD00000001/Workbook": biff8Workbook(numberValueRecord(0, 0, 1)),
+		"Workbook":             workbookStream(t, "profiles.xls"),
+	})
+	copy(file[512:1024], bytes.Repeat([]byte{2, 0, 0, 0}, 128))
+
+	book, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: file, Salvage: true})
+	if err != nil {
+		t.Fatalf("OpenWorkbook() with Salvage failed: %v", err)
+	}
+	assertSameWorkbook(t, book, want)
+}
+
+func TestSalvageTruncated(t *testing.T) {
+	want, err := OpenWorkbook(fromSample("profiles.xls"), &OpenWorkbookOptions{OnDemand: true})
+	if err != nil {
+		t.Fatalf("OpenWorkbook(profiles.xls) failed: %v", err)
+	}
+	stream := workbookStream(t, "profiles.xls")
+	file := compoundFile(map[string][]byte{"Workbook": stream})
+	start := bytes.Index(file, stream[:64])
+
+	for _, tt := range []struct {
+		name string
+		// The file ends cut bytes into the substream of sheet.
+		sheet, cut int
+	}{
+		{"inside sheet", 4, 9000},
+		{"inside BOF", 3, 10},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			end := start + want.sheetAbsPosn[tt.sheet] - want.base + tt.cut
+			data := file[:end]
+			if _, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data}); err == nil {
+				t.Error("OpenWorkbook() without Salvage succeeded")
+			}
+
+			book, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data, Salvage: true})
+			if err != nil {
+				t.Fatalf("OpenWorkbook() with Salvage failed: %v", err)
+			}
+			if book.NSheets != want.NSheets {
+				t.Fatalf("NSheets = %d, want %d", book.NSheets, want.NSheets)
+			}
+			for i := 0; i < book.NSheets; i++ {
+				gs, _ := book.SheetByIndex(i)
+				ws, _ := want.SheetByIndex(i)
+				got, all := 0, 0
+				for rowx := 0; rowx < ws.NRows; rowx++ {
+					for colx := 0; colx < ws.RowLen(rowx); colx++ {
+						if ws.CellType(rowx, colx) == XL_CELL_EMPTY {
+							continue
+						}
+						all++
+						if rowx >= gs.NRows || colx >= gs.RowLen(rowx) || gs.CellType(rowx, colx) == XL_CELL_EMPTY {
+							continue
+						}
+						got++
+						if gs.CellValue(rowx, colx) != ws.CellValue(rowx, colx) {
+							t.Errorf("sheet %d cell (%d, %d) = %v, want %v", i, rowx, colx,
+								gs.CellValue(rowx, colx), ws.CellValue(rowx, colx))
+						}
+					}
+				}
+				switch {
+				case i < tt.sheet && got != all:
+					t.Errorf("sheet %d has %d cells, want %d", i, got, all)
+				case i == tt.sheet && tt.cut > 20 && (got == 0 || got == all):
+					t.Errorf("sheet %d has %d cells, want some of its %d", i, got, all)
+				case (i > tt.sheet || i == tt.sheet && tt.cut <= 20) && got != 0:
+					t.Errorf("sheet %d has %d cells, want none", i, got)
+				}
+			}
+			if !hasDiagnostic(book, SeverityError, DiagSalvaged) {
+				t.Errorf("Diagnostics() = %v, want a %s error", book.Diagnostics(), DiagSalvaged)
+			}
+		})
+	}
+}
+
+func TestSalvageCorruptedError(t *testing.T) {
+	book, err := OpenWorkbook(fromSample("corrupted_error.xls"), &OpenWorkbookOptions{Salvage: true})
+	if err != nil {
+		t.Fatalf("OpenWorkbook(corrupted_error.xls) with Salvage failed: %v", err)
+	}
+	if book.NSheets == 0 {
+		t.Error("NSheets = 0, want the sheets of the workbook")
+	}
+}
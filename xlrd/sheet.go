@@ -2,10 +2,14 @@ package xlrd
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"log/slog"
 	"math"
 	"strings"
+	"sync"
 	"unicode/utf16"
 	"unicode/utf8"
 
@@ -78,6 +82,44 @@ type Sheet struct {
 	cellTypes     [][]int
 	cellXFIndexes [][]int
 
+	// stream, when set, receives cells instead of the arrays above.
+	stream *rowStream
+
+	// ncells counts the cells stored, and limitErr records the first
+	// Limits violation found by putCell. allocated is the part of the
+	// book's allocation budget charged for this sheet, which is returned
+	// when the sheet is unloaded.
+	ncells    int
+	limitErr  error
+	allocated int64
+
+	// embeddedRefs are the OBJ records of embedded OLE objects.
+	embeddedRefs []embeddedRef
+
+	// formulas holds the token array of each formula cell, and
+	// sharedFormulas the shared and array formulas that cells refer to
+	// with a tExp token, keyed by their first cell.
+	formulas       map[[2]int][]byte
+	sharedFormulas map[[2]int]*sharedFormula
+
+	// number is the index of the sheet in the book.
+	number int
+
+	// rdr reads this sheet's records from the workbook stream.
+	rdr *recordReader
+
+	// diagnostics are the problems noticed while reading the sheet, and
+	// diagSeen the set of them. diagMu guards both, since formulas may be
+	// evaluated concurrently with other uses of the sheet.
+	diagMu      sync.Mutex
+	diagnostics []Diagnostic
+	diagSeen    map[Diagnostic]bool
+
+	// logfile receives the trace material for this sheet, and logger, if
+	// set, the record summaries.
+	logfile io.Writer
+	logger  *slog.Logger
+
 	// Sheet formatting and view info
 	DefColWidth                     int
 	StandardWidth                   int
@@ -238,6 +280,17 @@ type MSObj struct {
 	ScrollbarMax   int
 	ScrollbarInc   int
 	ScrollbarPage  int
+
+	// storage and className identify an embedded OLE object.
+	storage   string
+	className string
+}
+
+// embeddedRef is the OBJ record of an embedded OLE object and the anchor
+// of its shape.
+type embeddedRef struct {
+	obj    *MSObj
+	anchor *MSODrawing
 }
 
 // MSTxo represents a TXO record.
@@ -575,13 +628,124 @@ func (s *Sheet) RawCellXFIndex(rowx, colx int) int {
 	return s.cellXFIndexes[rowx][colx]
 }
 
+// CellFormula returns the formula of the cell at the given row and column
+// in A1 notation, such as "SUM(B2:B9)*$A$1", without the leading "=".
+// ok reports whether the cell holds a formula; the text is empty if the
+// formula cannot be decompiled, and a DiagFormula warning giving the cell
+// and the error is added to Diagnostics. Formulas are not kept by
+// StreamSheet.
+func (s *Sheet) CellFormula(rowx, colx int) (formula string, ok bool) {
+	return s.cellFormula(rowx, colx, 0)
+}
+
+// CellFormulaR1C1 is like CellFormula, but returns the formula in R1C1
+// notation, such as "SUM(R[1]C:R[8]C)*R1C1".
+func (s *Sheet) CellFormulaR1C1(rowx, colx int) (formula string, ok bool) {
+	return s.cellFormula(rowx, colx, 1)
+}
+
+// ArrayFormulaRange reports whether the cell at the given row and column
+// belongs to an array formula, and returns the cells the formula covers.
+// CellFormula returns the same formula for each of them.
+func (s *Sheet) ArrayFormulaRange(rowx, colx int) (cells CellRange, ok bool) {
+	sf := s.sharedFormulaOf(rowx, colx)
+	if sf == nil || !sf.array {
+		return CellRange{}, false
+	}
+	return sf.cells, true
+}
+
+func (s *Sheet) cellFormula(rowx, colx, r1c1 int) (string, bool) {
+	fmla, ok := s.formulas[[2]int{rowx, colx}]
+	if !ok {
+		return "", false
+	}
+	fmlatype, browx, bcolx := FMLA_TYPE_CELL, rowx, colx
+	if isExpFormula(s.Book.BiffVersion, fmla) {
+		sf := s.sharedFormulaOf(rowx, colx)
+		if sf == nil {
+			s.formulaDiagnostic(rowx, colx, "no SHRFMLA or ARRAY record for its tExp token")
+			return "", true
+		}
+		fmla = sf.rgce
+		if sf.array {
+			// References in an array formula are relative to its first cell.
+			fmlatype, browx, bcolx = FMLA_TYPE_ARRAY, sf.cells.FirstRow, sf.cells.FirstCol
+		} else {
+			fmlatype = FMLA_TYPE_SHARED
+		}
+	}
+	text, err := DecompileFormula(s.Book, fmla, len(fmla), fmlatype, browx, bcolx, 0, 0, r1c1)
+	if err != nil {
+		s.formulaDiagnostic(rowx, colx, err.Error())
+		return "", true
+	}
+	return text, true
+}
+
+// formulaDiagnostic records that the formula of the cell at rowx, colx
+// cannot be decompiled.
+func (s *Sheet) formulaDiagnostic(rowx, colx int, reason string) {
+	s.addDiagnostic(Diagnostic{
+		Severity: SeverityWarning,
+		Code:     DiagFormula,
+		Sheet:    s.Name,
+		Opcode:   -1,
+		Offset:   -1,
+		Message:  fmt.Sprintf("Can't decompile formula of %s: %s", Cellname(rowx, colx), reason),
+	})
+}
+
+// sharedFormulaOf returns the shared or array formula that the formula
+// cell at rowx, colx refers to, or nil if it has its own formula.
+func (s *Sheet) sharedFormulaOf(rowx, colx int) *sharedFormula {
+	fmla := s.formulas[[2]int{rowx, colx}]
+	if !isExpFormula(s.Book.BiffVersion, fmla) {
+		return nil
+	}
+	// tExp gives the first cell of the shared or array formula.
+	var key [2]int
+	if s.Book.BiffVersion >= 30 {
+		key = [2]int{int(binary.LittleEndian.Uint16(fmla[1:3])), int(binary.LittleEndian.Uint16(fmla[3:5]))}
+	} else {
+		key = [2]int{int(binary.LittleEndian.Uint16(fmla[1:3])), int(fmla[3])}
+	}
+	sf := s.sharedFormulas[key]
+	if sf == nil || rowx < sf.cells.FirstRow || rowx >= sf.cells.LastRow ||
+		colx < sf.cells.FirstCol || colx >= sf.cells.LastCol {
+		return nil
+	}
+	return sf
+}
+
+// isExpFormula reports whether fmla consists of a single tExp token.
+func isExpFormula(bv int, fmla []byte) bool {
+	size := 5
+	if bv < 30 {
+		size = 4
+	}
+	return len(fmla) == size && fmla[0] == 0x01
+}
+
 // EmptyCell returns an empty cell.
 func EmptyCell() *Cell {
 	return &Cell{CType: XL_CELL_EMPTY}
 }
 
 // putCell stores cell data at the specified row and column.
+// A cell that would exceed the book's Limits is dropped, and the error is
+// recorded for read to return.
 func (s *Sheet) putCell(rowx, colx int, ctype int, value interface{}, xfIndex int) {
+	if s.limitErr != nil {
+		return
+	}
+	if s.limitErr = s.checkPutCell(rowx, colx, value); s.limitErr != nil {
+		return
+	}
+	if s.stream != nil {
+		s.stream.put(rowx, colx, ctype, value, xfIndex)
+		return
+	}
 	// Extend cell arrays if necessary
 	for len(s.cellValues) <= rowx {
 		s.cellValues = append(s.cellValues, nil)
@@ -608,13 +772,45 @@ func (s *Sheet) putCell(rowx, colx int, ctype int, value interface{}, xfIndex in
 	}
 }
 
-// read reads and parses the sheet data from the workbook.
-func (s *Sheet) read(bk *Book) error {
-	oldpos := bk.position
-	defer func() {
-		bk.position = oldpos
-	}()
+// checkPutCell checks the cell about to be stored at rowx, colx against
+// the book's Limits, charging the memory the cell arrays will grow by.
+func (s *Sheet) checkPutCell(rowx, colx int, value interface{}) error {
+	lim := &s.Book.limits
+	s.ncells++
+	if err := checkLimit("MaxCells", int64(lim.MaxCells), int64(s.ncells)); err != nil {
+		return err
+	}
+	if err := lim.checkExtent(rowx+1, colx+1); err != nil {
+		return err
+	}
+	if s.stream != nil || lim.MaxAllocBytes <= 0 {
+		return nil
+	}
+	n := 0
+	rowlen := 0
+	if rowx < len(s.cellValues) {
+		rowlen = len(s.cellValues[rowx])
+	} else {
+		n += (rowx + 1 - len(s.cellValues)) * rowSlotBytes
+	}
+	if colx >= rowlen {
+		n += (colx + 1 - rowlen) * cellSlotBytes
+	}
+	if str, ok := value.(string); ok {
+		n += len(str)
+	}
+	return s.charge(n)
+}
+
+// charge adds n bytes to the book's allocation budget on behalf of the
+// sheet.
+func (s *Sheet) charge(n int) error {
+	s.allocated += int64(n)
+	return s.Book.charge(n)
+}
 
+// read reads and parses the sheet data from the workbook.
+func (s *Sheet) read(ctx context.Context, bk *Book) error {
 	if s.UtterMaxRows == 0 {
 		if bk.BiffVersion >= 80 {
 			s.UtterMaxRows = 65536
@@ -623,19 +819,10 @@ func (s *Sheet) read(bk *Book) error {
 		}
 	}
 
-	// Find the sheet index to get stream length
-	sheetIndex := -1
-	for i, name := range bk.sheetNames {
-		if name == s.Name {
-			sheetIndex = i
-			break
-		}
-	}
-	var maxPosition int
-	if sheetIndex >= 0 && sheetIndex < len(bk.sheetAbsPosn)-1 {
-		maxPosition = bk.sheetAbsPosn[sheetIndex+1]
-	} else {
-		maxPosition = len(bk.mem)
+	rdr := s.rdr
+	maxPosition := len(rdr.mem)
+	if s.number < len(bk.sheetStreamLen) && bk.sheetAbsPosn[s.number] >= 0 {
+		maxPosition = minInt(bk.sheetAbsPosn[s.number]+bk.sheetStreamLen[s.number], maxPosition)
 	}
 
 	// Initialize cell arrays
@@ -646,18 +833,36 @@ func (s *Sheet) read(bk *Book) error {
 	dimCols := 0
 	fmtInfo := bk.formattingInfo
 	doSSTRichText := fmtInfo && bk.richTextRunlistMap != nil
+	// Drawings and OBJ records are only needed for formatting information
+	// and to anchor embedded objects.
+	parseObjs := fmtInfo || len(bk.embeddedObjects) > 0
 	rowinfoSharing := make(map[[2]int]*RowInfo)
 	rowinfoSharingB2 := make(map[[3]int]*RowInfo)
 	txos := make(map[int]*MSTxo)
 	savedObjID := 0
+	var anchor *MSODrawing
 	eofFound := false
 
 	// Parse BIFF records until EOF or end of sheet stream
-	for {
-		if bk.position >= maxPosition {
+	rc, offset := 0, 0
+	for nrec := 0; ; nrec++ {
+		if err := checkContext(ctx, nrec); err != nil {
+			return err
+		}
+		if s.limitErr != nil {
+			return recordError(s.limitErr, rc, offset)
+		}
+		if s.stream != nil && s.stream.err != nil {
+			return s.stream.err
+		}
+		if rdr.position+4 > maxPosition {
 			break
 		}
-		rc, dataLen, data := bk.getRecordParts()
+		offset = rdr.position - rdr.base
+		var dataLen int
+		var data []byte
+		rc, dataLen, data = rdr.getRecordParts()
+		traceRecord(s.logger, rc, offset, data)
 		if rc == XL_EOF {
 			eofFound = true
 			break
@@ -672,7 +877,7 @@ func (s *Sheet) read(bk *Book) error {
 				bits := binary.LittleEndian.Uint64(data[6:14])
 				value := math.Float64frombits(bits)
 				if bk.verbosity >= 2 && s.Name == "PROFILEDEF" {
-					fmt.Fprintf(bk.logfile, "DEBUG: %s XL_NUMBER at (%d,%d): value=%f, xf=%d\n", s.Name, rowx, colx, value, xfIndex)
+					fmt.Fprintf(s.logfile, "DEBUG: %s XL_NUMBER at (%d,%d): value=%f, xf=%d\n", s.Name, rowx, colx, value, xfIndex)
 				}
 				s.putCell(rowx, colx, XL_CELL_NUMBER, value, xfIndex)
 			}
@@ -683,7 +888,7 @@ func (s *Sheet) read(bk *Book) error {
 				cellAttr := data[4:7]
 				xfIndex, err := s.fixedBIFF2XFIndex(cellAttr, rowx, colx, nil)
 				if err != nil {
-					return err
+					return recordError(err, rc, offset)
 				}
 				bits := binary.LittleEndian.Uint64(data[7:15])
 				value := math.Float64frombits(bits)
@@ -713,7 +918,7 @@ func (s *Sheet) read(bk *Book) error {
 				rkData := data[6:10]
 				rkValue := unpackRK(rkData)
 				if bk.verbosity >= 2 && (s.Name == "PROFILEDEF" || rkValue == 100.0) {
-					fmt.Fprintf(bk.logfile, "DEBUG: %s XL_RK at (%d,%d): rkData=%x, value=%f, xf=%d\n", s.Name, rowx, colx, rkData, rkValue, xfIndex)
+					fmt.Fprintf(s.logfile, "DEBUG: %s XL_RK at (%d,%d): rkData=%x, value=%f, xf=%d\n", s.Name, rowx, colx, rkData, rkValue, xfIndex)
 				}
 				s.putCell(rowx, colx, XL_CELL_NUMBER, rkValue, xfIndex)
 			}
@@ -740,7 +945,7 @@ func (s *Sheet) read(bk *Book) error {
 				rowx := int(binary.LittleEndian.Uint16(data[0:2]))
 				if rowx < 0 || rowx >= s.UtterMaxRows {
 					if bk.verbosity > 0 {
-						fmt.Fprintf(bk.logfile,
+						fmt.Fprintf(s.logfile,
 							"*** NOTE: ROW record has row index %d; should have 0 <= rowx < %d -- record ignored!\n",
 							rowx, s.UtterMaxRows)
 					}
@@ -784,6 +989,9 @@ func (s *Sheet) read(bk *Book) error {
 					dimCols = int(binary.LittleEndian.Uint16(data[10:12]))
 				}
 			}
+			if err := bk.limits.checkExtent(dimRows, dimCols); err != nil {
+				return recordError(err, rc, offset)
+			}
 			if bk.BiffVersion < 80 && bk.BiffVersion >= 20 && bk.XFList != nil && !bk.xfEpilogueDone {
 				bk.xfEpilogue()
 			}
@@ -811,7 +1019,7 @@ func (s *Sheet) read(bk *Book) error {
 			flags := binary.LittleEndian.Uint16(data[8:10])
 			if !(0 <= firstColx && firstColx <= lastColx && lastColx <= 256) {
 				if bk.verbosity > 0 {
-					fmt.Fprintf(bk.logfile,
+					fmt.Fprintf(s.logfile,
 						"*** NOTE: COLINFO record has first col index %d, last %d; should have 0 <= first <= last <= 255 -- record ignored!\n",
 						firstColx, lastColx)
 				}
@@ -835,8 +1043,8 @@ func (s *Sheet) read(bk *Book) error {
 		case XL_STANDARDWIDTH:
 			if dataLen >= 2 {
 				s.StandardWidth = int(binary.LittleEndian.Uint16(data[0:2]))
-			} else if bk.verbosity > 0 {
-				fmt.Fprintf(bk.logfile, "*** ERROR *** STANDARDWIDTH %d %x\n", dataLen, data)
+			} else {
+				s.diag(SeverityError, DiagStandardWidth, "STANDARDWIDTH record len is %d, should be 2", dataLen)
 			}
 		case XL_GCW:
 			if !fmtInfo || dataLen < 34 {
@@ -942,7 +1150,7 @@ func (s *Sheet) read(bk *Book) error {
 				cellAttr := data[4:7]
 				xfIndex, err := s.fixedBIFF2XFIndex(cellAttr, rowx, colx, nil)
 				if err != nil {
-					return err
+					return recordError(err, rc, offset)
 				}
 				enc := bk.Encoding
 				if enc == "" {
@@ -960,7 +1168,7 @@ func (s *Sheet) read(bk *Book) error {
 				cellAttr := data[4:7]
 				xfIndex, err := s.fixedBIFF2XFIndex(cellAttr, rowx, colx, nil)
 				if err != nil {
-					return err
+					return recordError(err, rc, offset)
 				}
 				value := float64(binary.LittleEndian.Uint16(data[7:9]))
 				s.putCell(rowx, colx, XL_CELL_NUMBER, value, xfIndex)
@@ -972,7 +1180,7 @@ func (s *Sheet) read(bk *Book) error {
 				cellAttr := data[4:7]
 				xfIndex, err := s.fixedBIFF2XFIndex(cellAttr, rowx, colx, nil)
 				if err != nil {
-					return err
+					return recordError(err, rc, offset)
 				}
 				value := data[7]
 				isErr := data[8]
@@ -992,7 +1200,7 @@ func (s *Sheet) read(bk *Book) error {
 				cellAttr := data[4:7]
 				xfIndex, err := s.fixedBIFF2XFIndex(cellAttr, rowx, colx, nil)
 				if err != nil {
-					return err
+					return recordError(err, rc, offset)
 				}
 				s.putCell(rowx, colx, XL_CELL_BLANK, "", xfIndex)
 			}
@@ -1003,7 +1211,7 @@ func (s *Sheet) read(bk *Book) error {
 			rowx := int(binary.LittleEndian.Uint16(data[0:2]))
 			if rowx < 0 || rowx >= s.UtterMaxRows {
 				if bk.verbosity > 0 {
-					fmt.Fprintf(bk.logfile,
+					fmt.Fprintf(s.logfile,
 						"*** NOTE: ROW_B2 record has row index %d; should have 0 <= rowx < %d -- record ignored!\n",
 						rowx, s.UtterMaxRows)
 				}
@@ -1017,14 +1225,14 @@ func (s *Sheet) read(bk *Book) error {
 					trueXfx := int(binary.LittleEndian.Uint16(data[16:18]))
 					xf, err := s.fixedBIFF2XFIndex(nil, rowx, -1, &trueXfx)
 					if err != nil {
-						return err
+						return recordError(err, rc, offset)
 					}
 					xfIndex = xf
 				} else if dataLen >= 16 {
 					cellAttr := data[13:16]
 					xf, err := s.fixedBIFF2XFIndex(cellAttr, rowx, -1, nil)
 					if err != nil {
-						return err
+						return recordError(err, rc, offset)
 					}
 					xfIndex = xf
 				}
@@ -1055,7 +1263,7 @@ func (s *Sheet) read(bk *Book) error {
 			width := int(binary.LittleEndian.Uint16(data[2:4]))
 			if firstColx > lastColx {
 				if bk.verbosity > 0 {
-					fmt.Fprintf(bk.logfile,
+					fmt.Fprintf(s.logfile,
 						"*** NOTE: COLWIDTH record has first col index %d, last %d; should have first <= last -- record ignored!\n",
 						firstColx, lastColx)
 				}
@@ -1077,7 +1285,7 @@ func (s *Sheet) read(bk *Book) error {
 			lastColx := int(binary.LittleEndian.Uint16(data[2:4]))
 			if !(0 <= firstColx && firstColx < lastColx && lastColx <= 256) {
 				if bk.verbosity > 0 {
-					fmt.Fprintf(bk.logfile,
+					fmt.Fprintf(s.logfile,
 						"*** NOTE: COLUMNDEFAULT record has first col index %d, last %d; should have 0 <= first < last <= 256\n",
 						firstColx, lastColx)
 				}
@@ -1093,7 +1301,7 @@ func (s *Sheet) read(bk *Book) error {
 				cellAttr := data[offset : offset+3]
 				xfIndex, err := s.fixedBIFF2XFIndex(cellAttr, -1, colx, nil)
 				if err != nil {
-					return err
+					return recordError(err, rc, offset)
 				}
 				c := s.ColInfoMap[colx]
 				if c == nil {
@@ -1121,13 +1329,13 @@ func (s *Sheet) read(bk *Book) error {
 		case XL_FORMAT, XL_FORMAT2:
 			if bk.BiffVersion <= 45 {
 				if err := bk.handleFormat(data, rc); err != nil {
-					return err
+					return recordError(err, rc, offset)
 				}
 			}
 		case XL_FONT, XL_FONT_B3B4:
 			if bk.BiffVersion <= 45 {
 				if err := bk.handleFont(data); err != nil {
-					return err
+					return recordError(err, rc, offset)
 				}
 			}
 		case XL_STYLE:
@@ -1136,13 +1344,13 @@ func (s *Sheet) read(bk *Book) error {
 					bk.xfEpilogue()
 				}
 				if err := bk.handleStyle(data); err != nil {
-					return err
+					return recordError(err, rc, offset)
 				}
 			}
 		case XL_PALETTE:
 			if bk.BiffVersion <= 45 {
 				if err := bk.handlePalette(data); err != nil {
-					return err
+					return recordError(err, rc, offset)
 				}
 			}
 		case XL_BUILTINFMTCOUNT:
@@ -1152,7 +1360,7 @@ func (s *Sheet) read(bk *Book) error {
 		case XL_XF4, XL_XF3, XL_XF2:
 			if bk.BiffVersion <= 45 {
 				if err := bk.handleXF(data); err != nil {
-					return err
+					return recordError(err, rc, offset)
 				}
 			}
 		case XL_DATEMODE:
@@ -1165,9 +1373,10 @@ func (s *Sheet) read(bk *Book) error {
 			}
 		case XL_FILEPASS:
 			if bk.BiffVersion <= 45 {
-				if err := bk.handleFilepass(data); err != nil {
-					return err
+				if err := bk.handleFilepass(data, rdr.position); err != nil {
+					return recordError(err, rc, offset)
 				}
+				rdr.mem = bk.mem
 			}
 		case XL_WRITEACCESS:
 			if bk.BiffVersion <= 45 {
@@ -1175,24 +1384,34 @@ func (s *Sheet) read(bk *Book) error {
 			}
 		case XL_HLINK:
 			if fmtInfo {
-				s.handleHlink(data)
+				if err := s.handleHlink(data); err != nil {
+					return recordError(err, rc, offset)
+				}
 			}
 		case XL_QUICKTIP:
 			if fmtInfo {
 				s.handleQuicktip(data)
 			}
 		case XL_OBJ:
-			if fmtInfo {
-				saved := s.handleObj(bk, data)
-				if saved != nil {
-					savedObjID = saved.ID
-				} else {
-					savedObjID = 0
+			if !parseObjs {
+				break
+			}
+			saved := s.handleObj(bk, data)
+			if saved != nil {
+				savedObjID = saved.ID
+				if saved.storage != "" {
+					s.embeddedRefs = append(s.embeddedRefs, embeddedRef{obj: saved, anchor: anchor})
 				}
+			} else {
+				savedObjID = 0
 			}
+			anchor = nil
 		case XL_MSO_DRAWING:
-			if fmtInfo {
-				s.handleMSODrawingEtc(bk, rc, dataLen, data)
+			if !parseObjs {
+				break
+			}
+			if a := s.handleMSODrawingEtc(bk, rc, dataLen, data); a != nil {
+				anchor = a
 			}
 		case XL_TXO:
 			if fmtInfo {
@@ -1211,7 +1430,9 @@ func (s *Sheet) read(bk *Book) error {
 				s.handleFeat11(bk, data)
 			}
 		case XL_COUNTRY:
+			bk.mu.Lock()
 			bk.handleCountry(data)
+			bk.mu.Unlock()
 		case XL_LABELRANGES:
 			pos := 0
 			var ranges []CellRange
@@ -1225,31 +1446,15 @@ func (s *Sheet) read(bk *Book) error {
 				s.ColLabelRanges = append(s.ColLabelRanges, [4]int{r.FirstRow, r.LastRow, r.FirstCol, r.LastCol})
 			}
 			_ = pos
-		case XL_ARRAY:
-			if bk.verbosity >= 2 {
-				// Consume array header and ignore.
-				if dataLen >= 14 {
-					row1x := int(binary.LittleEndian.Uint16(data[0:2]))
-					rownx := int(binary.LittleEndian.Uint16(data[2:4]))
-					col1x := int(data[4])
-					colnx := int(data[5])
-					_ = row1x
-					_ = rownx
-					_ = col1x
-					_ = colnx
-				}
-			}
-		case XL_SHRFMLA:
-			if bk.verbosity >= 2 && dataLen >= 10 {
-				// Shared formula header only (no-op unless debug).
-			}
+		case XL_ARRAY, XL_ARRAY2, XL_SHRFMLA:
+			s.handleSharedFormula(bk, rc, data)
 		case XL_CONDFMT:
-			if fmtInfo && bk.verbosity >= 1 {
-				fmt.Fprintf(bk.logfile, "\n*** WARNING: Ignoring CONDFMT (conditional formatting) record in Sheet %q.\n", s.Name)
+			if fmtInfo {
+				s.diag(SeverityWarning, DiagCondFmtIgnored, "Ignoring CONDFMT (conditional formatting) record")
 			}
 		case XL_CF:
-			if fmtInfo && bk.verbosity >= 1 {
-				fmt.Fprintf(bk.logfile, "\n*** WARNING: Ignoring CF (conditional formatting) sub-record in Sheet %q.\n", s.Name)
+			if fmtInfo {
+				s.diag(SeverityWarning, DiagCondFmtIgnored, "Ignoring CF (conditional formatting) sub-record")
 			}
 		case XL_DEFAULTROWHEIGHT:
 			if dataLen == 4 {
@@ -1261,11 +1466,9 @@ func (s *Sheet) read(bk *Book) error {
 				s.DefaultAdditionalSpaceBelow = (bits >> 3) & 1
 			} else if dataLen == 2 {
 				s.DefaultRowHeight = int(binary.LittleEndian.Uint16(data[0:2]))
-				if bk.verbosity > 0 {
-					fmt.Fprintf(bk.logfile, "*** WARNING: DEFAULTROWHEIGHT record len is 2, should be 4; assuming BIFF2 format\n")
-				}
-			} else if bk.verbosity > 0 {
-				fmt.Fprintf(bk.logfile, "*** WARNING: DEFAULTROWHEIGHT record len is %d, should be 4; ignoring this record\n", dataLen)
+				s.diag(SeverityWarning, DiagDefaultRowHeight, "DEFAULTROWHEIGHT record len is 2, should be 4; assuming BIFF2 format")
+			} else {
+				s.diag(SeverityWarning, DiagDefaultRowHeight, "DEFAULTROWHEIGHT record len is %d, should be 4; ignoring this record", dataLen)
 			}
 		case XL_WINDOW2:
 			if bk.BiffVersion >= 80 && dataLen >= 14 {
@@ -1293,11 +1496,7 @@ func (s *Sheet) read(bk *Book) error {
 					result = (num * 100) / den
 				}
 				if result < 10 || result > 400 {
-					if bk.verbosity >= 0 {
-						fmt.Fprintf(bk.logfile,
-							"WARNING *** SCL rcd sheet %q: should have 0.1 <= num/den <= 4; got %d/%d\n",
-							s.Name, num, den)
-					}
+					s.diag(SeverityWarning, DiagSCL, "SCL rcd: should have 0.1 <= num/den <= 4; got %d/%d", num, den)
 					result = 100
 				}
 				s.SclMagFactor = result
@@ -1359,6 +1558,9 @@ func (s *Sheet) read(bk *Book) error {
 		}
 	}
 
+	if s.limitErr != nil {
+		return recordError(s.limitErr, rc, offset)
+	}
 	if dimRows > s.NRows {
 		s.NRows = dimRows
 	}
@@ -1366,7 +1568,7 @@ func (s *Sheet) read(bk *Book) error {
 		s.NCols = dimCols
 	}
 	if !eofFound {
-		return NewXLRDError("Sheet %q missing EOF record", s.Name)
+		return newXLRDError(ErrCorruptRecord, "Sheet %q missing EOF record", s.Name)
 	}
 
 	return nil
@@ -1407,7 +1609,7 @@ func (s *Sheet) fixedBIFF2XFIndex(cellAttr []byte, rowx, colx int, trueXfx *int)
 			}
 			if xfx == 0x3F {
 				if !s.hasIXFE {
-					return 0, NewXLRDError("BIFF2 cell record has XF index 63 but no preceding IXFE record")
+					return 0, newXLRDError(ErrCorruptRecord, "BIFF2 cell record has XF index 63 but no preceding IXFE record")
 				}
 				xfx = s.ixfe
 			}
@@ -1417,12 +1619,12 @@ func (s *Sheet) fixedBIFF2XFIndex(cellAttr []byte, rowx, colx int, trueXfx *int)
 	}
 
 	if len(cellAttr) < 3 {
-		return 0, NewXLRDError("BIFF2 cell_attr too short at (%d,%d)", rowx, colx)
+		return 0, newXLRDError(ErrCorruptRecord, "BIFF2 cell_attr too short at (%d,%d)", rowx, colx)
 	}
 
 	xfxSlot := cellAttr[0] & 0x3F
-	if xfxSlot != 0 && bk.verbosity > 0 {
-		fmt.Fprintf(bk.logfile, "WARNING: BIFF2 cell_attr slot not zero at (%d,%d): %02x\n", rowx, colx, xfxSlot)
+	if xfxSlot != 0 {
+		s.diag(SeverityWarning, DiagCellAttr, "BIFF2 cell_attr slot not zero at (%d,%d): %02x", rowx, colx, xfxSlot)
 	}
 
 	var key [3]byte
@@ -1452,8 +1654,8 @@ func (s *Sheet) insertNewBIFF20XF(cellAttr []byte, style bool) int {
 		bk.FormatMap = make(map[int]*Format)
 	}
 	if _, ok := bk.FormatMap[xf.FormatKey]; !ok {
-		if xf.FormatKey != 0 && bk.verbosity > 0 {
-			fmt.Fprintf(bk.logfile, "ERROR *** XF[%d] unknown format key (%d, 0x%04x)\n",
+		if xf.FormatKey != 0 {
+			s.diag(SeverityError, DiagFormatKey, "XF[%d] unknown format key (%d, 0x%04x)",
 				xf.XFIndex, xf.FormatKey, xf.FormatKey)
 		}
 		format := &Format{FormatKey: xf.FormatKey, Type: FUN, FormatString: "General"}
@@ -1595,9 +1797,13 @@ func getNulTerminatedUnicode(data []byte, offset int) (string, int) {
 	return uc, offset
 }
 
-func (s *Sheet) handleHlink(data []byte) {
+// maxHyperlinkMapCells bounds the number of HyperlinkMap entries that a
+// single HLINK record may add; a whole column is the largest normal range.
+const maxHyperlinkMapCells = 1 << 16
+
+func (s *Sheet) handleHlink(data []byte) error {
 	if len(data) < 32 {
-		return
+		return nil
 	}
 	h := &Hyperlink{}
 	h.FRowx = int(binary.LittleEndian.Uint16(data[0:2]))
@@ -1609,10 +1815,10 @@ func (s *Sheet) handleHlink(data []byte) {
 	options := int(binary.LittleEndian.Uint32(data[28:32]))
 
 	if string(guid0) != string([]byte{0xD0, 0xC9, 0xEA, 0x79, 0xF9, 0xBA, 0xCE, 0x11, 0x8C, 0x82, 0x00, 0xAA, 0x00, 0x4B, 0xA9, 0x0B}) {
-		panic(NewXLRDError("invalid hyperlink GUID"))
+		return newXLRDError(ErrCorruptRecord, "invalid hyperlink GUID")
 	}
 	if string(dummy) != string([]byte{0x02, 0x00, 0x00, 0x00}) {
-		panic(NewXLRDError("invalid hyperlink dummy header"))
+		return newXLRDError(ErrCorruptRecord, "invalid hyperlink dummy header")
 	}
 	offset := 32
 
@@ -1629,19 +1835,19 @@ func (s *Sheet) handleHlink(data []byte) {
 
 	if (options&1) != 0 && (options&0x100) == 0 {
 		if offset+16 > len(data) {
-			return
+			return nil
 		}
 		clsid := data[offset : offset+16]
 		offset += 16
 		if string(clsid) == string([]byte{0xE0, 0xC9, 0xEA, 0x79, 0xF9, 0xBA, 0xCE, 0x11, 0x8C, 0x82, 0x00, 0xAA, 0x00, 0x4B, 0xA9, 0x0B}) {
 			h.Type = "url"
 			if offset+4 > len(data) {
-				return
+				return nil
 			}
 			nbytes := int(binary.LittleEndian.Uint32(data[offset : offset+4]))
 			offset += 4
 			if offset+nbytes > len(data) {
-				return
+				return nil
 			}
 			raw := data[offset : offset+nbytes]
 			ustr := decodeUTF16LE(raw)
@@ -1660,34 +1866,34 @@ func (s *Sheet) handleHlink(data []byte) {
 		} else if string(clsid) == string([]byte{0x03, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xC0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x46}) {
 			h.Type = "local file"
 			if offset+6 > len(data) {
-				return
+				return nil
 			}
 			uplevels := int(binary.LittleEndian.Uint16(data[offset : offset+2]))
 			nbytes := int(binary.LittleEndian.Uint32(data[offset+2 : offset+6]))
 			offset += 6
-			if offset+nbytes > len(data) {
-				return
+			if nbytes < 1 || offset+nbytes > len(data) {
+				return nil
 			}
 			shortpath := append(bytes.Repeat([]byte("..\\"), uplevels), data[offset:offset+nbytes-1]...)
 			offset += nbytes
 			if offset+24 > len(data) {
-				return
+				return nil
 			}
 			offset += 24
 			if offset+4 > len(data) {
-				return
+				return nil
 			}
 			sz := int(binary.LittleEndian.Uint32(data[offset : offset+4]))
 			offset += 4
 			if sz != 0 {
 				if offset+6 > len(data) {
-					return
+					return nil
 				}
 				xl := int(binary.LittleEndian.Uint32(data[offset : offset+4]))
 				offset += 4
 				offset += 2
 				if offset+xl > len(data) {
-					return
+					return nil
 				}
 				extendedPath := decodeUTF16LE(data[offset : offset+xl])
 				offset += xl
@@ -1716,20 +1922,27 @@ func (s *Sheet) handleHlink(data []byte) {
 	}
 
 	extra := len(data) - offset
-	if extra > 0 && s.Book != nil && s.Book.verbosity > 0 {
-		fmt.Fprintf(s.Book.logfile, "*** WARNING: hyperlink at R%dC%d has %d extra data bytes\n",
+	if extra > 0 {
+		s.diag(SeverityWarning, DiagHyperlinkExtra, "hyperlink at R%dC%d has %d extra data bytes",
 			h.FRowx+1, h.FColx+1, extra)
 	}
 	if extra < 0 {
-		panic(NewXLRDError("hyperlink record size mismatch"))
+		return newXLRDError(ErrCorruptRecord, "hyperlink record size mismatch")
 	}
 
 	s.HyperlinkList = append(s.HyperlinkList, h)
+	nrows, ncols := h.LRowx-h.FRowx+1, h.LColx-h.FColx+1
+	if nrows > 0 && ncols > 0 && nrows*ncols > maxHyperlinkMapCells {
+		s.diag(SeverityWarning, DiagHyperlinkRange, "hyperlink at R%dC%d covers %d cells; not added to HyperlinkMap",
+			h.FRowx+1, h.FColx+1, nrows*ncols)
+		return nil
+	}
 	for rowx := h.FRowx; rowx <= h.LRowx; rowx++ {
 		for colx := h.FColx; colx <= h.LColx; colx++ {
 			s.HyperlinkMap[[2]int{rowx, colx}] = h
 		}
 	}
+	return nil
 }
 
 func (s *Sheet) handleQuicktip(data []byte) {
@@ -1749,13 +1962,13 @@ func (s *Sheet) handleQuicktip(data []byte) {
 	}
 }
 
-func (s *Sheet) handleMSODrawingEtc(bk *Book, recid int, dataLen int, data []byte) {
+// handleMSODrawingEtc returns the client anchor of the last shape in an
+// MSO_DRAWING record, or nil if it has none.
+func (s *Sheet) handleMSODrawingEtc(bk *Book, recid int, dataLen int, data []byte) *MSODrawing {
 	if recid != XL_MSO_DRAWING || bk.BiffVersion < 80 {
-		return
-	}
-	if dataLen == 0 {
-		return
+		return nil
 	}
+	var o *MSODrawing
 	pos := 0
 	for pos+8 <= dataLen {
 		tmp := binary.LittleEndian.Uint16(data[pos : pos+2])
@@ -1767,10 +1980,20 @@ func (s *Sheet) handleMSODrawingEtc(bk *Book, recid int, dataLen int, data []byt
 			ndb = 0
 		}
 		if fbt == 0xF010 && pos+8+ndb <= dataLen && ndb >= 18 {
-			_ = binary.LittleEndian.Uint16(data[pos+8 : pos+10])
+			// Flags, then the column and row of the top left and bottom
+			// right corners, each followed by an offset within the cell.
+			a := data[pos+8 : pos+8+ndb]
+			o = &MSODrawing{
+				AnchorUnk:   int(binary.LittleEndian.Uint16(a[0:2])),
+				AnchorColLo: int(binary.LittleEndian.Uint16(a[2:4])),
+				AnchorRowLo: int(binary.LittleEndian.Uint16(a[6:8])),
+				AnchorColHi: int(binary.LittleEndian.Uint16(a[10:12])),
+				AnchorRowHi: int(binary.LittleEndian.Uint16(a[14:16])),
+			}
 		}
 		pos += ndb + 8
 	}
+	return o
 }
 
 func (s *Sheet) handleObj(bk *Book, data []byte) *MSObj {
@@ -1778,14 +2001,13 @@ func (s *Sheet) handleObj(bk *Book, data []byte) *MSObj {
 		return nil
 	}
 	o := &MSObj{}
+	var pioGrbit uint16
 	pos := 0
 	for pos+4 <= len(data) {
 		ft := binary.LittleEndian.Uint16(data[pos : pos+2])
 		cb := binary.LittleEndian.Uint16(data[pos+2 : pos+4])
 		if pos == 0 && !(ft == 0x15 && cb == 18) {
-			if bk.verbosity > 0 {
-				fmt.Fprintf(bk.logfile, "*** WARNING Ignoring antique or corrupt OBJECT record\n")
-			}
+			s.diag(SeverityWarning, DiagObjectIgnored, "Ignoring antique or corrupt OBJECT record")
 			return nil
 		}
 		if ft == 0x15 && pos+10 <= len(data) {
@@ -1804,6 +2026,14 @@ func (s *Sheet) handleObj(bk *Book, data []byte) *MSObj {
 			o.ScrollbarMax = int(binary.LittleEndian.Uint16(data[pos+12 : pos+14]))
 			o.ScrollbarInc = int(binary.LittleEndian.Uint16(data[pos+14 : pos+16]))
 			o.ScrollbarPage = int(binary.LittleEndian.Uint16(data[pos+16 : pos+18]))
+		} else if ft == 0x08 && pos+6 <= len(data) {
+			pioGrbit = binary.LittleEndian.Uint16(data[pos+4 : pos+6])
+		} else if ft == 0x09 && pos+4+int(cb) <= len(data) {
+			// An embedded object, unless it is a control or a DDE link,
+			// lives in a storage named after its id.
+			if pioGrbit&0x0032 == 0 {
+				o.storage, o.className = parsePictFmla(data[pos+4 : pos+4+int(cb)])
+			}
 		} else if ft == 0x00 {
 			break
 		}
@@ -1812,6 +2042,40 @@ func (s *Sheet) handleObj(bk *Book, data []byte) *MSObj {
 	return o
 }
 
+// parsePictFmla returns the name of the storage of an embedded object and
+// its class name, such as "Word.Document.8", from an ftPictFmla
+// subrecord, or "" if there is none.
+func parsePictFmla(data []byte) (storage, className string) {
+	if len(data) < 2 {
+		return "", ""
+	}
+	cbFmla := int(binary.LittleEndian.Uint16(data[0:2]))
+	if 2+cbFmla+4 > len(data) {
+		return "", ""
+	}
+	storage = fmt.Sprintf("MBD%08X", binary.LittleEndian.Uint32(data[2+cbFmla:]))
+
+	// The formula, then the class name if the formula is a ptgTbl.
+	fmla := data[2 : 2+cbFmla]
+	if len(fmla) < 6 {
+		return storage, ""
+	}
+	cce := int(binary.LittleEndian.Uint16(fmla[0:2]) & 0x7FFF)
+	if 6+cce+4 > len(fmla) || fmla[6+cce] != 0x03 {
+		return storage, ""
+	}
+	info := fmla[6+cce:]
+	cch := int(info[1])
+	if cch == 0 {
+		return storage, ""
+	}
+	className, _, err := UnpackUnicodeUpdatePos(info, 3, 0, &cch)
+	if err != nil {
+		return storage, ""
+	}
+	return storage, className
+}
+
 func (s *Sheet) handleNote(bk *Book, data []byte, txos map[int]*MSTxo) {
 	o := &Note{}
 	if bk.BiffVersion < 80 {
@@ -1825,7 +2089,7 @@ func (s *Sheet) handleNote(bk *Book, data []byte, txos map[int]*MSTxo) {
 		pieces := [][]byte{data[6:]}
 		expectedBytes -= nb
 		for expectedBytes > 0 {
-			rc2, data2Len, data2 := bk.getRecordParts()
+			rc2, data2Len, data2 := s.rdr.getRecordParts()
 			if rc2 != XL_NOTE || data2Len < 6 {
 				return
 			}
@@ -1882,11 +2146,11 @@ func (s *Sheet) handleTxo(bk *Book, data []byte) *MSTxo {
 	o := &MSTxo{}
 	optionFlags := binary.LittleEndian.Uint16(data[0:2])
 	o.Rot = int(binary.LittleEndian.Uint16(data[2:4]))
-	o.ControlInfo = data[4:10]
+	o.ControlInfo = append([]byte(nil), data[4:10]...)
 	cchText := int(binary.LittleEndian.Uint16(data[10:12]))
 	cbRuns := int(binary.LittleEndian.Uint16(data[12:14]))
 	o.IfntEmpty = int(binary.LittleEndian.Uint16(data[14:16]))
-	o.Fmla = data[16:]
+	o.Fmla = append([]byte(nil), data[16:]...)
 
 	o.HorzAlign = int((optionFlags >> 3) & 0x7)
 	o.VertAlign = int((optionFlags >> 6) & 0x7)
@@ -1896,7 +2160,7 @@ func (s *Sheet) handleTxo(bk *Book, data []byte) *MSTxo {
 
 	totChars := 0
 	for totChars < cchText {
-		rc2, data2Len, data2 := bk.getRecordParts()
+		rc2, data2Len, data2 := s.rdr.getRecordParts()
 		if rc2 != XL_CONTINUE || data2Len == 0 {
 			break
 		}
@@ -1915,7 +2179,7 @@ func (s *Sheet) handleTxo(bk *Book, data []byte) *MSTxo {
 	o.RichTextRunlist = make([][2]int, 0)
 	totRuns := 0
 	for totRuns < cbRuns {
-		rc3, data3Len, data3 := bk.getRecordParts()
+		rc3, data3Len, data3 := s.rdr.getRecordParts()
 		if rc3 != XL_CONTINUE || data3Len%8 != 0 {
 			break
 		}
@@ -1959,7 +2223,7 @@ func (s *Sheet) handleFormula(bk *Book, data []byte, dataLen int) {
 		xfIndex = xf
 		resultStr = data[7:15]
 	}
-	_ = resultStr
+	s.keepFormula(bk, rowx, colx, data)
 
 	// Formula record parsed
 
@@ -1993,21 +2257,102 @@ func (s *Sheet) handleFormula(bk *Book, data []byte, dataLen int) {
 			s.putCell(rowx, colx, XL_CELL_NUMBER, value, xfIndex)
 		}
 	}
+}
 
-	// xlrd does not evaluate formulas - it only reads cached results from Excel
-	// Formula evaluation is performed by Excel itself when the file was saved
+// keepFormula stores the token array of a FORMULA record for CellFormula.
+func (s *Sheet) keepFormula(bk *Book, rowx, colx int, data []byte) {
+	if s.stream != nil || s.limitErr != nil {
+		return
+	}
+	// The token array follows the result, the option flags and, from
+	// BIFF5 on, 4 unused bytes.
+	var cce, pos int
+	switch {
+	case bk.BiffVersion >= 50 && len(data) >= 22:
+		cce, pos = int(binary.LittleEndian.Uint16(data[20:22])), 22
+	case bk.BiffVersion >= 30 && bk.BiffVersion < 50 && len(data) >= 18:
+		cce, pos = int(binary.LittleEndian.Uint16(data[16:18])), 18
+	case bk.BiffVersion < 30 && len(data) >= 17:
+		cce, pos = int(data[16]), 17
+	}
+	if pos == 0 || pos+cce > len(data) {
+		s.diag(SeverityWarning, DiagFormula, "FORMULA record at R%dC%d: token array truncated", rowx+1, colx+1)
+		return
+	}
+	if s.limitErr = s.charge(cce + cellSlotBytes); s.limitErr != nil {
+		return
+	}
+	if s.formulas == nil {
+		s.formulas = make(map[[2]int][]byte)
+	}
+	s.formulas[[2]int{rowx, colx}] = append([]byte(nil), data[pos:pos+cce]...)
+}
+
+// sharedFormula is a formula read from a SHRFMLA or ARRAY record, which
+// the formula cells in its range refer to.
+type sharedFormula struct {
+	cells CellRange
+	array bool
+	rgce  []byte
+}
+
+// handleSharedFormula stores the formula of a SHRFMLA, ARRAY or ARRAY2
+// record for CellFormula.
+func (s *Sheet) handleSharedFormula(bk *Book, rc int, data []byte) {
+	if s.stream != nil || s.limitErr != nil {
+		return
+	}
+	// Each record starts with the range it covers. The token array follows
+	// the option flags and, in ARRAY records from BIFF5 on, 4 unused bytes.
+	var cce, pos int
+	name := "ARRAY"
+	switch {
+	case rc == XL_SHRFMLA && len(data) >= 10:
+		cce, pos = int(binary.LittleEndian.Uint16(data[8:10])), 10
+		name = "SHRFMLA"
+	case rc == XL_ARRAY && bk.BiffVersion >= 50 && len(data) >= 14:
+		cce, pos = int(binary.LittleEndian.Uint16(data[12:14])), 14
+	case rc == XL_ARRAY && bk.BiffVersion < 50 && len(data) >= 10:
+		cce, pos = int(binary.LittleEndian.Uint16(data[8:10])), 10
+	case rc == XL_ARRAY2 && len(data) >= 8:
+		cce, pos = int(data[7]), 8
+	}
+	if pos == 0 || pos+cce > len(data) {
+		s.diag(SeverityWarning, DiagFormula, "%s record: token array truncated", name)
+		return
+	}
+	if s.limitErr = s.charge(cce + cellSlotBytes); s.limitErr != nil {
+		return
+	}
+	sf := &sharedFormula{
+		cells: CellRange{
+			FirstRow: int(binary.LittleEndian.Uint16(data[0:2])),
+			LastRow:  int(binary.LittleEndian.Uint16(data[2:4])) + 1,
+			FirstCol: int(data[4]),
+			LastCol:  int(data[5]) + 1,
+		},
+		array: rc != XL_SHRFMLA,
+		rgce:  append([]byte(nil), data[pos:pos+cce]...),
+	}
+	if s.sharedFormulas == nil {
+		s.sharedFormulas = make(map[[2]int]*sharedFormula)
+	}
+	s.sharedFormulas[[2]int{sf.cells.FirstRow, sf.cells.FirstCol}] = sf
 }
 
 // handleFormulaStringResult handles formulas that result in strings.
 // These are followed by a STRING record containing the actual string value.
 func (s *Sheet) handleFormulaStringResult(bk *Book, rowx, colx, xfIndex int) {
 	// Read the next record which should be a STRING record
-	rc, _, data := bk.getRecordParts()
+	rc, _, data := s.rdr.getRecordParts()
 	if rc != XL_STRING && rc != XL_STRING_B2 {
 		for {
 			switch rc {
-			case XL_ARRAY, XL_SHRFMLA, XL_TABLEOP, XL_TABLEOP2, XL_ARRAY2, XL_TABLEOP_B2:
-				rc, _, data = bk.getRecordParts()
+			case XL_ARRAY, XL_SHRFMLA, XL_ARRAY2:
+				s.handleSharedFormula(bk, rc, data)
+				rc, _, data = s.rdr.getRecordParts()
+			case XL_TABLEOP, XL_TABLEOP2, XL_TABLEOP_B2:
+				rc, _, data = s.rdr.getRecordParts()
 			default:
 				s.putCell(rowx, colx, XL_CELL_EMPTY, nil, xfIndex)
 				return
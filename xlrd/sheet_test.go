@@ -371,3 +371,13 @@ func TestSheetRagged(t *testing.T) {
 		t.Errorf("sheet.RowLen(4) = %d, want 4", sheet.RowLen(4))
 	}
 }
+
+func TestSheetHlinkInvalidGUID(t *testing.T) {
+	s := &Sheet{HyperlinkMap: make(map[[2]int]*Hyperlink)}
+	if err := s.handleHlink(make([]byte, 32)); err == nil {
+		t.Error("handleHlink() error = nil, want error for invalid GUID")
+	}
+	if len(s.HyperlinkList) != 0 {
+		t.Errorf("len(HyperlinkList) = %d, want 0", len(s.HyperlinkList))
+	}
+}
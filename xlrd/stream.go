@@ -0,0 +1,119 @@
+package xlrd
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrStopStream can be returned by a StreamSheet callback to stop reading
+// the sheet early. StreamSheet then returns nil.
+var ErrStopStream = errors.New("xlrd: stop streaming")
+
+// rowStream collects the cells of one row at a time and hands each row
+// to a callback as soon as a cell from a different row is met.
+type rowStream struct {
+	fn    func(rowx int, cells []Cell) error
+	rowx  int
+	cells []Cell
+	err   error
+}
+
+// callbackPanic carries a panic raised by a StreamSheet callback past
+// recoverParseError, which would otherwise report a runtime error in the
+// callback as a corrupt record.
+type callbackPanic struct {
+	value interface{}
+}
+
+func (rs *rowStream) put(rowx, colx int, ctype int, value interface{}, xfIndex int) {
+	if rs.err != nil || rowx < 0 || colx < 0 {
+		return
+	}
+	if rowx != rs.rowx {
+		rs.flush()
+		rs.rowx = rowx
+	}
+	for len(rs.cells) <= colx {
+		rs.cells = append(rs.cells, Cell{CType: XL_CELL_EMPTY, Value: "", XFIndex: 15})
+	}
+	rs.cells[colx] = Cell{CType: ctype, Value: value, XFIndex: xfIndex}
+}
+
+// flush passes the buffered row, if any, to the callback.
+func (rs *rowStream) flush() {
+	if rs.err != nil || len(rs.cells) == 0 {
+		return
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				panic(callbackPanic{r})
+			}
+		}()
+		rs.err = rs.fn(rs.rowx, rs.cells)
+	}()
+	// The buffer is reused, so memory use depends only on the widest row.
+	rs.cells = rs.cells[:0]
+}
+
+// StreamSheet reads the sheet with the given index and calls fn once for
+// each row that contains cells, in the order the rows appear in the file.
+// The cells are not stored, so memory use does not grow with the size of
+// the sheet. cells[colx] is the cell in column colx; missing cells are
+// XL_CELL_EMPTY. The cells slice is only valid until fn returns.
+//
+// Excel writes the cells of each row together; a row whose cells are
+// scattered through the file is delivered once for each run of cells.
+//
+// Merged cells are not expanded, and the sheet is not added to the book.
+// Open the workbook with OnDemand set, since otherwise all sheets are
+// loaded and resources released before StreamSheet can be called.
+// If fn returns ErrStopStream, reading stops and StreamSheet returns nil;
+// any other error stops reading and is returned. A panic in fn is passed
+// on to the caller of StreamSheet.
+func (b *Book) StreamSheet(sheetx int, fn func(rowx int, cells []Cell) error) error {
+	return b.StreamSheetContext(context.Background(), sheetx, fn)
+}
+
+// StreamSheetContext is like StreamSheet, but stops reading the sheet and
+// returns ctx.Err() if ctx is cancelled first.
+func (b *Book) StreamSheetContext(ctx context.Context, sheetx int, fn func(rowx int, cells []Cell) error) (err error) {
+	if sheetx < 0 || sheetx >= len(b.sheetNames) || sheetx >= len(b.sheetAbsPosn) {
+		return newXLRDError(ErrSheetNotFound, "sheet index %d out of range", sheetx)
+	}
+	b.resMu.RLock()
+	defer b.resMu.RUnlock()
+	if b.resourcesReleased {
+		return newXLRDError(ErrResourcesReleased, "Can't load sheets after releasing resources.")
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			if cp, ok := r.(callbackPanic); ok {
+				r = cp.value
+			}
+			panic(r)
+		}
+	}()
+	defer recoverParseError(&err)
+	rdr := &recordReader{mem: b.mem, base: b.base, position: b.sheetAbsPosn[sheetx]}
+	if _, err := rdr.getBOF(XL_WORKSHEET); err != nil {
+		return err
+	}
+	if b.BiffVersion < 80 {
+		b.globalsMu.Lock()
+		defer b.globalsMu.Unlock()
+	}
+
+	sheet := b.newSheet(sheetx, rdr)
+	sheet.stream = &rowStream{fn: fn, rowx: -1}
+	err = sheet.read(ctx, b)
+	if err == nil {
+		sheet.stream.flush()
+		err = sheet.stream.err
+	}
+	if errors.Is(err, ErrStopStream) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package xlrd
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+)
+
+func TestStreamSheet(t *testing.T) {
+	want, err := OpenWorkbook(fromSample("profiles.xls"), nil)
+	if err != nil {
+		t.Fatalf("Failed to open workbook: %v", err)
+	}
+	book, err := OpenWorkbook(fromSample("profiles.xls"), &OpenWorkbookOptions{OnDemand: true})
+	if err != nil {
+		t.Fatalf("Failed to open workbook: %v", err)
+	}
+	defer book.ReleaseResources()
+
+	for sheetx := 0; sheetx < book.NSheets; sheetx++ {
+		ws, _ := want.SheetByIndex(sheetx)
+		seen := 0
+		err := book.StreamSheet(sheetx, func(rowx int, cells []Cell) error {
+			seen++
+			if len(cells) != ws.RowLen(rowx) {
+				t.Errorf("sheet %d row %d has %d cells, want %d", sheetx, rowx, len(cells), ws.RowLen(rowx))
+			}
+			for colx, cell := range cells {
+				if cell.CType != ws.RawCellType(rowx, colx) || cell.Value != ws.RawCellValue(rowx, colx) {
+					t.Errorf("sheet %d cell (%d, %d) = %v (type %d), want %v (type %d)", sheetx, rowx, colx,
+						cell.Value, cell.CType, ws.RawCellValue(rowx, colx), ws.RawCellType(rowx, colx))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("book.StreamSheet(%d) error = %v", sheetx, err)
+		}
+		rows := 0
+		for rowx := 0; rowx < ws.NRows; rowx++ {
+			if ws.RowLen(rowx) > 0 {
+				rows++
+			}
+		}
+		if seen != rows {
+			t.Errorf("book.StreamSheet(%d) delivered %d rows, want %d", sheetx, seen, rows)
+		}
+	}
+
+	if loaded, _ := book.SheetLoaded(0); loaded {
+		t.Error("book.StreamSheet should not load the sheet into the book")
+	}
+}
+
+func TestStreamSheetStop(t *testing.T) {
+	book, err := OpenWorkbook(fromSample("profiles.xls"), &OpenWorkbookOptions{OnDemand: true})
+	if err != nil {
+		t.Fatalf("Failed to open workbook: %v", err)
+	}
+	defer book.ReleaseResources()
+
+	calls := 0
+	err = book.StreamSheet(0, func(rowx int, cells []Cell) error {
+		calls++
+		return ErrStopStream
+	})
+	if err != nil {
+		t.Errorf("book.StreamSheet with ErrStopStream error = %v, want nil", err)
+	}
+	if calls != 1 {
+		t.Errorf("callback called %d times after ErrStopStream, want 1", calls)
+	}
+
+	errBoom := errors.New("boom")
+	err = book.StreamSheet(0, func(rowx int, cells []Cell) error {
+		return errBoom
+	})
+	if !errors.Is(err, errBoom) {
+		t.Errorf("book.StreamSheet error = %v, want %v", err, errBoom)
+	}
+
+	if err := book.StreamSheet(5, func(int, []Cell) error { return nil }); err == nil {
+		t.Error("book.StreamSheet(5) should have returned an error")
+	}
+}
+
+func TestStreamSheetCallbackPanic(t *testing.T) {
+	book, err := OpenWorkbook(fromSample("profiles.xls"), &OpenWorkbookOptions{OnDemand: true})
+	if err != nil {
+		t.Fatalf("Failed to open workbook: %v", err)
+	}
+	defer book.ReleaseResources()
+
+	defer func() {
+		r := recover()
+		if _, ok := r.(runtime.Error); !ok {
+			t.Errorf("recover() = %v, want the runtime error raised by the callback", r)
+		}
+		// The book is still usable after the panic.
+		if err := book.StreamSheet(0, func(int, []Cell) error { return nil }); err != nil {
+			t.Errorf("book.StreamSheet after a panic error = %v", err)
+		}
+	}()
+	var cells []Cell
+	err = book.StreamSheet(0, func(rowx int, _ []Cell) error {
+		_ = cells[rowx+1]
+		return nil
+	})
+	t.Errorf("book.StreamSheet returned %v, want a panic", err)
+}
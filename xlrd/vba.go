@@ -0,0 +1,285 @@
+package xlrd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// vbaStorage is the storage holding the VBA project of a workbook.
+const vbaStorage = "_VBA_PROJECT_CUR"
+
+// VBAModuleType is the kind of a VBA module.
+type VBAModuleType int
+
+// VBA module types.
+const (
+	// VBAModuleStandard is a standard (procedural) module.
+	VBAModuleStandard VBAModuleType = iota
+	// VBAModuleDocument is the module of the workbook or of a sheet, such
+	// as ThisWorkbook or Sheet1.
+	VBAModuleDocument
+	// VBAModuleClass is a class module.
+	VBAModuleClass
+	// VBAModuleForm is the module of a user form.
+	VBAModuleForm
+)
+
+var vbaModuleTypeNames = [...]string{"standard", "document", "class", "form"}
+
+func (t VBAModuleType) String() string {
+	if t >= 0 && int(t) < len(vbaModuleTypeNames) {
+		return vbaModuleTypeNames[t]
+	}
+	return fmt.Sprintf("VBAModuleType(%d)", int(t))
+}
+
+// VBAProject is the VBA project of a workbook with macros.
+type VBAProject struct {
+	// Name is the name of the project, usually "VBAProject".
+	Name string
+
+	// Codepage is the codepage of the project's text, such as 1252.
+	Codepage int
+
+	// Modules lists the modules in the order of the project.
+	Modules []VBAModule
+}
+
+// VBAModule is a module of a VBA project.
+type VBAModule struct {
+	Name string
+	Type VBAModuleType
+
+	// StreamName is the name of the stream holding the module in the
+	// VBA storage.
+	StreamName string
+
+	// Code is the source code of the module, with its Attribute lines.
+	Code string
+}
+
+// VBAProject returns the VBA project of the workbook, with the source
+// code of its modules, or nil if the workbook has none. An error is
+// returned if the project could not be read.
+func (b *Book) VBAProject() (*VBAProject, error) {
+	return b.vbaProject, b.vbaErr
+}
+
+// readVBAProject reads the VBA project, if any, from the storage of cd.
+// Only limit errors are returned; others are kept for VBAProject.
+func (b *Book) readVBAProject(cd *CompDoc) error {
+	dir, err := cd.OpenStream(vbaStorage, "VBA", "dir")
+	if errors.Is(err, ErrStreamNotFound) {
+		return nil
+	}
+	b.HasMacros = true
+	if err == nil {
+		b.vbaProject, err = b.parseVBAProject(cd, dir)
+	}
+	if errors.Is(err, ErrLimitExceeded) {
+		return err
+	}
+	if err != nil {
+		b.vbaErr = fmt.Errorf("xlrd: can't read VBA project: %w", err)
+	}
+	return nil
+}
+
+// vbaModuleRecord is a module described by the dir stream.
+type vbaModuleRecord struct {
+	name, streamName string
+	offset           int
+	procedural       bool
+}
+
+// parseVBAProject parses the compressed dir stream of a VBA project
+// [MS-OVBA 2.3.4.2] and reads the source code of its modules.
+func (b *Book) parseVBAProject(cd *CompDoc, compressed []byte) (*VBAProject, error) {
+	dir, err := decompressVBA(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("dir stream: %w", err)
+	}
+	if err := b.charge(len(dir)); err != nil {
+		return nil, err
+	}
+
+	proj := &VBAProject{Codepage: 1252}
+	var modules []*vbaModuleRecord
+	var m *vbaModuleRecord
+	for pos := 0; pos+6 <= len(dir); {
+		id := binary.LittleEndian.Uint16(dir[pos:])
+		size := int(binary.LittleEndian.Uint32(dir[pos+2:]))
+		pos += 6
+		if id == 0x0009 {
+			// PROJECTVERSION: its size field is followed by 6 bytes.
+			size = 6
+		}
+		if size < 0 || size > len(dir)-pos {
+			return nil, fmt.Errorf("dir record 0x%04X truncated", id)
+		}
+		data := dir[pos : pos+size]
+		pos += size
+
+		switch id {
+		case 0x0003: // PROJECTCODEPAGE
+			if len(data) >= 2 {
+				proj.Codepage = int(binary.LittleEndian.Uint16(data))
+			}
+		case 0x0004: // PROJECTNAME
+			proj.Name = decodeCodepage(data, proj.Codepage)
+		case 0x0019: // MODULENAME
+			m = &vbaModuleRecord{name: decodeCodepage(data, proj.Codepage)}
+			modules = append(modules, m)
+		}
+		if m == nil {
+			continue
+		}
+		switch id {
+		case 0x0047: // MODULENAMEUNICODE
+			m.name = decodeCodepage(data, 1200)
+		case 0x001A: // MODULESTREAMNAME
+			m.streamName = decodeCodepage(data, proj.Codepage)
+		case 0x0032: // MODULESTREAMNAME, Unicode
+			m.streamName = decodeCodepage(data, 1200)
+		case 0x0031: // MODULEOFFSET
+			if len(data) >= 4 {
+				m.offset = int(binary.LittleEndian.Uint32(data))
+			}
+		case 0x0021: // MODULETYPE, procedural
+			m.procedural = true
+		case 0x002B: // TERMINATOR
+			m = nil
+		}
+	}
+
+	types := vbaModuleTypes(cd, proj.Codepage)
+	for _, m := range modules {
+		stream, err := cd.OpenStream(vbaStorage, "VBA", m.streamName)
+		if err != nil {
+			return nil, fmt.Errorf("module %s: %w", m.name, err)
+		}
+		if m.offset < 0 || m.offset > len(stream) {
+			return nil, fmt.Errorf("module %s: source offset %d out of range", m.name, m.offset)
+		}
+		code, err := decompressVBA(stream[m.offset:])
+		if err != nil {
+			return nil, fmt.Errorf("module %s: %w", m.name, err)
+		}
+		if err := b.charge(len(code)); err != nil {
+			return nil, err
+		}
+		typ, ok := types[strings.ToLower(m.name)]
+		if !ok {
+			typ = VBAModuleClass
+			if m.procedural {
+				typ = VBAModuleStandard
+			}
+		}
+		proj.Modules = append(proj.Modules, VBAModule{
+			Name:       m.name,
+			Type:       typ,
+			StreamName: m.streamName,
+			Code:       decodeCodepage(code, proj.Codepage),
+		})
+	}
+	return proj, nil
+}
+
+// vbaModuleTypes returns the module types declared by the PROJECT stream
+// [MS-OVBA 2.3.1], keyed by lower case module name. The dir stream alone
+// does not tell document and form modules from class modules.
+func vbaModuleTypes(cd *CompDoc, codepage int) map[string]VBAModuleType {
+	types := make(map[string]VBAModuleType)
+	data, err := cd.OpenStream(vbaStorage, "PROJECT")
+	if err != nil {
+		return types
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		key, value, ok := strings.Cut(decodeCodepage(sc.Bytes(), codepage), "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Module":
+			types[strings.ToLower(value)] = VBAModuleStandard
+		case "Document":
+			name, _, _ := strings.Cut(value, "/")
+			types[strings.ToLower(name)] = VBAModuleDocument
+		case "Class":
+			types[strings.ToLower(value)] = VBAModuleClass
+		case "BaseClass":
+			types[strings.ToLower(value)] = VBAModuleForm
+		}
+	}
+	return types
+}
+
+// decompressVBA decompresses a CompressedContainer [MS-OVBA 2.4.1].
+func decompressVBA(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != 0x01 {
+		return nil, errors.New("invalid compressed container signature")
+	}
+	var out []byte
+	for pos := 1; pos < len(data); {
+		if pos+2 > len(data) {
+			return nil, errors.New("compressed chunk header truncated")
+		}
+		header := binary.LittleEndian.Uint16(data[pos:])
+		if header>>12&0x07 != 0x03 {
+			return nil, errors.New("invalid compressed chunk signature")
+		}
+		end := pos + int(header&0x0FFF) + 3
+		if end > len(data) {
+			end = len(data)
+		}
+		pos += 2
+		start := len(out)
+		if header&0x8000 == 0 {
+			// An uncompressed chunk holds 4096 bytes.
+			if pos+4096 > len(data) {
+				return nil, errors.New("uncompressed chunk truncated")
+			}
+			out = append(out, data[pos:pos+4096]...)
+			pos += 4096
+			continue
+		}
+		for pos < end {
+			flags := data[pos]
+			pos++
+			for bit := 0; bit < 8 && pos < end; bit++ {
+				if flags&(1<<bit) == 0 {
+					out = append(out, data[pos])
+					pos++
+					continue
+				}
+				if pos+2 > end {
+					return nil, errors.New("copy token truncated")
+				}
+				token := int(binary.LittleEndian.Uint16(data[pos:]))
+				pos += 2
+				if len(out)-start > 4096 {
+					return nil, errors.New("compressed chunk too large")
+				}
+				bitCount := 4
+				for 1<<bitCount < len(out)-start {
+					bitCount++
+				}
+				length := token&(0xFFFF>>bitCount) + 3
+				offset := token>>(16-bitCount) + 1
+				if offset > len(out)-start {
+					return nil, errors.New("copy token offset out of range")
+				}
+				for i := 0; i < length; i++ {
+					out = append(out, out[len(out)-offset])
+				}
+			}
+		}
+	}
+	return out, nil
+}
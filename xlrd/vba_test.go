@@ -0,0 +1,170 @@
+package xlrd
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDecompressVBA(t *testing.T) {
+	// Literals only, then copy tokens, then a single token repeating a
+	// literal.
+	tests := []struct {
+		compressed []byte
+		want       string
+	}{
+		{
+			[]byte{0x01, 0x19, 0xB0, 0x00, 0x61, 0x62, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x00, 0x69, 0x6A, 0x6B,
+				0x6C, 0x6D, 0x6E, 0x6F, 0x70, 0x00, 0x71, 0x72, 0x73, 0x74, 0x75, 0x76, 0x2E},
+			"abcdefghijklmnopqrstuv.",
+		},
+		{
+			[]byte{0x01, 0x2F, 0xB0, 0x00, 0x23, 0x61, 0x61, 0x61, 0x62, 0x63, 0x64, 0x65, 0x82, 0x66, 0x00, 0x70,
+				0x61, 0x67, 0x68, 0x69, 0x6A, 0x01, 0x38, 0x08, 0x61, 0x6B, 0x6C, 0x00, 0x30, 0x6D, 0x6E, 0x6F,
+				0x70, 0x06, 0x71, 0x02, 0x70, 0x04, 0x10, 0x72, 0x73, 0x74, 0x75, 0x76, 0x10, 0x77, 0x78, 0x79,
+				0x7A, 0x00, 0x3C},
+			"#aaabcdefaaaaghijaaaaaklaaamnopqaaaaaaaaaaaarstuvwxyzaaa",
+		},
+		{
+			[]byte{0x01, 0x03, 0xB0, 0x02, 0x61, 0x45, 0x00},
+			strings.Repeat("a", 73),
+		},
+	}
+	for _, tt := range tests {
+		got, err := decompressVBA(tt.compressed)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("decompressVBA() = %q, %v, want %q", got, err, tt.want)
+		}
+	}
+}
+
+// vbaCompress returns data as a CompressedContainer without copy tokens:
+// full chunks are stored uncompressed, and the last one as literals.
+func vbaCompress(data []byte) []byte {
+	out := []byte{0x01}
+	for len(data) >= 4096 {
+		out = binary.LittleEndian.AppendUint16(out, 0x3FFF)
+		out = append(out, data[:4096]...)
+		data = data[4096:]
+	}
+	for len(data) > 0 {
+		n := len(data)
+		var chunk []byte
+		for i := 0; i < n; i += 8 {
+			chunk = append(chunk, 0)
+			chunk = append(chunk, data[i:min(i+8, n)]...)
+		}
+		out = binary.LittleEndian.AppendUint16(out, uint16(0xB000|(len(chunk)-1)))
+		out = append(out, chunk...)
+		data = data[n:]
+	}
+	return out
+}
+
+// vbaDirRecord returns a record of a dir stream.
+func vbaDirRecord(id uint16, data []byte) []byte {
+	rec := binary.LittleEndian.AppendUint16(nil, id)
+	rec = binary.LittleEndian.AppendUint32(rec, uint32(len(data)))
+	return append(rec, data...)
+}
+
+// vbaProjectStreams returns the streams of a VBA project holding the
+// given modules, each with a MODULEOFFSET of 8.
+func vbaProjectStreams(modules []VBAModule) map[string][]byte {
+	streams := map[string][]byte{"Workbook": biff8Workbook()}
+	var dir, project []byte
+	dir = append(dir, vbaDirRecord(0x0001, []byte{1, 0, 0, 0})...)
+	dir = append(dir, vbaDirRecord(0x0003, []byte{0xE4, 0x04})...)
+	dir = append(dir, vbaDirRecord(0x0004, []byte("VBAProject"))...)
+	dir = append(dir, vbaDirRecord(0x0009, []byte{0xAF, 0x4C, 0xE9, 0x74, 0x12, 0x00})[:6+4]...)
+	dir = append(dir, 0x12, 0x00)
+	dir = append(dir, vbaDirRecord(0x000F, []byte{byte(len(modules)), 0})...)
+	for _, m := range modules {
+		dir = append(dir, vbaDirRecord(0x0019, []byte(m.Name))...)
+		dir = append(dir, vbaDirRecord(0x001A, []byte(m.StreamName))...)
+		dir = append(dir, vbaDirRecord(0x0032, utf16LE(m.StreamName))...)
+		dir = append(dir, vbaDirRecord(0x0031, []byte{8, 0, 0, 0})...)
+		switch m.Type {
+		case VBAModuleStandard:
+			dir = append(dir, vbaDirRecord(0x0021, nil)...)
+			project = append(project, "Module="+m.Name+"\r\n"...)
+		case VBAModuleDocument:
+			dir = append(dir, vbaDirRecord(0x0022, nil)...)
+			project = append(project, "Document="+m.Name+"/&H00000000\r\n"...)
+		}
+		dir = append(dir, vbaDirRecord(0x002B, nil)...)
+		streams[vbaStorage+"/VBA/"+m.StreamName] = append(make([]byte, 8), vbaCompress([]byte(m.Code))...)
+	}
+	dir = append(dir, vbaDirRecord(0x0010, nil)...)
+	streams[vbaStorage+"/VBA/dir"] = vbaCompress(dir)
+	streams[vbaStorage+"/PROJECT"] = append([]byte(`ID="{00000000-0000-0000-0000-000000000000}"`+"\r\n"), project...)
+	return streams
+}
+
+func TestVBAProject(t *testing.T) {
+	modules := []VBAModule{
+		{Name: "ThisWorkbook", Type: VBAModuleDocument, StreamName: "ThisWorkbook",
+			Code: "Attribute VB_Name = \"ThisWorkbook\"\r\nPrivate Sub Workbook_Open()\r\nEnd Sub\r\n"},
+		{Name: "Module1", Type: VBAModuleStandard, StreamName: "Module1",
+			Code: "Attribute VB_Name = \"Module1\"\r\nSub Caf\xe9()\r\n    MsgBox \"Hello\"\r\nEnd Sub\r\n"},
+		{Name: "Class1", Type: VBAModuleClass, StreamName: "Class1", Code: strings.Repeat("' Comment\r\n", 500)},
+	}
+	data := compoundFile(vbaProjectStreams(modules))
+	book, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: data})
+	if err != nil {
+		t.Fatalf("OpenWorkbook() failed: %v", err)
+	}
+	if !book.HasMacros {
+		t.Error("HasMacros = false, want true")
+	}
+	proj, err := book.VBAProject()
+	if err != nil {
+		t.Fatalf("VBAProject() error = %v", err)
+	}
+	if proj.Name != "VBAProject" || proj.Codepage != 1252 {
+		t.Errorf("VBAProject() Name, Codepage = %q, %d, want VBAProject, 1252", proj.Name, proj.Codepage)
+	}
+	if len(proj.Modules) != len(modules) {
+		t.Fatalf("VBAProject() has %d modules, want %d", len(proj.Modules), len(modules))
+	}
+	modules[1].Code = decodeCodepage([]byte(modules[1].Code), 1252)
+	for i, m := range proj.Modules {
+		if m != modules[i] {
+			t.Errorf("Modules[%d] = %+v, want %+v", i, m, modules[i])
+		}
+	}
+
+	_, err = OpenWorkbook("", &OpenWorkbookOptions{FileContents: data, Limits: Limits{MaxAllocBytes: 4096}})
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("OpenWorkbook() with MaxAllocBytes error = %v, want ErrLimitExceeded", err)
+	}
+}
+
+func TestVBAProjectCorrupt(t *testing.T) {
+	streams := vbaProjectStreams([]VBAModule{{Name: "Module1", StreamName: "Module1", Code: "Sub A()\r\nEnd Sub\r\n"}})
+	streams[vbaStorage+"/VBA/Module1"] = []byte("truncated")
+	book, err := OpenWorkbook("", &OpenWorkbookOptions{FileContents: compoundFile(streams)})
+	if err != nil {
+		t.Fatalf("OpenWorkbook() failed: %v", err)
+	}
+	if !book.HasMacros {
+		t.Error("HasMacros = false, want true")
+	}
+	if proj, err := book.VBAProject(); proj != nil || err == nil {
+		t.Errorf("VBAProject() = %v, %v, want an error", proj, err)
+	}
+}
+
+func TestVBAProjectNone(t *testing.T) {
+	book, err := OpenWorkbook(fromSample("profiles.xls"), nil)
+	if err != nil {
+		t.Fatalf("OpenWorkbook(profiles.xls) failed: %v", err)
+	}
+	if book.HasMacros {
+		t.Error("HasMacros = true, want false")
+	}
+	if proj, err := book.VBAProject(); proj != nil || err != nil {
+		t.Errorf("VBAProject() = %v, %v, want nil, nil", proj, err)
+	}
+}
@@ -1,6 +1,7 @@
 package xlrd
 
 import (
+	"sync"
 	"testing"
 )
 
@@ -183,3 +184,122 @@ func TestWorkbookCellAccess(t *testing.T) {
 		t.Error("sheet.Cell(14, 12) returned nil")
 	}
 }
+
+func TestWorkbookOnDemand(t *testing.T) {
+	book, err := OpenWorkbook(fromSample("profiles.xls"), &OpenWorkbookOptions{OnDemand: true})
+	if err != nil {
+		t.Fatalf("Failed to open workbook: %v", err)
+	}
+	defer book.ReleaseResources()
+	if book.NSheets != 5 {
+		t.Errorf("book.NSheets = %d, want 5", book.NSheets)
+	}
+	for index := 0; index < 5; index++ {
+		if loaded, _ := book.SheetLoaded(index); loaded {
+			t.Errorf("book.SheetLoaded(%d) = true before any access", index)
+		}
+	}
+
+	sheet, err := book.SheetByIndex(1)
+	if err != nil {
+		t.Fatalf("book.SheetByIndex(1) error = %v", err)
+	}
+	if sheet.Name != "AXISDEF" {
+		t.Errorf("sheet.Name = %s, want AXISDEF", sheet.Name)
+	}
+	if loaded, _ := book.SheetLoaded(1); !loaded {
+		t.Error("book.SheetLoaded(1) = false after SheetByIndex(1)")
+	}
+	if loaded, _ := book.SheetLoaded(0); loaded {
+		t.Error("book.SheetLoaded(0) = true, want only the demanded sheet loaded")
+	}
+
+	if err := book.UnloadSheet("AXISDEF"); err != nil {
+		t.Fatalf("book.UnloadSheet(AXISDEF) error = %v", err)
+	}
+	if loaded, _ := book.SheetLoaded("AXISDEF"); loaded {
+		t.Error("book.SheetLoaded(AXISDEF) = true after UnloadSheet")
+	}
+	reloaded, err := book.Get("AXISDEF")
+	if err != nil {
+		t.Fatalf("book.Get(AXISDEF) error = %v", err)
+	}
+	if reloaded == sheet {
+		t.Error("book.Get(AXISDEF) returned the unloaded sheet instead of reloading it")
+	}
+	if reloaded.NRows != sheet.NRows || reloaded.NCols != sheet.NCols {
+		t.Errorf("reloaded sheet size = %dx%d, want %dx%d", reloaded.NRows, reloaded.NCols, sheet.NRows, sheet.NCols)
+	}
+
+	book.ReleaseResources()
+	if _, err := book.SheetByIndex(2); err == nil {
+		t.Error("book.SheetByIndex(2) after ReleaseResources should have returned an error")
+	}
+}
+
+func TestWorkbookUnloadSheetNotOnDemand(t *testing.T) {
+	book, err := OpenWorkbook(fromSample("profiles.xls"), nil)
+	if err != nil {
+		t.Fatalf("Failed to open workbook: %v", err)
+	}
+	for index := 0; index < 5; index++ {
+		if loaded, _ := book.SheetLoaded(index); !loaded {
+			t.Errorf("book.SheetLoaded(%d) = false, want all sheets loaded", index)
+		}
+	}
+	if err := book.UnloadSheet(0); err != nil {
+		t.Fatalf("book.UnloadSheet(0) error = %v", err)
+	}
+	// Resources are released once all sheets have been loaded.
+	if _, err := book.SheetByIndex(0); err == nil {
+		t.Error("book.SheetByIndex(0) after UnloadSheet should have returned an error")
+	}
+}
+
+func TestWorkbookParallelWorkers(t *testing.T) {
+	want, err := OpenWorkbook(fromSample("profiles.xls"), nil)
+	if err != nil {
+		t.Fatalf("Failed to open workbook: %v", err)
+	}
+	book, err := OpenWorkbook(fromSample("profiles.xls"), &OpenWorkbookOptions{Workers: 3})
+	if err != nil {
+		t.Fatalf("Failed to open workbook with Workers: %v", err)
+	}
+	assertSameWorkbook(t, book, want)
+}
+
+func TestWorkbookConcurrentSheetByIndex(t *testing.T) {
+	book, err := OpenWorkbook(fromSample("profiles.xls"), &OpenWorkbookOptions{OnDemand: true})
+	if err != nil {
+		t.Fatalf("Failed to open workbook: %v", err)
+	}
+	defer book.ReleaseResources()
+
+	const goroutines = 4
+	got := make([][]*Sheet, goroutines)
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for index := 0; index < book.NSheets; index++ {
+				sheet, err := book.SheetByIndex(index)
+				if err != nil {
+					t.Errorf("book.SheetByIndex(%d) error = %v", index, err)
+					return
+				}
+				got[g] = append(got[g], sheet)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// Every goroutine must see the same, singly loaded, sheets.
+	for g := 1; g < goroutines; g++ {
+		for index := range got[0] {
+			if index >= len(got[g]) || got[g][index] != got[0][index] {
+				t.Fatalf("goroutine %d got a different sheet %d", g, index)
+			}
+		}
+	}
+}
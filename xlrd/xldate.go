@@ -32,6 +32,11 @@ func (e *XLDateError) Error() string {
 	return e.Message
 }
 
+// Is reports whether target is ErrInvalidDate.
+func (e *XLDateError) Is(target error) bool {
+	return target == ErrInvalidDate
+}
+
 // XLDateNegative indicates that xldate < 0.00
 type XLDateNegative struct {
 	XLDateError